@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"image_gallery/internal/backfill"
+	"image_gallery/internal/imaging"
+	"image_gallery/internal/services"
+)
+
+// backfillFunc fills in a field of the image records
+type backfillFunc func(context.Context, services.StorageService, services.DatabaseService, *imaging.Decoder, backfill.Options) (backfill.Report, error)
+
+// runBackfillPalettes finds the dominant colours of images stored before
+// uploads recorded them
+func runBackfillPalettes(args []string) error {
+	return runBackfill("backfill-palettes", "palette", backfill.Palettes, args)
+}
+
+// runBackfillFeatures finds the perceptual hashes and colour histograms of
+// images stored before uploads recorded them
+func runBackfillFeatures(args []string) error {
+	return runBackfill("backfill-features", "visual features", backfill.Features, args)
+}
+
+// runBackfill runs the backfill command name, which fills in field with fill
+func runBackfill(name, field string, fill backfillFunc, args []string) error {
+	defaultStorage, defaultDatabase := defaultBackends()
+
+	flags := flag.NewFlagSet(name, flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only count the images without a "+field)
+	force := flags.Bool("force", false, "recompute the "+field+" of every image")
+	storageBackend := flags.String("storage", defaultStorage, "storage backend to read: local or s3")
+	databaseBackend := flags.String("database", defaultDatabase, "database backend to update: local or dynamodb")
+	flags.Parse(args)
+
+	limits, err := uploadLimits()
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	storageService, err := newStorageService(ctx, *storageBackend)
+	if err != nil {
+		return err
+	}
+	databaseService, err := newDatabaseService(ctx, *databaseBackend)
+	if err != nil {
+		return err
+	}
+
+	opts := backfill.Options{DryRun: *dryRun, Force: *force}
+	report, err := fill(ctx, storageService, databaseService, imaging.NewDecoder(limits), opts)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d images could not be backfilled", len(report.Failed))
+	}
+
+	log.Printf("Backfilled the %s of %d of %d images (dry run: %v)", field, report.Updated, report.Scanned, report.DryRun)
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"image_gallery/internal/backup"
+)
+
+// runBackup writes a compressed archive of every blob and record
+func runBackup(args []string) error {
+	defaultStorage, defaultDatabase := defaultBackends()
+
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	output := flags.String("output", "", "archive to write (.tar.gz or .tar.zst), or - for stdout")
+	compressionName := flags.String("compression", "", "gzip or zstd (default: from --output, else gzip)")
+	sinceValue := flags.String("since", "", "only back up images created, updated or deleted after this RFC 3339 time")
+	storageBackend := flags.String("storage", defaultStorage, "storage backend to read: local or s3")
+	databaseBackend := flags.String("database", defaultDatabase, "database backend to read: local or dynamodb")
+	flags.Parse(args)
+
+	if *output == "" {
+		return errors.New("usage: backup --output <file|-> [--compression gzip|zstd] [--since time]")
+	}
+
+	compression := backup.CompressionGzip
+	var err error
+	if *compressionName != "" {
+		compression, err = backup.ParseCompression(*compressionName)
+	} else if *output != "-" {
+		compression, err = backup.CompressionFromPath(*output)
+	}
+	if err != nil {
+		return err
+	}
+
+	var since time.Time
+	if *sinceValue != "" {
+		if since, err = time.Parse(time.RFC3339, *sinceValue); err != nil {
+			return fmt.Errorf("invalid --since: %w", err)
+		}
+	}
+
+	ctx := context.Background()
+	storageService, err := newStorageService(ctx, *storageBackend)
+	if err != nil {
+		return err
+	}
+	databaseService, err := newDatabaseService(ctx, *databaseBackend)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		// Write to a temporary name so a failed backup never leaves a
+		// complete-looking archive behind
+		file, err := os.Create(*output + ".partial")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(file.Name())
+		defer file.Close()
+		w = file
+	}
+
+	manifest, err := backup.Backup(ctx, storageService, databaseService, w, backup.Options{Compression: compression, Since: since})
+	if err != nil {
+		return err
+	}
+
+	if file, ok := w.(*os.File); ok {
+		if err := file.Sync(); err != nil {
+			return err
+		}
+		if err := os.Rename(file.Name(), *output); err != nil {
+			return err
+		}
+	}
+
+	for _, warning := range manifest.Warnings {
+		log.Printf("Warning: %s", warning)
+	}
+	for _, key := range manifest.Missing {
+		log.Printf("Warning: blob %s was not found and is not in the backup", key)
+	}
+	log.Printf("Backed up %d images and %d blobs (created %s)", manifest.Images, len(manifest.Entries)-1, manifest.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+// runRestore restores an archive into the selected backends
+func runRestore(args []string) error {
+	defaultStorage, defaultDatabase := defaultBackends()
+
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only check the archive against its manifest")
+	verify := flags.Bool("verify", true, "read the restored data back and compare it with the archive")
+	storageBackend := flags.String("storage", defaultStorage, "storage backend to restore into: local or s3")
+	databaseBackend := flags.String("database", defaultDatabase, "database backend to restore into: local or dynamodb")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: restore [--dry-run] [--verify=false] [--storage local|s3] [--database local|dynamodb] <file|->")
+	}
+	input := flags.Arg(0)
+
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	ctx := context.Background()
+	storageService, err := newStorageService(ctx, *storageBackend)
+	if err != nil {
+		return err
+	}
+	databaseService, err := newDatabaseService(ctx, *databaseBackend)
+	if err != nil {
+		return err
+	}
+
+	report, restoreErr := backup.Restore(ctx, storageService, databaseService, r, backup.RestoreOptions{DryRun: *dryRun, Verify: *verify})
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	if restoreErr != nil {
+		return restoreErr
+	}
+
+	log.Printf("Restore: %d images, %d blobs (dry run: %v, verified: %v)", report.Images, report.Blobs, report.DryRun, report.Verified)
+	return nil
+}
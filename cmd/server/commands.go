@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// runCommand runs a maintenance subcommand and exits on failure
+func runCommand(name string, args []string) {
+	var err error
+
+	switch name {
+	case "provision":
+		err = runProvision(args)
+	case "export":
+		err = runExport(args)
+	case "import":
+		err = runImport(args)
+	case "backup":
+		err = runBackup(args)
+	case "restore":
+		err = runRestore(args)
+	case "migrate-records":
+		err = runMigrateRecords(args)
+	case "backfill-palettes":
+		err = runBackfillPalettes(args)
+	case "backfill-features":
+		err = runBackfillFeatures(args)
+	case "help", "-h", "--help":
+		printUsage()
+		return
+	default:
+		printUsage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+}
+
+// printUsage lists the available subcommands
+func printUsage() {
+	fmt.Fprintln(os.Stderr, `Usage: server [command] [flags]
+
+Without a command the web server is started.
+
+Commands:
+  provision         create or verify the S3 bucket and DynamoDB table
+  export            write all image metadata as JSON Lines or CSV
+  import            upsert image metadata from a JSON Lines or CSV file
+  backup            write an archive of every image and its metadata
+  restore           restore a backup archive into any storage and database
+  migrate-records   upgrade stored records to the current schema version
+  backfill-palettes find the dominant colours of images stored without them
+  backfill-features find the visual features of images stored without them`)
+}
@@ -2,18 +2,32 @@ package main
 
 import (
 	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"image"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 
+	"image_gallery/internal/changefeed"
+	"image_gallery/internal/derived"
+	"image_gallery/internal/duplicates"
+	"image_gallery/internal/expiry"
 	"image_gallery/internal/handlers"
+	"image_gallery/internal/imaging"
+	"image_gallery/internal/models"
+	"image_gallery/internal/saga"
 	"image_gallery/internal/services"
 )
 
@@ -45,49 +59,84 @@ func main() {
 	// Load environment variables from .env file
 	loadEnv()
 	
+	// Run a maintenance command instead of the server if one was given
+	if len(os.Args) > 1 {
+		runCommand(os.Args[1], os.Args[2:])
+		return
+	}
+	
 	// Get configuration from environment variables
-	s3BucketName := getEnv("S3_BUCKET_NAME", "image-gallery-bucket")
-	dynamoDBTableName := getEnv("DYNAMODB_TABLE_NAME", "image-gallery-table")
 	port := getEnv("PORT", "8080")
-	localStoragePath := getEnv("LOCAL_STORAGE_PATH", "./data/images")
-	useLocalStorage := getEnv("USE_LOCAL_STORAGE", "true") == "true"
 
-	var storageService services.StorageService
-	var databaseService services.DatabaseService
-	var err error
+	storageService, databaseService, err := newServices(context.Background())
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	if useLocalStorage {
-		// Use local file storage instead of S3
-		log.Println("Using local storage at:", localStoragePath)
-		storageService, err = services.NewLocalStorageService(localStoragePath)
+	// Cache DynamoDB reads so the home page does not scan the table on every
+	// request. The local database already keeps every record in memory
+	var cache *services.CachedDatabaseService
+	if _, databaseBackend := defaultBackends(); databaseBackend == databaseDynamoDB && getEnv("DB_CACHE", "true") == "true" {
+		cache, err = newDatabaseCache(databaseService)
 		if err != nil {
-			log.Fatalf("Failed to initialize local storage: %v", err)
-		}
-		
-		// Use local DB service
-		log.Println("Using local database at:", localStoragePath)
-		databaseService, err = services.NewLocalDBService(localStoragePath)
-		if err != nil {
-			log.Fatalf("Failed to initialize local database: %v", err)
-		}
-	} else {
-		// Initialize AWS SDK configuration
-		cfg, err := config.LoadDefaultConfig(context.Background())
-		if err != nil {
-			log.Fatalf("Failed to load AWS configuration: %v", err)
+			log.Fatal(err)
 		}
+		databaseService = cache
+	}
 
-		// Create AWS service clients
-		s3Client := s3.NewFromConfig(cfg)
-		dynamoDBClient := dynamodb.NewFromConfig(cfg)
+	// Finish uploads and deletes interrupted by a crash, at startup and then
+	// periodically for uploads that were too recent to judge
+	go saga.RunRecovery(context.Background(), storageService, databaseService, recoveryInterval)
+
+	// Purge expired images in the background. DynamoDB's time to live also
+	// removes expired records, but only a day later, and only the sweeper
+	// deletes their blobs
+	sweepInterval, err := time.ParseDuration(getEnv("EXPIRY_SWEEP_INTERVAL", "1m"))
+	if err != nil {
+		log.Fatalf("Invalid EXPIRY_SWEEP_INTERVAL: %v", err)
+	}
+	if sweepInterval > 0 {
+		go expiry.NewSweeper(storageService, databaseService).Run(context.Background(), sweepInterval)
+	}
 
-		// Create services
-		storageService = services.NewS3Service(s3Client, s3BucketName)
-		databaseService = services.NewDynamoDBService(dynamoDBClient, dynamoDBTableName)
+	// Uploads are decoded to validate them, within limits so a small file
+	// cannot expand into an enormous image
+	limits, err := uploadLimits()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Resized copies requested with query parameters are cached in memory
+	derivedCacheBytes, err := getEnvInt("DERIVED_CACHE_BYTES", 64<<20)
+	if err != nil {
+		log.Fatal(err)
+	}
+	decoder := imaging.NewDecoder(limits)
+	renderer := derived.NewRenderer(storageService, decoder, derived.Options{MaxBytes: derivedCacheBytes})
+	expvar.Publish("derivedCache", expvar.Func(func() any { return renderer.Stats() }))
+
+	// GPS positions and serial numbers are stripped from uploads unless
+	// configured otherwise
+	metadataPolicy, err := models.ParseMetadataPolicy(getEnv("METADATA_POLICY", string(models.MetadataStripGPS)))
+	if err != nil {
+		log.Fatalf("Invalid METADATA_POLICY: %v", err)
+	}
+
+	// Served images carry a watermark when one is configured
+	mark, err := watermark()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Uploads that look like images already in the gallery get a warning
+	// unless configured otherwise
+	duplicateOptions, err := duplicateDetection()
+	if err != nil {
+		log.Fatal(err)
 	}
 
 	// Create handlers
-	imageHandler := handlers.NewImageHandler(storageService, databaseService)
+	imageHandler := handlers.NewImageHandler(storageService, databaseService, decoder, renderer, metadataPolicy, mark, duplicateOptions)
 
 	// Set up router
 	router := mux.NewRouter()
@@ -95,11 +144,28 @@ func main() {
 	// Define routes
 	router.HandleFunc("/", imageHandler.ListImages).Methods("GET")
 	router.HandleFunc("/image/{id}", imageHandler.GetImage).Methods("GET")
+	router.HandleFunc("/image/{id}/similar", imageHandler.SimilarImages).Methods("GET")
 	router.HandleFunc("/upload", imageHandler.UploadImageForm).Methods("GET")
 	router.HandleFunc("/upload", imageHandler.UploadImage).Methods("POST")
 	router.HandleFunc("/edit/{id}", imageHandler.EditImageForm).Methods("GET")
 	router.HandleFunc("/update/{id}", imageHandler.UpdateImage).Methods("POST")
+	router.HandleFunc("/image/{id}/edits", imageHandler.UpdateEdits).Methods("POST")
+	router.HandleFunc("/image/{id}/edits", imageHandler.ResetEdits).Methods("DELETE")
+	router.HandleFunc("/image/{id}/edits/reset", imageHandler.ResetEdits).Methods("POST")
 	router.HandleFunc("/delete/{id}", imageHandler.DeleteImage).Methods("POST")
+	router.HandleFunc("/delete", imageHandler.BatchDeleteImages).Methods("POST")
+
+	// Admin endpoints are only served when an admin token is configured
+	if adminToken := os.Getenv("ADMIN_TOKEN"); adminToken != "" {
+		adminHandler := handlers.NewAdminHandler(databaseService, adminToken)
+		admin := router.PathPrefix("/admin").Subrouter()
+		admin.Use(adminHandler.RequireToken)
+		admin.HandleFunc("/export", adminHandler.ExportMetadata).Methods("GET")
+		admin.HandleFunc("/import", adminHandler.ImportMetadata).Methods("POST")
+		admin.HandleFunc("/images/{id}/original", imageHandler.DownloadOriginal).Methods("GET")
+		admin.HandleFunc("/duplicates", imageHandler.DuplicateReport).Methods("GET")
+		admin.Handle("/vars", expvar.Handler()).Methods("GET")
+	}
 
 	// Handle image proxy to S3
 	router.PathPrefix("/images/").Handler(http.StripPrefix("/images/", http.HandlerFunc(imageHandler.ServeImage)))
@@ -109,6 +175,274 @@ func main() {
 	log.Fatal(http.ListenAndServe(":"+port, router))
 }
 
+// newDatabaseCache wraps databaseService with a cache configured by the
+// environment and publishes its counters as the "databaseCache" expvar. With
+// CACHE_INVALIDATION_CONSUMER set, changes made by other servers are read
+// from the change feed under that consumer name and dropped from the cache
+func newDatabaseCache(databaseService services.DatabaseService) (*services.CachedDatabaseService, error) {
+	var opts services.CacheOptions
+	var err error
+	if opts.RecordTTL, err = time.ParseDuration(getEnv("DB_CACHE_RECORD_TTL", "30s")); err != nil {
+		return nil, fmt.Errorf("invalid DB_CACHE_RECORD_TTL: %w", err)
+	}
+	if opts.ListTTL, err = time.ParseDuration(getEnv("DB_CACHE_LIST_TTL", "10s")); err != nil {
+		return nil, fmt.Errorf("invalid DB_CACHE_LIST_TTL: %w", err)
+	}
+
+	cache := services.NewCachedDatabaseService(databaseService, opts)
+	expvar.Publish("databaseCache", expvar.Func(func() any { return cache.Stats() }))
+
+	consumer := os.Getenv("CACHE_INVALIDATION_CONSUMER")
+	if events, ok := databaseService.(services.EventLog); ok && consumer != "" {
+		feed := changefeed.New(events, changefeed.Options{})
+		go func() {
+			ctx := context.Background()
+			for {
+				err := feed.Subscribe(ctx, consumer, func(ctx context.Context, event models.ImageEvent) error {
+					cache.Invalidate(event.ImageID)
+					return nil
+				})
+				if !errors.Is(err, services.ErrEventsExpired) {
+					log.Printf("Cache invalidation feed stopped: %v", err)
+					return
+				}
+
+				// A consumer that fell behind cannot know what changed, so
+				// it drops everything and continues from the latest events
+				cache.InvalidateAll()
+				if err := feed.SeekLatest(ctx, consumer); err != nil {
+					log.Printf("Cache invalidation feed stopped: %v", err)
+					return
+				}
+			}
+		}()
+	}
+
+	return cache, nil
+}
+
+// recoveryInterval is how often interrupted uploads and deletes are
+// recovered. Uploads pending for longer than this are considered abandoned
+const recoveryInterval = 5 * time.Minute
+
+// Backend names accepted by newStorageService and newDatabaseService
+const (
+	storageLocal     = "local"
+	storageS3        = "s3"
+	databaseLocal    = "local"
+	databaseDynamoDB = "dynamodb"
+)
+
+// newServices creates the storage and database services selected by the
+// environment
+func newServices(ctx context.Context) (services.StorageService, services.DatabaseService, error) {
+	storageBackend, databaseBackend := defaultBackends()
+
+	storageService, err := newStorageService(ctx, storageBackend)
+	if err != nil {
+		return nil, nil, err
+	}
+	databaseService, err := newDatabaseService(ctx, databaseBackend)
+	if err != nil {
+		return nil, nil, err
+	}
+	return storageService, databaseService, nil
+}
+
+// defaultBackends returns the storage and database backends selected by
+// USE_LOCAL_STORAGE
+func defaultBackends() (string, string) {
+	if getEnv("USE_LOCAL_STORAGE", "true") == "true" {
+		return storageLocal, databaseLocal
+	}
+	return storageS3, databaseDynamoDB
+}
+
+// newStorageService creates the named storage backend
+func newStorageService(ctx context.Context, backend string) (services.StorageService, error) {
+	switch backend {
+	case storageLocal:
+		// Use local file storage instead of S3
+		localStoragePath := getEnv("LOCAL_STORAGE_PATH", "./data/images")
+		log.Println("Using local storage at:", localStoragePath)
+		storageService, err := services.NewLocalStorageService(localStoragePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize local storage: %w", err)
+		}
+		return storageService, nil
+	case storageS3:
+		s3Client, _, _, err := newAWSClients(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+		}
+		return services.NewS3Service(s3Client, getEnv("S3_BUCKET_NAME", "image-gallery-bucket")), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q, expected %s or %s", backend, storageLocal, storageS3)
+}
+
+// newDatabaseService creates the named database backend
+func newDatabaseService(ctx context.Context, backend string) (services.DatabaseService, error) {
+	switch backend {
+	case databaseLocal:
+		localStoragePath := getEnv("LOCAL_STORAGE_PATH", "./data/images")
+		log.Println("Using local database at:", localStoragePath)
+		databaseService, err := services.NewLocalDBService(localStoragePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize local database: %w", err)
+		}
+		return databaseService, nil
+	case databaseDynamoDB:
+		_, dynamoDBClient, _, err := newAWSClients(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+		}
+		return services.NewDynamoDBService(dynamoDBClient, getEnv("DYNAMODB_TABLE_NAME", "image-gallery-table")), nil
+	}
+	return nil, fmt.Errorf("unknown database backend %q, expected %s or %s", backend, databaseLocal, databaseDynamoDB)
+}
+
+// newAWSClients creates S3 and DynamoDB clients from the default AWS
+// configuration. Endpoints can be overridden with AWS_ENDPOINT_URL_S3 and
+// AWS_ENDPOINT_URL_DYNAMODB to use MinIO or DynamoDB Local
+func newAWSClients(ctx context.Context) (*s3.Client, *dynamodb.Client, aws.Config, error) {
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, nil, aws.Config{}, err
+	}
+
+	// MinIO and most S3-compatible servers need path-style bucket addressing
+	usePathStyle := getEnv("S3_USE_PATH_STYLE", "false") == "true"
+	s3Client := s3.NewFromConfig(cfg, func(o *s3.Options) {
+		o.UsePathStyle = usePathStyle
+	})
+
+	return s3Client, dynamodb.NewFromConfig(cfg), cfg, nil
+}
+
+// uploadLimits reads the upload limits from the environment. Unset
+// variables keep the defaults
+func uploadLimits() (imaging.Limits, error) {
+	limits := imaging.DefaultLimits()
+	settings := []struct {
+		key   string
+		value *int64
+	}{
+		{"UPLOAD_MAX_BYTES", &limits.MaxFileSize},
+		{"IMAGE_MAX_PIXELS", &limits.MaxPixels},
+	}
+	for _, setting := range settings {
+		value, err := getEnvInt(setting.key, *setting.value)
+		if err != nil {
+			return limits, err
+		}
+		*setting.value = value
+	}
+
+	intSettings := []struct {
+		key   string
+		value *int
+	}{
+		{"IMAGE_MAX_WIDTH", &limits.MaxWidth},
+		{"IMAGE_MAX_HEIGHT", &limits.MaxHeight},
+		{"IMAGE_MAX_FRAMES", &limits.MaxFrames},
+		{"IMAGE_DECODE_CONCURRENCY", &limits.MaxConcurrentDecodes},
+	}
+	for _, setting := range intSettings {
+		value, err := getEnvInt(setting.key, int64(*setting.value))
+		if err != nil {
+			return limits, err
+		}
+		*setting.value = int(value)
+	}
+	return limits, nil
+}
+
+// watermark reads the watermark from the environment: WATERMARK_TEXT or
+// WATERMARK_LOGO, the path of an image file, with WATERMARK_POSITION,
+// WATERMARK_OPACITY and WATERMARK_SCALE. It returns nil when neither text
+// nor a logo is set
+func watermark() (*imaging.Watermark, error) {
+	opts := imaging.WatermarkOptions{
+		Text:     os.Getenv("WATERMARK_TEXT"),
+		Position: imaging.Position(getEnv("WATERMARK_POSITION", string(imaging.PositionBottomRight))),
+	}
+	if path := os.Getenv("WATERMARK_LOGO"); path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open WATERMARK_LOGO: %w", err)
+		}
+		defer file.Close()
+		if opts.Logo, _, err = image.Decode(file); err != nil {
+			return nil, fmt.Errorf("failed to read WATERMARK_LOGO: %w", err)
+		}
+	}
+	if opts.Text == "" && opts.Logo == nil {
+		return nil, nil
+	}
+
+	var err error
+	if opts.Opacity, err = getEnvFloat("WATERMARK_OPACITY", 0.5); err != nil {
+		return nil, err
+	}
+	if opts.Scale, err = getEnvFloat("WATERMARK_SCALE", 0.25); err != nil {
+		return nil, err
+	}
+	mark, err := imaging.NewWatermark(opts)
+	if err != nil {
+		return nil, fmt.Errorf("invalid watermark: %w", err)
+	}
+	return mark, nil
+}
+
+// duplicateDetection reads DUPLICATE_POLICY and DUPLICATE_THRESHOLD
+func duplicateDetection() (duplicates.Options, error) {
+	policy, err := duplicates.ParsePolicy(getEnv("DUPLICATE_POLICY", string(duplicates.PolicyWarn)))
+	if err != nil {
+		return duplicates.Options{}, fmt.Errorf("invalid DUPLICATE_POLICY: %w", err)
+	}
+	// 0 is a valid threshold that only matches identical hashes, so it is
+	// not read with getEnvInt
+	threshold := duplicates.DefaultThreshold
+	if value := os.Getenv("DUPLICATE_THRESHOLD"); value != "" {
+		threshold, err = strconv.Atoi(value)
+		if err != nil || threshold < 0 {
+			return duplicates.Options{}, errors.New("invalid DUPLICATE_THRESHOLD: must be a non-negative integer")
+		}
+	}
+	if threshold > 64 {
+		return duplicates.Options{}, fmt.Errorf("invalid DUPLICATE_THRESHOLD: hashes have 64 bits, got %d", threshold)
+	}
+	return duplicates.Options{Policy: policy, Threshold: threshold}, nil
+}
+
+// getEnvFloat gets a number environment variable or returns the default
+// value
+func getEnvFloat(key string, defaultValue float64) (float64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: must be a number", key)
+	}
+	return f, nil
+}
+
+// getEnvInt gets a positive integer environment variable or returns the
+// default value
+func getEnvInt(key string, defaultValue int64) (int64, error) {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue, nil
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid %s: must be a positive integer", key)
+	}
+	return n, nil
+}
+
 // getEnv gets an environment variable or returns the default value
 func getEnv(key, defaultValue string) string {
 	value := os.Getenv(key)
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// runMigrateRecords rewrites every record stored with an older schema version
+func runMigrateRecords(args []string) error {
+	_, defaultDatabase := defaultBackends()
+
+	flags := flag.NewFlagSet("migrate-records", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only count the outdated records")
+	databaseBackend := flags.String("database", defaultDatabase, "database backend to migrate: local or dynamodb")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	databaseService, err := newDatabaseService(ctx, *databaseBackend)
+	if err != nil {
+		return err
+	}
+
+	migrator, ok := databaseService.(services.RecordMigrator)
+	if !ok {
+		return fmt.Errorf("database backend %q does not support record migration", *databaseBackend)
+	}
+
+	report, err := migrator.MigrateRecords(ctx, *dryRun)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+
+	for _, migration := range models.Migrations() {
+		if count := report.Outdated[migration.From]; count > 0 {
+			log.Printf("%d records at schema version %d: %s", count, migration.From, migration.Description)
+		}
+	}
+	if len(report.Failed) > 0 {
+		return fmt.Errorf("%d records could not be migrated", len(report.Failed))
+	}
+
+	log.Printf("Migrated %d of %d records to schema version %d (dry run: %v)", report.Migrated, report.Scanned, models.CurrentSchemaVersion, report.DryRun)
+	return nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"image_gallery/internal/provision"
+)
+
+// runProvision creates or verifies the AWS resources used by the gallery
+func runProvision(args []string) error {
+	flags := flag.NewFlagSet("provision", flag.ExitOnError)
+	check := flags.Bool("check", false, "report differences between expected and actual resources without changing anything")
+	flags.Parse(args)
+
+	ctx := context.Background()
+	s3Client, dynamoDBClient, cfg, err := newAWSClients(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+
+	spec := provision.Spec{
+		BucketName:            getEnv("S3_BUCKET_NAME", "image-gallery-bucket"),
+		TableName:             getEnv("DYNAMODB_TABLE_NAME", "image-gallery-table"),
+		Region:                cfg.Region,
+		CORSAllowedOrigins:    strings.Split(getEnv("CORS_ALLOWED_ORIGINS", "*"), ","),
+		NoncurrentVersionDays: 30,
+		AbortMultipartDays:    7,
+	}
+	provisioner := provision.NewProvisioner(s3Client, dynamoDBClient, spec)
+
+	var results []provision.Result
+	if *check {
+		results, err = provisioner.Check(ctx)
+	} else {
+		results, err = provisioner.Apply(ctx)
+	}
+	for _, result := range results {
+		fmt.Println(result)
+	}
+	if err != nil {
+		return err
+	}
+
+	// In check mode any drift is a failure so the command can gate deploys
+	for _, result := range results {
+		if result.Status == provision.StatusDrift {
+			os.Exit(1)
+		}
+	}
+	return nil
+}
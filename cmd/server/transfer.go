@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"image_gallery/internal/transfer"
+)
+
+// runExport writes all image metadata as JSON Lines or CSV
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	formatName := flags.String("format", "", "output format: jsonl or csv (default: from --output extension, else jsonl)")
+	output := flags.String("output", "-", "file to write, or - for stdout")
+	flags.Parse(args)
+
+	format, err := transferFormat(*formatName, *output)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	_, databaseService, err := newServices(ctx)
+	if err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "-" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	count, err := transfer.Export(ctx, databaseService, w, format)
+	if err != nil {
+		return err
+	}
+	log.Printf("Exported %d images", count)
+	return nil
+}
+
+// runImport upserts image metadata from a JSON Lines or CSV file and prints
+// the change report as JSON
+func runImport(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	formatName := flags.String("format", "", "input format: jsonl or csv (default: from the file extension)")
+	dryRun := flags.Bool("dry-run", false, "validate and report changes without writing them")
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		return errors.New("usage: import [--format jsonl|csv] [--dry-run] <file|->")
+	}
+	input := flags.Arg(0)
+
+	format, err := transferFormat(*formatName, input)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if input != "-" {
+		file, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	ctx := context.Background()
+	_, databaseService, err := newServices(ctx)
+	if err != nil {
+		return err
+	}
+
+	report, importErr := transfer.Import(ctx, databaseService, r, format, transfer.ImportOptions{DryRun: *dryRun})
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(report); err != nil {
+		return err
+	}
+	if importErr != nil {
+		return importErr
+	}
+
+	log.Printf("Import: %d created, %d updated, %d unchanged (dry run: %v)", report.Created, report.Updated, report.Unchanged, report.DryRun)
+	return nil
+}
+
+// transferFormat picks the format from the flag or, failing that, the path
+func transferFormat(name, path string) (transfer.Format, error) {
+	if name != "" {
+		return transfer.ParseFormat(name)
+	}
+	if path == "-" {
+		return transfer.FormatJSONL, nil
+	}
+	format, err := transfer.FormatFromPath(path)
+	if err != nil {
+		return "", fmt.Errorf("%w; use --format", err)
+	}
+	return format, nil
+}
@@ -0,0 +1,128 @@
+// Package backfill fills in what uploads record about an image for the
+// images stored before they recorded it
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+
+	"image_gallery/internal/derived"
+	"image_gallery/internal/duplicates"
+	"image_gallery/internal/imaging"
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// Options controls a backfill
+type Options struct {
+	// DryRun only counts the images that need backfilling
+	DryRun bool
+	// Force recomputes the field for every image, not only those without it
+	Force bool
+}
+
+// Report summarizes a backfill
+type Report struct {
+	DryRun  bool `json:"dryRun"`
+	Scanned int  `json:"scanned"`
+	// Missing counts the images that needed backfilling
+	Missing int `json:"missing"`
+	Updated int `json:"updated"`
+	// Failed maps image IDs to the reason they could not be backfilled
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// field is a field of the image record that a backfill fills in
+type field struct {
+	// has reports whether an image already has the field
+	has func(models.Image) bool
+	// fill reads what the field needs from storage and sets it on image
+	fill func(image *models.Image) error
+}
+
+// Palettes finds the dominant colours of the images without a palette and
+// saves them. Images are read from their smallest variant, which already
+// has the edits applied, or from the original when they have no variants.
+// Images with nothing opaque get no palette and count as updated
+func Palettes(ctx context.Context, storageService services.StorageService, databaseService services.DatabaseService, decoder *imaging.Decoder, opts Options) (Report, error) {
+	return run(ctx, databaseService, opts, field{
+		has: func(image models.Image) bool { return len(image.Palette) > 0 },
+		fill: func(image *models.Image) error {
+			key, edits := image.S3Key, derived.Recipe(image.Edits)
+			if len(image.Variants) > 0 {
+				key, edits = image.Variants[0].Key, imaging.Edits{}
+			}
+			content, _, err := storageService.GetImage(ctx, key)
+			if err != nil {
+				return err
+			}
+			palette, err := decoder.Palette(ctx, bytes.NewReader(content), edits)
+			if err != nil {
+				return err
+			}
+			image.Palette = derived.Swatches(palette)
+			return nil
+		},
+	})
+}
+
+// Features finds the perceptual hashes and colour histograms of the images
+// without them and saves them. Like uploads, they are of the image as
+// uploaded: the smallest variant when the image is unedited, the original
+// otherwise
+func Features(ctx context.Context, storageService services.StorageService, databaseService services.DatabaseService, decoder *imaging.Decoder, opts Options) (Report, error) {
+	return run(ctx, databaseService, opts, field{
+		has: func(image models.Image) bool { return image.PerceptualHash != "" && len(image.ColorHistogram) > 0 },
+		fill: func(image *models.Image) error {
+			key := image.S3Key
+			if len(image.Variants) > 0 && image.Edits.IsZero() {
+				key = image.Variants[0].Key
+			}
+			content, _, err := storageService.GetImage(ctx, key)
+			if err != nil {
+				return err
+			}
+			features, err := decoder.Features(ctx, bytes.NewReader(content))
+			if err != nil {
+				return err
+			}
+			image.PerceptualHash = duplicates.FormatHash(features.PerceptualHash)
+			image.ColorHistogram = features.Histogram
+			return nil
+		},
+	})
+}
+
+// run fills in f for the images without it, or for all with opts.Force
+func run(ctx context.Context, databaseService services.DatabaseService, opts Options, f field) (Report, error) {
+	report := Report{DryRun: opts.DryRun, Failed: make(map[string]string)}
+	images, err := databaseService.ListImages(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	for _, image := range images {
+		report.Scanned++
+		if image.Pending() || (f.has(image) && !opts.Force) {
+			continue
+		}
+		report.Missing++
+		if opts.DryRun {
+			continue
+		}
+
+		if err := f.fill(&image); err != nil {
+			report.Failed[image.ID] = err.Error()
+			continue
+		}
+		// A conflict means the image changed since it was listed; the next
+		// run picks it up
+		if err := databaseService.SaveImage(ctx, image); err != nil {
+			report.Failed[image.ID] = err.Error()
+			continue
+		}
+		report.Updated++
+	}
+	return report, nil
+}
@@ -0,0 +1,164 @@
+package backfill
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"reflect"
+	"testing"
+
+	"image_gallery/internal/duplicates"
+	"image_gallery/internal/imaging"
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// bytesFile adapts a byte slice to multipart.File for UploadImage
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (bytesFile) Close() error { return nil }
+
+// solid encodes a small PNG of one colour
+func solid(t *testing.T, c color.Color) []byte {
+	t.Helper()
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestPalettes(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage, err := services.NewLocalStorageService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	db, err := services.NewLocalDBService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+
+	blobs := map[string][]byte{
+		"original.png":          solid(t, color.NRGBA{R: 255, A: 255}),
+		"variants/256/blue.png": solid(t, color.NRGBA{B: 255, A: 255}),
+		"blue.png":              solid(t, color.NRGBA{G: 255, A: 255}),
+		"transparent.png":       solid(t, color.NRGBA{}),
+		"done.png":              solid(t, color.NRGBA{G: 255, A: 255}),
+	}
+	for key, content := range blobs {
+		if err := storage.UploadImage(ctx, key, bytesFile{bytes.NewReader(content)}, "image/png"); err != nil {
+			t.Fatalf("Failed to upload %s: %v", key, err)
+		}
+	}
+	for _, image := range []models.Image{
+		{ID: "original", S3Key: "original.png"},
+		// The variant is read rather than the original
+		{ID: "blue", S3Key: "blue.png", Variants: []models.Variant{{Size: 256, Key: "variants/256/blue.png"}}},
+		{ID: "transparent", S3Key: "transparent.png"},
+		{ID: "done", S3Key: "done.png", Palette: []models.Swatch{{Color: "#123456", Weight: 1}}},
+		{ID: "missing", S3Key: "missing.png"},
+	} {
+		if err := db.SaveImage(ctx, image); err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+	}
+	decoder := imaging.NewDecoder(imaging.DefaultLimits())
+
+	t.Run("DryRun", func(t *testing.T) {
+		report, err := Palettes(ctx, storage, db, decoder, Options{DryRun: true})
+		if err != nil {
+			t.Fatalf("Failed to backfill: %v", err)
+		}
+		if report.Scanned != 5 || report.Missing != 4 || report.Updated != 0 {
+			t.Errorf("Expected 4 of 5 images to need a palette and none updated, got %+v", report)
+		}
+		if image, _ := db.GetImage(ctx, "original"); image.Palette != nil {
+			t.Errorf("Expected a dry run to save nothing, got %+v", image.Palette)
+		}
+	})
+
+	t.Run("FillsMissingPalettes", func(t *testing.T) {
+		report, err := Palettes(ctx, storage, db, decoder, Options{})
+		if err != nil {
+			t.Fatalf("Failed to backfill: %v", err)
+		}
+		if report.Updated != 3 || len(report.Failed) != 1 || report.Failed["missing"] == "" {
+			t.Errorf("Expected 3 updated and the missing blob to fail, got %+v", report)
+		}
+
+		expected := map[string][]models.Swatch{
+			"original":    {{Color: "#ff0000", Weight: 1}},
+			"blue":        {{Color: "#0000ff", Weight: 1}},
+			"transparent": nil,
+			"done":        {{Color: "#123456", Weight: 1}},
+		}
+		for id, palette := range expected {
+			image, err := db.GetImage(ctx, id)
+			if err != nil {
+				t.Fatalf("Failed to get %s: %v", id, err)
+			}
+			if !reflect.DeepEqual(image.Palette, palette) {
+				t.Errorf("Expected %s to have palette %+v, got %+v", id, palette, image.Palette)
+			}
+		}
+	})
+
+	t.Run("Force", func(t *testing.T) {
+		if _, err := Palettes(ctx, storage, db, decoder, Options{Force: true}); err != nil {
+			t.Fatalf("Failed to backfill: %v", err)
+		}
+		image, _ := db.GetImage(ctx, "done")
+		if !reflect.DeepEqual(image.Palette, []models.Swatch{{Color: "#00ff00", Weight: 1}}) {
+			t.Errorf("Expected the palette to be recomputed, got %+v", image.Palette)
+		}
+	})
+}
+
+func TestFeatures(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage, err := services.NewLocalStorageService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	db, err := services.NewLocalDBService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+
+	content := solid(t, color.NRGBA{R: 255, A: 255})
+	if err := storage.UploadImage(ctx, "red.png", bytesFile{bytes.NewReader(content)}, "image/png"); err != nil {
+		t.Fatalf("Failed to upload: %v", err)
+	}
+	// The variant of an edited image is not the image as uploaded
+	image := models.Image{ID: "red", S3Key: "red.png", Edits: &models.Edits{Rotate: 90}, Variants: []models.Variant{{Size: 256, Key: "variants/256/missing.png"}}}
+	if err := db.SaveImage(ctx, image); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+
+	decoder := imaging.NewDecoder(imaging.DefaultLimits())
+	report, err := Features(ctx, storage, db, decoder, Options{})
+	if err != nil {
+		t.Fatalf("Failed to backfill: %v", err)
+	}
+	if report.Updated != 1 || len(report.Failed) != 0 {
+		t.Fatalf("Expected 1 updated, got %+v", report)
+	}
+	image, _ = db.GetImage(ctx, "red")
+	features, err := decoder.Features(ctx, bytes.NewReader(content))
+	if err != nil || image.PerceptualHash != duplicates.FormatHash(features.PerceptualHash) {
+		t.Errorf("Expected the hash of the original, got %q", image.PerceptualHash)
+	}
+	if len(image.ColorHistogram) != 64 || image.ColorHistogram[48] != 255 {
+		t.Errorf("Expected all of the histogram in the red bin, got %v", image.ColorHistogram)
+	}
+}
@@ -0,0 +1,356 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// Archive layout. The metadata comes first so a restore knows the content
+// type of each blob, and the manifest last so it can hold every checksum
+const (
+	metadataPath = "metadata.jsonl"
+	manifestPath = "manifest.json"
+	blobPrefix   = "blobs/"
+)
+
+// manifestVersion is the version of the archive layout written by Backup.
+// Version 2 added tombstones
+const manifestVersion = 2
+
+// tombstoneMargin widens the window an incremental backup reads from the
+// outbox, as event times from different servers are not exactly in order
+const tombstoneMargin = time.Minute
+
+// eventBatch is the number of outbox events read at a time
+const eventBatch = 500
+
+// Compression is the compression of the tar stream
+type Compression string
+
+const (
+	CompressionGzip Compression = "gzip"
+	CompressionZstd Compression = "zstd"
+)
+
+// ParseCompression parses a compression name
+func ParseCompression(name string) (Compression, error) {
+	switch strings.ToLower(name) {
+	case "gzip", "gz":
+		return CompressionGzip, nil
+	case "zstd", "zst":
+		return CompressionZstd, nil
+	}
+	return "", fmt.Errorf("unknown compression %q, expected gzip or zstd", name)
+}
+
+// CompressionFromPath infers the compression from an archive file name
+func CompressionFromPath(path string) (Compression, error) {
+	switch {
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return CompressionGzip, nil
+	case strings.HasSuffix(path, ".tar.zst"), strings.HasSuffix(path, ".tzst"):
+		return CompressionZstd, nil
+	}
+	return "", fmt.Errorf("cannot infer compression of %q, expected .tar.gz or .tar.zst", path)
+}
+
+// Entry is a file in the archive with its checksum
+type Entry struct {
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Manifest describes the contents of an archive
+type Manifest struct {
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"createdAt"`
+	Since     *time.Time `json:"since,omitempty"`
+	Images    int        `json:"images"`
+	Entries   []Entry    `json:"entries"`
+	// Missing lists the keys of images whose blob was not found in storage
+	Missing []string `json:"missing,omitempty"`
+	// Deleted lists the images an incremental backup saw deleted
+	Deleted []Tombstone `json:"deleted,omitempty"`
+	// Warnings describes what an incremental backup could not capture
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Tombstone records the deletion of an image
+type Tombstone struct {
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// Options controls a backup
+type Options struct {
+	Compression Compression
+	// Since limits the backup to images created, updated or deleted after
+	// it; the zero time backs up everything. Changes are read from the
+	// outbox; where it no longer reaches back to Since, images are picked by
+	// their timestamps instead and deletions before the outbox are missed
+	Since time.Time
+}
+
+// Backup streams a compressed tar archive of every image record and blob to w.
+// Images whose upload or delete has not finished are left out
+func Backup(ctx context.Context, storage services.StorageService, db services.DatabaseService, w io.Writer, opts Options) (Manifest, error) {
+	manifest := Manifest{Version: manifestVersion, CreatedAt: time.Now().UTC(), Entries: []Entry{}}
+	if !opts.Since.IsZero() {
+		since := opts.Since.UTC()
+		manifest.Since = &since
+	}
+
+	// The outbox is read before the records, so an image deleted in between
+	// is missing from the listing rather than listed and tombstoned
+	var changed map[string]bool
+	if !opts.Since.IsZero() {
+		events, ok := db.(services.EventLog)
+		if !ok {
+			return manifest, errors.New("incremental backups need a database with an outbox")
+		}
+		var err error
+		var window time.Time
+		changed, manifest.Deleted, window, err = changesSince(ctx, events, opts.Since)
+		if err != nil {
+			return manifest, err
+		}
+		if !window.IsZero() {
+			manifest.Warnings = append(manifest.Warnings, fmt.Sprintf("the outbox only goes back to %s, so images deleted between %s and then have no tombstone and changes that did not move a timestamp are missed; take a full backup to capture them", window.UTC().Format(time.RFC3339), opts.Since.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	images, err := db.ListImages(ctx)
+	if err != nil {
+		return manifest, fmt.Errorf("failed to list images: %w", err)
+	}
+	images = changedSince(images, opts.Since, changed)
+	manifest.Images = len(images)
+
+	compressor, err := newCompressor(w, opts.Compression)
+	if err != nil {
+		return manifest, err
+	}
+	archive := tar.NewWriter(compressor)
+
+	var metadata bytes.Buffer
+	encoder := json.NewEncoder(&metadata)
+	for _, image := range images {
+		if err := encoder.Encode(image); err != nil {
+			return manifest, err
+		}
+	}
+	if err := writeEntry(archive, &manifest, metadataPath, metadata.Bytes()); err != nil {
+		return manifest, err
+	}
+
+	seen := make(map[string]bool)
+	for _, image := range images {
+		for _, key := range image.Keys() {
+			if key == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			data, _, err := storage.GetImage(ctx, key)
+			if errors.Is(err, services.ErrNotFound) {
+				manifest.Missing = append(manifest.Missing, key)
+				continue
+			}
+			if err != nil {
+				return manifest, fmt.Errorf("failed to read blob %s: %w", key, err)
+			}
+			if err := writeEntry(archive, &manifest, blobPrefix+key, data); err != nil {
+				return manifest, err
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	if err := writeFile(archive, manifestPath, data, manifest.CreatedAt); err != nil {
+		return manifest, err
+	}
+
+	if err := archive.Close(); err != nil {
+		return manifest, err
+	}
+	return manifest, compressor.Close()
+}
+
+// changedSince returns the finished images created or updated after since,
+// or named in ids, oldest first
+func changedSince(images []models.Image, since time.Time, ids map[string]bool) []models.Image {
+	var changed []models.Image
+	for _, image := range images {
+		if image.Pending() {
+			continue
+		}
+		if since.IsZero() || image.CreatedAt.After(since) || image.UpdatedAt.After(since) || ids[image.ID] {
+			changed = append(changed, image)
+		}
+	}
+
+	sort.Slice(changed, func(i, j int) bool {
+		if !changed[i].CreatedAt.Equal(changed[j].CreatedAt) {
+			return changed[i].CreatedAt.Before(changed[j].CreatedAt)
+		}
+		return changed[i].ID < changed[j].ID
+	})
+	return changed
+}
+
+// changesSince reads the outbox for the images changed after since and the
+// deletions among them. A change such as marking an upload finished does not
+// move UpdatedAt, so the record timestamps alone would miss it. When a shard
+// has already dropped events from after since, it returns the time its
+// outbox now starts from, the latest across shards, and the caller falls
+// back to the timestamps
+func changesSince(ctx context.Context, log services.EventLog, since time.Time) (map[string]bool, []Tombstone, time.Time, error) {
+	from := since.Add(-tombstoneMargin)
+
+	changed := make(map[string]bool)
+	deleted := make(map[string]time.Time)
+	var window time.Time
+	for shard := range log.Shards() {
+		after, err := firstEventAfter(ctx, log, shard, from)
+		if err != nil {
+			return nil, nil, time.Time{}, fmt.Errorf("failed to read outbox shard %d: %w", shard, err)
+		}
+		start, err := droppedUntil(ctx, log, shard, after)
+		if err != nil {
+			return nil, nil, time.Time{}, fmt.Errorf("failed to read outbox shard %d: %w", shard, err)
+		}
+		if start.After(window) {
+			window = start
+		}
+		for {
+			events, err := log.ReadEvents(ctx, shard, after, eventBatch)
+			if err != nil {
+				return nil, nil, time.Time{}, fmt.Errorf("failed to read outbox shard %d: %w", shard, err)
+			}
+			if len(events) == 0 {
+				break
+			}
+			for _, event := range events {
+				changed[event.ImageID] = true
+				if event.Type == models.EventDeleted && event.OccurredAt.After(deleted[event.ImageID]) {
+					deleted[event.ImageID] = event.OccurredAt
+				}
+			}
+			after = events[len(events)-1].Sequence
+		}
+	}
+
+	tombstones := make([]Tombstone, 0, len(deleted))
+	for id, at := range deleted {
+		tombstones = append(tombstones, Tombstone{ID: id, DeletedAt: at.UTC()})
+	}
+	sort.Slice(tombstones, func(i, j int) bool { return tombstones[i].ID < tombstones[j].ID })
+	return changed, tombstones, window, nil
+}
+
+// droppedUntil returns the time a shard's outbox now starts from if events
+// before the offset firstEventAfter found are gone, as they may have occurred
+// after from, or the zero time if they are all still there
+func droppedUntil(ctx context.Context, log services.EventLog, shard int, offset int64) (time.Time, error) {
+	if offset == 0 {
+		return time.Time{}, nil
+	}
+	_, err := log.ReadEvents(ctx, shard, offset-1, 1)
+	if !errors.Is(err, services.ErrEventsExpired) {
+		return time.Time{}, err
+	}
+	events, err := log.ReadEvents(ctx, shard, offset, 1)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if len(events) == 0 {
+		// Every event is gone, so the outbox holds nothing before now
+		return time.Now(), nil
+	}
+	return events[0].OccurredAt, nil
+}
+
+// firstEventAfter returns the offset of a shard from which every event that
+// occurred after from is read. Events are in commit order, so it searches
+// for the first one that is still present and occurred after from
+func firstEventAfter(ctx context.Context, log services.EventLog, shard int, from time.Time) (int64, error) {
+	high, err := log.LatestSequence(ctx, shard)
+	if err != nil {
+		return 0, err
+	}
+	low := int64(0)
+	for low < high {
+		mid := low + (high-low)/2
+		events, err := log.ReadEvents(ctx, shard, mid, 1)
+		switch {
+		case errors.Is(err, services.ErrEventsExpired):
+			low = mid + 1
+		case err != nil:
+			return 0, err
+		case len(events) == 0 || events[0].OccurredAt.After(from):
+			high = mid
+		default:
+			low = mid + 1
+		}
+	}
+	return low, nil
+}
+
+// writeEntry adds a file to the archive and records it in the manifest
+func writeEntry(archive *tar.Writer, manifest *Manifest, path string, data []byte) error {
+	sum := sha256.Sum256(data)
+	manifest.Entries = append(manifest.Entries, Entry{
+		Path:   path,
+		Size:   int64(len(data)),
+		SHA256: hex.EncodeToString(sum[:]),
+	})
+	return writeFile(archive, path, data, manifest.CreatedAt)
+}
+
+func writeFile(archive *tar.Writer, path string, data []byte, modTime time.Time) error {
+	header := &tar.Header{
+		Name:     path,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+		Format:   tar.FormatPAX,
+	}
+	if err := archive.WriteHeader(header); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if _, err := archive.Write(data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+func newCompressor(w io.Writer, compression Compression) (io.WriteCloser, error) {
+	switch compression {
+	case CompressionGzip, "":
+		return gzip.NewWriter(w), nil
+	case CompressionZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unknown compression %q", compression)
+}
@@ -0,0 +1,342 @@
+package backup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// bytesFile adapts a byte slice to multipart.File for UploadImage
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (bytesFile) Close() error { return nil }
+
+func newBackends(t *testing.T) (services.StorageService, services.DatabaseService) {
+	t.Helper()
+
+	dir := t.TempDir()
+	storage, err := services.NewLocalStorageService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	db, err := services.NewLocalDBService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+	return storage, db
+}
+
+func addImage(t *testing.T, storage services.StorageService, db services.DatabaseService, id string, createdAt time.Time) {
+	t.Helper()
+
+	ctx := context.Background()
+	content := []byte("content of " + id)
+	if err := storage.UploadImage(ctx, id+".jpg", bytesFile{bytes.NewReader(content)}, "image/jpeg"); err != nil {
+		t.Fatalf("Failed to upload image: %v", err)
+	}
+	err := db.SaveImage(ctx, models.Image{
+		ID:          id,
+		Title:       "Image " + id,
+		S3Key:       id + ".jpg",
+		ContentType: "image/jpeg",
+		Size:        int64(len(content)),
+		CreatedAt:   createdAt,
+		UpdatedAt:   createdAt,
+	})
+	if err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+}
+
+func TestBackupRestore(t *testing.T) {
+	for _, compression := range []Compression{CompressionGzip, CompressionZstd} {
+		t.Run(string(compression), func(t *testing.T) {
+			ctx := context.Background()
+			storage, db := newBackends(t)
+			now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+			addImage(t, storage, db, "a", now)
+			addImage(t, storage, db, "b", now.Add(time.Hour))
+
+			var archive bytes.Buffer
+			manifest, err := Backup(ctx, storage, db, &archive, Options{Compression: compression})
+			if err != nil {
+				t.Fatalf("Failed to back up: %v", err)
+			}
+			if manifest.Images != 2 || len(manifest.Entries) != 3 {
+				t.Fatalf("Expected 2 images and 3 entries, got %+v", manifest)
+			}
+
+			targetStorage, targetDB := newBackends(t)
+			report, err := Restore(ctx, targetStorage, targetDB, &archive, RestoreOptions{Verify: true})
+			if err != nil {
+				t.Fatalf("Failed to restore: %v (%v)", err, report.Errors)
+			}
+			if !report.Verified || report.Images != 2 || report.Blobs != 2 {
+				t.Errorf("Expected 2 verified images and blobs, got %+v", report)
+			}
+
+			data, contentType, err := targetStorage.GetImage(ctx, "b.jpg")
+			if err != nil || string(data) != "content of b" {
+				t.Errorf("Expected restored blob, got %q, %v", data, err)
+			}
+			if contentType != "image/jpeg" {
+				t.Errorf("Expected image/jpeg, got %q", contentType)
+			}
+			if image, err := targetDB.GetImage(ctx, "a"); err != nil || image.Title != "Image a" {
+				t.Errorf("Expected restored record, got %+v, %v", image, err)
+			}
+		})
+	}
+}
+
+// eventDB gives a database a fixed outbox, so tests control when events
+// occurred. Events up to expired are gone
+type eventDB struct {
+	services.DatabaseService
+	events  []models.ImageEvent
+	expired int64
+}
+
+func (d *eventDB) Shards() int { return 1 }
+
+func (d *eventDB) ReadEvents(ctx context.Context, shard int, after int64, limit int) ([]models.ImageEvent, error) {
+	if after < d.expired {
+		return nil, services.ErrEventsExpired
+	}
+	if after >= int64(len(d.events)) {
+		return nil, nil
+	}
+	return d.events[after:min(int(after)+limit, len(d.events))], nil
+}
+
+func (d *eventDB) LatestSequence(ctx context.Context, shard int) (int64, error) {
+	return int64(len(d.events)), nil
+}
+
+func (d *eventDB) LoadOffset(ctx context.Context, consumer string, shard int) (int64, error) {
+	return 0, services.ErrNotFound
+}
+
+func (d *eventDB) SaveOffset(ctx context.Context, consumer string, shard int, offset int64) error {
+	return nil
+}
+
+func TestIncrementalBackup(t *testing.T) {
+	ctx := context.Background()
+	storage, local := newBackends(t)
+	since := time.Now().UTC().Add(-time.Hour)
+	addImage(t, storage, local, "old", since.Add(-time.Hour))
+	addImage(t, storage, local, "finished", since.Add(-time.Hour))
+	addImage(t, storage, local, "new", since.Add(10*time.Minute))
+	addImage(t, storage, local, "pending", since.Add(30*time.Minute))
+	pending, err := local.GetImage(ctx, "pending")
+	if err != nil {
+		t.Fatalf("Failed to get image: %v", err)
+	}
+	pending.Status = models.StatusUploading
+	if err := local.SaveImage(ctx, pending); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+
+	event := func(sequence int64, eventType models.EventType, id string, at time.Time) models.ImageEvent {
+		return models.ImageEvent{Sequence: sequence, Type: eventType, ImageID: id, OccurredAt: at}
+	}
+	db := &eventDB{DatabaseService: local, expired: 2, events: []models.ImageEvent{
+		event(1, models.EventCreated, "old", since.Add(-time.Hour)),
+		event(2, models.EventCreated, "finished", since.Add(-time.Hour)),
+		event(3, models.EventCreated, "gone", since.Add(-time.Hour)),
+		event(4, models.EventUpdated, "old", since.Add(-30*time.Minute)),
+		// Marking an upload finished does not move UpdatedAt
+		event(5, models.EventUpdated, "finished", since.Add(5*time.Minute)),
+		event(6, models.EventCreated, "new", since.Add(10*time.Minute)),
+		event(7, models.EventDeleted, "gone", since.Add(20*time.Minute)),
+		event(8, models.EventCreated, "pending", since.Add(30*time.Minute)),
+	}}
+
+	var archive bytes.Buffer
+	manifest, err := Backup(ctx, storage, db, &archive, Options{Since: since})
+	if err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	if manifest.Images != 2 || manifest.Since == nil || !manifest.Since.Equal(since) {
+		t.Fatalf("Expected two images changed since %v, got %+v", since, manifest)
+	}
+	if len(manifest.Deleted) != 1 || manifest.Deleted[0].ID != "gone" || !manifest.Deleted[0].DeletedAt.Equal(since.Add(20*time.Minute)) {
+		t.Fatalf("Expected a tombstone for the deleted image, got %+v", manifest.Deleted)
+	}
+
+	// The target holds an earlier full backup
+	targetStorage, targetDB := newBackends(t)
+	addImage(t, targetStorage, targetDB, "old", since.Add(-time.Hour))
+	addImage(t, targetStorage, targetDB, "gone", since.Add(-time.Hour))
+	report, err := Restore(ctx, targetStorage, targetDB, &archive, RestoreOptions{Verify: true})
+	if err != nil {
+		t.Fatalf("Failed to restore: %v", err)
+	}
+	if report.Images != 2 || report.Deleted != 1 || !report.Verified {
+		t.Errorf("Unexpected report: %+v", report)
+	}
+	for _, id := range []string{"old", "finished", "new"} {
+		if _, err := targetDB.GetImage(ctx, id); err != nil {
+			t.Errorf("Expected %s to be present, got %v", id, err)
+		}
+	}
+	for _, id := range []string{"gone", "pending"} {
+		if _, err := targetDB.GetImage(ctx, id); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("Expected %s to be absent, got %v", id, err)
+		}
+	}
+	if _, _, err := targetStorage.GetImage(ctx, "gone.jpg"); !errors.Is(err, services.ErrNotFound) {
+		t.Errorf("Expected the deleted image's blob to be removed, got %v", err)
+	}
+
+	manifest, err = Backup(ctx, storage, db, io.Discard, Options{Since: time.Now().Add(-services.OutboxRetention - time.Hour)})
+	if err != nil || len(manifest.Warnings) != 1 {
+		t.Errorf("Expected a backup since before the outbox retention to warn, got %+v, %v", manifest.Warnings, err)
+	}
+	_, err = Backup(ctx, storage, local, io.Discard, Options{Since: since})
+	if err != nil {
+		t.Errorf("Expected the local database to support incremental backups, got %v", err)
+	}
+}
+
+func TestIncrementalBackupBeyondOutbox(t *testing.T) {
+	ctx := context.Background()
+	storage, local := newBackends(t)
+	since := time.Now().UTC().Add(-time.Hour)
+	addImage(t, storage, local, "old", since.Add(-time.Hour))
+	addImage(t, storage, local, "finished", since.Add(-time.Hour))
+	addImage(t, storage, local, "new", since.Add(10*time.Minute))
+
+	event := func(sequence int64, eventType models.EventType, id string, at time.Time) models.ImageEvent {
+		return models.ImageEvent{Sequence: sequence, Type: eventType, ImageID: id, OccurredAt: at}
+	}
+	// The events up to the deletion, which all occurred after since, are gone
+	db := &eventDB{DatabaseService: local, expired: 3, events: []models.ImageEvent{
+		event(1, models.EventUpdated, "finished", since.Add(5*time.Minute)),
+		event(2, models.EventCreated, "new", since.Add(10*time.Minute)),
+		event(3, models.EventDeleted, "gone", since.Add(20*time.Minute)),
+		event(4, models.EventUpdated, "old", since.Add(40*time.Minute)),
+	}}
+
+	manifest, err := Backup(ctx, storage, db, io.Discard, Options{Since: since})
+	if err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+	// The new image is found by its timestamp and the old one by the
+	// remaining event, but the finished upload and the deletion are missed
+	if manifest.Images != 2 || len(manifest.Deleted) != 0 {
+		t.Errorf("Expected two images and no tombstones, got %+v", manifest)
+	}
+	if len(manifest.Warnings) != 1 || !strings.Contains(manifest.Warnings[0], since.Add(40*time.Minute).Format(time.RFC3339)) {
+		t.Errorf("Expected a warning that the outbox starts at its oldest event, got %+v", manifest.Warnings)
+	}
+}
+
+// tamper rewrites a gzip archive, passing every entry through modify
+func tamper(t *testing.T, archive []byte, modify func(name string, data []byte) []byte) []byte {
+	t.Helper()
+
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatalf("Failed to open archive: %v", err)
+	}
+	reader := tar.NewReader(gz)
+
+	var out bytes.Buffer
+	gzOut := gzip.NewWriter(&out)
+	writer := tar.NewWriter(gzOut)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Failed to read archive: %v", err)
+		}
+		data, _ := io.ReadAll(reader)
+		data = modify(header.Name, data)
+		if data == nil {
+			continue
+		}
+		header.Size = int64(len(data))
+		writer.WriteHeader(header)
+		writer.Write(data)
+	}
+	writer.Close()
+	gzOut.Close()
+	return out.Bytes()
+}
+
+func TestRestoreRejectsInvalidArchives(t *testing.T) {
+	ctx := context.Background()
+	storage, db := newBackends(t)
+	addImage(t, storage, db, "a", time.Now())
+
+	var archive bytes.Buffer
+	if _, err := Backup(ctx, storage, db, &archive, Options{}); err != nil {
+		t.Fatalf("Failed to back up: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(name string, data []byte) []byte
+	}{
+		{"CorruptBlob", func(name string, data []byte) []byte {
+			if name == blobPrefix+"a.jpg" {
+				return []byte("corrupted")
+			}
+			return data
+		}},
+		{"MissingManifest", func(name string, data []byte) []byte {
+			if name == manifestPath {
+				return nil
+			}
+			return data
+		}},
+		{"MissingBlob", func(name string, data []byte) []byte {
+			if name == blobPrefix+"a.jpg" {
+				return nil
+			}
+			return data
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetStorage, targetDB := newBackends(t)
+			tampered := tamper(t, archive.Bytes(), tt.modify)
+
+			_, err := Restore(ctx, targetStorage, targetDB, bytes.NewReader(tampered), RestoreOptions{Verify: true})
+			if !errors.Is(err, ErrInvalidArchive) {
+				t.Fatalf("Expected ErrInvalidArchive, got %v", err)
+			}
+			if images, _ := targetDB.ListImages(ctx); len(images) != 0 {
+				t.Errorf("Invalid archive restored %d records", len(images))
+			}
+			if _, _, err := targetStorage.GetImage(ctx, "a.jpg"); !errors.Is(err, services.ErrNotFound) {
+				t.Errorf("Invalid archive restored a blob")
+			}
+		})
+	}
+
+	t.Run("Truncated", func(t *testing.T) {
+		targetStorage, targetDB := newBackends(t)
+		truncated := archive.Bytes()[:archive.Len()/2]
+
+		if _, err := Restore(ctx, targetStorage, targetDB, bytes.NewReader(truncated), RestoreOptions{}); !errors.Is(err, ErrInvalidArchive) {
+			t.Fatalf("Expected ErrInvalidArchive, got %v", err)
+		}
+	})
+}
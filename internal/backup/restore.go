@@ -0,0 +1,425 @@
+package backup
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/saga"
+	"image_gallery/internal/services"
+)
+
+var (
+	// ErrInvalidArchive is returned when an archive is truncated, corrupt or
+	// does not match its manifest. Nothing is restored from such an archive
+	ErrInvalidArchive = errors.New("invalid backup archive")
+
+	// ErrVerificationFailed is returned when the restored data read back
+	// from the target backends differs from the archive
+	ErrVerificationFailed = errors.New("restore verification failed")
+)
+
+// RestoreOptions controls a restore
+type RestoreOptions struct {
+	// DryRun only checks the archive against its manifest
+	DryRun bool
+	// Verify reads every restored blob and record back from the target and
+	// compares it with the archive
+	Verify bool
+}
+
+// RestoreReport summarizes a restore
+type RestoreReport struct {
+	Manifest Manifest `json:"manifest"`
+	DryRun   bool     `json:"dryRun"`
+	Images   int      `json:"images"`
+	Blobs    int      `json:"blobs"`
+	// Deleted is the number of images removed from the target because the
+	// archive has a tombstone for them
+	Deleted  int      `json:"deleted"`
+	Verified bool     `json:"verified"`
+	Errors   []string `json:"errors,omitempty"`
+}
+
+// Restore writes the blobs and records of an archive created by Backup to
+// the given backends, which need not be the ones it was taken from, and
+// deletes the images it has tombstones for. The archive is staged in a temporary directory and checked against its
+// manifest before anything is written, so the input may be a plain stream
+func Restore(ctx context.Context, storage services.StorageService, db services.DatabaseService, r io.Reader, opts RestoreOptions) (RestoreReport, error) {
+	report := RestoreReport{DryRun: opts.DryRun}
+
+	staging, err := os.MkdirTemp("", "gallery-restore-")
+	if err != nil {
+		return report, fmt.Errorf("failed to create staging directory: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	archive, err := stageArchive(r, staging)
+	if err != nil {
+		return report, err
+	}
+	report.Manifest = archive.manifest
+
+	if problems := archive.check(); len(problems) > 0 {
+		report.Errors = problems
+		return report, fmt.Errorf("%w: %d problems", ErrInvalidArchive, len(problems))
+	}
+
+	images, err := archive.readMetadata()
+	if err != nil {
+		return report, err
+	}
+	report.Images = len(images)
+	report.Blobs = len(archive.files) - 1
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	contentTypes := make(map[string]string, len(images))
+	for _, image := range images {
+		contentTypes[image.S3Key] = image.ContentType
+		for _, variant := range image.Variants {
+			contentTypes[variant.Key] = variant.ContentType
+		}
+	}
+
+	for path, file := range archive.files {
+		key, ok := strings.CutPrefix(path, blobPrefix)
+		if !ok {
+			continue
+		}
+		if err := uploadStaged(ctx, storage, key, file.staged, contentTypes[key]); err != nil {
+			return report, fmt.Errorf("failed to restore blob %s: %w", key, err)
+		}
+	}
+
+	deleted := tombstoned(archive.manifest.Deleted, images)
+	report.Deleted, err = removeDeleted(ctx, storage, db, deleted)
+	if err != nil {
+		return report, fmt.Errorf("failed to remove deleted images: %w", err)
+	}
+
+	if len(images) > 0 {
+		if err := db.BatchSaveImages(ctx, images); err != nil {
+			return report, fmt.Errorf("failed to restore metadata: %w", err)
+		}
+	}
+
+	if !opts.Verify {
+		return report, nil
+	}
+
+	report.Errors = verify(ctx, storage, db, archive, images, deleted)
+	if len(report.Errors) > 0 {
+		return report, fmt.Errorf("%w: %d problems", ErrVerificationFailed, len(report.Errors))
+	}
+	report.Verified = true
+	return report, nil
+}
+
+// stagedFile is an archive entry copied to the staging directory
+type stagedFile struct {
+	entry  Entry
+	staged string
+}
+
+// stagedArchive is an archive unpacked to the staging directory
+type stagedArchive struct {
+	manifest    Manifest
+	hasManifest bool
+	files       map[string]stagedFile
+}
+
+// stageArchive unpacks r into dir, computing the checksum of every file
+func stageArchive(r io.Reader, dir string) (*stagedArchive, error) {
+	decompressed, err := newDecompressor(r)
+	if err != nil {
+		return nil, err
+	}
+	defer decompressed.Close()
+
+	archive := &stagedArchive{files: make(map[string]stagedFile)}
+	reader := tar.NewReader(decompressed)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+		if header.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("%w: unexpected entry %s", ErrInvalidArchive, header.Name)
+		}
+
+		if header.Name == manifestPath {
+			if err := json.NewDecoder(reader).Decode(&archive.manifest); err != nil {
+				return nil, fmt.Errorf("%w: failed to read manifest: %v", ErrInvalidArchive, err)
+			}
+			archive.hasManifest = true
+			continue
+		}
+
+		if key, ok := strings.CutPrefix(header.Name, blobPrefix); ok {
+			if err := services.ValidateKey(key); err != nil {
+				return nil, fmt.Errorf("%w: blob %s: %v", ErrInvalidArchive, header.Name, err)
+			}
+		} else if header.Name != metadataPath {
+			return nil, fmt.Errorf("%w: unexpected entry %s", ErrInvalidArchive, header.Name)
+		}
+		if _, ok := archive.files[header.Name]; ok {
+			return nil, fmt.Errorf("%w: duplicate entry %s", ErrInvalidArchive, header.Name)
+		}
+
+		file, err := stageFile(reader, header.Name, filepath.Join(dir, strconv.Itoa(len(archive.files))))
+		if err != nil {
+			return nil, err
+		}
+		archive.files[header.Name] = file
+	}
+
+	// Drain the compressed stream so its own checksum is verified
+	if _, err := io.Copy(io.Discard, decompressed); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	return archive, nil
+}
+
+func stageFile(r io.Reader, path, staged string) (stagedFile, error) {
+	file, err := os.Create(staged)
+	if err != nil {
+		return stagedFile{}, fmt.Errorf("failed to stage %s: %w", path, err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), r)
+	if err != nil {
+		return stagedFile{}, fmt.Errorf("%w: failed to read %s: %v", ErrInvalidArchive, path, err)
+	}
+
+	return stagedFile{
+		entry:  Entry{Path: path, Size: size, SHA256: hex.EncodeToString(hash.Sum(nil))},
+		staged: staged,
+	}, nil
+}
+
+// check compares the staged files with the manifest
+func (a *stagedArchive) check() []string {
+	if !a.hasManifest {
+		return []string{"manifest is missing, the archive may be truncated"}
+	}
+	if a.manifest.Version > manifestVersion {
+		return []string{fmt.Sprintf("manifest version %d is newer than the supported version %d", a.manifest.Version, manifestVersion)}
+	}
+
+	var problems []string
+	listed := make(map[string]bool, len(a.manifest.Entries))
+	for _, entry := range a.manifest.Entries {
+		listed[entry.Path] = true
+		file, ok := a.files[entry.Path]
+		switch {
+		case !ok:
+			problems = append(problems, fmt.Sprintf("%s: missing from archive", entry.Path))
+		case file.entry.Size != entry.Size:
+			problems = append(problems, fmt.Sprintf("%s: size %d, manifest says %d", entry.Path, file.entry.Size, entry.Size))
+		case file.entry.SHA256 != entry.SHA256:
+			problems = append(problems, fmt.Sprintf("%s: checksum mismatch", entry.Path))
+		}
+	}
+	for path := range a.files {
+		if !listed[path] {
+			problems = append(problems, fmt.Sprintf("%s: not listed in manifest", path))
+		}
+	}
+	return problems
+}
+
+// readMetadata parses the staged image records
+func (a *stagedArchive) readMetadata() ([]models.Image, error) {
+	file, ok := a.files[metadataPath]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is missing", ErrInvalidArchive, metadataPath)
+	}
+
+	f, err := os.Open(file.staged)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var images []models.Image
+	decoder := json.NewDecoder(f)
+	for {
+		var image models.Image
+		if err := decoder.Decode(&image); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("%w: failed to read metadata: %v", ErrInvalidArchive, err)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// tombstoned returns the IDs of the tombstones that no restored image
+// replaces, such as one deleted and then uploaded again under the same ID
+func tombstoned(tombstones []Tombstone, images []models.Image) []string {
+	restored := make(map[string]bool, len(images))
+	for _, image := range images {
+		restored[image.ID] = true
+	}
+	var ids []string
+	for _, tombstone := range tombstones {
+		if !restored[tombstone.ID] {
+			ids = append(ids, tombstone.ID)
+		}
+	}
+	return ids
+}
+
+// removeDeleted deletes those of the given images the target still has,
+// with their blobs, and returns how many it deleted
+func removeDeleted(ctx context.Context, storage services.StorageService, db services.DatabaseService, ids []string) (int, error) {
+	if len(ids) == 0 {
+		return 0, nil
+	}
+
+	existing, err := db.BatchGetImages(ctx, ids)
+	var batchErr *services.BatchError
+	if errors.As(err, &batchErr) {
+		for id, itemErr := range batchErr.Errors {
+			if !errors.Is(itemErr, services.ErrNotFound) {
+				return 0, fmt.Errorf("failed to read record %s: %w", id, itemErr)
+			}
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	if err := saga.DeleteImages(ctx, storage, db, existing); err != nil {
+		return 0, err
+	}
+	return len(existing), nil
+}
+
+func uploadStaged(ctx context.Context, storage services.StorageService, key, staged, contentType string) error {
+	file, err := os.Open(staged)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return storage.UploadImage(ctx, key, file, contentType)
+}
+
+// verify reads the restored data back from the target backends
+func verify(ctx context.Context, storage services.StorageService, db services.DatabaseService, archive *stagedArchive, images []models.Image, deleted []string) []string {
+	var problems []string
+
+	for path, file := range archive.files {
+		key, ok := strings.CutPrefix(path, blobPrefix)
+		if !ok {
+			continue
+		}
+		data, _, err := storage.GetImage(ctx, key)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("blob %s: %v", key, err))
+			continue
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != file.entry.SHA256 {
+			problems = append(problems, fmt.Sprintf("blob %s: checksum mismatch after restore", key))
+		}
+	}
+
+	ids := make([]string, len(images))
+	for i, image := range images {
+		ids[i] = image.ID
+	}
+	restored, err := db.BatchGetImages(ctx, ids)
+	var batchErr *services.BatchError
+	if errors.As(err, &batchErr) {
+		for id, itemErr := range batchErr.Errors {
+			problems = append(problems, fmt.Sprintf("record %s: %v", id, itemErr))
+		}
+	} else if err != nil {
+		return append(problems, fmt.Sprintf("failed to read records: %v", err))
+	}
+
+	byID := make(map[string]models.Image, len(restored))
+	for _, image := range restored {
+		byID[image.ID] = image
+	}
+	for _, image := range images {
+		got, ok := byID[image.ID]
+		if ok && !sameMetadata(got, image) {
+			problems = append(problems, fmt.Sprintf("record %s: differs after restore", image.ID))
+		}
+	}
+
+	for _, id := range deleted {
+		if _, err := db.GetImage(ctx, id); !errors.Is(err, services.ErrNotFound) {
+			problems = append(problems, fmt.Sprintf("record %s: still present after restore", id))
+		}
+	}
+
+	return problems
+}
+
+// sameMetadata compares the fields a restore must preserve. The version is
+// managed by the target backend and not compared
+func sameMetadata(a, b models.Image) bool {
+	return a.ID == b.ID &&
+		a.Title == b.Title &&
+		a.Description == b.Description &&
+		a.S3Key == b.S3Key &&
+		a.ContentType == b.ContentType &&
+		a.Size == b.Size &&
+		a.CreatedAt.Equal(b.CreatedAt) &&
+		a.UpdatedAt.Equal(b.UpdatedAt)
+}
+
+// newDecompressor detects gzip or zstd from the stream's magic number
+func newDecompressor(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	magic, err := buffered.Peek(4)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		reader, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+		return reader, nil
+	case bytes.Equal(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("%w: not a gzip or zstd stream", ErrInvalidArchive)
+}
@@ -0,0 +1,179 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// Handler processes one event. If it returns an error the same event is
+// delivered again after Options.RetryDelay, and later events wait for it
+type Handler func(ctx context.Context, event models.ImageEvent) error
+
+// Options controls how a Feed reads the outbox
+type Options struct {
+	// PollInterval is how often the outbox is checked for new events
+	PollInterval time.Duration
+	// BatchSize is the number of events read at a time
+	BatchSize int
+	// RetryDelay is the wait before an event whose handler failed is
+	// delivered again
+	RetryDelay time.Duration
+	// FromBeginning starts consumers that have no stored offset at the
+	// oldest event instead of after the latest one
+	FromBeginning bool
+}
+
+// Feed delivers the image events recorded in a database's outbox to
+// subscribed consumers
+type Feed struct {
+	events services.EventLog
+	opts   Options
+}
+
+// New creates a Feed reading from events. Zero options get defaults
+func New(events services.EventLog, opts Options) *Feed {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = time.Second
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = 5 * time.Second
+	}
+	return &Feed{events: events, opts: opts}
+}
+
+// Subscribe delivers events to handler until ctx is done or the consumer
+// has fallen behind the outbox retention in some shard, which returns
+// services.ErrEventsExpired. Each outbox shard is read separately: the
+// events of an image are delivered in order, but handler is called
+// concurrently for events of different shards. The consumer's offset in a
+// shard is stored after each handled event, so a later Subscribe with the
+// same name resumes where this one stopped. Delivery is at least once: an
+// event handled just before the process stops may be delivered again
+func (f *Feed) Subscribe(ctx context.Context, consumer string, handler Handler) error {
+	group, ctx := errgroup.WithContext(ctx)
+	for shard := range f.events.Shards() {
+		group.Go(func() error {
+			return f.subscribeShard(ctx, consumer, shard, handler)
+		})
+	}
+	return group.Wait()
+}
+
+// subscribeShard delivers the events of one shard to handler
+func (f *Feed) subscribeShard(ctx context.Context, consumer string, shard int, handler Handler) error {
+	offset, err := f.startOffset(ctx, consumer, shard)
+	if err != nil {
+		return err
+	}
+
+	for {
+		events, err := f.events.ReadEvents(ctx, shard, offset, f.opts.BatchSize)
+		if errors.Is(err, services.ErrEventsExpired) {
+			return fmt.Errorf("consumer %s at offset %d of shard %d: %w", consumer, offset, shard, err)
+		}
+		if err != nil {
+			log.Printf("Change feed %s: failed to read events of shard %d: %v", consumer, shard, err)
+			if err := sleep(ctx, f.opts.PollInterval); err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, event := range events {
+			if err := f.deliver(ctx, consumer, handler, event); err != nil {
+				return err
+			}
+			offset = event.Sequence
+			if err := f.events.SaveOffset(ctx, consumer, shard, offset); err != nil {
+				// Only costs a redelivery after a restart
+				log.Printf("Change feed %s: failed to save offset %d of shard %d: %v", consumer, offset, shard, err)
+			}
+		}
+
+		if len(events) < f.opts.BatchSize {
+			if err := sleep(ctx, f.opts.PollInterval); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Offset returns the stored offset of a consumer in a shard, or
+// services.ErrNotFound
+func (f *Feed) Offset(ctx context.Context, consumer string, shard int) (int64, error) {
+	return f.events.LoadOffset(ctx, consumer, shard)
+}
+
+// Seek moves a consumer to offset in a shard, so the next Subscribe delivers
+// the events of that shard after it. Use it to replay events
+func (f *Feed) Seek(ctx context.Context, consumer string, shard int, offset int64) error {
+	return f.events.SaveOffset(ctx, consumer, shard, offset)
+}
+
+// SeekLatest moves a consumer past the latest event of every shard, for
+// example to skip past expired events
+func (f *Feed) SeekLatest(ctx context.Context, consumer string) error {
+	for shard := range f.events.Shards() {
+		latest, err := f.events.LatestSequence(ctx, shard)
+		if err != nil {
+			return err
+		}
+		if err := f.events.SaveOffset(ctx, consumer, shard, latest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startOffset returns the stored offset of a consumer in a shard, or for a
+// new consumer the offset selected by Options.FromBeginning
+func (f *Feed) startOffset(ctx context.Context, consumer string, shard int) (int64, error) {
+	offset, err := f.events.LoadOffset(ctx, consumer, shard)
+	if !errors.Is(err, services.ErrNotFound) {
+		return offset, err
+	}
+
+	if !f.opts.FromBeginning {
+		if offset, err = f.events.LatestSequence(ctx, shard); err != nil {
+			return 0, err
+		}
+	}
+	return offset, f.events.SaveOffset(ctx, consumer, shard, offset)
+}
+
+// deliver calls handler until it accepts the event
+func (f *Feed) deliver(ctx context.Context, consumer string, handler Handler, event models.ImageEvent) error {
+	for {
+		err := handler(ctx, event)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Change feed %s: event %d of shard %d not handled, retrying: %v", consumer, event.Sequence, event.Shard, err)
+		if err := sleep(ctx, f.opts.RetryDelay); err != nil {
+			return err
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,233 @@
+package changefeed
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// collector records delivered events and stops the subscription once it has
+// seen want events
+type collector struct {
+	mutex  sync.Mutex
+	events []models.ImageEvent
+	want   int
+	cancel context.CancelFunc
+}
+
+func (c *collector) handle(ctx context.Context, event models.ImageEvent) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.events = append(c.events, event)
+	if len(c.events) == c.want {
+		c.cancel()
+	}
+	return nil
+}
+
+func subscribe(t *testing.T, feed *Feed, consumer string, want int, handler func(*collector) Handler) []models.ImageEvent {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	c := &collector{want: want, cancel: cancel}
+	h := Handler(c.handle)
+	if handler != nil {
+		h = handler(c)
+	}
+
+	err := feed.Subscribe(ctx, consumer, h)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the subscription to be canceled, got %v", err)
+	}
+	return c.events
+}
+
+func newTestDB(t *testing.T) *services.LocalDBService {
+	t.Helper()
+
+	db, err := services.NewLocalDBService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+	return db
+}
+
+func TestFeed(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	feed := New(db, Options{PollInterval: 10 * time.Millisecond, RetryDelay: 10 * time.Millisecond, FromBeginning: true})
+
+	image := models.Image{ID: "test-id", Title: "Test Image", S3Key: "test.jpg"}
+	if err := db.SaveImage(ctx, image); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	image.Version = 1
+	image.Title = "Renamed"
+	if err := db.SaveImage(ctx, image); err != nil {
+		t.Fatalf("Failed to update image: %v", err)
+	}
+
+	t.Run("DeliversInOrder", func(t *testing.T) {
+		events := subscribe(t, feed, "consumer", 2, nil)
+
+		if events[0].Type != models.EventCreated || events[1].Type != models.EventUpdated {
+			t.Fatalf("Expected created then updated, got %s and %s", events[0].Type, events[1].Type)
+		}
+		if fmt.Sprint(events[1].Fields) != "[title]" || events[1].ImageVersion != 2 {
+			t.Errorf("Expected the title change at version 2, got %+v", events[1])
+		}
+	})
+
+	t.Run("ResumesFromStoredOffset", func(t *testing.T) {
+		if err := db.DeleteImage(ctx, "test-id"); err != nil {
+			t.Fatalf("Failed to delete image: %v", err)
+		}
+
+		events := subscribe(t, feed, "consumer", 1, nil)
+		if events[0].Type != models.EventDeleted || events[0].Sequence != 3 {
+			t.Errorf("Expected only the deletion, got %+v", events[0])
+		}
+	})
+
+	t.Run("RedeliversFailedEvents", func(t *testing.T) {
+		failures := 0
+		events := subscribe(t, feed, "flaky", 3, func(c *collector) Handler {
+			return func(ctx context.Context, event models.ImageEvent) error {
+				if event.Sequence == 2 && failures < 2 {
+					failures++
+					return errors.New("temporarily unavailable")
+				}
+				return c.handle(ctx, event)
+			}
+		})
+
+		if failures != 2 {
+			t.Errorf("Expected 2 failed deliveries, got %d", failures)
+		}
+		for i, event := range events {
+			if event.Sequence != int64(i+1) {
+				t.Errorf("Expected event %d in order, got %d", i+1, event.Sequence)
+			}
+		}
+	})
+
+	t.Run("NewConsumersStartAtLatest", func(t *testing.T) {
+		latest := New(db, Options{PollInterval: 10 * time.Millisecond})
+		go func() {
+			// Wait for the consumer to store its start offset
+			for {
+				if _, err := latest.Offset(ctx, "latest", 0); err == nil {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			db.SaveImage(ctx, models.Image{ID: "other-id", Title: "Other", S3Key: "other.jpg"})
+		}()
+
+		events := subscribe(t, latest, "latest", 1, nil)
+		if events[0].ImageID != "other-id" {
+			t.Errorf("Expected only the new event, got %+v", events[0])
+		}
+	})
+}
+
+// expiredLog is an EventLog whose events have all expired
+type expiredLog struct {
+	services.EventLog
+}
+
+func (expiredLog) Shards() int { return 1 }
+
+func (expiredLog) LoadOffset(ctx context.Context, consumer string, shard int) (int64, error) {
+	return 1, nil
+}
+
+func (expiredLog) ReadEvents(ctx context.Context, shard int, after int64, limit int) ([]models.ImageEvent, error) {
+	return nil, services.ErrEventsExpired
+}
+
+func TestFeedReportsExpiredOffsets(t *testing.T) {
+	feed := New(expiredLog{}, Options{})
+
+	err := feed.Subscribe(context.Background(), "consumer", func(ctx context.Context, event models.ImageEvent) error {
+		return nil
+	})
+	if !errors.Is(err, services.ErrEventsExpired) {
+		t.Errorf("Expected ErrEventsExpired, got %v", err)
+	}
+}
+
+// shardedLog is an in-memory EventLog with events in several shards
+type shardedLog struct {
+	mutex   sync.Mutex
+	events  [][]models.ImageEvent
+	offsets map[string]int64
+}
+
+func (l *shardedLog) Shards() int { return len(l.events) }
+
+func (l *shardedLog) ReadEvents(ctx context.Context, shard int, after int64, limit int) ([]models.ImageEvent, error) {
+	events := l.events[shard][min(int(after), len(l.events[shard])):]
+	return events[:min(limit, len(events))], nil
+}
+
+func (l *shardedLog) LatestSequence(ctx context.Context, shard int) (int64, error) {
+	return int64(len(l.events[shard])), nil
+}
+
+func (l *shardedLog) LoadOffset(ctx context.Context, consumer string, shard int) (int64, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	offset, ok := l.offsets[fmt.Sprint(consumer, shard)]
+	if !ok {
+		return 0, services.ErrNotFound
+	}
+	return offset, nil
+}
+
+func (l *shardedLog) SaveOffset(ctx context.Context, consumer string, shard int, offset int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.offsets[fmt.Sprint(consumer, shard)] = offset
+	return nil
+}
+
+func TestFeedReadsEveryShard(t *testing.T) {
+	log := &shardedLog{events: make([][]models.ImageEvent, 3), offsets: make(map[string]int64)}
+	for i := range 9 {
+		shard := i % 3
+		log.events[shard] = append(log.events[shard], models.ImageEvent{
+			Shard:    shard,
+			Sequence: int64(len(log.events[shard]) + 1),
+			ImageID:  fmt.Sprintf("image-%d", i),
+		})
+	}
+	feed := New(log, Options{PollInterval: 10 * time.Millisecond, FromBeginning: true})
+
+	events := subscribe(t, feed, "consumer", 9, nil)
+	last := make(map[int]int64)
+	for _, event := range events {
+		if event.Sequence != last[event.Shard]+1 {
+			t.Errorf("Expected event %d of shard %d next, got %d", last[event.Shard]+1, event.Shard, event.Sequence)
+		}
+		last[event.Shard] = event.Sequence
+	}
+
+	if err := feed.SeekLatest(context.Background(), "latest"); err != nil {
+		t.Fatalf("Failed to seek: %v", err)
+	}
+	for shard := range 3 {
+		if offset, _ := feed.Offset(context.Background(), "latest", shard); offset != 3 {
+			t.Errorf("Expected shard %d at offset 3, got %d", shard, offset)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+// Package derived renders transformed copies of stored images on request.
+// Results are cached in memory, and concurrent requests for the same copy
+// share one render
+package derived
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"image"
+	"sync"
+
+	"golang.org/x/sync/singleflight"
+
+	"image_gallery/internal/imaging"
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// Image is a rendered copy
+type Image struct {
+	Data        []byte
+	ContentType string
+}
+
+// Options controls a Renderer
+type Options struct {
+	// MaxBytes bounds the total size of the cached copies; the least
+	// recently used are evicted first
+	MaxBytes int64
+}
+
+// Stats are the counters of a Renderer
+type Stats struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Renders   int64 `json:"renders"`
+	Shared    int64 `json:"shared"`
+	Evictions int64 `json:"evictions"`
+	Entries   int   `json:"entries"`
+	Bytes     int64 `json:"bytes"`
+}
+
+// Renderer renders and caches transformed copies of images. Copies are
+// keyed by blob key, the edits of originals and transform; blobs are never
+// overwritten, so cached copies do not go stale
+type Renderer struct {
+	storage services.StorageService
+	decoder *imaging.Decoder
+	opts    Options
+	group   singleflight.Group
+
+	mutex   sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	bytes   int64
+	stats   Stats
+}
+
+// cacheEntry is an element of the LRU list
+type cacheEntry struct {
+	key   string
+	image Image
+}
+
+// NewRenderer creates a renderer reading blobs from storage. Zero options
+// get defaults
+func NewRenderer(storage services.StorageService, decoder *imaging.Decoder, opts Options) *Renderer {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 64 << 20
+	}
+	return &Renderer{
+		storage: storage,
+		decoder: decoder,
+		opts:    opts,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Stats returns the current counters
+func (r *Renderer) Stats() Stats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	stats := r.stats
+	stats.Entries = r.lru.Len()
+	stats.Bytes = r.bytes
+	return stats
+}
+
+// Render returns the blob at key, the original or a variant of image,
+// transformed by t. Originals have the image's edits applied first; the
+// variants were made with them
+func (r *Renderer) Render(ctx context.Context, image models.Image, key string, t imaging.Transform) (Image, error) {
+	cacheKey := key + "?" + t.String()
+	if key == image.S3Key {
+		cacheKey += "&edits=" + image.Edits.String()
+	}
+	if cached, ok := r.cached(cacheKey); ok {
+		return cached, nil
+	}
+
+	// The render carries on if the request that started it goes away, as
+	// other requests may be waiting for it
+	result, err, shared := r.group.Do(cacheKey, func() (any, error) {
+		rendered, err := r.render(context.WithoutCancel(ctx), image, key, t)
+		if err != nil {
+			return Image{}, err
+		}
+		r.store(cacheKey, rendered)
+		return rendered, nil
+	})
+	if shared {
+		r.mutex.Lock()
+		r.stats.Shared++
+		r.mutex.Unlock()
+	}
+	return result.(Image), err
+}
+
+func (r *Renderer) render(ctx context.Context, image models.Image, key string, t imaging.Transform) (Image, error) {
+	r.mutex.Lock()
+	r.stats.Renders++
+	r.mutex.Unlock()
+
+	sourceKey := source(image, key, t)
+	var edits imaging.Edits
+	if sourceKey == image.S3Key {
+		edits = Recipe(image.Edits)
+	}
+
+	data, _, err := r.storage.GetImage(ctx, sourceKey)
+	if err != nil {
+		return Image{}, err
+	}
+	variant, err := r.decoder.Transform(ctx, bytes.NewReader(data), edits, t)
+	if err != nil {
+		return Image{}, err
+	}
+	return Image{Data: variant.Data, ContentType: variant.MIMEType}, nil
+}
+
+// source picks the blob to render from. Requests for the original use the
+// smallest variant that is large enough, which is much faster to decode
+func source(image models.Image, key string, t imaging.Transform) string {
+	if key != image.S3Key {
+		return key
+	}
+	width, height := image.Dimensions()
+	needed := t.SourceSize(width, height)
+	if needed == 0 {
+		return key
+	}
+	longest := max(width, height)
+	for _, variant := range image.Variants {
+		size := max(variant.Width, variant.Height)
+		if size >= needed || size == longest {
+			return variant.Key
+		}
+	}
+	return key
+}
+
+// Recipe converts the edits stored on an image for imaging
+func Recipe(edits *models.Edits) imaging.Edits {
+	if edits == nil {
+		return imaging.Edits{}
+	}
+	recipe := imaging.Edits{
+		Rotate:         edits.Rotate,
+		FlipHorizontal: edits.FlipHorizontal,
+		FlipVertical:   edits.FlipVertical,
+	}
+	if crop := edits.Crop; crop != nil {
+		recipe.Crop = image.Rect(crop.X, crop.Y, crop.X+crop.Width, crop.Y+crop.Height)
+	}
+	return recipe
+}
+
+// Swatches converts a palette found by imaging for storing on an image
+func Swatches(palette []imaging.Swatch) []models.Swatch {
+	if len(palette) == 0 {
+		return nil
+	}
+	swatches := make([]models.Swatch, len(palette))
+	for i, swatch := range palette {
+		swatches[i] = models.Swatch(swatch)
+	}
+	return swatches
+}
+
+// cached returns a cached copy and counts the hit or miss
+func (r *Renderer) cached(key string) (Image, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	element, ok := r.entries[key]
+	if !ok {
+		r.stats.Misses++
+		return Image{}, false
+	}
+	r.lru.MoveToFront(element)
+	r.stats.Hits++
+	return element.Value.(*cacheEntry).image, true
+}
+
+// store caches a copy, evicting the least recently used to make room.
+// Copies larger than the whole cache are not kept
+func (r *Renderer) store(key string, image Image) {
+	size := int64(len(image.Data))
+	if size > r.opts.MaxBytes {
+		return
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.entries[key]; ok {
+		return
+	}
+	r.entries[key] = r.lru.PushFront(&cacheEntry{key: key, image: image})
+	r.bytes += size
+
+	for r.bytes > r.opts.MaxBytes {
+		oldest := r.lru.Back()
+		entry := oldest.Value.(*cacheEntry)
+		r.lru.Remove(oldest)
+		delete(r.entries, entry.key)
+		r.bytes -= int64(len(entry.image.Data))
+		r.stats.Evictions++
+	}
+}
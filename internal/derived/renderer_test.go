@@ -0,0 +1,173 @@
+package derived
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"image_gallery/internal/imaging"
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// countingStorage counts the blobs read by key
+type countingStorage struct {
+	services.StorageService
+	reads sync.Map
+	total atomic.Int64
+}
+
+func (s *countingStorage) GetImage(ctx context.Context, key string) ([]byte, string, error) {
+	count, _ := s.reads.LoadOrStore(key, new(atomic.Int64))
+	count.(*atomic.Int64).Add(1)
+	s.total.Add(1)
+	return s.StorageService.GetImage(ctx, key)
+}
+
+func (s *countingStorage) readsOf(key string) int64 {
+	count, ok := s.reads.Load(key)
+	if !ok {
+		return 0
+	}
+	return count.(*atomic.Int64).Load()
+}
+
+func newStorage(t *testing.T) *countingStorage {
+	t.Helper()
+	storage, err := services.NewLocalStorageService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	return &countingStorage{StorageService: storage}
+}
+
+// store writes a width by height PNG under key
+func store(t *testing.T, storage services.StorageService, key string, width, height int) {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	if err := storage.UploadImage(context.Background(), key, bytesFile{bytes.NewReader(buf.Bytes())}, "image/png"); err != nil {
+		t.Fatalf("Failed to store %s: %v", key, err)
+	}
+}
+
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (bytesFile) Close() error { return nil }
+
+func TestRender(t *testing.T) {
+	ctx := context.Background()
+	decoder := imaging.NewDecoder(imaging.DefaultLimits())
+	transform := imaging.Transform{Width: 100, Height: 100, Fit: imaging.FitCover, FocusX: 0.5, FocusY: 0.5, Quality: 80}
+
+	t.Run("CachesResults", func(t *testing.T) {
+		storage := newStorage(t)
+		store(t, storage, "a.png", 300, 200)
+		renderer := NewRenderer(storage, decoder, Options{})
+		image := models.Image{ID: "a", S3Key: "a.png", Width: 300, Height: 200}
+
+		for i := 0; i < 3; i++ {
+			rendered, err := renderer.Render(ctx, image, "a.png", transform)
+			if err != nil {
+				t.Fatalf("Failed to render: %v", err)
+			}
+			if rendered.ContentType != "image/jpeg" || len(rendered.Data) == 0 {
+				t.Fatalf("Expected a JPEG, got %s", rendered.ContentType)
+			}
+		}
+		if reads := storage.readsOf("a.png"); reads != 1 {
+			t.Errorf("Expected 1 read, got %d", reads)
+		}
+		if stats := renderer.Stats(); stats.Hits != 2 || stats.Renders != 1 || stats.Entries != 1 {
+			t.Errorf("Expected 2 hits from 1 render, got %+v", stats)
+		}
+	})
+
+	t.Run("CollapsesConcurrentRequests", func(t *testing.T) {
+		storage := newStorage(t)
+		store(t, storage, "a.png", 300, 200)
+		renderer := NewRenderer(storage, decoder, Options{})
+		image := models.Image{ID: "a", S3Key: "a.png", Width: 300, Height: 200}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 20; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := renderer.Render(ctx, image, "a.png", transform); err != nil {
+					t.Errorf("Failed to render: %v", err)
+				}
+			}()
+		}
+		wg.Wait()
+
+		// Later requests either join the render or find its result cached
+		if reads := storage.total.Load(); reads != 1 {
+			t.Errorf("Expected 1 read, got %d", reads)
+		}
+	})
+
+	t.Run("RendersFromVariants", func(t *testing.T) {
+		storage := newStorage(t)
+		store(t, storage, "a.png", 3000, 2000)
+		store(t, storage, "variants/256/a.jpg", 256, 171)
+		renderer := NewRenderer(storage, decoder, Options{})
+		image := models.Image{
+			ID: "a", S3Key: "a.png", Width: 3000, Height: 2000,
+			Variants: []models.Variant{{Size: 256, Width: 256, Height: 171, Key: "variants/256/a.jpg"}},
+		}
+
+		small := imaging.Transform{Width: 120, Fit: imaging.FitContain, Quality: 80}
+		if _, err := renderer.Render(ctx, image, "a.png", small); err != nil {
+			t.Fatalf("Failed to render: %v", err)
+		}
+		if storage.readsOf("a.png") != 0 || storage.readsOf("variants/256/a.jpg") != 1 {
+			t.Errorf("Expected the small copy to be rendered from the variant")
+		}
+
+		large := imaging.Transform{Width: 1200, Fit: imaging.FitContain, Quality: 80}
+		if _, err := renderer.Render(ctx, image, "a.png", large); err != nil {
+			t.Fatalf("Failed to render: %v", err)
+		}
+		if storage.readsOf("a.png") != 1 {
+			t.Errorf("Expected the large copy to be rendered from the original")
+		}
+	})
+
+	t.Run("EvictsLeastRecentlyUsed", func(t *testing.T) {
+		storage := newStorage(t)
+		store(t, storage, "a.png", 300, 200)
+		image := models.Image{ID: "a", S3Key: "a.png", Width: 300, Height: 200}
+
+		probe := NewRenderer(storage, decoder, Options{})
+		first, err := probe.Render(ctx, image, "a.png", transform)
+		if err != nil {
+			t.Fatalf("Failed to render: %v", err)
+		}
+
+		// Room for one copy only
+		renderer := NewRenderer(storage, decoder, Options{MaxBytes: int64(len(first.Data)) * 3 / 2})
+		other := transform
+		other.Quality = 81
+		renderer.Render(ctx, image, "a.png", transform)
+		renderer.Render(ctx, image, "a.png", other)
+
+		if stats := renderer.Stats(); stats.Entries != 1 || stats.Evictions != 1 {
+			t.Errorf("Expected 1 entry after 1 eviction, got %+v", stats)
+		}
+	})
+}
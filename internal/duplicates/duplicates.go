@@ -0,0 +1,132 @@
+// Package duplicates finds images that look the same by comparing their
+// perceptual hashes
+package duplicates
+
+import (
+	"cmp"
+	"fmt"
+	"math/bits"
+	"slices"
+	"strconv"
+	"time"
+
+	"image_gallery/internal/models"
+)
+
+// DefaultThreshold is the largest Hamming distance between two perceptual
+// hashes of near-duplicates unless configured otherwise. Re-exports and
+// small edits of a photo usually stay well within it; different photos
+// are typically 25 bits or more apart
+const DefaultThreshold = 10
+
+// Policy is what an upload that looks like a near-duplicate does
+type Policy string
+
+// Policies an upload can be checked with
+const (
+	// PolicyOff does not look for duplicates
+	PolicyOff Policy = "off"
+	// PolicyWarn stores the upload and records what it duplicates
+	PolicyWarn Policy = "warn"
+	// PolicyBlock rejects the upload
+	PolicyBlock Policy = "block"
+)
+
+// ParsePolicy reads a policy by name
+func ParsePolicy(s string) (Policy, error) {
+	switch policy := Policy(s); policy {
+	case PolicyOff, PolicyWarn, PolicyBlock:
+		return policy, nil
+	}
+	return "", fmt.Errorf("duplicate policy must be off, warn or block, got %q", s)
+}
+
+// Options configures duplicate detection
+type Options struct {
+	Policy Policy
+	// Threshold is the largest Hamming distance, in bits, between the
+	// hashes of near-duplicates
+	Threshold int
+}
+
+// FormatHash writes a hash as the 16 hex digits stored on images
+func FormatHash(hash uint64) string {
+	return fmt.Sprintf("%016x", hash)
+}
+
+// ParseHash reads a hash written by FormatHash
+func ParseHash(s string) (uint64, error) {
+	if len(s) != 16 {
+		return 0, fmt.Errorf("perceptual hash must be 16 hex digits, got %q", s)
+	}
+	return strconv.ParseUint(s, 16, 64)
+}
+
+// Distance is the number of bits in which two hashes differ
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// Match is an image near a hash
+type Match struct {
+	Image    models.Image
+	Distance int
+}
+
+// Report lists the groups of near-duplicates in a gallery
+type Report struct {
+	Threshold int `json:"threshold"`
+	Scanned   int `json:"scanned"`
+	// Unhashed counts the images without a perceptual hash, which are left
+	// out until they are backfilled
+	Unhashed int       `json:"unhashed"`
+	Clusters []Cluster `json:"clusters"`
+}
+
+// Cluster is a group of images each within the threshold of at least one
+// other, oldest first, so the first is most likely the original
+type Cluster struct {
+	Images []Entry `json:"images"`
+	// MaxDistance is the largest distance between two images of the cluster
+	MaxDistance int `json:"maxDistance"`
+}
+
+// Entry is an image in a cluster
+type Entry struct {
+	ID             string    `json:"id"`
+	Title          string    `json:"title"`
+	CreatedAt      time.Time `json:"createdAt"`
+	PerceptualHash string    `json:"perceptualHash"`
+}
+
+// NewReport describes groups of near-duplicates found within threshold
+// among scanned images, of which unhashed had no hash. Larger clusters come
+// first; groups of fewer than two images are left out
+func NewReport(threshold, scanned, unhashed int, groups [][]models.Image) Report {
+	report := Report{Threshold: threshold, Scanned: scanned, Unhashed: unhashed, Clusters: []Cluster{}}
+	for _, group := range groups {
+		if len(group) < 2 {
+			continue
+		}
+		group = slices.Clone(group)
+		slices.SortFunc(group, func(a, b models.Image) int {
+			return cmp.Or(a.CreatedAt.Compare(b.CreatedAt), cmp.Compare(a.ID, b.ID))
+		})
+
+		var cluster Cluster
+		hashes := make([]uint64, len(group))
+		for i, image := range group {
+			hashes[i], _ = ParseHash(image.PerceptualHash)
+			cluster.Images = append(cluster.Images, Entry{ID: image.ID, Title: image.Title, CreatedAt: image.CreatedAt, PerceptualHash: image.PerceptualHash})
+			for _, other := range hashes[:i] {
+				cluster.MaxDistance = max(cluster.MaxDistance, Distance(hashes[i], other))
+			}
+		}
+		report.Clusters = append(report.Clusters, cluster)
+	}
+
+	slices.SortFunc(report.Clusters, func(a, b Cluster) int {
+		return cmp.Or(cmp.Compare(len(b.Images), len(a.Images)), a.Images[0].CreatedAt.Compare(b.Images[0].CreatedAt), cmp.Compare(a.Images[0].ID, b.Images[0].ID))
+	})
+	return report
+}
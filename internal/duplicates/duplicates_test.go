@@ -0,0 +1,83 @@
+package duplicates
+
+import (
+	"testing"
+	"time"
+
+	"image_gallery/internal/models"
+)
+
+func TestHash(t *testing.T) {
+	if s := FormatHash(0xf0); s != "00000000000000f0" {
+		t.Errorf("Expected 16 hex digits, got %q", s)
+	}
+	if hash, err := ParseHash("ffffffffffffffff"); err != nil || hash != ^uint64(0) {
+		t.Errorf("Expected every bit set, got %x, %v", hash, err)
+	}
+	for _, s := range []string{"", "f0", "zzzzzzzzzzzzzzzz"} {
+		if _, err := ParseHash(s); err == nil {
+			t.Errorf("Expected %q to be rejected", s)
+		}
+	}
+	if d := Distance(0b1011, 0b0110); d != 3 {
+		t.Errorf("Expected a distance of 3, got %d", d)
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, name := range []string{"off", "warn", "block"} {
+		if policy, err := ParsePolicy(name); err != nil || string(policy) != name {
+			t.Errorf("Expected %s to parse, got %q, %v", name, policy, err)
+		}
+	}
+	if _, err := ParsePolicy("reject"); err == nil {
+		t.Errorf("Expected an unknown policy to be rejected")
+	}
+}
+
+func TestNewReport(t *testing.T) {
+	day := func(d int) time.Time { return time.Date(2024, 1, d, 0, 0, 0, 0, time.UTC) }
+	groups := [][]models.Image{
+		{
+			{ID: "x", CreatedAt: day(5), PerceptualHash: FormatHash(0xff00ff0000000000)},
+			{ID: "y", CreatedAt: day(4), PerceptualHash: FormatHash(0xff00ff0000000001)},
+		},
+		// a, b and c are a chain: a and c are 8 bits apart, each 4 from b
+		{
+			{ID: "c", CreatedAt: day(3), PerceptualHash: FormatHash(0xff)},
+			{ID: "a", CreatedAt: day(1), PerceptualHash: FormatHash(0)},
+			{ID: "b", CreatedAt: day(2), PerceptualHash: FormatHash(0x0f)},
+		},
+		// What is left of a group whose other images were deleted
+		{{ID: "alone", CreatedAt: day(6), PerceptualHash: FormatHash(0xffffffff00000000)}},
+	}
+
+	report := NewReport(4, 7, 1, groups)
+	if report.Scanned != 7 || report.Unhashed != 1 || report.Threshold != 4 {
+		t.Errorf("Expected 7 scanned and 1 unhashed at threshold 4, got %+v", report)
+	}
+	if len(report.Clusters) != 2 {
+		t.Fatalf("Expected 2 clusters, got %+v", report.Clusters)
+	}
+
+	ids := func(cluster Cluster) []string {
+		var ids []string
+		for _, entry := range cluster.Images {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+	if got := ids(report.Clusters[0]); len(got) != 3 || got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("Expected the chain oldest first, got %v", got)
+	}
+	if report.Clusters[0].MaxDistance != 8 {
+		t.Errorf("Expected a largest distance of 8, got %d", report.Clusters[0].MaxDistance)
+	}
+	if got := ids(report.Clusters[1]); len(got) != 2 || got[0] != "y" || got[1] != "x" {
+		t.Errorf("Expected y then x, got %v", got)
+	}
+
+	if report := NewReport(0, 0, 0, nil); report.Clusters == nil || len(report.Clusters) != 0 {
+		t.Errorf("Expected an empty list of clusters, got %+v", report.Clusters)
+	}
+}
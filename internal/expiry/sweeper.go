@@ -0,0 +1,102 @@
+package expiry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"image_gallery/internal/saga"
+	"image_gallery/internal/services"
+)
+
+// Sweeper purges expired images: first the blob, then the metadata record,
+// so an image never loses its record while the blob is still served. Deletes
+// go through saga.Delete, so an interrupted purge is finished by recovery
+type Sweeper struct {
+	storageService  services.StorageService
+	databaseService services.DatabaseService
+	// now is the clock, replaced in tests
+	now func() time.Time
+}
+
+// NewSweeper creates a sweeper for the given services
+func NewSweeper(storageService services.StorageService, databaseService services.DatabaseService) *Sweeper {
+	return &Sweeper{
+		storageService:  storageService,
+		databaseService: databaseService,
+		now:             time.Now,
+	}
+}
+
+// Run sweeps every interval until ctx is done
+func (s *Sweeper) Run(ctx context.Context, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := s.Sweep(ctx)
+		if err != nil {
+			log.Printf("Expiry sweep: %v", err)
+		}
+		if purged > 0 {
+			log.Printf("Expiry sweep: purged %d images", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep purges every image that has expired and returns how many were
+// purged. Images that fail are left for the next sweep and reported in the
+// returned error
+func (s *Sweeper) Sweep(ctx context.Context) (int, error) {
+	images, err := s.databaseService.ListImages(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	purged := 0
+	var errs []error
+	for _, image := range images {
+		if !image.Expired(s.now()) {
+			continue
+		}
+		done, err := s.purge(ctx, image.ID)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("image %s: %w", image.ID, err))
+			continue
+		}
+		if done {
+			purged++
+		}
+	}
+
+	return purged, errors.Join(errs...)
+}
+
+// purge deletes one image after checking that it is still expired, as its
+// expiry may have been changed since the listing. It reports whether the
+// image was deleted
+func (s *Sweeper) purge(ctx context.Context, id string) (bool, error) {
+	image, err := s.databaseService.GetImage(ctx, id)
+	if errors.Is(err, services.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !image.Expired(s.now()) {
+		return false, nil
+	}
+
+	if err := saga.Delete(ctx, s.storageService, s.databaseService, image); err != nil {
+		return false, err
+	}
+	return true, nil
+}
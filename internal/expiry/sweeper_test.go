@@ -0,0 +1,103 @@
+package expiry
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// bytesFile adapts a byte slice to multipart.File for UploadImage
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (bytesFile) Close() error { return nil }
+
+func TestSweeper(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	storage, err := services.NewLocalStorageService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	db, err := services.NewLocalDBService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	images := map[string]*time.Time{"expired": &past, "expiring": &future, "kept": nil}
+	for id, expiresAt := range images {
+		if err := storage.UploadImage(ctx, id+".jpg", bytesFile{bytes.NewReader([]byte(id))}, "image/jpeg"); err != nil {
+			t.Fatalf("Failed to upload image: %v", err)
+		}
+		err := db.SaveImage(ctx, models.Image{ID: id, Title: id, S3Key: id + ".jpg", CreatedAt: now, UpdatedAt: now, ExpiresAt: expiresAt})
+		if err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+	}
+
+	sweeper := NewSweeper(storage, db)
+	sweeper.now = func() time.Time { return now }
+
+	t.Run("PurgesExpiredImages", func(t *testing.T) {
+		purged, err := sweeper.Sweep(ctx)
+		if err != nil {
+			t.Fatalf("Failed to sweep: %v", err)
+		}
+		if purged != 1 {
+			t.Errorf("Expected 1 purged image, got %d", purged)
+		}
+		if _, err := db.GetImage(ctx, "expired"); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("Expected expired record to be deleted, got %v", err)
+		}
+		if _, _, err := storage.GetImage(ctx, "expired.jpg"); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("Expected expired blob to be deleted, got %v", err)
+		}
+		for _, id := range []string{"expiring", "kept"} {
+			if _, err := db.GetImage(ctx, id); err != nil {
+				t.Errorf("Expected %s to be kept, got %v", id, err)
+			}
+			if _, _, err := storage.GetImage(ctx, id+".jpg"); err != nil {
+				t.Errorf("Expected %s blob to be kept, got %v", id, err)
+			}
+		}
+	})
+
+	t.Run("PurgesOnceTimeHasPassed", func(t *testing.T) {
+		sweeper.now = func() time.Time { return future }
+
+		purged, err := sweeper.Sweep(ctx)
+		if err != nil {
+			t.Fatalf("Failed to sweep: %v", err)
+		}
+		if purged != 1 {
+			t.Errorf("Expected 1 purged image, got %d", purged)
+		}
+		if _, err := db.GetImage(ctx, "kept"); err != nil {
+			t.Errorf("Expected image without expiry to be kept, got %v", err)
+		}
+	})
+
+	t.Run("ToleratesMissingBlob", func(t *testing.T) {
+		err := db.SaveImage(ctx, models.Image{ID: "orphan", Title: "orphan", S3Key: "orphan.jpg", ExpiresAt: &past})
+		if err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+
+		purged, err := sweeper.Sweep(ctx)
+		if err != nil {
+			t.Fatalf("Failed to sweep: %v", err)
+		}
+		if purged != 1 {
+			t.Errorf("Expected 1 purged image, got %d", purged)
+		}
+	})
+}
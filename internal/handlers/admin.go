@@ -0,0 +1,159 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"image_gallery/internal/services"
+	"image_gallery/internal/transfer"
+)
+
+// maxImportSize limits the size of an uploaded import file
+const maxImportSize = 32 << 20
+
+// AdminHandler handles maintenance endpoints that require the admin token
+type AdminHandler struct {
+	databaseService services.DatabaseService
+	token           string
+}
+
+// NewAdminHandler creates a new AdminHandler. Requests must send the token as
+// "Authorization: Bearer <token>"
+func NewAdminHandler(databaseService services.DatabaseService, token string) *AdminHandler {
+	return &AdminHandler{
+		databaseService: databaseService,
+		token:           token,
+	}
+}
+
+// RequireToken rejects requests without the admin bearer token
+func (h *AdminHandler) RequireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || h.token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			writeProblem(w, r, http.StatusUnauthorized, "Admin token required")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ExportMetadata streams every image record as JSON Lines or CSV
+func (h *AdminHandler) ExportMetadata(w http.ResponseWriter, r *http.Request) {
+	format, err := requestFormat(r)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filename := "images-" + time.Now().UTC().Format("20060102-150405") + "." + string(format)
+	w.Header().Set("Content-Type", format.ContentType())
+	w.Header().Set("Content-Disposition", `attachment; filename="`+filename+`"`)
+
+	// Headers are already sent once the first record is written, so a
+	// failure after that aborts the response, leaving the client with a
+	// truncated download rather than a problem appended to the records
+	stream := &streamWriter{ResponseWriter: w}
+	if _, err := transfer.Export(r.Context(), h.databaseService, stream, format); err != nil {
+		if stream.started {
+			log.Printf("Failed to export metadata after streaming started: %v", err)
+			panic(http.ErrAbortHandler)
+		}
+		w.Header().Del("Content-Disposition")
+		writeError(w, r, err, "Failed to export metadata")
+	}
+}
+
+// streamWriter records whether anything has been written to a response
+type streamWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *streamWriter) Write(data []byte) (int, error) {
+	w.started = true
+	return w.ResponseWriter.Write(data)
+}
+
+// ImportMetadata upserts image records from the request body, either raw or
+// as the "file" field of a multipart form, and responds with the change
+// report. Pass dryRun=true to only validate and report
+func (h *AdminHandler) ImportMetadata(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	var file io.Reader = r.Body
+	filename := ""
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		part, header, err := r.FormFile("file")
+		if err != nil {
+			writeImportReadError(w, r, err)
+			return
+		}
+		defer part.Close()
+		file = part
+		filename = header.Filename
+	}
+
+	// Read the whole file up front so an oversized upload is rejected
+	// before any record is imported
+	data, err := io.ReadAll(file)
+	if err != nil {
+		writeImportReadError(w, r, err)
+		return
+	}
+
+	format, err := requestFormat(r)
+	if r.URL.Query().Get("format") == "" && filename != "" {
+		format, err = transfer.FormatFromPath(filename)
+	}
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun"))
+	report, err := transfer.Import(r.Context(), h.databaseService, bytes.NewReader(data), format, transfer.ImportOptions{DryRun: dryRun})
+
+	status := http.StatusOK
+	switch {
+	case errors.Is(err, transfer.ErrInvalidImport):
+		status = http.StatusUnprocessableEntity
+	case err != nil && len(report.Errors) == 0:
+		writeError(w, r, err, "Failed to import metadata")
+		return
+	case err != nil:
+		status = statusForError(err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(report)
+}
+
+// writeImportReadError responds to a failure to read the uploaded file
+func writeImportReadError(w http.ResponseWriter, r *http.Request, err error) {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeProblem(w, r, http.StatusRequestEntityTooLarge, "Import file too large")
+		return
+	}
+	writeProblem(w, r, http.StatusBadRequest, "Failed to read import file")
+}
+
+// requestFormat reads the format query parameter, defaulting to JSON Lines
+func requestFormat(r *http.Request) (transfer.Format, error) {
+	name := r.URL.Query().Get("format")
+	if name == "" {
+		return transfer.FormatJSONL, nil
+	}
+	return transfer.ParseFormat(name)
+}
@@ -0,0 +1,176 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/transfer"
+)
+
+func TestAdminRequireToken(t *testing.T) {
+	handler := NewAdminHandler(NewMockDatabaseService(), "secret")
+	next := handler.RequireToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name          string
+		authorization string
+		want          int
+	}{
+		{"Missing", "", http.StatusUnauthorized},
+		{"Wrong", "Bearer wrong", http.StatusUnauthorized},
+		{"NotBearer", "secret", http.StatusUnauthorized},
+		{"Valid", "Bearer secret", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/admin/export", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rr := httptest.NewRecorder()
+			next.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("Expected status %d, got %d", tt.want, rr.Code)
+			}
+		})
+	}
+}
+
+func TestAdminExportMetadata(t *testing.T) {
+	mockDB := NewMockDatabaseService()
+	mockDB.SaveImage(context.Background(), models.Image{ID: "test-id", Title: "Test Image", S3Key: "test.jpg"})
+	handler := NewAdminHandler(mockDB, "secret")
+
+	req := httptest.NewRequest("GET", "/admin/export?format=csv", nil)
+	rr := httptest.NewRecorder()
+	handler.ExportMetadata(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/csv") {
+		t.Errorf("Expected CSV content type, got %q", contentType)
+	}
+	if !strings.Contains(rr.Body.String(), "test-id,Test Image") {
+		t.Errorf("Expected exported record, got %q", rr.Body.String())
+	}
+}
+
+// failingWriter is a response whose connection breaks after the first write
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	writes int
+}
+
+func (w *failingWriter) Write(data []byte) (int, error) {
+	w.writes++
+	if w.writes > 1 {
+		return 0, errors.New("connection reset")
+	}
+	return w.ResponseRecorder.Write(data)
+}
+
+func TestAdminExportMetadataAbortsOnceStreaming(t *testing.T) {
+	mockDB := NewMockDatabaseService()
+	for i := range 3 {
+		id := fmt.Sprintf("test-%d", i)
+		mockDB.SaveImage(context.Background(), models.Image{ID: id, Title: "Test Image", S3Key: id + ".jpg"})
+	}
+	handler := NewAdminHandler(mockDB, "secret")
+
+	req := httptest.NewRequest("GET", "/admin/export?format=jsonl", nil)
+	rr := &failingWriter{ResponseRecorder: httptest.NewRecorder()}
+	defer func() {
+		if recovered := recover(); recovered != http.ErrAbortHandler {
+			t.Errorf("Expected the response to be aborted, got %v", recovered)
+		}
+		if strings.Contains(rr.Body.String(), "Failed to export metadata") || rr.Code != http.StatusOK {
+			t.Errorf("Expected no problem after the first record, got %d %q", rr.Code, rr.Body.String())
+		}
+	}()
+	handler.ExportMetadata(rr, req)
+}
+
+func TestAdminImportMetadata(t *testing.T) {
+	t.Run("DryRun", func(t *testing.T) {
+		mockDB := NewMockDatabaseService()
+		mockDB.SaveImage(context.Background(), models.Image{ID: "test-id", Title: "Old", S3Key: "test.jpg"})
+		handler := NewAdminHandler(mockDB, "secret")
+
+		req := httptest.NewRequest("POST", "/admin/import?dryRun=true", strings.NewReader(`{"id":"test-id","title":"New"}`))
+		rr := httptest.NewRecorder()
+		handler.ImportMetadata(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+
+		var report transfer.Report
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to parse response JSON: %v", err)
+		}
+		if !report.DryRun || report.Updated != 1 {
+			t.Errorf("Expected a dry-run update, got %+v", report)
+		}
+		if mockDB.images["test-id"].Title != "Old" {
+			t.Errorf("Dry run changed the image")
+		}
+	})
+
+	t.Run("MultipartCSV", func(t *testing.T) {
+		mockDB := NewMockDatabaseService()
+		mockDB.SaveImage(context.Background(), models.Image{ID: "test-id", Title: "Old", S3Key: "test.jpg"})
+		handler := NewAdminHandler(mockDB, "secret")
+
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", "images.csv")
+		part.Write([]byte("id,title\ntest-id,New\n"))
+		writer.Close()
+
+		req := httptest.NewRequest("POST", "/admin/import", body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rr := httptest.NewRecorder()
+		handler.ImportMetadata(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", rr.Code, http.StatusOK, rr.Body.String())
+		}
+		if mockDB.images["test-id"].Title != "New" {
+			t.Errorf("Expected title to be imported, got %q", mockDB.images["test-id"].Title)
+		}
+	})
+
+	t.Run("InvalidFile", func(t *testing.T) {
+		handler := NewAdminHandler(NewMockDatabaseService(), "secret")
+
+		req := httptest.NewRequest("POST", "/admin/import", strings.NewReader(`{"title":"No ID"}`))
+		rr := httptest.NewRecorder()
+		handler.ImportMetadata(rr, req)
+
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", rr.Code, http.StatusUnprocessableEntity)
+		}
+
+		var report transfer.Report
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to parse response JSON: %v", err)
+		}
+		if len(report.Errors) != 1 {
+			t.Errorf("Expected one error, got %+v", report.Errors)
+		}
+	})
+}
@@ -1,34 +1,90 @@
 package handlers
 
 import (
+	"bytes"
+	"cmp"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
 	"net/http"
-	"path/filepath"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
 
+	"image_gallery/internal/derived"
+	"image_gallery/internal/duplicates"
+	"image_gallery/internal/imaging"
+	"image_gallery/internal/metadata"
 	"image_gallery/internal/models"
+	"image_gallery/internal/saga"
 	"image_gallery/internal/services"
+	"image_gallery/internal/similar"
 	"image_gallery/internal/templates/components"
 )
 
+// maxExpiry is the latest expiry an upload may ask for
+const maxExpiry = 365 * 24 * time.Hour
+
+// imageCacheMaxAge is how long browsers may cache image content
+const imageCacheMaxAge = 24 * time.Hour
+
+// defaultSimilarImages and maxSimilarImages are how many similar images
+// are listed unless asked for otherwise, and at most
+const (
+	defaultSimilarImages = 8
+	maxSimilarImages     = 50
+)
+
+// similarStripSize is how many similar images the view page shows
+const similarStripSize = 6
+
+// editedQuality is the JPEG quality of edited and watermarked originals,
+// which stand in for the full-size upload
+const editedQuality = 92
+
 // ImageHandler handles HTTP requests for images
 type ImageHandler struct {
 	storageService  services.StorageService
 	databaseService services.DatabaseService
+	// decoder checks uploads against the upload limits
+	decoder *imaging.Decoder
+	// renderer serves resized copies requested with query parameters
+	renderer *derived.Renderer
+	// metadataPolicy is what is stripped from uploads before they are
+	// stored. Empty keeps everything
+	metadataPolicy models.MetadataPolicy
+	// watermark is drawn over served images that have not opted out. Nil
+	// serves images unmarked
+	watermark *imaging.Watermark
+	// duplicates is how uploads that look like images already in the
+	// gallery are handled. The zero value does not look for them
+	duplicates duplicates.Options
+	// similar finds the images that look like an image. Nil finds none
+	similar *similar.Searcher
 }
 
 // NewImageHandler creates a new image handler
-func NewImageHandler(storageService services.StorageService, databaseService services.DatabaseService) *ImageHandler {
+func NewImageHandler(storageService services.StorageService, databaseService services.DatabaseService, decoder *imaging.Decoder, renderer *derived.Renderer, metadataPolicy models.MetadataPolicy, watermark *imaging.Watermark, duplicateOptions duplicates.Options) *ImageHandler {
 	return &ImageHandler{
 		storageService:  storageService,
 		databaseService: databaseService,
+		decoder:         decoder,
+		renderer:        renderer,
+		metadataPolicy:  metadataPolicy,
+		watermark:       watermark,
+		duplicates:      duplicateOptions,
+		similar:         similar.NewSearcher(databaseService, similar.DefaultMaxAge),
 	}
 }
 
@@ -41,63 +97,143 @@ func generateID() string {
 	return hex.EncodeToString(bytes)
 }
 
-// ListImages displays all images
+// ListImages displays all images, or with a color query parameter only the
+// images with a dominant colour near it, closest first
 func (h *ImageHandler) ListImages(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
-	images, err := h.databaseService.ListImages(ctx)
+	filter, err := parseColorFilter(r.URL.Query())
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid colour filter: "+err.Error())
+		return
+	}
+
+	images, err := h.listImages(ctx)
 	if err != nil {
-		http.Error(w, "Failed to fetch images", http.StatusInternalServerError)
+		writeError(w, r, err, "Failed to fetch images")
 		return
 	}
+	if filter != nil {
+		images = filter.apply(images)
+	}
 
 	// Get URLs for each image
 	for i := range images {
-		url, err := h.storageService.GetImageURL(ctx, images[i].S3Key)
-		if err == nil {
-			images[i].S3Key = url
-		}
+		images[i] = h.withURLs(ctx, images[i])
 	}
 
 	// For API requests
-	if r.Header.Get("Content-Type") == "application/json" {
+	if isAPIRequest(r) {
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(images)
 		return
 	}
 
 	// For web page requests
-	if err := components.RenderListPage(w, images); err != nil {
+	var selected string
+	if filter != nil {
+		selected = filter.color.Hex()
+	}
+	if err := components.RenderListPage(w, images, selected); err != nil {
 		log.Printf("Error rendering template: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
 }
 
+// defaultColorTolerance is the colour difference, in CIE76 units, within
+// which an image matches a colour filter that does not give a tolerance.
+// It matches somewhat lighter and darker shades of the colour
+const defaultColorTolerance = 25
+
+// colorFilter selects images by the colours of their palettes
+type colorFilter struct {
+	color     models.Color
+	tolerance float64
+}
+
+// parseColorFilter reads color, as "#rrggbb" or "#rgb", and an optional
+// tolerance from 0 to 100 from query. It returns nil when color is not set
+func parseColorFilter(query url.Values) (*colorFilter, error) {
+	if query.Get("color") == "" {
+		return nil, nil
+	}
+	color, err := models.ParseColor(query.Get("color"))
+	if err != nil {
+		return nil, err
+	}
+	filter := &colorFilter{color: color, tolerance: defaultColorTolerance}
+	if value := query.Get("tolerance"); value != "" {
+		tolerance, err := strconv.ParseFloat(value, 64)
+		if err != nil || !(tolerance >= 0 && tolerance <= 100) {
+			return nil, fmt.Errorf("tolerance must be a number from 0 to 100, got %q", value)
+		}
+		filter.tolerance = tolerance
+	}
+	return filter, nil
+}
+
+// apply keeps the images with a dominant colour within the tolerance,
+// closest first. Images without a palette never match
+func (f *colorFilter) apply(images []models.Image) []models.Image {
+	distances := make(map[string]float64)
+	var matching []models.Image
+	for _, image := range images {
+		if distance, ok := image.ColorDistance(f.color); ok && distance <= f.tolerance {
+			distances[image.ID] = distance
+			matching = append(matching, image)
+		}
+	}
+	slices.SortStableFunc(matching, func(a, b models.Image) int {
+		return cmp.Compare(distances[a.ID], distances[b.ID])
+	})
+	return matching
+}
+
+// listImages lists the images that are shown. Expired images are hidden
+// until the sweeper purges them, and pending ones until their upload or
+// delete finishes
+func (h *ImageHandler) listImages(ctx context.Context) ([]models.Image, error) {
+	images, err := h.databaseService.ListImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	visible := images[:0]
+	for _, image := range images {
+		if !image.Expired(now) && !image.Pending() {
+			visible = append(visible, image)
+		}
+	}
+	return visible, nil
+}
+
 // GetImage gets a single image
 func (h *ImageHandler) GetImage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	ctx := r.Context()
 
-	image, err := h.databaseService.GetImage(ctx, id)
+	image, err := h.getImage(ctx, id)
 	if err != nil {
-		http.Error(w, "Image not found", http.StatusNotFound)
+		writeError(w, r, err, "Failed to fetch image")
 		return
 	}
-
-	url, err := h.storageService.GetImageURL(ctx, image.S3Key)
-	if err == nil {
-		image.S3Key = url
+	if image.Expired(time.Now()) {
+		writeGone(w, r)
+		return
 	}
 
+	image = h.withURLs(ctx, image)
+
 	// For API requests
-	if r.Header.Get("Content-Type") == "application/json" {
+	if isAPIRequest(r) {
+		w.Header().Set("ETag", imageETag(image))
 		w.Header().Set("Content-Type", "application/json")
 		json.NewEncoder(w).Encode(image)
 		return
 	}
 
 	// For web page requests
-	if err := components.RenderViewPage(w, image); err != nil {
+	if err := components.RenderViewPage(w, image, h.similarImages(ctx, image, similarStripSize)); err != nil {
 		log.Printf("Error rendering template: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
@@ -105,7 +241,7 @@ func (h *ImageHandler) GetImage(w http.ResponseWriter, r *http.Request) {
 
 // UploadImageForm displays the form to upload an image
 func (h *ImageHandler) UploadImageForm(w http.ResponseWriter, r *http.Request) {
-	if err := components.RenderUploadPage(w); err != nil {
+	if err := components.RenderUploadPage(w, h.decoder.Limits().MaxFileSize); err != nil {
 		log.Printf("Error rendering template: %v", err)
 		http.Error(w, "Internal server error", http.StatusInternalServerError)
 	}
@@ -117,16 +253,17 @@ func (h *ImageHandler) EditImageForm(w http.ResponseWriter, r *http.Request) {
 	id := vars["id"]
 	ctx := r.Context()
 
-	image, err := h.databaseService.GetImage(ctx, id)
+	image, err := h.getImage(ctx, id)
 	if err != nil {
-		http.Error(w, "Image not found", http.StatusNotFound)
+		writeError(w, r, err, "Failed to fetch image")
 		return
 	}
-	
-	url, err := h.storageService.GetImageURL(ctx, image.S3Key)
-	if err == nil {
-		image.S3Key = url
+	if image.Expired(time.Now()) {
+		writeGone(w, r)
+		return
 	}
+	
+	image = h.withURLs(ctx, image)
 
 	if err := components.RenderEditPage(w, image); err != nil {
 		log.Printf("Error rendering template: %v", err)
@@ -137,75 +274,294 @@ func (h *ImageHandler) EditImageForm(w http.ResponseWriter, r *http.Request) {
 // UploadImage handles image upload
 func (h *ImageHandler) UploadImage(w http.ResponseWriter, r *http.Request) {
 	// Parse multipart form
-	err := r.ParseMultipartForm(10 << 20) // 10 MB max
+	maxFileSize := h.decoder.Limits().MaxFileSize
+	r.Body = http.MaxBytesReader(w, r.Body, maxFileSize)
+	err := r.ParseMultipartForm(maxFileSize)
 	if err != nil {
-		http.Error(w, "Failed to parse form", http.StatusBadRequest)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			writeProblem(w, r, http.StatusRequestEntityTooLarge, "Upload exceeds the "+formatSize(maxFileSize)+" limit")
+			return
+		}
+		writeProblem(w, r, http.StatusBadRequest, "Failed to parse form")
 		return
 	}
 
 	file, handler, err := r.FormFile("image")
 	if err != nil {
-		http.Error(w, "Failed to get file from form", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, "Failed to get file from form")
 		return
 	}
 	defer file.Close()
 
+	// Decode the upload to learn what it really is; the file name and the
+	// client's Content-Type are not trusted. The header is checked against
+	// the limits before the image is decoded
+	info, generated, err := h.decoder.Variants(r.Context(), file, imaging.VariantSizes, imaging.Edits{})
+	if err != nil {
+		writeError(w, r, err, "Failed to read image")
+		return
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		writeError(w, r, err, "Failed to read image")
+		return
+	}
+
+	// Camera and caption metadata is best effort: a damaged block does not
+	// reject an image that decoded fine
+	embedded, err := metadata.Extract(file, info.Format)
+	if err != nil {
+		log.Printf("Upload of %s: %v", handler.Filename, err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		writeError(w, r, err, "Failed to read image")
+		return
+	}
+
+	// Private metadata is removed before the file reaches storage. Variants
+	// are encoded without metadata, so only the original needs stripping
+	policy := h.metadataPolicy
+	if policy == "" {
+		policy = models.MetadataKeep
+	}
+	var content multipart.File = file
+	size := handler.Size
+	if policy != models.MetadataKeep {
+		stripped, err := metadata.Strip(file, info.Format, policy)
+		if err != nil {
+			writeError(w, r, err, "Failed to read image")
+			return
+		}
+		content = memoryFile{bytes.NewReader(stripped)}
+		size = int64(len(stripped))
+	}
+
+	now := time.Now()
+	expiresAt, err := parseExpiry(r.FormValue("expiresIn"), r.FormValue("expiresAt"), now)
+	if err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid expiry: "+err.Error())
+		return
+	}
+
 	// Create image metadata
 	id := generateID()
-	s3Key := fmt.Sprintf("%s%s", id, filepath.Ext(handler.Filename))
+	s3Key := id + info.Extension
 	
 	image := models.Image{
-		ID:          id,
-		Title:       r.FormValue("title"),
-		Description: r.FormValue("description"),
-		S3Key:       s3Key,
-		ContentType: handler.Header.Get("Content-Type"),
-		Size:        handler.Size,
-		CreatedAt:   time.Now(),
-		UpdatedAt:   time.Now(),
+		ID:             id,
+		Title:          r.FormValue("title"),
+		Description:    r.FormValue("description"),
+		S3Key:          s3Key,
+		ContentType:    info.MIMEType,
+		Size:           size,
+		Width:          info.Width,
+		Height:         info.Height,
+		PixelFormat:    info.PixelFormat,
+		Metadata:       policy.Redact(embedded),
+		MetadataPolicy: policy,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		ExpiresAt:      expiresAt,
+		NoWatermark:    r.FormValue("noWatermark") == "true",
 	}
 
-	// Upload image to S3
-	ctx := r.Context()
-	err = h.storageService.UploadImage(ctx, s3Key, file, image.ContentType)
+	// Resized variants are stored next to the original for the pages to use
+	var variants map[string][]byte
+	image.Variants, variants = variantRecords(id, generated, nil)
+	image.Placeholder = placeholder(id, generated)
+	image.Palette = palette(id, generated)
+	image.PerceptualHash, image.ColorHistogram = visualFeatures(id, generated)
+
+	// Uploads that look like images already in the gallery are rejected or
+	// stored with a warning, as configured
+	matches, err := h.findDuplicates(r.Context(), image)
 	if err != nil {
-		http.Error(w, "Failed to upload image to S3", http.StatusInternalServerError)
+		writeError(w, r, err, "Failed to check for duplicates")
 		return
 	}
+	if len(matches) > 0 && h.duplicates.Policy == duplicates.PolicyBlock {
+		h.similar.Release(id, false)
+		writeProblem(w, r, http.StatusConflict, "Upload looks like a near-duplicate of "+describeMatches(matches))
+		return
+	}
+	for _, match := range matches {
+		image.DuplicateOf = append(image.DuplicateOf, match.Image.ID)
+	}
 
-	// Save metadata to DynamoDB
-	err = h.databaseService.SaveImage(ctx, image)
+	// Upload the image and save its metadata, undoing both if either fails
+	_, err = saga.Upload(r.Context(), h.storageService, h.databaseService, image, content, variants)
+	if h.checksDuplicates() {
+		h.similar.Release(id, err == nil)
+	}
 	if err != nil {
-		http.Error(w, "Failed to save image metadata", http.StatusInternalServerError)
+		writeError(w, r, err, "Failed to upload image")
 		return
 	}
 
-	// Redirect to list page
+	// Redirect to list page, or to the new image to show the warning
+	if len(image.DuplicateOf) > 0 {
+		http.Redirect(w, r, "/image/"+id, http.StatusSeeOther)
+		return
+	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
+// findDuplicates looks up the images within the duplicate threshold of an
+// upload, closest first, including uploads still in progress. The upload
+// is reserved in the similarity index until it is released. It finds none
+// when duplicates are not looked for or the upload has no hash
+func (h *ImageHandler) findDuplicates(ctx context.Context, image models.Image) ([]duplicates.Match, error) {
+	if !h.checksDuplicates() {
+		return nil, nil
+	}
+	return h.similar.Reserve(ctx, image, h.duplicates.Threshold)
+}
+
+// checksDuplicates reports whether uploads are checked for duplicates
+func (h *ImageHandler) checksDuplicates() bool {
+	return h.similar != nil && h.duplicates.Policy != "" && h.duplicates.Policy != duplicates.PolicyOff
+}
+
+// describeMatches names the images an upload duplicates, for messages
+func describeMatches(matches []duplicates.Match) string {
+	var names []string
+	for _, match := range matches {
+		names = append(names, fmt.Sprintf("%q (/image/%s, %d bits apart)", match.Image.Title, match.Image.ID, match.Distance))
+	}
+	return strings.Join(names, ", ")
+}
+
+// memoryFile adapts a stripped upload to the multipart.File that
+// StorageService uploads
+type memoryFile struct {
+	*bytes.Reader
+}
+
+func (memoryFile) Close() error {
+	return nil
+}
+
+// formatSize formats a byte count for messages, such as "10 MB"
+func formatSize(size int64) string {
+	if size >= 1<<20 && size%(1<<20) == 0 {
+		return fmt.Sprintf("%d MB", size>>20)
+	}
+	if size >= 1<<10 && size%(1<<10) == 0 {
+		return fmt.Sprintf("%d KB", size>>10)
+	}
+	return fmt.Sprintf("%d bytes", size)
+}
+
+// parseExpiry reads the optional expiry of an upload, given either as a
+// duration from now (expiresIn, e.g. "24h") or as an RFC 3339 time
+// (expiresAt). It returns nil when neither is set
+func parseExpiry(expiresIn, expiresAt string, now time.Time) (*time.Time, error) {
+	var expiry time.Time
+	switch {
+	case expiresIn != "" && expiresAt != "":
+		return nil, errors.New("give either expiresIn or expiresAt, not both")
+	case expiresIn != "":
+		d, err := time.ParseDuration(expiresIn)
+		if err != nil {
+			return nil, errors.New("expiresIn must be a duration such as 24h")
+		}
+		expiry = now.Add(d)
+	case expiresAt != "":
+		t, err := time.Parse(time.RFC3339, expiresAt)
+		if err != nil {
+			return nil, errors.New("expiresAt must be an RFC 3339 time")
+		}
+		expiry = t
+	default:
+		return nil, nil
+	}
+
+	if !expiry.After(now) {
+		return nil, errors.New("expiry must be in the future")
+	}
+	if expiry.Sub(now) > maxExpiry {
+		return nil, errors.New("expiry must be within 365 days")
+	}
+	// DynamoDB keeps expiry times in whole seconds
+	expiry = expiry.Truncate(time.Second)
+	return &expiry, nil
+}
+
+// imageUpdate is the JSON body accepted by UpdateImage. Fields left out of
+// the body are nil and keep their stored values
+type imageUpdate struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	NoWatermark *bool   `json:"noWatermark"`
+}
+
 // UpdateImage handles image update
 func (h *ImageHandler) UpdateImage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	id := vars["id"]
 	ctx := r.Context()
+	isAPI := isAPIRequest(r)
+	isJSONBody := r.Header.Get("Content-Type") == "application/json"
 
 	// Get existing image
-	existingImage, err := h.databaseService.GetImage(ctx, id)
+	existingImage, err := h.getImage(ctx, id)
 	if err != nil {
-		http.Error(w, "Image not found", http.StatusNotFound)
+		writeError(w, r, err, "Failed to fetch image")
+		return
+	}
+	if existingImage.Expired(time.Now()) {
+		writeGone(w, r)
 		return
 	}
 
-	// Update fields
-	existingImage.Title = r.FormValue("title")
-	existingImage.Description = r.FormValue("description")
-	existingImage.UpdatedAt = time.Now()
+	expectedVersion, ok := requestedVersion(w, r, existingImage.Version, isJSONBody)
+	if !ok {
+		return
+	}
+
+	// The edit form always sends every field; a JSON body only changes the
+	// fields it has
+	var update imageUpdate
+	if isJSONBody {
+		if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+	} else {
+		title, description, noWatermark := r.FormValue("title"), r.FormValue("description"), r.FormValue("noWatermark") == "true"
+		update = imageUpdate{Title: &title, Description: &description, NoWatermark: &noWatermark}
+	}
+
+	updatedImage := existingImage
+	if update.Title != nil {
+		updatedImage.Title = *update.Title
+	}
+	if update.Description != nil {
+		updatedImage.Description = *update.Description
+	}
+	if update.NoWatermark != nil {
+		updatedImage.NoWatermark = *update.NoWatermark
+	}
+	updatedImage.UpdatedAt = time.Now()
+	updatedImage.Version = expectedVersion
 
 	// Save updated metadata to DynamoDB
-	err = h.databaseService.SaveImage(ctx, existingImage)
+	err = h.databaseService.SaveImage(ctx, updatedImage)
+	if errors.Is(err, services.ErrVersionConflict) {
+		h.writeConflict(w, r, id, isAPI)
+		return
+	}
 	if err != nil {
-		http.Error(w, "Failed to update image metadata", http.StatusInternalServerError)
+		writeError(w, r, err, "Failed to update image metadata")
+		return
+	}
+
+	// For API requests
+	if isAPI {
+		updatedImage.Version++
+		w.Header().Set("ETag", imageETag(updatedImage))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.withURLs(ctx, updatedImage))
 		return
 	}
 
@@ -213,31 +569,534 @@ func (h *ImageHandler) UpdateImage(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusSeeOther)
 }
 
-// ServeImage serves an image from S3
+// requestedVersion returns the version the client edited. It comes from
+// If-Match on the API and a hidden form field on the web page; without
+// either it is current, which only guards the window between our own read
+// and write. An invalid version is answered with 400 and reports false
+func requestedVersion(w http.ResponseWriter, r *http.Request, current int64, isJSONBody bool) (int64, bool) {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" && ifMatch != "*" {
+		version, err := parseImageETag(ifMatch)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid If-Match header")
+			return 0, false
+		}
+		return version, true
+	}
+	if formVersion := r.FormValue("version"); !isJSONBody && formVersion != "" {
+		version, err := strconv.ParseInt(formVersion, 10, 64)
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid version")
+			return 0, false
+		}
+		return version, true
+	}
+	return current, true
+}
+
+// UpdateEdits sets the rotate, flip and crop edits of an image from the
+// edit form or a JSON body, and regenerates its variants with them. The
+// original blob is not changed
+func (h *ImageHandler) UpdateEdits(w http.ResponseWriter, r *http.Request) {
+	isJSONBody := r.Header.Get("Content-Type") == "application/json"
+
+	var edits models.Edits
+	if isJSONBody {
+		if err := json.NewDecoder(r.Body).Decode(&edits); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+	} else {
+		var err error
+		if edits, err = parseEditsForm(r); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid edits: "+err.Error())
+			return
+		}
+	}
+
+	h.applyEdits(w, r, &edits, isJSONBody)
+}
+
+// ResetEdits removes every edit of an image, so it is served as uploaded
+func (h *ImageHandler) ResetEdits(w http.ResponseWriter, r *http.Request) {
+	h.applyEdits(w, r, nil, false)
+}
+
+// applyEdits replaces the edits of the image in the URL and its variants
+func (h *ImageHandler) applyEdits(w http.ResponseWriter, r *http.Request, edits *models.Edits, isJSONBody bool) {
+	id := mux.Vars(r)["id"]
+	ctx := r.Context()
+	isAPI := isAPIRequest(r)
+
+	existingImage, err := h.getImage(ctx, id)
+	if err != nil {
+		writeError(w, r, err, "Failed to fetch image")
+		return
+	}
+	if existingImage.Expired(time.Now()) {
+		writeGone(w, r)
+		return
+	}
+
+	expectedVersion, ok := requestedVersion(w, r, existingImage.Version, isJSONBody)
+	if !ok {
+		return
+	}
+
+	if edits.IsZero() {
+		edits = nil
+	}
+	if err := edits.Validate(existingImage.Width, existingImage.Height); err != nil {
+		writeProblem(w, r, http.StatusBadRequest, "Invalid edits: "+err.Error())
+		return
+	}
+
+	// Variants are made from the original, never from an edited copy
+	content, _, err := h.storageService.GetImage(ctx, existingImage.S3Key)
+	if err != nil {
+		writeError(w, r, err, "Failed to read image")
+		return
+	}
+	_, generated, err := h.decoder.Variants(ctx, bytes.NewReader(content), imaging.VariantSizes, derived.Recipe(edits))
+	if err != nil {
+		writeError(w, r, err, "Failed to edit image")
+		return
+	}
+
+	updatedImage := existingImage
+	updatedImage.Edits = edits
+	updatedImage.UpdatedAt = time.Now()
+	updatedImage.Version = expectedVersion
+	var variants map[string][]byte
+	updatedImage.Variants, variants = variantRecords(id, generated, edits)
+	updatedImage.Placeholder = placeholder(id, generated)
+	updatedImage.Palette = palette(id, generated)
+
+	updatedImage, err = saga.ReplaceVariants(ctx, h.storageService, h.databaseService, existingImage, updatedImage, variants)
+	if errors.Is(err, services.ErrVersionConflict) {
+		h.writeConflict(w, r, id, isAPI)
+		return
+	}
+	if err != nil {
+		writeError(w, r, err, "Failed to save edits")
+		return
+	}
+
+	// For API requests
+	if isAPI {
+		w.Header().Set("ETag", imageETag(updatedImage))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.withURLs(ctx, updatedImage))
+		return
+	}
+
+	// Back to the edit page to see the result
+	http.Redirect(w, r, "/edit/"+id, http.StatusSeeOther)
+}
+
+// parseEditsForm reads edits from the edit form: rotate in degrees, the
+// flipHorizontal and flipVertical checkboxes and a crop from cropX, cropY,
+// cropWidth and cropHeight, which are either all set or all empty
+func parseEditsForm(r *http.Request) (models.Edits, error) {
+	var edits models.Edits
+	if rotate := r.FormValue("rotate"); rotate != "" {
+		var err error
+		if edits.Rotate, err = strconv.Atoi(rotate); err != nil {
+			return edits, errors.New("rotate must be a number of degrees")
+		}
+	}
+	edits.FlipHorizontal = r.FormValue("flipHorizontal") != ""
+	edits.FlipVertical = r.FormValue("flipVertical") != ""
+
+	fields := []string{"cropX", "cropY", "cropWidth", "cropHeight"}
+	values := make([]int, len(fields))
+	set := 0
+	for i, field := range fields {
+		value := r.FormValue(field)
+		if value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return edits, fmt.Errorf("%s must be a whole number of pixels", field)
+		}
+		values[i] = n
+		set++
+	}
+	switch set {
+	case 0:
+	case len(fields):
+		edits.Crop = &models.Crop{X: values[0], Y: values[1], Width: values[2], Height: values[3]}
+	default:
+		return edits, errors.New("crop needs x, y, width and height")
+	}
+	return edits, nil
+}
+
+// variantRecords describes generated variants for the record of image id
+// and returns their content by storage key
+func variantRecords(id string, generated []imaging.Variant, edits *models.Edits) ([]models.Variant, map[string][]byte) {
+	records := make([]models.Variant, 0, len(generated))
+	content := make(map[string][]byte, len(generated))
+	for _, variant := range generated {
+		key := models.VariantKey(id, variant.Size, variant.Extension, edits)
+		records = append(records, models.Variant{
+			Size:        variant.Size,
+			Width:       variant.Width,
+			Height:      variant.Height,
+			Key:         key,
+			ContentType: variant.MIMEType,
+		})
+		content[key] = variant.Data
+	}
+	return records, content
+}
+
+// placeholder makes the placeholder of an image from its variants. It is
+// cosmetic, so a failure is logged and leaves the image without one
+func placeholder(id string, generated []imaging.Variant) string {
+	placeholder, err := imaging.Placeholder(generated)
+	if err != nil {
+		log.Printf("Placeholder for %s: %v", id, err)
+	}
+	return placeholder
+}
+
+// palette finds the dominant colours of an image from its variants. Like
+// the placeholder, a failure is logged and leaves the image without one
+func palette(id string, generated []imaging.Variant) []models.Swatch {
+	swatches, err := imaging.Palette(generated)
+	if err != nil {
+		log.Printf("Palette for %s: %v", id, err)
+	}
+	return derived.Swatches(swatches)
+}
+
+// visualFeatures finds the perceptual hash and colour histogram of an
+// image from its variants, in the form stored on the image. A failure is
+// logged and leaves the image without them, so it is neither checked for
+// duplicates nor found by similarity
+func visualFeatures(id string, generated []imaging.Variant) (string, []byte) {
+	features, ok, err := imaging.FeaturesOf(generated)
+	if err != nil {
+		log.Printf("Visual features for %s: %v", id, err)
+	}
+	if !ok || err != nil {
+		return "", nil
+	}
+	return duplicates.FormatHash(features.PerceptualHash), features.Histogram
+}
+
+// writeConflict responds to a stale edit with 409 and the current record
+func (h *ImageHandler) writeConflict(w http.ResponseWriter, r *http.Request, id string, isAPI bool) {
+	ctx := r.Context()
+
+	current, err := h.databaseService.GetImage(ctx, id)
+	if err != nil {
+		writeError(w, r, err, "Failed to fetch image")
+		return
+	}
+
+	w.Header().Set("ETag", imageETag(current))
+
+	current = h.withURLs(ctx, current)
+
+	// For API requests
+	if isAPI {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(current)
+		return
+	}
+
+	// For web page requests
+	w.WriteHeader(http.StatusConflict)
+	if err := components.RenderEditConflictPage(w, current); err != nil {
+		log.Printf("Error rendering template: %v", err)
+	}
+}
+
+// imageETag returns the entity tag for an image's current version
+func imageETag(image models.Image) string {
+	return fmt.Sprintf("%q", strconv.FormatInt(image.Version, 10))
+}
+
+// parseImageETag extracts the image version from an If-Match value
+func parseImageETag(etag string) (int64, error) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	return strconv.ParseInt(strings.Trim(etag, `"`), 10, 64)
+}
+
+// ServeImage serves an image from S3. Only blobs of a readable, finished
+// and unexpired record are served. A watermarked, edited or resized blob is
+// decoded and encoded again as a JPEG or PNG, so an animated GIF is served
+// as its first frame
 func (h *ImageHandler) ServeImage(w http.ResponseWriter, r *http.Request) {
 	// Get the image key from the URL path
 	imageKey := strings.TrimPrefix(r.URL.Path, "/images/")
 	if imageKey == "" {
-		http.Error(w, "Image key is required", http.StatusBadRequest)
+		writeProblem(w, r, http.StatusBadRequest, "Image key is required")
 		return
 	}
 
-	// Get the image from S3
+	// Without its record a blob cannot be checked for expiry or served with
+	// its watermark, so it is not served at all
 	ctx := r.Context()
+	image, err := h.imageForKey(ctx, imageKey)
+	if errors.Is(err, services.ErrNotFound) || errors.Is(err, services.ErrInvalidKey) {
+		writeError(w, r, err, "Failed to get image")
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to fetch image for %s: %v", imageKey, err)
+		writeProblem(w, r, http.StatusServiceUnavailable, "Failed to get image")
+		return
+	}
+
+	// Expired blobs stay in storage until the sweeper purges them, and
+	// caches must not keep an expiring image past its expiry
+	maxAge := imageCacheMaxAge
+	if image.ExpiresAt != nil {
+		remaining := image.ExpiresAt.Sub(time.Now())
+		if remaining <= 0 {
+			writeGone(w, r)
+			return
+		}
+		maxAge = min(maxAge, remaining)
+	}
+
+	// Query parameters ask for a resized copy, such as ?w=400&h=300&fit=cover
+	watermark := h.watermarkFor(image)
+	if imaging.IsTransform(r.URL.Query()) {
+		transform, err := imaging.ParseTransform(r.URL.Query())
+		if err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid transform: "+err.Error())
+			return
+		}
+		transform.Watermark = watermark
+		h.serveRendered(w, r, image, imageKey, transform, maxAge)
+		return
+	}
+
+	// The original of an edited image is served with its edits, and every
+	// blob of a watermarked image with the watermark; the stored blobs stay
+	// as uploaded
+	if watermark != nil || imageKey == image.S3Key && !image.Edits.IsZero() {
+		quality := imaging.DefaultQuality
+		if imageKey == image.S3Key {
+			quality = editedQuality
+		}
+		h.serveRendered(w, r, image, imageKey, imaging.Transform{Quality: quality, Watermark: watermark}, maxAge)
+		return
+	}
+
+	// Get the image from S3
 	content, contentType, err := h.storageService.GetImage(ctx, imageKey)
 	if err != nil {
-		log.Printf("Error getting image from S3: %v", err)
-		http.Error(w, "Image not found", http.StatusNotFound)
+		writeError(w, r, err, "Failed to get image from S3")
 		return
 	}
 
 	// Set content type and write the image content
 	w.Header().Set("Content-Type", contentType)
-	w.Header().Set("Cache-Control", "public, max-age=86400") // Cache for 1 day
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	w.Write(content)
+}
+
+// DownloadOriginal serves the stored original of an image as it was
+// uploaded, without edits or watermark, as an attachment. It is routed
+// behind the admin token
+func (h *ImageHandler) DownloadOriginal(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	ctx := r.Context()
+
+	image, err := h.getImage(ctx, id)
+	if err != nil {
+		writeError(w, r, err, "Failed to fetch image")
+		return
+	}
+	if image.Expired(time.Now()) {
+		writeGone(w, r)
+		return
+	}
+
+	content, contentType, err := h.storageService.GetImage(ctx, image.S3Key)
+	if err != nil {
+		writeError(w, r, err, "Failed to get image from S3")
+		return
+	}
+
+	// The unmarked original must not be kept by shared caches
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", `attachment; filename="`+image.ID+path.Ext(image.S3Key)+`"`)
+	w.Header().Set("Cache-Control", "private, no-store")
 	w.WriteHeader(http.StatusOK)
 	w.Write(content)
 }
 
+// DuplicateReport responds with the clusters of near-duplicates across the
+// gallery, within the configured threshold or the threshold query
+// parameter, from 0 to 64 bits. It is routed behind the admin token
+func (h *ImageHandler) DuplicateReport(w http.ResponseWriter, r *http.Request) {
+	threshold := h.duplicates.Threshold
+	if value := r.URL.Query().Get("threshold"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 0 || parsed > 64 {
+			writeProblem(w, r, http.StatusBadRequest, "threshold must be a number of bits from 0 to 64")
+			return
+		}
+		threshold = parsed
+	}
+
+	report := duplicates.NewReport(threshold, 0, 0, nil)
+	if h.similar != nil {
+		var err error
+		report, err = h.similar.Duplicates(r.Context(), threshold)
+		if err != nil {
+			writeError(w, r, err, "Failed to find duplicates")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(report)
+}
+
+// SimilarImages lists the images that look most like an image, closest
+// first, as JSON. The n query parameter sets how many, from 1 to
+// maxSimilarImages. An image without visual features has none
+func (h *ImageHandler) SimilarImages(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	n := defaultSimilarImages
+	if value := r.URL.Query().Get("n"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > maxSimilarImages {
+			writeProblem(w, r, http.StatusBadRequest, fmt.Sprintf("n must be a number from 1 to %d", maxSimilarImages))
+			return
+		}
+		n = parsed
+	}
+
+	image, err := h.getImage(ctx, mux.Vars(r)["id"])
+	if err != nil {
+		writeError(w, r, err, "Failed to fetch image")
+		return
+	}
+	if image.Expired(time.Now()) {
+		writeGone(w, r)
+		return
+	}
+
+	results := []similar.Result{}
+	if h.similar != nil {
+		found, err := h.similar.Similar(ctx, image, n)
+		if err != nil {
+			writeError(w, r, err, "Failed to find similar images")
+			return
+		}
+		for _, result := range found {
+			result.Image = h.withURLs(ctx, result.Image)
+			results = append(results, result)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// similarImages returns up to n images that look like image, with their
+// URLs, for the view page. A failure is logged and shows none
+func (h *ImageHandler) similarImages(ctx context.Context, image models.Image, n int) []models.Image {
+	if h.similar == nil {
+		return nil
+	}
+	results, err := h.similar.Similar(ctx, image, n)
+	if err != nil {
+		log.Printf("Similar images for %s: %v", image.ID, err)
+		return nil
+	}
+	images := make([]models.Image, len(results))
+	for i, result := range results {
+		images[i] = h.withURLs(ctx, result.Image)
+	}
+	return images
+}
+
+// watermarkFor returns the watermark image is served with, nil when there
+// is none or the image opted out
+func (h *ImageHandler) watermarkFor(image models.Image) *imaging.Watermark {
+	if image.NoWatermark {
+		return nil
+	}
+	return h.watermark
+}
+
+// serveRendered serves a copy of the blob at key, the original or a
+// variant of image, transformed by transform
+func (h *ImageHandler) serveRendered(w http.ResponseWriter, r *http.Request, image models.Image, key string, transform imaging.Transform, maxAge time.Duration) {
+	rendered, err := h.renderer.Render(r.Context(), image, key, transform)
+	if err != nil {
+		writeError(w, r, err, "Failed to transform image")
+		return
+	}
+
+	w.Header().Set("Content-Type", rendered.ContentType)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	w.WriteHeader(http.StatusOK)
+	w.Write(rendered.Data)
+}
+
+// withURLs replaces the storage keys of an image and its variants with the
+// URLs they are served from. The variants are copied, as the record may be
+// shared with the database cache
+func (h *ImageHandler) withURLs(ctx context.Context, image models.Image) models.Image {
+	if url, err := h.storageService.GetImageURL(ctx, image.S3Key); err == nil {
+		image.S3Key = url
+	}
+	if len(image.Variants) == 0 {
+		return image
+	}
+
+	variants := make([]models.Variant, len(image.Variants))
+	for i, variant := range image.Variants {
+		if url, err := h.storageService.GetImageURL(ctx, variant.Key); err == nil {
+			variant.Key = url
+		}
+		variants[i] = variant
+	}
+	image.Variants = variants
+	return image
+}
+
+// getImage reads an image, treating images whose upload or delete has not
+// finished as missing
+func (h *ImageHandler) getImage(ctx context.Context, id string) (models.Image, error) {
+	image, err := h.databaseService.GetImage(ctx, id)
+	if err != nil {
+		return image, err
+	}
+	if image.Pending() {
+		return models.Image{}, fmt.Errorf("image %s: %w", id, services.ErrNotFound)
+	}
+	return image, nil
+}
+
+// imageForKey finds the record of a blob from the image ID that uploads use
+// as the base name of the original's and the variants' keys. It returns
+// services.ErrNotFound if there is no such record, the record is pending or
+// the key is not one of its blobs
+func (h *ImageHandler) imageForKey(ctx context.Context, key string) (models.Image, error) {
+	id := strings.TrimSuffix(path.Base(key), path.Ext(key))
+	image, err := h.getImage(ctx, id)
+	if err != nil {
+		return image, err
+	}
+	if !slices.Contains(image.Keys(), key) {
+		return models.Image{}, fmt.Errorf("image %s has no blob %s: %w", id, key, services.ErrNotFound)
+	}
+	return image, nil
+}
+
 // DeleteImage handles image deletion
 func (h *ImageHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
@@ -245,26 +1104,128 @@ func (h *ImageHandler) DeleteImage(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 
 	// Get existing image
-	existingImage, err := h.databaseService.GetImage(ctx, id)
+	existingImage, err := h.getImage(ctx, id)
 	if err != nil {
-		http.Error(w, "Image not found", http.StatusNotFound)
+		writeError(w, r, err, "Failed to fetch image")
 		return
 	}
 
-	// Delete image from S3
-	err = h.storageService.DeleteImage(ctx, existingImage.S3Key)
+	// Delete the blob and then the metadata; the record is restored if the
+	// blob cannot be deleted
+	err = saga.Delete(ctx, h.storageService, h.databaseService, existingImage)
 	if err != nil {
-		http.Error(w, "Failed to delete image from S3", http.StatusInternalServerError)
+		writeError(w, r, err, "Failed to delete image")
 		return
 	}
 
-	// Delete metadata from DynamoDB
-	err = h.databaseService.DeleteImage(ctx, id)
-	if err != nil {
-		http.Error(w, "Failed to delete image metadata", http.StatusInternalServerError)
+	// Redirect to list page
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// batchDeleteRequest is the JSON body accepted by BatchDeleteImages
+type batchDeleteRequest struct {
+	IDs []string `json:"ids"`
+}
+
+// batchDeleteResponse reports which images were deleted and why others were not
+type batchDeleteResponse struct {
+	Deleted []string          `json:"deleted"`
+	Failed  map[string]string `json:"failed,omitempty"`
+}
+
+// BatchDeleteImages handles deletion of several images at once
+func (h *ImageHandler) BatchDeleteImages(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	// IDs come from a JSON body on the API and repeated "id" fields on forms
+	var request batchDeleteRequest
+	if r.Header.Get("Content-Type") == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Invalid JSON body")
+			return
+		}
+	} else {
+		if err := r.ParseForm(); err != nil {
+			writeProblem(w, r, http.StatusBadRequest, "Failed to parse form")
+			return
+		}
+		request.IDs = r.PostForm["id"]
+	}
+	if len(request.IDs) == 0 {
+		writeProblem(w, r, http.StatusBadRequest, "No image IDs given")
+		return
+	}
+
+	response := batchDeleteResponse{Deleted: []string{}, Failed: make(map[string]string)}
+
+	// Look up storage keys; IDs that cannot be read are reported as failed
+	images, err := h.databaseService.BatchGetImages(ctx, request.IDs)
+	if !collectBatchFailures(err, response.Failed) {
+		writeError(w, r, err, "Failed to fetch images")
+		return
+	}
+
+	// Images already being deleted are left to that delete
+	pending := make([]models.Image, 0, len(images))
+	for _, image := range images {
+		if image.Pending() {
+			response.Failed[image.ID] = services.ErrNotFound.Error()
+			continue
+		}
+		pending = append(pending, image)
+	}
+
+	// Delete blobs first, as DeleteImage does; metadata is only removed for
+	// images whose blob is gone
+	deleteFailures := make(map[string]string)
+	err = saga.DeleteImages(ctx, h.storageService, h.databaseService, pending)
+	if !collectBatchFailures(err, deleteFailures) {
+		writeError(w, r, err, "Failed to delete images")
+		return
+	}
+
+	for _, image := range pending {
+		if reason, failed := deleteFailures[image.ID]; failed {
+			response.Failed[image.ID] = reason
+			continue
+		}
+		response.Deleted = append(response.Deleted, image.ID)
+	}
+
+	// For API requests
+	if isAPIRequest(r) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
 		return
 	}
 
 	// Redirect to list page
 	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// collectBatchFailures copies the per-item failures of a *services.BatchError
+// into failures. It reports false if err is some other error, meaning the
+// whole batch failed
+func collectBatchFailures(err error, failures map[string]string) bool {
+	if err == nil {
+		return true
+	}
+
+	var batchErr *services.BatchError
+	if !errors.As(err, &batchErr) {
+		return false
+	}
+	for key, itemErr := range batchErr.Errors {
+		if statusForError(itemErr) >= http.StatusInternalServerError {
+			log.Printf("Batch item %s failed: %v", key, itemErr)
+			failures[key] = http.StatusText(statusForError(itemErr))
+			continue
+		}
+		detail, own := clientDetail(itemErr)
+		if !own {
+			log.Printf("Batch item %s failed: %v", key, itemErr)
+		}
+		failures[key] = detail
+	}
+	return true
 }
\ No newline at end of file
@@ -3,16 +3,31 @@ package handlers
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"image_gallery/internal/derived"
+	"image_gallery/internal/duplicates"
+	"image_gallery/internal/imaging"
+	"image_gallery/internal/metadata"
 	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+	"image_gallery/internal/similar"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"net/url"
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/gorilla/mux"
 )
 
 // MockStorageService implements the StorageService interface for testing
@@ -45,7 +60,7 @@ func (m *MockStorageService) GetImageURL(_ context.Context, key string) (string,
 func (m *MockStorageService) GetImage(_ context.Context, key string) ([]byte, string, error) {
 	content, ok := m.images[key]
 	if !ok {
-		return nil, "", os.ErrNotExist
+		return nil, "", services.ErrNotFound
 	}
 	return content, "image/jpeg", nil
 }
@@ -55,6 +70,13 @@ func (m *MockStorageService) DeleteImage(_ context.Context, key string) error {
 	return nil
 }
 
+func (m *MockStorageService) DeleteImages(_ context.Context, keys []string) error {
+	for _, key := range keys {
+		delete(m.images, key)
+	}
+	return nil
+}
+
 func (m *MockStorageService) GetBucketName() string {
 	return "mock-bucket"
 }
@@ -71,6 +93,10 @@ func NewMockDatabaseService() *MockDatabaseService {
 }
 
 func (m *MockDatabaseService) SaveImage(_ context.Context, image models.Image) error {
+	if m.images[image.ID].Version != image.Version {
+		return services.ErrVersionConflict
+	}
+	image.Version++
 	m.images[image.ID] = image
 	return nil
 }
@@ -78,7 +104,7 @@ func (m *MockDatabaseService) SaveImage(_ context.Context, image models.Image) e
 func (m *MockDatabaseService) GetImage(_ context.Context, id string) (models.Image, error) {
 	image, ok := m.images[id]
 	if !ok {
-		return models.Image{}, os.ErrNotExist
+		return models.Image{}, services.ErrNotFound
 	}
 	return image, nil
 }
@@ -96,6 +122,51 @@ func (m *MockDatabaseService) DeleteImage(_ context.Context, id string) error {
 	return nil
 }
 
+func (m *MockDatabaseService) BatchGetImages(_ context.Context, ids []string) ([]models.Image, error) {
+	images := make([]models.Image, 0, len(ids))
+	failed := make(map[string]error)
+	for _, id := range ids {
+		image, ok := m.images[id]
+		if !ok {
+			failed[id] = services.ErrNotFound
+			continue
+		}
+		images = append(images, image)
+	}
+	if len(failed) > 0 {
+		return images, &services.BatchError{Errors: failed}
+	}
+	return images, nil
+}
+
+func (m *MockDatabaseService) BatchSaveImages(_ context.Context, images []models.Image) error {
+	for _, image := range images {
+		image.Version = m.images[image.ID].Version + 1
+		m.images[image.ID] = image
+	}
+	return nil
+}
+
+func (m *MockDatabaseService) BatchUpdateImages(ctx context.Context, images []models.Image) error {
+	failed := make(map[string]error)
+	for _, image := range images {
+		if err := m.SaveImage(ctx, image); err != nil {
+			failed[image.ID] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &services.BatchError{Errors: failed}
+	}
+	return nil
+}
+
+func (m *MockDatabaseService) BatchDeleteImages(_ context.Context, ids []string) error {
+	for _, id := range ids {
+		delete(m.images, id)
+	}
+	return nil
+}
+
 
 func TestListImages(t *testing.T) {
 	// Set up mock services
@@ -216,6 +287,9 @@ func TestServeImage(t *testing.T) {
 	// Add a test image to the mock storage
 	imageContent := []byte("test image content")
 	mockStorage.images["test.jpg"] = imageContent
+	mockDB.images["test"] = models.Image{ID: "test", S3Key: "test.jpg", ContentType: "image/jpeg"}
+	// A blob that shares the image's base name but is not one of its blobs
+	mockStorage.images["other/test.jpg"] = imageContent
 
 	// Create a handler
 	handler := &ImageHandler{
@@ -265,4 +339,1193 @@ func TestServeImage(t *testing.T) {
 			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
 		}
 	})
-}
\ No newline at end of file
+
+	t.Run("ServeImage_KeyOfAnotherBlob", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeImage(rr, httptest.NewRequest("GET", "/images/other/test.jpg", nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("ServeImage_RecordUnavailable", func(t *testing.T) {
+		failing := &ImageHandler{
+			storageService:  mockStorage,
+			databaseService: &unreadableDB{MockDatabaseService: mockDB},
+		}
+		rr := httptest.NewRecorder()
+		failing.ServeImage(rr, httptest.NewRequest("GET", "/images/test.jpg", nil))
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, rr.Code)
+		}
+		if bytes.Equal(rr.Body.Bytes(), imageContent) {
+			t.Error("Expected the blob not to be served without its record")
+		}
+	})
+}
+
+// unreadableDB fails every read of a single record
+type unreadableDB struct {
+	*MockDatabaseService
+}
+
+func (d *unreadableDB) GetImage(_ context.Context, id string) (models.Image, error) {
+	return models.Image{}, errors.New("connection reset")
+}
+
+func TestUpdateImage(t *testing.T) {
+	// Set up mock services
+	mockStorage := NewMockStorageService()
+	mockDB := NewMockDatabaseService()
+
+	now := time.Now().Truncate(time.Second)
+	mockDB.SaveImage(context.Background(), models.Image{
+		ID:          "test-id-1",
+		Title:       "Original Title",
+		Description: "Original Description",
+		S3Key:       "test1.jpg",
+		CreatedAt:   now,
+		UpdatedAt:   now,
+		NoWatermark: true,
+	})
+
+	// Create a handler
+	handler := &ImageHandler{
+		storageService:  mockStorage,
+		databaseService: mockDB,
+	}
+
+	newUpdateRequest := func(body string, ifMatch string) *http.Request {
+		req := httptest.NewRequest("POST", "/update/test-id-1", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			req.Header.Set("If-Match", ifMatch)
+		}
+		return mux.SetURLVars(req, map[string]string{"id": "test-id-1"})
+	}
+
+	t.Run("UpdateImage_JSON_Success", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.UpdateImage(rr, newUpdateRequest(`{"title":"First Edit"}`, `"1"`))
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		if etag := rr.Header().Get("ETag"); etag != `"2"` {
+			t.Errorf("Expected ETag %q, got %q", `"2"`, etag)
+		}
+		stored := mockDB.images["test-id-1"]
+		if stored.Title != "First Edit" {
+			t.Errorf("Expected stored title %q, got %q", "First Edit", stored.Title)
+		}
+		if stored.Description != "Original Description" || !stored.NoWatermark {
+			t.Errorf("Expected the fields left out of the body to be kept, got %q, %v", stored.Description, stored.NoWatermark)
+		}
+
+		var updated models.Image
+		if err := json.Unmarshal(rr.Body.Bytes(), &updated); err != nil {
+			t.Fatalf("Failed to parse response JSON: %v", err)
+		}
+		if updated.S3Key != "/images/test1.jpg" {
+			t.Errorf("Expected the image URL in the response, got %q", updated.S3Key)
+		}
+	})
+
+	t.Run("UpdateImage_JSON_StaleIfMatch", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.UpdateImage(rr, newUpdateRequest(`{"title":"Stale Edit"}`, `"1"`))
+
+		if status := rr.Code; status != http.StatusConflict {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+		}
+		if etag := rr.Header().Get("ETag"); etag != `"2"` {
+			t.Errorf("Expected ETag of current record %q, got %q", `"2"`, etag)
+		}
+
+		var current models.Image
+		if err := json.Unmarshal(rr.Body.Bytes(), &current); err != nil {
+			t.Fatalf("Failed to parse response JSON: %v", err)
+		}
+		if current.Title != "First Edit" {
+			t.Errorf("Expected current title %q, got %q", "First Edit", current.Title)
+		}
+		if title := mockDB.images["test-id-1"].Title; title != "First Edit" {
+			t.Errorf("Stale edit overwrote stored title: %q", title)
+		}
+	})
+
+	t.Run("UpdateImage_Form_StaleVersion", func(t *testing.T) {
+		form := url.Values{"title": {"Stale Form Edit"}, "version": {"1"}}
+		req := httptest.NewRequest("POST", "/update/test-id-1", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = mux.SetURLVars(req, map[string]string{"id": "test-id-1"})
+
+		rr := httptest.NewRecorder()
+		handler.UpdateImage(rr, req)
+
+		if status := rr.Code; status != http.StatusConflict {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusConflict)
+		}
+		if !strings.Contains(rr.Body.String(), "First Edit") {
+			t.Errorf("Conflict page does not show the current title")
+		}
+	})
+}
+
+func TestGetImageNotFound(t *testing.T) {
+	// Create a handler with empty mock services
+	handler := &ImageHandler{
+		storageService:  NewMockStorageService(),
+		databaseService: NewMockDatabaseService(),
+	}
+
+	t.Run("GetImage_NotFound_JSON", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/image/missing", nil)
+		req.Header.Set("Accept", "application/json")
+		req = mux.SetURLVars(req, map[string]string{"id": "missing"})
+
+		rr := httptest.NewRecorder()
+		handler.GetImage(rr, req)
+
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != "application/problem+json" {
+			t.Errorf("Handler returned wrong content type: got %v want %v", contentType, "application/problem+json")
+		}
+
+		var body problem
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to parse problem JSON: %v", err)
+		}
+		if body.Status != http.StatusNotFound || body.Title != "Not Found" {
+			t.Errorf("Unexpected problem body: %+v", body)
+		}
+		if body.Instance != "/image/missing" {
+			t.Errorf("Expected instance %q, got %q", "/image/missing", body.Instance)
+		}
+	})
+
+	t.Run("GetImage_NotFound_HTML", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/image/missing", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "missing"})
+
+		rr := httptest.NewRecorder()
+		handler.GetImage(rr, req)
+
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+		}
+		if contentType := rr.Header().Get("Content-Type"); !strings.HasPrefix(contentType, "text/plain") {
+			t.Errorf("Handler returned wrong content type: got %v want text/plain", contentType)
+		}
+	})
+}
+
+func TestStatusForError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{fmt.Errorf("image x: %w", services.ErrNotFound), http.StatusNotFound},
+		{services.ErrVersionConflict, http.StatusConflict},
+		{services.ErrInvalidKey, http.StatusBadRequest},
+		{services.ErrTooLarge, http.StatusRequestEntityTooLarge},
+		{services.ErrUnavailable, http.StatusServiceUnavailable},
+		{imaging.ErrUnsupportedFormat, http.StatusUnsupportedMediaType},
+		{fmt.Errorf("%w: unexpected EOF", imaging.ErrCorruptImage), http.StatusUnprocessableEntity},
+		{&imaging.LimitError{Reason: "image has 84 pixels, the limit is 50"}, http.StatusUnprocessableEntity},
+		{fmt.Errorf("%w: 4096 bytes, the limit is 1024", imaging.ErrFileTooLarge), http.StatusRequestEntityTooLarge},
+		{errors.New("boom"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		if status := statusForError(tt.err); status != tt.status {
+			t.Errorf("statusForError(%v) = %d, want %d", tt.err, status, tt.status)
+		}
+	}
+}
+
+func TestWriteErrorHidesServiceDetails(t *testing.T) {
+	tests := []struct {
+		err    error
+		detail string
+	}{
+		{fmt.Errorf("%w: operation error DynamoDB: GetItem, RequestID: 7Q2K, table gallery-images", services.ErrNotFound), "Not found"},
+		{fmt.Errorf("%w: PreconditionFailed, bucket gallery-blobs", services.ErrConflict), "The request conflicts with the stored image"},
+		{services.ErrVersionConflict, "The image was changed by another request"},
+		{&imaging.LimitError{Reason: "image has 84 pixels, the limit is 50"}, "image has 84 pixels, the limit is 50"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/image/x", nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		writeError(rr, req, tt.err, "Failed to fetch image")
+
+		var body problem
+		if err := json.Unmarshal(rr.Body.Bytes(), &body); err != nil {
+			t.Fatalf("Failed to parse problem JSON: %v", err)
+		}
+		if !strings.Contains(body.Detail, tt.detail) || strings.Contains(body.Detail, "gallery-") {
+			t.Errorf("Expected detail %q for %v, got %q", tt.detail, tt.err, body.Detail)
+		}
+	}
+}
+
+func TestBatchDeleteImages(t *testing.T) {
+	// Set up mock services
+	mockStorage := NewMockStorageService()
+	mockDB := NewMockDatabaseService()
+
+	for _, id := range []string{"test-id-1", "test-id-2", "test-id-3"} {
+		mockDB.SaveImage(context.Background(), models.Image{ID: id, S3Key: id + ".jpg"})
+		mockStorage.images[id+".jpg"] = []byte("content")
+	}
+
+	// Create a handler
+	handler := &ImageHandler{
+		storageService:  mockStorage,
+		databaseService: mockDB,
+	}
+
+	req := httptest.NewRequest("POST", "/delete", strings.NewReader(`{"ids":["test-id-1","test-id-2","missing"]}`))
+	req.Header.Set("Content-Type", "application/json")
+
+	rr := httptest.NewRecorder()
+	handler.BatchDeleteImages(rr, req)
+
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+
+	var response batchDeleteResponse
+	if err := json.Unmarshal(rr.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to parse response JSON: %v", err)
+	}
+	if len(response.Deleted) != 2 {
+		t.Errorf("Expected 2 deleted images, got %v", response.Deleted)
+	}
+	if _, ok := response.Failed["missing"]; !ok || len(response.Failed) != 1 {
+		t.Errorf("Expected only the missing ID to fail, got %v", response.Failed)
+	}
+
+	if _, ok := mockDB.images["test-id-3"]; !ok {
+		t.Errorf("Image not in the batch was deleted")
+	}
+	if _, ok := mockStorage.images["test-id-1.jpg"]; ok {
+		t.Errorf("Blob of deleted image still exists")
+	}
+	if _, ok := mockDB.images["test-id-1"]; ok {
+		t.Errorf("Metadata of deleted image still exists")
+	}
+}
+func TestExpiringImages(t *testing.T) {
+	mockStorage := NewMockStorageService()
+	mockDB := NewMockDatabaseService()
+	handler := &ImageHandler{
+		storageService:  mockStorage,
+		databaseService: mockDB,
+	}
+
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+	mockDB.SaveImage(context.Background(), models.Image{ID: "expired", Title: "Expired", S3Key: "expired.jpg", ExpiresAt: &past})
+	mockDB.SaveImage(context.Background(), models.Image{ID: "expiring", Title: "Expiring", S3Key: "expiring.jpg", ExpiresAt: &future})
+	mockStorage.images["expired.jpg"] = []byte("expired content")
+	mockStorage.images["expiring.jpg"] = []byte("expiring content")
+
+	t.Run("GetImage_Expired", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/image/expired", nil)
+		req.Header.Set("Accept", "application/json")
+		req = mux.SetURLVars(req, map[string]string{"id": "expired"})
+
+		rr := httptest.NewRecorder()
+		handler.GetImage(rr, req)
+
+		if status := rr.Code; status != http.StatusGone {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusGone)
+		}
+	})
+
+	t.Run("ListImages_HidesExpired", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept", "application/json")
+
+		rr := httptest.NewRecorder()
+		handler.ListImages(rr, req)
+
+		var images []models.Image
+		if err := json.Unmarshal(rr.Body.Bytes(), &images); err != nil {
+			t.Fatalf("Failed to parse response JSON: %v", err)
+		}
+		if len(images) != 1 || images[0].ID != "expiring" {
+			t.Errorf("Expected only the unexpired image, got %+v", images)
+		}
+	})
+
+	t.Run("ServeImage_Expired", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/images/expired.jpg", nil)
+
+		rr := httptest.NewRecorder()
+		handler.ServeImage(rr, req)
+
+		if status := rr.Code; status != http.StatusGone {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusGone)
+		}
+	})
+
+	t.Run("ServeImage_CacheEndsAtExpiry", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/images/expiring.jpg", nil)
+
+		rr := httptest.NewRecorder()
+		handler.ServeImage(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var maxAge int
+		if _, err := fmt.Sscanf(rr.Header().Get("Cache-Control"), "public, max-age=%d", &maxAge); err != nil {
+			t.Fatalf("Unexpected Cache-Control %q", rr.Header().Get("Cache-Control"))
+		}
+		if maxAge <= 0 || maxAge > int(time.Hour.Seconds()) {
+			t.Errorf("Expected max-age within the hour before expiry, got %d", maxAge)
+		}
+	})
+}
+
+func TestParseExpiry(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	t.Run("None", func(t *testing.T) {
+		expiresAt, err := parseExpiry("", "", now)
+		if err != nil || expiresAt != nil {
+			t.Errorf("Expected no expiry, got %v, %v", expiresAt, err)
+		}
+	})
+
+	t.Run("Duration", func(t *testing.T) {
+		expiresAt, err := parseExpiry("24h", "", now)
+		if err != nil {
+			t.Fatalf("Failed to parse expiry: %v", err)
+		}
+		if want := now.Add(24 * time.Hour); !expiresAt.Equal(want) {
+			t.Errorf("Expected %v, got %v", want, expiresAt)
+		}
+	})
+
+	t.Run("Time", func(t *testing.T) {
+		expiresAt, err := parseExpiry("", "2024-06-02T08:30:00Z", now)
+		if err != nil {
+			t.Fatalf("Failed to parse expiry: %v", err)
+		}
+		if want := time.Date(2024, 6, 2, 8, 30, 0, 0, time.UTC); !expiresAt.Equal(want) {
+			t.Errorf("Expected %v, got %v", want, expiresAt)
+		}
+	})
+
+	for name, values := range map[string][2]string{
+		"Both":        {"1h", "2024-06-02T08:30:00Z"},
+		"InvalidTime": {"", "tomorrow"},
+		"Past":        {"-1h", ""},
+		"TooLate":     {"9000h", ""},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if _, err := parseExpiry(values[0], values[1], now); err == nil {
+				t.Errorf("Expected an error for %q", values)
+			}
+		})
+	}
+}
+
+func TestPendingImagesAreHidden(t *testing.T) {
+	mockDB := NewMockDatabaseService()
+	handler := &ImageHandler{
+		storageService:  NewMockStorageService(),
+		databaseService: mockDB,
+	}
+	mockDB.SaveImage(context.Background(), models.Image{ID: "uploading", Title: "Uploading", S3Key: "uploading.jpg", Status: models.StatusUploading})
+	mockDB.SaveImage(context.Background(), models.Image{ID: "deleting", Title: "Deleting", S3Key: "deleting.jpg", Status: models.StatusDeleting})
+
+	for _, id := range []string{"uploading", "deleting"} {
+		req := httptest.NewRequest("GET", "/image/"+id, nil)
+		req.Header.Set("Accept", "application/json")
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+
+		rr := httptest.NewRecorder()
+		handler.GetImage(rr, req)
+
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Errorf("Handler returned wrong status code for %s: got %v want %v", id, status, http.StatusNotFound)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Accept", "application/json")
+	rr := httptest.NewRecorder()
+	handler.ListImages(rr, req)
+
+	var images []models.Image
+	if err := json.Unmarshal(rr.Body.Bytes(), &images); err != nil {
+		t.Fatalf("Failed to parse response JSON: %v", err)
+	}
+	if len(images) != 0 {
+		t.Errorf("Expected pending images to be hidden, got %+v", images)
+	}
+}
+
+// newUploadRequest builds a multipart upload of content under filename
+func newUploadRequest(t *testing.T, filename, contentType string, content []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	writer.WriteField("title", "Uploaded")
+	header := make(map[string][]string)
+	header["Content-Disposition"] = []string{fmt.Sprintf(`form-data; name="image"; filename="%s"`, filename)}
+	header["Content-Type"] = []string{contentType}
+	part, err := writer.CreatePart(header)
+	if err != nil {
+		t.Fatalf("Failed to create form part: %v", err)
+	}
+	part.Write(content)
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/upload", &body)
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+func TestListImagesByColor(t *testing.T) {
+	mockDB := NewMockDatabaseService()
+	for _, img := range []models.Image{
+		{ID: "sky", Title: "Sky", S3Key: "sky.jpg", Palette: []models.Swatch{{Color: "#4a90d9", Weight: 0.7}, {Color: "#ffffff", Weight: 0.3}}},
+		{ID: "navy", Title: "Navy", S3Key: "navy.jpg", Palette: []models.Swatch{{Color: "#1e88e5", Weight: 0.6}, {Color: "#222222", Weight: 0.4}}},
+		{ID: "roses", Title: "Roses", S3Key: "roses.jpg", Palette: []models.Swatch{{Color: "#d81b60", Weight: 0.8}, {Color: "#1e88e5", Weight: 0.05}}},
+		{ID: "old", Title: "Old", S3Key: "old.jpg"},
+	} {
+		mockDB.SaveImage(context.Background(), img)
+	}
+	handler := &ImageHandler{storageService: NewMockStorageService(), databaseService: mockDB}
+
+	t.Run("JSON_ClosestFirst", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/?color=%231e88e5", nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ListImages(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var images []models.Image
+		if err := json.Unmarshal(rr.Body.Bytes(), &images); err != nil {
+			t.Fatalf("Failed to parse response JSON: %v", err)
+		}
+		var ids []string
+		for _, img := range images {
+			ids = append(ids, img.ID)
+		}
+		if strings.Join(ids, ",") != "navy,sky" {
+			t.Errorf("Expected navy then sky, got %v", ids)
+		}
+	})
+
+	t.Run("Tolerance", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/?color=1e88e5&tolerance=0", nil)
+		req.Header.Set("Accept", "application/json")
+		rr := httptest.NewRecorder()
+		handler.ListImages(rr, req)
+
+		var images []models.Image
+		json.Unmarshal(rr.Body.Bytes(), &images)
+		if len(images) != 1 || images[0].ID != "navy" {
+			t.Errorf("Expected only the exact match, got %+v", images)
+		}
+	})
+
+	t.Run("HTML_SelectsSwatch", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ListImages(rr, httptest.NewRequest("GET", "/?color=%23D81B60", nil))
+
+		body := rr.Body.String()
+		if !strings.Contains(body, "Roses") || strings.Contains(body, "Sky") {
+			t.Errorf("Expected only the pink image")
+		}
+		if !strings.Contains(body, `class="swatch swatch-selected" style="background-color: #d81b60"`) {
+			t.Errorf("Expected the pink swatch to be selected")
+		}
+	})
+
+	for name, query := range map[string]string{"Color": "color=blue", "Tolerance": "color=%23000000&tolerance=-1"} {
+		t.Run("Invalid"+name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/?"+query, nil)
+			req.Header.Set("Accept", "application/json")
+			rr := httptest.NewRecorder()
+			handler.ListImages(rr, req)
+
+			if status := rr.Code; status != http.StatusBadRequest {
+				t.Errorf("Expected status %d, got %d", http.StatusBadRequest, status)
+			}
+		})
+	}
+}
+
+func TestUploadImage(t *testing.T) {
+	t.Run("RecordsDecodedFormat", func(t *testing.T) {
+		mockStorage := NewMockStorageService()
+		mockDB := NewMockDatabaseService()
+		handler := &ImageHandler{storageService: mockStorage, databaseService: mockDB, decoder: imaging.NewDecoder(imaging.DefaultLimits())}
+
+		var content bytes.Buffer
+		png.Encode(&content, image.NewGray(image.Rect(0, 0, 12, 7)))
+
+		// The client claims a text file; the content decides
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "notes.txt", "text/plain", content.Bytes()))
+
+		if status := rr.Code; status != http.StatusSeeOther {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", status, http.StatusSeeOther, rr.Body.String())
+		}
+		if len(mockDB.images) != 1 {
+			t.Fatalf("Expected 1 saved image, got %d", len(mockDB.images))
+		}
+		for _, img := range mockDB.images {
+			if img.ContentType != "image/png" || !strings.HasSuffix(img.S3Key, ".png") {
+				t.Errorf("Expected a PNG stored as .png, got %s at %s", img.ContentType, img.S3Key)
+			}
+			if img.Width != 12 || img.Height != 7 || img.PixelFormat != "Gray8" {
+				t.Errorf("Expected a 12x7 Gray8 image, got %dx%d %s", img.Width, img.Height, img.PixelFormat)
+			}
+			if !bytes.Equal(mockStorage.images[img.S3Key], content.Bytes()) {
+				t.Errorf("Expected the whole upload to be stored")
+			}
+			if len(img.Variants) != 1 || img.Variants[0].Key != models.VariantKey(img.ID, 256, ".jpg", nil) {
+				t.Fatalf("Expected a 256 pixel variant, got %+v", img.Variants)
+			}
+			if _, ok := mockStorage.images[img.Variants[0].Key]; !ok {
+				t.Errorf("Expected the variant to be stored")
+			}
+			if !strings.HasPrefix(img.Placeholder, "data:image/jpeg;base64,") {
+				t.Errorf("Expected a placeholder, got %q", img.Placeholder)
+			}
+			if len(img.Palette) != 1 || img.Palette[0] != (models.Swatch{Color: "#000000", Weight: 1}) {
+				t.Errorf("Expected a black palette, got %+v", img.Palette)
+			}
+		}
+	})
+
+	t.Run("RecordsEmbeddedMetadata", func(t *testing.T) {
+		mockStorage := NewMockStorageService()
+		mockDB := NewMockDatabaseService()
+		handler := &ImageHandler{storageService: mockStorage, databaseService: mockDB, decoder: imaging.NewDecoder(imaging.DefaultLimits())}
+
+		var encoded bytes.Buffer
+		jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 12, 7)), nil)
+		xmp := "http://ns.adobe.com/xap/1.0/\x00" + `<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#"><rdf:Description xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:subject><rdf:Bag><rdf:li>harbour</rdf:li></rdf:Bag></dc:subject></rdf:Description></rdf:RDF></x:xmpmeta>`
+		content := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, byte((len(xmp) + 2) >> 8), byte(len(xmp) + 2)}, xmp...)
+		content = append(content, encoded.Bytes()[2:]...)
+
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "photo.jpg", "image/jpeg", content))
+
+		if status := rr.Code; status != http.StatusSeeOther {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", status, http.StatusSeeOther, rr.Body.String())
+		}
+		for _, img := range mockDB.images {
+			if img.Metadata == nil || len(img.Metadata.Keywords) != 1 || img.Metadata.Keywords[0] != "harbour" {
+				t.Errorf("Expected the XMP keywords to be stored, got %+v", img.Metadata)
+			}
+		}
+	})
+
+	t.Run("StripsGPSMetadata", func(t *testing.T) {
+		mockStorage := NewMockStorageService()
+		mockDB := NewMockDatabaseService()
+		handler := &ImageHandler{storageService: mockStorage, databaseService: mockDB, decoder: imaging.NewDecoder(imaging.DefaultLimits()), metadataPolicy: models.MetadataStripGPS}
+
+		// A little-endian TIFF structure whose IFD0 points to a GPS IFD
+		// holding 51.5 N, 0.125 W
+		le := binary.LittleEndian
+		exif := []byte("Exif\x00\x00II*\x00\x08\x00\x00\x00\x01\x00\x25\x88\x04\x00\x01\x00\x00\x00\x1a\x00\x00\x00\x00\x00\x00\x00")
+		exif = le.AppendUint16(exif, 4)
+		exif = append(exif, "\x01\x00\x02\x00\x02\x00\x00\x00N\x00\x00\x00"...)
+		exif = append(exif, "\x02\x00\x05\x00\x03\x00\x00\x00\x50\x00\x00\x00"...)
+		exif = append(exif, "\x03\x00\x02\x00\x02\x00\x00\x00W\x00\x00\x00"...)
+		exif = append(exif, "\x04\x00\x05\x00\x03\x00\x00\x00\x68\x00\x00\x00"...)
+		exif = append(exif, 0, 0, 0, 0)
+		for _, v := range []uint32{51, 1, 30, 1, 0, 1, 0, 1, 7, 1, 30, 1} {
+			exif = le.AppendUint32(exif, v)
+		}
+
+		var encoded bytes.Buffer
+		jpeg.Encode(&encoded, image.NewGray(image.Rect(0, 0, 12, 7)), nil)
+		content := append([]byte{0xFF, 0xD8, 0xFF, 0xE1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)}, exif...)
+		content = append(content, encoded.Bytes()[2:]...)
+
+		// The upload is checked to really carry a position
+		if embedded, err := metadata.Extract(bytes.NewReader(content), "jpeg"); err != nil || embedded == nil || embedded.GPS == nil {
+			t.Fatalf("Expected the test upload to have a GPS position, got %+v, %v", embedded, err)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "photo.jpg", "image/jpeg", content))
+
+		if status := rr.Code; status != http.StatusSeeOther {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", status, http.StatusSeeOther, rr.Body.String())
+		}
+		for _, img := range mockDB.images {
+			if img.MetadataPolicy != models.MetadataStripGPS {
+				t.Errorf("Expected the policy to be recorded, got %q", img.MetadataPolicy)
+			}
+			if img.Metadata != nil {
+				t.Errorf("Expected no metadata to be kept, got %+v", img.Metadata)
+			}
+			stored := mockStorage.images[img.S3Key]
+			if img.Size != int64(len(stored)) {
+				t.Errorf("Expected the size of the stored file, %d, got %d", len(stored), img.Size)
+			}
+			if embedded, _ := metadata.Extract(bytes.NewReader(stored), "jpeg"); embedded != nil {
+				t.Errorf("Expected the stored file to have no GPS position, got %+v", embedded)
+			}
+		}
+	})
+
+	t.Run("RejectsNonImages", func(t *testing.T) {
+		mockStorage := NewMockStorageService()
+		mockDB := NewMockDatabaseService()
+		handler := &ImageHandler{storageService: mockStorage, databaseService: mockDB, decoder: imaging.NewDecoder(imaging.DefaultLimits())}
+
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "photo.jpg", "image/jpeg", []byte("not really a jpeg")))
+
+		if status := rr.Code; status != http.StatusUnsupportedMediaType {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusUnsupportedMediaType)
+		}
+		if len(mockDB.images) != 0 || len(mockStorage.images) != 0 {
+			t.Errorf("Expected nothing to be stored")
+		}
+	})
+	t.Run("RejectsImagesOverThePixelLimit", func(t *testing.T) {
+		mockStorage := NewMockStorageService()
+		mockDB := NewMockDatabaseService()
+		handler := &ImageHandler{storageService: mockStorage, databaseService: mockDB, decoder: imaging.NewDecoder(imaging.Limits{MaxPixels: 50})}
+
+		var content bytes.Buffer
+		png.Encode(&content, image.NewGray(image.Rect(0, 0, 12, 7)))
+
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "large.png", "image/png", content.Bytes()))
+
+		if status := rr.Code; status != http.StatusUnprocessableEntity {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusUnprocessableEntity)
+		}
+		if !strings.Contains(rr.Body.String(), "image has 84 pixels, the limit is 50") {
+			t.Errorf("Expected the limit to be explained, got %s", rr.Body.String())
+		}
+		if len(mockDB.images) != 0 || len(mockStorage.images) != 0 {
+			t.Errorf("Expected nothing to be stored")
+		}
+	})
+
+	t.Run("RejectsFilesOverTheSizeLimit", func(t *testing.T) {
+		mockStorage := NewMockStorageService()
+		mockDB := NewMockDatabaseService()
+		handler := &ImageHandler{storageService: mockStorage, databaseService: mockDB, decoder: imaging.NewDecoder(imaging.Limits{MaxFileSize: 1 << 10})}
+
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "large.png", "image/png", make([]byte, 4<<10)))
+
+		if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusRequestEntityTooLarge)
+		}
+		if !strings.Contains(rr.Body.String(), "1 KB") {
+			t.Errorf("Expected the limit to be explained, got %s", rr.Body.String())
+		}
+	})
+}
+
+func TestServeTransformedImage(t *testing.T) {
+	mockStorage := NewMockStorageService()
+	mockDB := NewMockDatabaseService()
+	decoder := imaging.NewDecoder(imaging.DefaultLimits())
+	handler := &ImageHandler{
+		storageService:  mockStorage,
+		databaseService: mockDB,
+		decoder:         decoder,
+		renderer:        derived.NewRenderer(mockStorage, decoder, derived.Options{}),
+	}
+
+	var content bytes.Buffer
+	png.Encode(&content, image.NewGray(image.Rect(0, 0, 400, 200)))
+	mockStorage.images["photo.png"] = content.Bytes()
+	mockStorage.images["orphan.png"] = content.Bytes()
+	mockDB.SaveImage(context.Background(), models.Image{ID: "photo", Title: "Photo", S3Key: "photo.png", Width: 400, Height: 200})
+
+	serve := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		rr := httptest.NewRecorder()
+		handler.ServeImage(rr, req)
+		return rr
+	}
+
+	t.Run("Cover", func(t *testing.T) {
+		rr := serve("/images/photo.png?w=100&h=100&fit=cover&q=80")
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+		}
+		if contentType := rr.Header().Get("Content-Type"); contentType != "image/jpeg" {
+			t.Errorf("Expected a JPEG, got %s", contentType)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(rr.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if config.Width != 100 || config.Height != 100 {
+			t.Errorf("Expected a 100x100 image, got %dx%d", config.Width, config.Height)
+		}
+	})
+
+	t.Run("InvalidParameters", func(t *testing.T) {
+		rr := serve("/images/photo.png?w=100&fit=squash")
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("OnlyGalleryImages", func(t *testing.T) {
+		rr := serve("/images/orphan.png?w=100")
+		if status := rr.Code; status != http.StatusNotFound {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusNotFound)
+		}
+	})
+}
+
+func TestImageEdits(t *testing.T) {
+	mockStorage := NewMockStorageService()
+	mockDB := NewMockDatabaseService()
+	decoder := imaging.NewDecoder(imaging.DefaultLimits())
+	handler := &ImageHandler{
+		storageService:  mockStorage,
+		databaseService: mockDB,
+		decoder:         decoder,
+		renderer:        derived.NewRenderer(mockStorage, decoder, derived.Options{}),
+	}
+
+	var content bytes.Buffer
+	png.Encode(&content, image.NewGray(image.Rect(0, 0, 400, 200)))
+	mockStorage.images["photo.png"] = content.Bytes()
+	plainKey := models.VariantKey("photo", 256, ".jpg", nil)
+	mockStorage.images[plainKey] = []byte("thumbnail")
+	mockDB.SaveImage(context.Background(), models.Image{
+		ID: "photo", Title: "Photo", S3Key: "photo.png", Width: 400, Height: 200,
+		Variants: []models.Variant{{Size: 256, Width: 256, Height: 128, Key: plainKey, ContentType: "image/jpeg"}},
+	})
+
+	newEditsRequest := func(method, body string) *http.Request {
+		req := httptest.NewRequest(method, "/image/photo/edits", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		return mux.SetURLVars(req, map[string]string{"id": "photo"})
+	}
+
+	t.Run("UpdateEdits_JSON", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.UpdateEdits(rr, newEditsRequest("POST", `{"rotate":90,"crop":{"x":0,"y":0,"width":200,"height":100}}`))
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+		}
+		stored := mockDB.images["photo"]
+		if stored.Edits == nil || stored.Edits.Rotate != 90 {
+			t.Fatalf("Expected the edits to be stored, got %+v", stored.Edits)
+		}
+		if len(stored.Variants) == 0 || stored.Variants[0].Key == plainKey {
+			t.Fatalf("Expected new variants, got %+v", stored.Variants)
+		}
+		if variant := stored.Variants[0]; variant.Width != 100 || variant.Height != 200 {
+			t.Errorf("Expected a 100x200 variant, got %dx%d", variant.Width, variant.Height)
+		}
+		if _, ok := mockStorage.images[plainKey]; ok {
+			t.Errorf("Expected the old variant to be deleted")
+		}
+		if _, ok := mockStorage.images["photo.png"]; !ok {
+			t.Errorf("Expected the original to be kept")
+		}
+	})
+
+	t.Run("ServeImage_Edited", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/images/photo.png", nil)
+		rr := httptest.NewRecorder()
+		handler.ServeImage(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		config, _, err := image.DecodeConfig(bytes.NewReader(rr.Body.Bytes()))
+		if err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		if config.Width != 100 || config.Height != 200 {
+			t.Errorf("Expected the edited 100x200 image, got %dx%d", config.Width, config.Height)
+		}
+	})
+
+	t.Run("UpdateEdits_Invalid", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.UpdateEdits(rr, newEditsRequest("POST", `{"crop":{"x":300,"y":0,"width":200,"height":100}}`))
+
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("Handler returned wrong status code: got %v want %v", status, http.StatusBadRequest)
+		}
+	})
+
+	t.Run("ResetEdits", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ResetEdits(rr, newEditsRequest("DELETE", ""))
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", status, http.StatusOK, rr.Body.String())
+		}
+		stored := mockDB.images["photo"]
+		if stored.Edits != nil {
+			t.Errorf("Expected the edits to be removed, got %+v", stored.Edits)
+		}
+		if len(stored.Variants) == 0 || stored.Variants[0].Key != plainKey {
+			t.Errorf("Expected the plain variants back, got %+v", stored.Variants)
+		}
+	})
+}
+
+func TestWatermarking(t *testing.T) {
+	mockStorage := NewMockStorageService()
+	mockDB := NewMockDatabaseService()
+	decoder := imaging.NewDecoder(imaging.DefaultLimits())
+	logo := image.NewGray(image.Rect(0, 0, 10, 10))
+	watermark, err := imaging.NewWatermark(imaging.WatermarkOptions{Logo: logo, Position: imaging.PositionCenter, Opacity: 1, Scale: 0.5})
+	if err != nil {
+		t.Fatalf("Failed to create watermark: %v", err)
+	}
+	handler := &ImageHandler{
+		storageService:  mockStorage,
+		databaseService: mockDB,
+		decoder:         decoder,
+		renderer:        derived.NewRenderer(mockStorage, decoder, derived.Options{}),
+		watermark:       watermark,
+	}
+
+	// Both images are white; the watermark is a black square in the centre
+	white := image.NewGray(image.Rect(0, 0, 64, 64))
+	for i := range white.Pix {
+		white.Pix[i] = 255
+	}
+	var content bytes.Buffer
+	png.Encode(&content, white)
+	mockStorage.images["marked.png"] = content.Bytes()
+	mockStorage.images["unmarked.png"] = content.Bytes()
+	mockDB.SaveImage(context.Background(), models.Image{ID: "marked", S3Key: "marked.png", Width: 64, Height: 64})
+	mockDB.SaveImage(context.Background(), models.Image{ID: "unmarked", S3Key: "unmarked.png", Width: 64, Height: 64, NoWatermark: true})
+
+	centre := func(t *testing.T, body []byte) uint32 {
+		t.Helper()
+		decoded, _, err := image.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to decode response: %v", err)
+		}
+		r, _, _, _ := decoded.At(32, 32).RGBA()
+		return r >> 8
+	}
+
+	for _, path := range []string{"/images/marked.png", "/images/marked.png?w=32"} {
+		t.Run("ServeImage_Watermarked"+strings.TrimPrefix(path, "/images/marked.png"), func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			handler.ServeImage(rr, httptest.NewRequest("GET", path, nil))
+
+			if status := rr.Code; status != http.StatusOK {
+				t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+			}
+			decoded, _, err := image.Decode(bytes.NewReader(rr.Body.Bytes()))
+			if err != nil {
+				t.Fatalf("Failed to decode response: %v", err)
+			}
+			bounds := decoded.Bounds()
+			if r, _, _, _ := decoded.At(bounds.Dx()/2, bounds.Dy()/2).RGBA(); r>>8 > 32 {
+				t.Errorf("Expected the watermark in the centre, got %v", decoded.At(bounds.Dx()/2, bounds.Dy()/2))
+			}
+		})
+	}
+
+	t.Run("StoredOriginalUnchanged", func(t *testing.T) {
+		if !bytes.Equal(mockStorage.images["marked.png"], content.Bytes()) {
+			t.Errorf("Expected the stored original to be left unmarked")
+		}
+	})
+
+	t.Run("ServeImage_OptedOut", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		handler.ServeImage(rr, httptest.NewRequest("GET", "/images/unmarked.png", nil))
+
+		if !bytes.Equal(rr.Body.Bytes(), content.Bytes()) {
+			t.Errorf("Expected the image to be served as stored")
+		}
+	})
+
+	t.Run("DownloadOriginal", func(t *testing.T) {
+		req := mux.SetURLVars(httptest.NewRequest("GET", "/admin/images/marked/original", nil), map[string]string{"id": "marked"})
+		rr := httptest.NewRecorder()
+		handler.DownloadOriginal(rr, req)
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		if centre(t, rr.Body.Bytes()) != 255 {
+			t.Errorf("Expected the original without the watermark")
+		}
+		if got := rr.Header().Get("Content-Disposition"); got != `attachment; filename="marked.png"` {
+			t.Errorf("Expected the original as an attachment, got %q", got)
+		}
+		if got := rr.Header().Get("Cache-Control"); got != "private, no-store" {
+			t.Errorf("Expected the original not to be cached, got %q", got)
+		}
+	})
+
+	t.Run("UpdateImage_OptOut", func(t *testing.T) {
+		form := url.Values{"title": {"Marked"}, "noWatermark": {"true"}}
+		req := httptest.NewRequest("POST", "/update/marked", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+		handler.UpdateImage(rr, mux.SetURLVars(req, map[string]string{"id": "marked"}))
+
+		if status := rr.Code; status != http.StatusSeeOther {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusSeeOther)
+		}
+		if !mockDB.images["marked"].NoWatermark {
+			t.Errorf("Expected the image to opt out of the watermark")
+		}
+	})
+}
+
+func TestDuplicateDetection(t *testing.T) {
+	// A gradient with a dark square, and the same shot re-exported smaller
+	// as a JPEG
+	shot := image.NewGray(image.Rect(0, 0, 300, 200))
+	for y := range 200 {
+		for x := range 300 {
+			shot.SetGray(x, y, color.Gray{Y: uint8(x * 255 / 300)})
+			if x > 40 && x < 120 && y > 60 && y < 140 {
+				shot.SetGray(x, y, color.Gray{Y: 20})
+			}
+		}
+	}
+	var original, reexport bytes.Buffer
+	png.Encode(&original, shot)
+	jpeg.Encode(&reexport, imaging.Thumbnail(shot, 150), &jpeg.Options{Quality: 60})
+
+	newHandler := func(policy duplicates.Policy) (*ImageHandler, *MockDatabaseService) {
+		mockDB := NewMockDatabaseService()
+		handler := &ImageHandler{
+			storageService:  NewMockStorageService(),
+			databaseService: mockDB,
+			decoder:         imaging.NewDecoder(imaging.DefaultLimits()),
+			duplicates:      duplicates.Options{Policy: policy, Threshold: duplicates.DefaultThreshold},
+			similar:         similar.NewSearcher(mockDB, time.Minute),
+		}
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "shot.png", "image/png", original.Bytes()))
+		if status := rr.Code; status != http.StatusSeeOther || rr.Header().Get("Location") != "/" {
+			t.Fatalf("Expected the first upload to go to the gallery, got %v %q", status, rr.Header().Get("Location"))
+		}
+		return handler, mockDB
+	}
+
+	t.Run("Warn", func(t *testing.T) {
+		handler, mockDB := newHandler(duplicates.PolicyWarn)
+		var first models.Image
+		for _, img := range mockDB.images {
+			first = img
+		}
+		if len(first.PerceptualHash) != 16 || first.DuplicateOf != nil {
+			t.Fatalf("Expected a hashed upload without duplicates, got %q, %v", first.PerceptualHash, first.DuplicateOf)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "shot.jpg", "image/jpeg", reexport.Bytes()))
+
+		if status := rr.Code; status != http.StatusSeeOther {
+			t.Fatalf("Handler returned wrong status code: got %v want %v: %s", status, http.StatusSeeOther, rr.Body.String())
+		}
+		for id, img := range mockDB.images {
+			if id == first.ID {
+				continue
+			}
+			if len(img.DuplicateOf) != 1 || img.DuplicateOf[0] != first.ID {
+				t.Errorf("Expected the re-export to be recorded as a duplicate of %s, got %v", first.ID, img.DuplicateOf)
+			}
+			if location := rr.Header().Get("Location"); location != "/image/"+id {
+				t.Errorf("Expected a redirect to the new image, got %q", location)
+			}
+		}
+	})
+
+	t.Run("Block", func(t *testing.T) {
+		handler, mockDB := newHandler(duplicates.PolicyBlock)
+
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "shot.jpg", "image/jpeg", reexport.Bytes()))
+
+		if status := rr.Code; status != http.StatusConflict {
+			t.Fatalf("Expected status %d, got %d", http.StatusConflict, status)
+		}
+		if !strings.Contains(rr.Body.String(), "near-duplicate of \\\"Uploaded\\\"") {
+			t.Errorf("Expected the duplicated image to be named, got %s", rr.Body.String())
+		}
+		if len(mockDB.images) != 1 {
+			t.Errorf("Expected the upload to be rejected, got %d images", len(mockDB.images))
+		}
+	})
+
+	t.Run("Off", func(t *testing.T) {
+		handler, mockDB := newHandler(duplicates.PolicyOff)
+
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "shot.jpg", "image/jpeg", reexport.Bytes()))
+
+		if status := rr.Code; status != http.StatusSeeOther || len(mockDB.images) != 2 {
+			t.Fatalf("Expected the upload to be stored, got %v with %d images", status, len(mockDB.images))
+		}
+		for _, img := range mockDB.images {
+			if img.DuplicateOf != nil {
+				t.Errorf("Expected no duplicate check, got %v", img.DuplicateOf)
+			}
+		}
+	})
+
+	t.Run("Report", func(t *testing.T) {
+		handler, mockDB := newHandler(duplicates.PolicyOff)
+		handler.UploadImage(httptest.NewRecorder(), newUploadRequest(t, "shot.jpg", "image/jpeg", reexport.Bytes()))
+		mockDB.SaveImage(context.Background(), models.Image{ID: "unhashed", Title: "Old", S3Key: "old.jpg"})
+
+		rr := httptest.NewRecorder()
+		handler.DuplicateReport(rr, httptest.NewRequest("GET", "/admin/duplicates", nil))
+
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var report duplicates.Report
+		if err := json.Unmarshal(rr.Body.Bytes(), &report); err != nil {
+			t.Fatalf("Failed to parse response JSON: %v", err)
+		}
+		if report.Scanned != 3 || report.Unhashed != 1 || len(report.Clusters) != 1 || len(report.Clusters[0].Images) != 2 {
+			t.Errorf("Expected one cluster of both uploads, got %+v", report)
+		}
+
+		rr = httptest.NewRecorder()
+		handler.DuplicateReport(rr, httptest.NewRequest("GET", "/admin/duplicates?threshold=65", nil))
+		if status := rr.Code; status != http.StatusBadRequest {
+			t.Errorf("Expected status %d, got %d", http.StatusBadRequest, status)
+		}
+	})
+}
+
+func TestSimilarImages(t *testing.T) {
+	mockDB := NewMockDatabaseService()
+	handler := &ImageHandler{
+		storageService:  NewMockStorageService(),
+		databaseService: mockDB,
+		decoder:         imaging.NewDecoder(imaging.DefaultLimits()),
+		similar:         similar.NewSearcher(mockDB, time.Minute),
+	}
+	ctx := context.Background()
+	red := make([]byte, 64)
+	red[48] = 255
+	for _, img := range []models.Image{
+		{ID: "query", Title: "Query", S3Key: "query.jpg", PerceptualHash: duplicates.FormatHash(0), ColorHistogram: red},
+		{ID: "near", Title: "Near", S3Key: "near.jpg", PerceptualHash: duplicates.FormatHash(0b1), ColorHistogram: red},
+		{ID: "further", Title: "Further", S3Key: "further.jpg", PerceptualHash: duplicates.FormatHash(0xff), ColorHistogram: red},
+		{ID: "unrelated", Title: "Unrelated", S3Key: "unrelated.jpg", PerceptualHash: duplicates.FormatHash(^uint64(0))},
+		{ID: "unhashed", Title: "Unhashed", S3Key: "unhashed.jpg"},
+	} {
+		mockDB.SaveImage(ctx, img)
+	}
+
+	request := func(id, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/image/"+id+"/similar"+query, nil)
+		req = mux.SetURLVars(req, map[string]string{"id": id})
+		rr := httptest.NewRecorder()
+		handler.SimilarImages(rr, req)
+		return rr
+	}
+
+	t.Run("ClosestFirst", func(t *testing.T) {
+		rr := request("query", "")
+		if status := rr.Code; status != http.StatusOK {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusOK)
+		}
+		var results []similar.Result
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil {
+			t.Fatalf("Failed to parse response JSON: %v", err)
+		}
+		if len(results) != 2 || results[0].Image.ID != "near" || results[1].Image.ID != "further" {
+			t.Fatalf("Expected near then further, got %+v", results)
+		}
+		if results[0].Image.S3Key != "/images/near.jpg" {
+			t.Errorf("Expected the image URL, got %q", results[0].Image.S3Key)
+		}
+
+		rr = request("query", "?n=1")
+		if err := json.Unmarshal(rr.Body.Bytes(), &results); err != nil || len(results) != 1 {
+			t.Errorf("Expected 1 result, got %s", rr.Body.String())
+		}
+	})
+
+	t.Run("WithoutFeatures", func(t *testing.T) {
+		rr := request("unhashed", "")
+		if status := rr.Code; status != http.StatusOK || strings.TrimSpace(rr.Body.String()) != "[]" {
+			t.Errorf("Expected an empty list, got %v %s", status, rr.Body.String())
+		}
+	})
+
+	t.Run("InvalidCount", func(t *testing.T) {
+		for _, query := range []string{"?n=0", "?n=51", "?n=many"} {
+			if status := request("query", query).Code; status != http.StatusBadRequest {
+				t.Errorf("Expected status %d for %s, got %d", http.StatusBadRequest, query, status)
+			}
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		if status := request("missing", "").Code; status != http.StatusNotFound {
+			t.Errorf("Expected status %d, got %d", http.StatusNotFound, status)
+		}
+	})
+
+	t.Run("ViewPage", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/image/query", nil)
+		req = mux.SetURLVars(req, map[string]string{"id": "query"})
+		rr := httptest.NewRecorder()
+		handler.GetImage(rr, req)
+
+		body := rr.Body.String()
+		if !strings.Contains(body, "Similar images") || !strings.Contains(body, `href="/image/near"`) {
+			t.Errorf("Expected a strip of similar images, got %s", body)
+		}
+		if strings.Contains(body, `href="/image/unrelated"`) {
+			t.Errorf("Expected an unrelated image to be left out")
+		}
+	})
+
+	t.Run("UploadRecordsFeatures", func(t *testing.T) {
+		var content bytes.Buffer
+		png.Encode(&content, image.NewGray(image.Rect(0, 0, 40, 30)))
+		rr := httptest.NewRecorder()
+		handler.UploadImage(rr, newUploadRequest(t, "grey.png", "image/png", content.Bytes()))
+		if status := rr.Code; status != http.StatusSeeOther {
+			t.Fatalf("Handler returned wrong status code: got %v want %v", status, http.StatusSeeOther)
+		}
+		for _, img := range mockDB.images {
+			if img.Title == "Uploaded" && (len(img.PerceptualHash) != 16 || len(img.ColorHistogram) != 64) {
+				t.Errorf("Expected the upload to record its features, got %q, %v", img.PerceptualHash, img.ColorHistogram)
+			}
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"image_gallery/internal/imaging"
+	"image_gallery/internal/metadata"
+	"image_gallery/internal/services"
+)
+
+// problem is an RFC 9457 problem details body
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+}
+
+// isAPIRequest reports whether the client expects JSON rather than HTML
+func isAPIRequest(r *http.Request) bool {
+	if r.Header.Get("Content-Type") == "application/json" {
+		return true
+	}
+	accept := r.Header.Get("Accept")
+	return strings.Contains(accept, "application/json") || strings.Contains(accept, "application/problem+json")
+}
+
+// statusForError maps service errors to HTTP status codes
+func statusForError(err error) int {
+	switch {
+	case errors.Is(err, services.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, services.ErrConflict):
+		return http.StatusConflict
+	case errors.Is(err, services.ErrInvalidKey):
+		return http.StatusBadRequest
+	case errors.Is(err, services.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, imaging.ErrUnsupportedFormat):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, imaging.ErrCorruptImage), errors.Is(err, imaging.ErrLimitExceeded), errors.Is(err, metadata.ErrMalformed):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, imaging.ErrInvalidEdits):
+		return http.StatusBadRequest
+	case errors.Is(err, imaging.ErrFileTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, services.ErrUnavailable):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// serviceErrorDetails are what clients are told about service errors, most
+// specific first. The errors themselves can carry backend messages with
+// request IDs and resource names, so they are only logged
+var serviceErrorDetails = []struct {
+	err    error
+	detail string
+}{
+	{services.ErrNotFound, "Not found"},
+	{services.ErrVersionConflict, "The image was changed by another request"},
+	{services.ErrConflict, "The request conflicts with the stored image"},
+	{services.ErrInvalidKey, "Invalid image ID or storage key"},
+	{services.ErrTooLarge, "Content too large"},
+}
+
+// clientDetail returns the text a client is shown for a client error. Service
+// errors get fixed text; upload and edit validation errors are made by this
+// program and describe what is wrong with the request. It reports false when
+// the text is not err's own
+func clientDetail(err error) (string, bool) {
+	for _, known := range serviceErrorDetails {
+		if errors.Is(err, known.err) {
+			return known.detail, false
+		}
+	}
+	return err.Error(), true
+}
+
+// writeError responds with the status matching err. Validation errors
+// describe err itself; service and server errors show fixed text and are
+// logged, so internals are not leaked
+func writeError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	status := statusForError(err)
+	detail := message
+	if status < http.StatusInternalServerError {
+		var own bool
+		if detail, own = clientDetail(err); !own {
+			log.Printf("%s: %v", message, err)
+		}
+	} else {
+		log.Printf("%s: %v", message, err)
+	}
+
+	writeProblem(w, r, status, detail)
+}
+
+// writeGone responds to requests for an image that has expired but has not
+// been purged yet
+func writeGone(w http.ResponseWriter, r *http.Request) {
+	writeProblem(w, r, http.StatusGone, "Image has expired")
+}
+
+// writeProblem responds with application/problem+json for API requests and
+// plain text for web page requests
+func writeProblem(w http.ResponseWriter, r *http.Request, status int, detail string) {
+	if !isAPIRequest(r) {
+		http.Error(w, detail, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   detail,
+		Instance: r.URL.Path,
+	})
+}
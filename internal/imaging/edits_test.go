@@ -0,0 +1,82 @@
+package imaging
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// markedImage returns a 3x2 image whose top left pixel is red and the rest
+// white, so where the red pixel ends up shows the orientation
+func markedImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 3, 2))
+	for y := 0; y < 2; y++ {
+		for x := 0; x < 3; x++ {
+			img.Set(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+		}
+	}
+	img.Set(0, 0, color.NRGBA{R: 255, A: 255})
+	return img
+}
+
+func TestEditsApply(t *testing.T) {
+	red := color.NRGBA{R: 255, A: 255}
+
+	tests := []struct {
+		name          string
+		edits         Edits
+		width, height int
+		redX, redY    int
+	}{
+		{"Rotate90", Edits{Rotate: 90}, 2, 3, 1, 0},
+		{"Rotate180", Edits{Rotate: 180}, 3, 2, 2, 1},
+		{"Rotate270", Edits{Rotate: 270}, 2, 3, 0, 2},
+		{"FlipHorizontal", Edits{FlipHorizontal: true}, 3, 2, 2, 0},
+		{"FlipVertical", Edits{FlipVertical: true}, 3, 2, 0, 1},
+		{"RotateThenFlip", Edits{Rotate: 90, FlipHorizontal: true}, 2, 3, 0, 0},
+		{"Crop", Edits{Crop: image.Rect(0, 0, 2, 1)}, 2, 1, 0, 0},
+		{"CropThenRotate", Edits{Crop: image.Rect(0, 0, 2, 1), Rotate: 90}, 1, 2, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			edited, err := tt.edits.Apply(markedImage())
+			if err != nil {
+				t.Fatalf("Failed to apply: %v", err)
+			}
+			bounds := edited.Bounds()
+			if bounds.Dx() != tt.width || bounds.Dy() != tt.height {
+				t.Fatalf("Expected %dx%d, got %dx%d", tt.width, tt.height, bounds.Dx(), bounds.Dy())
+			}
+			if got := color.NRGBAModel.Convert(edited.At(tt.redX, tt.redY)); got != red {
+				t.Errorf("Expected the red pixel at %d,%d, got %v there", tt.redX, tt.redY, got)
+			}
+		})
+	}
+
+	t.Run("NoEdits", func(t *testing.T) {
+		img := markedImage()
+		edited, err := Edits{}.Apply(img)
+		if err != nil {
+			t.Fatalf("Failed to apply: %v", err)
+		}
+		if edited != image.Image(img) {
+			t.Errorf("Expected the image to be returned unchanged")
+		}
+	})
+
+	invalid := []struct {
+		name  string
+		edits Edits
+	}{
+		{"CropOutside", Edits{Crop: image.Rect(1, 0, 4, 2)}},
+		{"OddRotation", Edits{Rotate: 45}},
+	}
+	for _, tt := range invalid {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.edits.Apply(markedImage()); !errors.Is(err, ErrInvalidEdits) {
+				t.Errorf("Expected ErrInvalidEdits, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"io"
+	"slices"
+)
+
+// histogramLevels is the number of levels each RGB channel is divided into
+// for colour histograms, which have this many cubed bins
+const histogramLevels = 4
+
+// Features are the compact visual features images are compared by
+type Features struct {
+	// PerceptualHash describes the image's structure in 64 bits
+	PerceptualHash uint64
+	// Histogram is the share of the image's opaque pixels in each of the 64
+	// bins of a 4x4x4 division of RGB, scaled to 255, with red most
+	// significant. It is nil when no pixel is opaque
+	Histogram []byte
+}
+
+// FeaturesOf finds the features of the smallest of variants. It returns
+// false for no variants
+func FeaturesOf(variants []Variant) (Features, bool, error) {
+	if len(variants) == 0 {
+		return Features{}, false, nil
+	}
+	smallest := slices.MinFunc(variants, func(a, b Variant) int {
+		return max(a.Width, a.Height) - max(b.Width, b.Height)
+	})
+	img, _, err := image.Decode(bytes.NewReader(smallest.Data))
+	if err != nil {
+		return Features{}, false, err
+	}
+	return features(img), true, nil
+}
+
+// Features decodes r within the limits and finds its features, for images
+// stored before features were recorded
+func (d *Decoder) Features(ctx context.Context, r io.ReadSeeker) (Features, error) {
+	var result Features
+	_, err := d.decode(ctx, r, func(img image.Image) error {
+		result = features(img)
+		return nil
+	})
+	return result, err
+}
+
+// features finds the perceptual hash and colour histogram of img
+func features(img image.Image) Features {
+	return Features{PerceptualHash: perceptualHash(img), Histogram: colorHistogram(img)}
+}
+
+// colorHistogram counts the opaque pixels of a small copy of img by colour
+func colorHistogram(img image.Image) []byte {
+	sample := Thumbnail(img, paletteSampleSize).(*image.NRGBA)
+	var counts [histogramLevels * histogramLevels * histogramLevels]int
+	bin := func(v uint8) int { return int(v) * histogramLevels / 256 }
+	total := 0
+	for i := 0; i < len(sample.Pix); i += 4 {
+		if sample.Pix[i+3] < 128 {
+			continue
+		}
+		counts[(bin(sample.Pix[i])*histogramLevels+bin(sample.Pix[i+1]))*histogramLevels+bin(sample.Pix[i+2])]++
+		total++
+	}
+	if total == 0 {
+		return nil
+	}
+
+	histogram := make([]byte, len(counts))
+	for i, count := range counts {
+		histogram[i] = byte((255*count + total/2) / total)
+	}
+	return histogram
+}
@@ -0,0 +1,124 @@
+package imaging
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// countFrames counts the frames of an animated image by walking its block
+// structure, without decoding any pixels. Formats without animation have
+// one frame
+func countFrames(r io.Reader, format string) (int, error) {
+	switch format {
+	case "gif":
+		return countGIFFrames(bufio.NewReader(r))
+	case "webp":
+		return countWebPFrames(bufio.NewReader(r))
+	}
+	return 1, nil
+}
+
+// countGIFFrames counts the image descriptors of a GIF
+func countGIFFrames(r *bufio.Reader) (int, error) {
+	// Header and logical screen descriptor
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+	if err := skipColorTable(r, header[10]); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	for {
+		introducer, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+
+		switch introducer {
+		case 0x21: // Extension: label, then data sub-blocks
+			if _, err := r.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, err
+			}
+		case 0x2C: // Image descriptor, local color table, LZW code size, data
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(r, descriptor); err != nil {
+				return 0, err
+			}
+			if err := skipColorTable(r, descriptor[8]); err != nil {
+				return 0, err
+			}
+			if _, err := r.ReadByte(); err != nil {
+				return 0, err
+			}
+			if err := skipSubBlocks(r); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3B: // Trailer
+			return frames, nil
+		default:
+			return 0, errors.New("gif: unknown block type")
+		}
+	}
+}
+
+// skipColorTable skips the color table announced by a GIF packed field
+func skipColorTable(r *bufio.Reader, packed byte) error {
+	if packed&0x80 == 0 {
+		return nil
+	}
+	_, err := r.Discard(3 << ((packed & 0x07) + 1))
+	return err
+}
+
+// skipSubBlocks skips GIF data sub-blocks up to the terminating empty block
+func skipSubBlocks(r *bufio.Reader) error {
+	for {
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if size == 0 {
+			return nil
+		}
+		if _, err := r.Discard(int(size)); err != nil {
+			return err
+		}
+	}
+}
+
+// countWebPFrames counts the animation frame chunks of a WebP file
+func countWebPFrames(r *bufio.Reader) (int, error) {
+	header := make([]byte, 12)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, err
+	}
+
+	frames := 0
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunk); err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, err
+		}
+		if string(chunk[:4]) == "ANMF" {
+			frames++
+		}
+
+		// Chunk payloads are padded to an even length
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if _, err := io.CopyN(io.Discard, r, size+size%2); err != nil && err != io.EOF {
+			return 0, err
+		}
+	}
+
+	return max(frames, 1), nil
+}
@@ -0,0 +1,119 @@
+// Package imaging decodes uploaded images to find out what they really are,
+// rather than trusting the file name or the client's Content-Type
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+
+	// Decoders for the accepted formats
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+
+	_ "golang.org/x/image/bmp"
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+var (
+	// ErrUnsupportedFormat means the content is not in an accepted image format
+	ErrUnsupportedFormat = errors.New("unsupported image format")
+
+	// ErrCorruptImage means the content claims an accepted format but cannot
+	// be decoded
+	ErrCorruptImage = errors.New("image could not be decoded")
+)
+
+// formats maps the accepted decoder names to their MIME type and file
+// extension
+var formats = map[string]struct {
+	mimeType  string
+	extension string
+}{
+	"jpeg": {"image/jpeg", ".jpg"},
+	"png":  {"image/png", ".png"},
+	"gif":  {"image/gif", ".gif"},
+	"webp": {"image/webp", ".webp"},
+	"bmp":  {"image/bmp", ".bmp"},
+	"tiff": {"image/tiff", ".tiff"},
+}
+
+// Info describes a decoded image
+type Info struct {
+	// Format is the decoder name, such as "jpeg"
+	Format      string
+	MIMEType    string
+	Extension   string
+	Width       int
+	Height      int
+	PixelFormat string
+}
+
+// describe builds the Info of a decoded image
+func describe(img image.Image, format string) (Info, error) {
+	known, ok := formats[format]
+	if !ok {
+		return Info{}, ErrUnsupportedFormat
+	}
+
+	bounds := img.Bounds()
+	return Info{
+		Format:      format,
+		MIMEType:    known.mimeType,
+		Extension:   known.extension,
+		Width:       bounds.Dx(),
+		Height:      bounds.Dy(),
+		PixelFormat: PixelFormat(img),
+	}, nil
+}
+
+// PixelFormat names the in-memory pixel layout of a decoded image
+func PixelFormat(img image.Image) string {
+	switch img := img.(type) {
+	case *image.YCbCr:
+		return "YCbCr " + subsampleRatio(img.SubsampleRatio)
+	case *image.NYCbCrA:
+		return "YCbCrA " + subsampleRatio(img.SubsampleRatio)
+	case *image.Gray:
+		return "Gray8"
+	case *image.Gray16:
+		return "Gray16"
+	case *image.RGBA:
+		return "RGBA8"
+	case *image.RGBA64:
+		return "RGBA16"
+	case *image.NRGBA:
+		return "NRGBA8"
+	case *image.NRGBA64:
+		return "NRGBA16"
+	case *image.CMYK:
+		return "CMYK"
+	case *image.Paletted:
+		return fmt.Sprintf("Paletted (%d colors)", len(img.Palette))
+	case *image.Alpha:
+		return "Alpha8"
+	case *image.Alpha16:
+		return "Alpha16"
+	}
+	return fmt.Sprintf("%T", img)
+}
+
+func subsampleRatio(ratio image.YCbCrSubsampleRatio) string {
+	switch ratio {
+	case image.YCbCrSubsampleRatio444:
+		return "4:4:4"
+	case image.YCbCrSubsampleRatio422:
+		return "4:2:2"
+	case image.YCbCrSubsampleRatio420:
+		return "4:2:0"
+	case image.YCbCrSubsampleRatio440:
+		return "4:4:0"
+	case image.YCbCrSubsampleRatio411:
+		return "4:1:1"
+	case image.YCbCrSubsampleRatio410:
+		return "4:1:0"
+	}
+	return ratio.String()
+}
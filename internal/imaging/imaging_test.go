@@ -0,0 +1,134 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+func encodeTestImage(t *testing.T, format string, width, height int) []byte {
+	t.Helper()
+
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 128, A: 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	var err error
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(&buf, img, nil)
+	case "png":
+		err = png.Encode(&buf, img)
+	case "gif":
+		err = gif.Encode(&buf, img, &gif.Options{NumColors: 256})
+	case "bmp":
+		err = bmp.Encode(&buf, img)
+	case "tiff":
+		err = tiff.Encode(&buf, img, nil)
+	default:
+		t.Fatalf("Unknown test format %s", format)
+	}
+	if err != nil {
+		t.Fatalf("Failed to encode %s: %v", format, err)
+	}
+	return buf.Bytes()
+}
+
+func TestInspect(t *testing.T) {
+	ctx := context.Background()
+	decoder := NewDecoder(DefaultLimits())
+
+	tests := []struct {
+		format      string
+		mimeType    string
+		pixelFormat string
+	}{
+		{"jpeg", "image/jpeg", "YCbCr 4:2:0"},
+		{"png", "image/png", "RGBA8"},
+		{"gif", "image/gif", "Paletted (256 colors)"},
+		{"bmp", "image/bmp", "RGBA8"},
+		{"tiff", "image/tiff", "NRGBA8"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			info, err := decoder.Inspect(ctx, bytes.NewReader(encodeTestImage(t, tt.format, 40, 30)))
+			if err != nil {
+				t.Fatalf("Failed to inspect image: %v", err)
+			}
+			if info.Format != tt.format || info.MIMEType != tt.mimeType {
+				t.Errorf("Expected %s (%s), got %s (%s)", tt.format, tt.mimeType, info.Format, info.MIMEType)
+			}
+			if info.Width != 40 || info.Height != 30 {
+				t.Errorf("Expected 40x30, got %dx%d", info.Width, info.Height)
+			}
+			if info.PixelFormat != tt.pixelFormat {
+				t.Errorf("Expected pixel format %q, got %q", tt.pixelFormat, info.PixelFormat)
+			}
+		})
+	}
+
+	t.Run("webp", func(t *testing.T) {
+		data, err := os.ReadFile("testdata/1x1.webp")
+		if err != nil {
+			t.Fatalf("Failed to read fixture: %v", err)
+		}
+		info, err := decoder.Inspect(ctx, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("Failed to inspect image: %v", err)
+		}
+		if info.MIMEType != "image/webp" || info.Extension != ".webp" || info.Width != 1 || info.Height != 1 {
+			t.Errorf("Unexpected info %+v", info)
+		}
+	})
+
+	t.Run("NotAnImage", func(t *testing.T) {
+		_, err := decoder.Inspect(ctx, bytes.NewReader([]byte("<html>definitely not a picture</html>")))
+		if !errors.Is(err, ErrUnsupportedFormat) {
+			t.Errorf("Expected ErrUnsupportedFormat, got %v", err)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		data := encodeTestImage(t, "png", 40, 30)
+		_, err := decoder.Inspect(ctx, bytes.NewReader(data[:len(data)/2]))
+		if !errors.Is(err, ErrCorruptImage) {
+			t.Errorf("Expected ErrCorruptImage, got %v", err)
+		}
+	})
+}
+
+func TestPixelFormat(t *testing.T) {
+	rect := image.Rect(0, 0, 1, 1)
+	tests := []struct {
+		img  image.Image
+		want string
+	}{
+		{image.NewGray(rect), "Gray8"},
+		{image.NewGray16(rect), "Gray16"},
+		{image.NewRGBA64(rect), "RGBA16"},
+		{image.NewCMYK(rect), "CMYK"},
+		{image.NewYCbCr(rect, image.YCbCrSubsampleRatio444), "YCbCr 4:4:4"},
+		{image.NewPaletted(rect, palette.Plan9), "Paletted (256 colors)"},
+	}
+	for _, tt := range tests {
+		if got := PixelFormat(tt.img); got != tt.want {
+			t.Errorf("Expected %q for %T, got %q", tt.want, tt.img, got)
+		}
+	}
+}
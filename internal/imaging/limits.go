@@ -0,0 +1,207 @@
+package imaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"image_gallery/internal/metadata"
+)
+
+var (
+	// ErrFileTooLarge means the upload is bigger than Limits.MaxFileSize
+	ErrFileTooLarge = errors.New("file too large")
+
+	// ErrLimitExceeded means the image header declares more pixels, a larger
+	// dimension or more frames than the limits allow
+	ErrLimitExceeded = errors.New("image exceeds limits")
+)
+
+// LimitError explains which limit an image exceeds
+type LimitError struct {
+	Reason string
+}
+
+func (e *LimitError) Error() string {
+	return e.Reason
+}
+
+func (e *LimitError) Unwrap() error {
+	return ErrLimitExceeded
+}
+
+// Limits bounds the resources spent on an upload
+type Limits struct {
+	// MaxFileSize is the largest upload in bytes, including the form fields
+	MaxFileSize int64
+	// MaxWidth and MaxHeight bound each dimension in pixels
+	MaxWidth  int
+	MaxHeight int
+	// MaxPixels bounds width × height, which decides the memory a decode takes
+	MaxPixels int64
+	// MaxFrames bounds the frames of an animated GIF or WebP
+	MaxFrames int
+	// MaxConcurrentDecodes is the size of the decode pool
+	MaxConcurrentDecodes int
+}
+
+// DefaultLimits are the limits used unless configured otherwise. 50
+// megapixels decode to at most 400 MB at 16 bits per channel
+func DefaultLimits() Limits {
+	return Limits{
+		MaxFileSize:          10 << 20,
+		MaxWidth:             16384,
+		MaxHeight:            16384,
+		MaxPixels:            50_000_000,
+		MaxFrames:            500,
+		MaxConcurrentDecodes: 4,
+	}
+}
+
+// Decoder decodes uploads within limits. Headers are checked before
+// anything is decoded, and full decodes wait for a slot in a pool of
+// Limits.MaxConcurrentDecodes
+type Decoder struct {
+	limits Limits
+	slots  chan struct{}
+}
+
+// NewDecoder creates a decoder. Zero limits take the default
+func NewDecoder(limits Limits) *Decoder {
+	defaults := DefaultLimits()
+	if limits.MaxFileSize <= 0 {
+		limits.MaxFileSize = defaults.MaxFileSize
+	}
+	if limits.MaxWidth <= 0 {
+		limits.MaxWidth = defaults.MaxWidth
+	}
+	if limits.MaxHeight <= 0 {
+		limits.MaxHeight = defaults.MaxHeight
+	}
+	if limits.MaxPixels <= 0 {
+		limits.MaxPixels = defaults.MaxPixels
+	}
+	if limits.MaxFrames <= 0 {
+		limits.MaxFrames = defaults.MaxFrames
+	}
+	if limits.MaxConcurrentDecodes <= 0 {
+		limits.MaxConcurrentDecodes = defaults.MaxConcurrentDecodes
+	}
+	return &Decoder{limits: limits, slots: make(chan struct{}, limits.MaxConcurrentDecodes)}
+}
+
+// Limits returns the decoder's limits
+func (d *Decoder) Limits() Limits {
+	return d.limits
+}
+
+// Inspect checks the image in r against the limits, then decodes it and
+// describes it. r is left at an unspecified position
+func (d *Decoder) Inspect(ctx context.Context, r io.ReadSeeker) (Info, error) {
+	return d.decode(ctx, r, nil)
+}
+
+// decode checks and decodes the image in r, then calls process, if not nil,
+// with the decoded image before giving up the decode slot
+func (d *Decoder) decode(ctx context.Context, r io.ReadSeeker, process func(image.Image) error) (Info, error) {
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return Info{}, err
+	}
+	if size > d.limits.MaxFileSize {
+		return Info{}, fmt.Errorf("%w: %d bytes, the limit is %d", ErrFileTooLarge, size, d.limits.MaxFileSize)
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Info{}, err
+	}
+	config, format, err := image.DecodeConfig(r)
+	if errors.Is(err, image.ErrFormat) {
+		return Info{}, ErrUnsupportedFormat
+	}
+	if err != nil {
+		return Info{}, fmt.Errorf("%w: %v", ErrCorruptImage, err)
+	}
+
+	// Cameras often store pixels sideways and record how to turn them in
+	// EXIF. Images are handled upright, as they are displayed
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Info{}, err
+	}
+	orientation := metadata.Orientation(r, format)
+	if transposed(orientation) {
+		config.Width, config.Height = config.Height, config.Width
+	}
+	if err := d.checkConfig(config); err != nil {
+		return Info{}, err
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Info{}, err
+	}
+	frames, err := countFrames(r, format)
+	if err != nil {
+		return Info{}, fmt.Errorf("%w: %v", ErrCorruptImage, err)
+	}
+	if frames > d.limits.MaxFrames {
+		return Info{}, &LimitError{Reason: fmt.Sprintf("image has %d frames, the limit is %d", frames, d.limits.MaxFrames)}
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Info{}, err
+	}
+	release, err := d.acquire(ctx)
+	if err != nil {
+		return Info{}, err
+	}
+	defer release()
+
+	img, format, err := image.Decode(r)
+	if err != nil {
+		return Info{}, fmt.Errorf("%w: %v", ErrCorruptImage, err)
+	}
+	// The header was checked, but the decoded image is what uses memory
+	info, err := describe(img, format)
+	if err != nil {
+		return info, err
+	}
+	if transposed(orientation) {
+		info.Width, info.Height = info.Height, info.Width
+	}
+	if err := d.checkConfig(image.Config{Width: info.Width, Height: info.Height}); err != nil {
+		return Info{}, err
+	}
+	if process == nil {
+		return info, nil
+	}
+	return info, process(orient(img, orientation))
+}
+
+// checkConfig compares declared dimensions with the limits
+func (d *Decoder) checkConfig(config image.Config) error {
+	if config.Width <= 0 || config.Height <= 0 {
+		return fmt.Errorf("%w: image declares no pixels", ErrCorruptImage)
+	}
+	if config.Width > d.limits.MaxWidth {
+		return &LimitError{Reason: fmt.Sprintf("image is %d pixels wide, the limit is %d", config.Width, d.limits.MaxWidth)}
+	}
+	if config.Height > d.limits.MaxHeight {
+		return &LimitError{Reason: fmt.Sprintf("image is %d pixels high, the limit is %d", config.Height, d.limits.MaxHeight)}
+	}
+	if pixels := int64(config.Width) * int64(config.Height); pixels > d.limits.MaxPixels {
+		return &LimitError{Reason: fmt.Sprintf("image has %d pixels, the limit is %d", pixels, d.limits.MaxPixels)}
+	}
+	return nil
+}
+
+// acquire waits for a slot in the decode pool
+func (d *Decoder) acquire(ctx context.Context) (func(), error) {
+	select {
+	case d.slots <- struct{}{}:
+		return func() { <-d.slots }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
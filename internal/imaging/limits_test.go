@@ -0,0 +1,130 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"testing"
+)
+
+// pngDeclaring returns a small PNG whose header claims the given size, like
+// a decompression bomb
+func pngDeclaring(t *testing.T, width, height uint32) []byte {
+	t.Helper()
+
+	data := encodeTestImage(t, "png", 2, 2)
+	// The IHDR chunk follows the 8 byte signature: length, type, data, CRC
+	ihdr := data[8+8 : 8+8+13]
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	binary.BigEndian.PutUint32(data[8+8+13:], crc32.ChecksumIEEE(data[8+4:8+8+13]))
+	return data
+}
+
+func animatedGIF(t *testing.T, frames int) []byte {
+	t.Helper()
+
+	animation := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		animation.Image = append(animation.Image, image.NewPaletted(image.Rect(0, 0, 4, 4), palette.Plan9))
+		animation.Delay = append(animation.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, animation); err != nil {
+		t.Fatalf("Failed to encode GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecoderLimits(t *testing.T) {
+	ctx := context.Background()
+	decoder := NewDecoder(Limits{MaxFileSize: 64 << 10, MaxWidth: 1000, MaxHeight: 500, MaxPixels: 400_000, MaxFrames: 3})
+
+	tests := []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"Bomb", pngDeclaring(t, 50000, 50000), ErrLimitExceeded},
+		{"TooWide", pngDeclaring(t, 1001, 10), ErrLimitExceeded},
+		{"TooHigh", pngDeclaring(t, 10, 501), ErrLimitExceeded},
+		{"TooManyPixels", pngDeclaring(t, 1000, 401), ErrLimitExceeded},
+		{"TooManyFrames", animatedGIF(t, 4), ErrLimitExceeded},
+		{"FileTooLarge", make([]byte, 64<<10+1), ErrFileTooLarge},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decoder.Inspect(ctx, bytes.NewReader(tt.data))
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("Expected %v, got %v", tt.want, err)
+			}
+			var limitErr *LimitError
+			if errors.As(err, &limitErr) && limitErr.Reason == "" {
+				t.Errorf("Expected a reason for the exceeded limit")
+			}
+		})
+	}
+
+	t.Run("WithinLimits", func(t *testing.T) {
+		if _, err := decoder.Inspect(ctx, bytes.NewReader(animatedGIF(t, 3))); err != nil {
+			t.Errorf("Expected a 3 frame GIF to be accepted, got %v", err)
+		}
+	})
+}
+
+func TestCountFrames(t *testing.T) {
+	for _, frames := range []int{1, 2, 7} {
+		got, err := countFrames(bytes.NewReader(animatedGIF(t, frames)), "gif")
+		if err != nil {
+			t.Fatalf("Failed to count frames: %v", err)
+		}
+		if got != frames {
+			t.Errorf("Expected %d frames, got %d", frames, got)
+		}
+	}
+
+	// RIFF header, then an animation header and two frame chunks
+	var webp bytes.Buffer
+	webp.WriteString("RIFF\x00\x00\x00\x00WEBP")
+	for _, chunk := range []struct {
+		fourCC string
+		size   int
+	}{{"ANIM", 6}, {"ANMF", 3}, {"ANMF", 4}} {
+		webp.WriteString(chunk.fourCC)
+		binary.Write(&webp, binary.LittleEndian, uint32(chunk.size))
+		webp.Write(make([]byte, chunk.size+chunk.size%2))
+	}
+	got, err := countFrames(&webp, "webp")
+	if err != nil {
+		t.Fatalf("Failed to count frames: %v", err)
+	}
+	if got != 2 {
+		t.Errorf("Expected 2 WebP frames, got %d", got)
+	}
+}
+
+func TestDecoderPool(t *testing.T) {
+	decoder := NewDecoder(Limits{MaxConcurrentDecodes: 1})
+
+	release, err := decoder.acquire(context.Background())
+	if err != nil {
+		t.Fatalf("Failed to acquire a slot: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = decoder.Inspect(ctx, bytes.NewReader(encodeTestImage(t, "png", 4, 4)))
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the decode to wait for the busy pool, got %v", err)
+	}
+
+	release()
+	if _, err := decoder.Inspect(context.Background(), bytes.NewReader(encodeTestImage(t, "png", 4, 4))); err != nil {
+		t.Errorf("Expected the decode to run once a slot is free, got %v", err)
+	}
+}
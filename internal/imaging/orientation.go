@@ -0,0 +1,31 @@
+package imaging
+
+import "image"
+
+// orientations are the edits that turn an image stored in each EXIF
+// orientation upright. Orientation 1 is already upright
+var orientations = map[int]Edits{
+	2: {FlipHorizontal: true},
+	3: {Rotate: 180},
+	4: {FlipVertical: true},
+	5: {Rotate: 90, FlipHorizontal: true},
+	6: {Rotate: 90},
+	7: {Rotate: 270, FlipHorizontal: true},
+	8: {Rotate: 270},
+}
+
+// transposed reports whether an orientation swaps the width and height
+func transposed(orientation int) bool {
+	return orientation >= 5 && orientation <= 8
+}
+
+// orient turns img, stored in the given EXIF orientation, upright
+func orient(img image.Image, orientation int) image.Image {
+	edits, ok := orientations[orientation]
+	if !ok {
+		return img
+	}
+	// The edits have no crop, so they cannot fail
+	upright, _ := edits.Apply(img)
+	return upright
+}
@@ -0,0 +1,98 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+)
+
+// withOrientation returns a JPEG of img with an EXIF orientation tag
+func withOrientation(t *testing.T, img image.Image, orientation int) []byte {
+	t.Helper()
+	var encoded bytes.Buffer
+	if err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+
+	// A little-endian TIFF structure with one IFD holding the orientation
+	exif := []byte("Exif\x00\x00II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00")
+	exif = binary.LittleEndian.AppendUint16(exif, uint16(orientation))
+	exif = append(exif, 0, 0, 0, 0, 0, 0)
+
+	content := []byte{0xFF, 0xD8, 0xFF, 0xE1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)}
+	content = append(content, exif...)
+	return append(content, encoded.Bytes()[2:]...)
+}
+
+func TestOrientation(t *testing.T) {
+	ctx := context.Background()
+	decoder := NewDecoder(DefaultLimits())
+	red := color.NRGBA{R: 255, A: 255}
+
+	// The upright image is 32x16, white with a red block in its top left
+	upright := image.NewNRGBA(image.Rect(0, 0, 32, 16))
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 32; x++ {
+			upright.Set(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: 255})
+			if x < 8 && y < 8 {
+				upright.Set(x, y, red)
+			}
+		}
+	}
+
+	// stored undoes each orientation, giving the pixels a camera would store
+	stored := map[int]Edits{
+		1: {},
+		2: {FlipHorizontal: true},
+		3: {Rotate: 180},
+		4: {FlipVertical: true},
+		5: {Rotate: 90, FlipHorizontal: true},
+		6: {Rotate: 270},
+		7: {Rotate: 270, FlipHorizontal: true},
+		8: {Rotate: 90},
+	}
+
+	for orientation := 1; orientation <= 8; orientation++ {
+		t.Run(fmt.Sprintf("Orientation%d", orientation), func(t *testing.T) {
+			sideways, err := stored[orientation].Apply(upright)
+			if err != nil {
+				t.Fatalf("Failed to prepare image: %v", err)
+			}
+			content := withOrientation(t, sideways, orientation)
+
+			info, err := decoder.Inspect(ctx, bytes.NewReader(content))
+			if err != nil {
+				t.Fatalf("Failed to inspect: %v", err)
+			}
+			if info.Width != 32 || info.Height != 16 {
+				t.Errorf("Expected upright dimensions 32x16, got %dx%d", info.Width, info.Height)
+			}
+
+			result, err := decoder.Transform(ctx, bytes.NewReader(content), Edits{}, Transform{Quality: 100})
+			if err != nil {
+				t.Fatalf("Failed to transform: %v", err)
+			}
+			decoded, err := jpeg.Decode(bytes.NewReader(result.Data))
+			if err != nil {
+				t.Fatalf("Failed to decode result: %v", err)
+			}
+			if bounds := decoded.Bounds(); bounds.Dx() != 32 || bounds.Dy() != 16 {
+				t.Fatalf("Expected a 32x16 result, got %dx%d", bounds.Dx(), bounds.Dy())
+			}
+			if !isRed(decoded.At(3, 3)) || isRed(decoded.At(28, 12)) {
+				t.Errorf("Expected the red block in the top left only")
+			}
+		})
+	}
+}
+
+// isRed reports whether a lossy copy of a pixel is still clearly red
+func isRed(c color.Color) bool {
+	r, g, b, _ := c.RGBA()
+	return r > 0xC000 && g < 0x4000 && b < 0x4000
+}
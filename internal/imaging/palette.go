@@ -0,0 +1,151 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"slices"
+)
+
+// PaletteSize is the number of dominant colours in a palette
+const PaletteSize = 5
+
+// paletteSampleSize is the longer side, in pixels, images are scaled to
+// before their colours are counted. Dominant colours survive the scaling
+// and the counting stays fast
+const paletteSampleSize = 64
+
+// Swatch is a dominant colour of an image
+type Swatch struct {
+	// Color is the sRGB colour as "#rrggbb"
+	Color string
+	// Weight is the share of the image's opaque pixels the colour stands
+	// for, from 0 to 1, rounded to thousandths
+	Weight float64
+}
+
+// Palette finds the dominant colours of the smallest of variants, like
+// Placeholder. It returns nil for no variants
+func Palette(variants []Variant) ([]Swatch, error) {
+	if len(variants) == 0 {
+		return nil, nil
+	}
+	smallest := slices.MinFunc(variants, func(a, b Variant) int {
+		return max(a.Width, a.Height) - max(b.Width, b.Height)
+	})
+	img, _, err := image.Decode(bytes.NewReader(smallest.Data))
+	if err != nil {
+		return nil, err
+	}
+	return dominantColors(img), nil
+}
+
+// Palette decodes r within the limits, applies edits and finds the dominant
+// colours of the result, for images stored before palettes were made
+func (d *Decoder) Palette(ctx context.Context, r io.ReadSeeker, edits Edits) ([]Swatch, error) {
+	var palette []Swatch
+	_, err := d.decode(ctx, r, func(img image.Image) error {
+		edited, err := edits.Apply(img)
+		if err != nil {
+			return err
+		}
+		palette = dominantColors(edited)
+		return nil
+	})
+	return palette, err
+}
+
+// dominantColors finds up to PaletteSize colours of img by median cut: the
+// opaque pixels start in one box, and the box with the widest spread of a
+// channel, times its pixel count, is split at the median of that channel
+// until there are enough boxes. Each box's mean colour is a swatch. The
+// swatches are ordered by weight, heaviest first; fully transparent images
+// have none
+func dominantColors(img image.Image) []Swatch {
+	sample := Thumbnail(img, paletteSampleSize).(*image.NRGBA)
+	var pixels [][3]uint8
+	for i := 0; i < len(sample.Pix); i += 4 {
+		// Mostly transparent pixels are not part of what is seen
+		if sample.Pix[i+3] < 128 {
+			continue
+		}
+		pixels = append(pixels, [3]uint8{sample.Pix[i], sample.Pix[i+1], sample.Pix[i+2]})
+	}
+	if len(pixels) == 0 {
+		return nil
+	}
+
+	boxes := [][][3]uint8{pixels}
+	for len(boxes) < PaletteSize {
+		split, channel, best := -1, 0, 0
+		for i, box := range boxes {
+			c, spread := widestChannel(box)
+			if score := spread * len(box); score > best {
+				split, channel, best = i, c, score
+			}
+		}
+		// Every box is a single colour
+		if split < 0 {
+			break
+		}
+		box := boxes[split]
+		slices.SortFunc(box, func(a, b [3]uint8) int {
+			return int(a[channel]) - int(b[channel])
+		})
+		// Pixels of the median's value stay together, on whichever side
+		// leaves both halves non-empty
+		median := box[len(box)/2][channel]
+		at, _ := slices.BinarySearchFunc(box, median, func(p [3]uint8, v uint8) int {
+			return int(p[channel]) - int(v)
+		})
+		if at == 0 {
+			at, _ = slices.BinarySearchFunc(box, median+1, func(p [3]uint8, v uint8) int {
+				return int(p[channel]) - int(v)
+			})
+		}
+		boxes[split] = box[:at]
+		boxes = append(boxes, box[at:])
+	}
+
+	palette := make([]Swatch, len(boxes))
+	for i, box := range boxes {
+		var sum [3]int
+		for _, p := range box {
+			sum[0], sum[1], sum[2] = sum[0]+int(p[0]), sum[1]+int(p[1]), sum[2]+int(p[2])
+		}
+		n := len(box)
+		palette[i] = Swatch{
+			Color:  fmt.Sprintf("#%02x%02x%02x", (sum[0]+n/2)/n, (sum[1]+n/2)/n, (sum[2]+n/2)/n),
+			Weight: math.Round(1000*float64(n)/float64(len(pixels))) / 1000,
+		}
+	}
+	slices.SortStableFunc(palette, func(a, b Swatch) int {
+		switch {
+		case a.Weight > b.Weight:
+			return -1
+		case a.Weight < b.Weight:
+			return 1
+		}
+		return 0
+	})
+	return palette
+}
+
+// widestChannel returns the RGB channel whose values in box spread the
+// most, and that spread
+func widestChannel(box [][3]uint8) (int, int) {
+	channel, widest := 0, 0
+	for c := range 3 {
+		low, high := uint8(255), uint8(0)
+		for _, p := range box {
+			low, high = min(low, p[c]), max(high, p[c])
+		}
+		if spread := int(high) - int(low); spread > widest {
+			channel, widest = c, spread
+		}
+	}
+	return channel, widest
+}
@@ -0,0 +1,90 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"reflect"
+	"testing"
+)
+
+// stripes returns a 64x64 image whose left half is red and right half is
+// blue above green
+func stripes() *image.NRGBA {
+	img := uniform(64, 64, color.NRGBA{R: 255, A: 255})
+	draw.Draw(img, image.Rect(32, 0, 64, 32), image.NewUniform(color.NRGBA{B: 255, A: 255}), image.Point{}, draw.Src)
+	draw.Draw(img, image.Rect(32, 32, 64, 64), image.NewUniform(color.NRGBA{G: 255, A: 255}), image.Point{}, draw.Src)
+	return img
+}
+
+func TestPalette(t *testing.T) {
+	t.Run("DominantColors", func(t *testing.T) {
+		var buf bytes.Buffer
+		png.Encode(&buf, stripes())
+		palette, err := Palette([]Variant{{Width: 64, Height: 64, Data: buf.Bytes()}})
+		if err != nil {
+			t.Fatalf("Failed to find palette: %v", err)
+		}
+		if len(palette) != 3 {
+			t.Fatalf("Expected 3 colours, got %+v", palette)
+		}
+		if palette[0] != (Swatch{Color: "#ff0000", Weight: 0.5}) {
+			t.Errorf("Expected red first with half the weight, got %+v", palette[0])
+		}
+		rest := map[string]float64{palette[1].Color: palette[1].Weight, palette[2].Color: palette[2].Weight}
+		if !reflect.DeepEqual(rest, map[string]float64{"#0000ff": 0.25, "#00ff00": 0.25}) {
+			t.Errorf("Expected blue and green with a quarter each, got %+v", palette[1:])
+		}
+	})
+
+	t.Run("AtMostPaletteSize", func(t *testing.T) {
+		gradient := image.NewNRGBA(image.Rect(0, 0, 256, 1))
+		for x := range 256 {
+			gradient.SetNRGBA(x, 0, color.NRGBA{R: uint8(x), G: uint8(255 - x), A: 255})
+		}
+		palette := dominantColors(gradient)
+		if len(palette) != PaletteSize {
+			t.Fatalf("Expected %d colours, got %d", PaletteSize, len(palette))
+		}
+		var total float64
+		for i, swatch := range palette {
+			total += swatch.Weight
+			if i > 0 && swatch.Weight > palette[i-1].Weight {
+				t.Errorf("Expected swatches heaviest first, got %+v", palette)
+			}
+		}
+		if total < 0.99 || total > 1.01 {
+			t.Errorf("Expected the weights to add up to 1, got %g", total)
+		}
+	})
+
+	t.Run("Transparent", func(t *testing.T) {
+		if palette := dominantColors(uniform(10, 10, color.NRGBA{R: 255})); palette != nil {
+			t.Errorf("Expected no palette, got %+v", palette)
+		}
+	})
+
+	t.Run("NoVariants", func(t *testing.T) {
+		if palette, err := Palette(nil); palette != nil || err != nil {
+			t.Errorf("Expected no palette, got %+v, %v", palette, err)
+		}
+	})
+}
+
+func TestDecoderPalette(t *testing.T) {
+	var buf bytes.Buffer
+	png.Encode(&buf, stripes())
+
+	// The crop keeps only the red half
+	edits := Edits{Crop: image.Rect(0, 0, 32, 64)}
+	palette, err := NewDecoder(DefaultLimits()).Palette(context.Background(), bytes.NewReader(buf.Bytes()), edits)
+	if err != nil {
+		t.Fatalf("Failed to find palette: %v", err)
+	}
+	if !reflect.DeepEqual(palette, []Swatch{{Color: "#ff0000", Weight: 1}}) {
+		t.Errorf("Expected only red, got %+v", palette)
+	}
+}
@@ -0,0 +1,74 @@
+package imaging
+
+import (
+	"image"
+	"math"
+	"slices"
+
+	"golang.org/x/image/draw"
+)
+
+// hashSampleSize is the side, in pixels, of the greyscale square an image
+// is reduced to before its perceptual hash is taken
+const hashSampleSize = 32
+
+// hashSize is the side of the block of lowest frequencies that make up a
+// perceptual hash, one bit each
+const hashSize = 8
+
+// hashCosines holds cos((2x+1)uπ/2N) for the DCT of the sample, by u then x
+var hashCosines = func() [hashSize][hashSampleSize]float64 {
+	var cosines [hashSize][hashSampleSize]float64
+	for u := range hashSize {
+		for x := range hashSampleSize {
+			cosines[u][x] = math.Cos(float64(2*x+1) * float64(u) * math.Pi / (2 * hashSampleSize))
+		}
+	}
+	return cosines
+}()
+
+// perceptualHash reduces img to a 32x32 greyscale square, ignoring its
+// aspect ratio, and takes the discrete cosine transform. The 8x8 lowest
+// frequencies describe the image's overall structure, which resizing,
+// re-encoding and small colour changes leave alone; each is a bit, set when
+// the frequency is above their median. Similar images have hashes that
+// differ in few bits
+func perceptualHash(img image.Image) uint64 {
+	gray := image.NewGray(image.Rect(0, 0, hashSampleSize, hashSampleSize))
+	draw.ApproxBiLinear.Scale(gray, gray.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+	// The transform is separable: rows first, then columns, keeping only
+	// the frequencies in the hash
+	var rows [hashSampleSize][hashSize]float64
+	for y := range hashSampleSize {
+		for u := range hashSize {
+			var sum float64
+			for x := range hashSampleSize {
+				sum += float64(gray.Pix[y*gray.Stride+x]) * hashCosines[u][x]
+			}
+			rows[y][u] = sum
+		}
+	}
+	var frequencies [hashSize * hashSize]float64
+	for v := range hashSize {
+		for u := range hashSize {
+			var sum float64
+			for y := range hashSampleSize {
+				sum += rows[y][u] * hashCosines[v][y]
+			}
+			frequencies[v*hashSize+u] = sum
+		}
+	}
+
+	sorted := frequencies
+	slices.Sort(sorted[:])
+	median := (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+
+	var hash uint64
+	for i, f := range frequencies {
+		if f > median {
+			hash |= 1 << (len(frequencies) - 1 - i)
+		}
+	}
+	return hash
+}
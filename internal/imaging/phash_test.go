@@ -0,0 +1,114 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"math/bits"
+	"testing"
+)
+
+// scene draws a width by height image of a gradient with a dark disc, at
+// cx across the image, and a bright bar
+func scene(width, height int, cx float64) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for y := range height {
+		for x := range width {
+			u, v := float64(x)/float64(width), float64(y)/float64(height)
+			c := color.NRGBA{R: uint8(200 * u), G: uint8(120 + 100*v), B: uint8(180 - 150*u*v), A: 255}
+			if math.Hypot(u-cx, v-0.5) < 0.2 {
+				c = color.NRGBA{R: 30, G: 20, B: 40, A: 255}
+			}
+			if v > 0.8 && u > 0.1 && u < 0.6 {
+				c = color.NRGBA{R: 250, G: 250, B: 240, A: 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestPerceptualHash(t *testing.T) {
+	original := perceptualHash(scene(400, 300, 0.3))
+
+	t.Run("SurvivesResizingAndReencoding", func(t *testing.T) {
+		var buf bytes.Buffer
+		jpeg.Encode(&buf, Thumbnail(scene(400, 300, 0.3), 120), &jpeg.Options{Quality: 40})
+		reexported, err := jpeg.Decode(&buf)
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+		if d := bits.OnesCount64(original ^ perceptualHash(reexported)); d > 4 {
+			t.Errorf("Expected a re-export to be within 4 bits, got %d", d)
+		}
+	})
+
+	t.Run("SurvivesBrightening", func(t *testing.T) {
+		brighter := scene(400, 300, 0.3)
+		for i := range brighter.Pix {
+			if i%4 != 3 {
+				brighter.Pix[i] = uint8(min(255, int(brighter.Pix[i])+20))
+			}
+		}
+		if d := bits.OnesCount64(original ^ perceptualHash(brighter)); d > 6 {
+			t.Errorf("Expected a brighter copy to be within 6 bits, got %d", d)
+		}
+	})
+
+	t.Run("DiffersForOtherImages", func(t *testing.T) {
+		if d := bits.OnesCount64(original ^ perceptualHash(scene(400, 300, 0.75))); d < 16 {
+			t.Errorf("Expected a different image to be at least 16 bits away, got %d", d)
+		}
+	})
+
+	t.Run("FromVariantsAndDecoder", func(t *testing.T) {
+		var buf bytes.Buffer
+		png.Encode(&buf, scene(64, 48, 0.3))
+		fromVariants, ok, err := FeaturesOf([]Variant{{Width: 64, Height: 48, Data: buf.Bytes()}})
+		if err != nil || !ok {
+			t.Fatalf("Failed to find features of variants: %v", err)
+		}
+		fromDecoder, err := NewDecoder(DefaultLimits()).Features(context.Background(), bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("Failed to find features: %v", err)
+		}
+		if fromVariants.PerceptualHash != fromDecoder.PerceptualHash || !bytes.Equal(fromVariants.Histogram, fromDecoder.Histogram) {
+			t.Errorf("Expected the same features, got %+v and %+v", fromVariants, fromDecoder)
+		}
+		if _, ok, _ := FeaturesOf(nil); ok {
+			t.Errorf("Expected no features without variants")
+		}
+	})
+}
+
+func TestColorHistogram(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 40, 40))
+	for y := range 40 {
+		for x := range 40 {
+			switch {
+			case y < 10:
+				// Transparent pixels are not counted
+				img.SetNRGBA(x, y, color.NRGBA{R: 255})
+			case y < 25:
+				img.SetNRGBA(x, y, color.NRGBA{R: 255, A: 255})
+			default:
+				img.SetNRGBA(x, y, color.NRGBA{B: 255, A: 255})
+			}
+		}
+	}
+	histogram := colorHistogram(img)
+	if len(histogram) != 64 {
+		t.Fatalf("Expected 64 bins, got %d", len(histogram))
+	}
+	// Red is bin 3*16, blue bin 3
+	if histogram[48] < 126 || histogram[48] > 129 || histogram[3] < 126 || histogram[3] > 129 {
+		t.Errorf("Expected red and blue to share the histogram, got %v", histogram)
+	}
+	if colorHistogram(image.NewNRGBA(image.Rect(0, 0, 8, 8))) != nil {
+		t.Errorf("Expected no histogram for a transparent image")
+	}
+}
@@ -0,0 +1,43 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"slices"
+)
+
+// placeholderSize is the longer side, in pixels, of placeholders. Browsers
+// scale them up smoothly, which blurs them
+const placeholderSize = 16
+
+// placeholderQuality is the JPEG quality of placeholders; at their size
+// the difference does not show
+const placeholderQuality = 50
+
+// Placeholder makes a low-quality image placeholder from the smallest of
+// variants: a data URI of a tiny copy, for pages to show while the image
+// loads. Images with transparency get none, as the placeholder would show
+// through, and neither do images without variants
+func Placeholder(variants []Variant) (string, error) {
+	if len(variants) == 0 {
+		return "", nil
+	}
+	smallest := slices.MinFunc(variants, func(a, b Variant) int {
+		return max(a.Width, a.Height) - max(b.Width, b.Height)
+	})
+	img, _, err := image.Decode(bytes.NewReader(smallest.Data))
+	if err != nil {
+		return "", err
+	}
+
+	tiny := Thumbnail(img, placeholderSize)
+	if !isOpaque(tiny) {
+		return "", nil
+	}
+	encoded, err := encode(tiny, placeholderQuality)
+	if err != nil {
+		return "", err
+	}
+	return "data:" + encoded.MIMEType + ";base64," + base64.StdEncoding.EncodeToString(encoded.Data), nil
+}
@@ -0,0 +1,59 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/base64"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"strings"
+	"testing"
+)
+
+func TestPlaceholder(t *testing.T) {
+	t.Run("Opaque", func(t *testing.T) {
+		variants, err := makeVariants(uniform(600, 300, color.NRGBA{R: 200, G: 40, B: 40, A: 255}), VariantSizes)
+		if err != nil {
+			t.Fatalf("Failed to make variants: %v", err)
+		}
+		placeholder, err := Placeholder(variants)
+		if err != nil {
+			t.Fatalf("Failed to make placeholder: %v", err)
+		}
+
+		data, ok := strings.CutPrefix(placeholder, "data:image/jpeg;base64,")
+		if !ok {
+			t.Fatalf("Expected a JPEG data URI, got %.40s", placeholder)
+		}
+		decoded, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			t.Fatalf("Failed to decode base64: %v", err)
+		}
+		img, err := jpeg.Decode(bytes.NewReader(decoded))
+		if err != nil {
+			t.Fatalf("Failed to decode placeholder: %v", err)
+		}
+		if bounds := img.Bounds(); bounds.Dx() != 16 || bounds.Dy() != 8 {
+			t.Errorf("Expected a 16x8 placeholder, got %dx%d", bounds.Dx(), bounds.Dy())
+		}
+		if r, g, _, _ := img.At(8, 4).RGBA(); r>>8 < 170 || g>>8 > 80 {
+			t.Errorf("Expected the placeholder to keep the image's colour, got %v", img.At(8, 4))
+		}
+	})
+
+	t.Run("Transparent", func(t *testing.T) {
+		variants, err := makeVariants(image.NewNRGBA(image.Rect(0, 0, 64, 64)), VariantSizes)
+		if err != nil {
+			t.Fatalf("Failed to make variants: %v", err)
+		}
+		if placeholder, err := Placeholder(variants); err != nil || placeholder != "" {
+			t.Errorf("Expected no placeholder for a transparent image, got %q, %v", placeholder, err)
+		}
+	})
+
+	t.Run("NoVariants", func(t *testing.T) {
+		if placeholder, err := Placeholder(nil); err != nil || placeholder != "" {
+			t.Errorf("Expected no placeholder, got %q, %v", placeholder, err)
+		}
+	})
+}
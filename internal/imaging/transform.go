@@ -0,0 +1,245 @@
+package imaging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"net/url"
+	"strconv"
+
+	"golang.org/x/image/draw"
+)
+
+// Fit is how a transform fits an image into the requested box
+type Fit string
+
+const (
+	// FitContain scales the image to fit inside the box, keeping its aspect
+	// ratio. The result may be smaller than the box on one side
+	FitContain Fit = "contain"
+	// FitCover scales the image to cover the box, keeping its aspect ratio,
+	// and crops what overflows around the focal point
+	FitCover Fit = "cover"
+	// FitFill stretches the image to the box
+	FitFill Fit = "fill"
+)
+
+const (
+	// MaxTransformSize bounds the requested width and height
+	MaxTransformSize = 4096
+	// DefaultQuality is the JPEG quality of transforms that do not set one
+	DefaultQuality = variantQuality
+)
+
+// Transform describes a resized, possibly cropped, copy of an image
+type Transform struct {
+	// Width and Height are the box in pixels. One may be zero to follow the
+	// image's aspect ratio, and both to keep the image's size
+	Width  int
+	Height int
+	Fit    Fit
+	// FocusX and FocusY are the point kept in view by FitCover, from 0 to 1
+	// across and down the image
+	FocusX float64
+	FocusY float64
+	// Quality is the JPEG quality from 1 to 100; it does not apply to PNG
+	Quality int
+	// Watermark, if set, is drawn over the resized image
+	Watermark *Watermark
+}
+
+// transformParams are the query parameters ParseTransform reads
+var transformParams = []string{"w", "h", "fit", "fx", "fy", "q"}
+
+// IsTransform reports whether query asks for a transform
+func IsTransform(query url.Values) bool {
+	for _, param := range transformParams {
+		if query.Has(param) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseTransform reads a transform from query parameters: w and h for the
+// box, fit (contain, cover or fill, default contain), fx and fy for the
+// focal point (default 0.5, the centre) and q for the JPEG quality
+func ParseTransform(query url.Values) (Transform, error) {
+	t := Transform{Fit: FitContain, FocusX: 0.5, FocusY: 0.5, Quality: DefaultQuality}
+
+	var err error
+	if t.Width, err = parseInt(query, "w", 1, MaxTransformSize); err != nil {
+		return t, err
+	}
+	if t.Height, err = parseInt(query, "h", 1, MaxTransformSize); err != nil {
+		return t, err
+	}
+	if t.Width == 0 && t.Height == 0 {
+		return t, errors.New("w or h is required")
+	}
+
+	if fit := query.Get("fit"); fit != "" {
+		switch Fit(fit) {
+		case FitContain, FitCover, FitFill:
+			t.Fit = Fit(fit)
+		default:
+			return t, fmt.Errorf("fit must be contain, cover or fill, got %q", fit)
+		}
+	}
+
+	if t.FocusX, err = parseFocus(query, "fx"); err != nil {
+		return t, err
+	}
+	if t.FocusY, err = parseFocus(query, "fy"); err != nil {
+		return t, err
+	}
+
+	quality, err := parseInt(query, "q", 1, 100)
+	if err != nil {
+		return t, err
+	}
+	if quality != 0 {
+		t.Quality = quality
+	}
+	return t, nil
+}
+
+// parseInt reads an optional integer parameter, returning 0 when it is absent
+func parseInt(query url.Values, name string, low, high int) (int, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < low || n > high {
+		return 0, fmt.Errorf("%s must be an integer from %d to %d", name, low, high)
+	}
+	return n, nil
+}
+
+// parseFocus reads an optional focal point coordinate, 0.5 when absent
+func parseFocus(query url.Values, name string) (float64, error) {
+	value := query.Get(name)
+	if value == "" {
+		return 0.5, nil
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || f < 0 || f > 1 || math.IsNaN(f) {
+		return 0, fmt.Errorf("%s must be a number from 0 to 1", name)
+	}
+	return f, nil
+}
+
+// String is a canonical form of the transform, for use in cache keys.
+// Transforms that produce the same image have the same string
+func (t Transform) String() string {
+	s := fmt.Sprintf("w%d-h%d-%s", t.Width, t.Height, t.fit())
+	if t.fit() == FitCover {
+		s += fmt.Sprintf("-fx%g-fy%g", t.FocusX, t.FocusY)
+	}
+	s += fmt.Sprintf("-q%d", t.Quality)
+	if t.Watermark != nil {
+		s += "-wm-" + t.Watermark.String()
+	}
+	return s
+}
+
+// fit is the effective fit mode. With only one side given the image is
+// always scaled to it, whatever the fit
+func (t Transform) fit() Fit {
+	if t.Width == 0 || t.Height == 0 {
+		return FitContain
+	}
+	return t.Fit
+}
+
+// SourceSize returns the size in pixels of the longer side an image of
+// width by height must be decoded at to produce the transform without
+// enlarging it, so a smaller stored variant can be used as the source
+func (t Transform) SourceSize(width, height int) int {
+	if width <= 0 || height <= 0 {
+		return 0
+	}
+	scaleX := float64(t.Width) / float64(width)
+	scaleY := float64(t.Height) / float64(height)
+	var scale float64
+	switch {
+	case t.Width == 0:
+		scale = scaleY
+	case t.Height == 0:
+		scale = scaleX
+	case t.fit() == FitContain:
+		scale = math.Min(scaleX, scaleY)
+	default:
+		scale = math.Max(scaleX, scaleY)
+	}
+	return int(math.Ceil(scale * float64(max(width, height))))
+}
+
+// Apply resizes img as described by the transform. Contained images are not
+// enlarged; covered and filled ones are, to give the exact box
+func (t Transform) Apply(img image.Image) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	src := bounds
+
+	var outWidth, outHeight int
+	switch t.fit() {
+	case FitContain:
+		scale := 1.0
+		if t.Width > 0 {
+			scale = math.Min(scale, float64(t.Width)/float64(width))
+		}
+		if t.Height > 0 {
+			scale = math.Min(scale, float64(t.Height)/float64(height))
+		}
+		outWidth = max(1, int(math.Round(float64(width)*scale)))
+		outHeight = max(1, int(math.Round(float64(height)*scale)))
+	case FitFill:
+		outWidth, outHeight = t.Width, t.Height
+	case FitCover:
+		outWidth, outHeight = t.Width, t.Height
+		scale := math.Max(float64(t.Width)/float64(width), float64(t.Height)/float64(height))
+		cropWidth := min(width, int(math.Round(float64(t.Width)/scale)))
+		cropHeight := min(height, int(math.Round(float64(t.Height)/scale)))
+		x := cropOrigin(width, cropWidth, t.FocusX)
+		y := cropOrigin(height, cropHeight, t.FocusY)
+		src = image.Rect(x, y, x+cropWidth, y+cropHeight).Add(bounds.Min)
+	}
+
+	if src == bounds && outWidth == width && outHeight == height {
+		return img
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, outWidth, outHeight))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, src, draw.Src, nil)
+	return dst
+}
+
+// cropOrigin places a crop of length crop within length so that focus, a
+// fraction of length, is as close to the crop's centre as it can be
+func cropOrigin(length, crop int, focus float64) int {
+	origin := int(math.Round(focus*float64(length) - float64(crop)/2))
+	return max(0, min(origin, length-crop))
+}
+
+// Transform decodes r within the limits, applies edits and then t, with
+// its watermark last. The result's Size is zero
+func (d *Decoder) Transform(ctx context.Context, r io.ReadSeeker, edits Edits, t Transform) (Variant, error) {
+	var result Variant
+	_, err := d.decode(ctx, r, func(img image.Image) error {
+		edited, err := edits.Apply(img)
+		if err != nil {
+			return err
+		}
+		resized := t.Apply(edited)
+		if t.Watermark != nil {
+			resized = t.Watermark.Apply(resized)
+		}
+		result, err = encode(resized, t.Quality)
+		return err
+	})
+	return result, err
+}
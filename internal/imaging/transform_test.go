@@ -0,0 +1,152 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"net/url"
+	"testing"
+)
+
+func TestParseTransform(t *testing.T) {
+	t.Run("Defaults", func(t *testing.T) {
+		transform, err := ParseTransform(url.Values{"w": {"400"}})
+		if err != nil {
+			t.Fatalf("Failed to parse: %v", err)
+		}
+		want := Transform{Width: 400, Fit: FitContain, FocusX: 0.5, FocusY: 0.5, Quality: DefaultQuality}
+		if transform != want {
+			t.Errorf("Expected %+v, got %+v", want, transform)
+		}
+	})
+
+	t.Run("AllParameters", func(t *testing.T) {
+		query, _ := url.ParseQuery("w=400&h=300&fit=cover&fx=0.25&fy=1&q=80")
+		transform, err := ParseTransform(query)
+		if err != nil {
+			t.Fatalf("Failed to parse: %v", err)
+		}
+		want := Transform{Width: 400, Height: 300, Fit: FitCover, FocusX: 0.25, FocusY: 1, Quality: 80}
+		if transform != want {
+			t.Errorf("Expected %+v, got %+v", want, transform)
+		}
+	})
+
+	invalid := []string{
+		"q=80",
+		"w=0",
+		"w=abc",
+		"w=5000",
+		"w=400&fit=stretch",
+		"w=400&fx=1.5",
+		"w=400&fy=NaN",
+		"w=400&q=0",
+		"w=400&q=101",
+	}
+	for _, raw := range invalid {
+		t.Run(raw, func(t *testing.T) {
+			query, _ := url.ParseQuery(raw)
+			if _, err := ParseTransform(query); err == nil {
+				t.Errorf("Expected %s to be rejected", raw)
+			}
+		})
+	}
+}
+
+func TestTransformString(t *testing.T) {
+	// The focal point only matters when cropping
+	a := Transform{Width: 400, Height: 300, Fit: FitContain, FocusX: 0.1, FocusY: 0.5, Quality: 80}
+	b := Transform{Width: 400, Height: 300, Fit: FitContain, FocusX: 0.9, FocusY: 0.5, Quality: 80}
+	if a.String() != b.String() {
+		t.Errorf("Expected the same key for %+v and %+v, got %s and %s", a, b, a.String(), b.String())
+	}
+
+	a.Fit, b.Fit = FitCover, FitCover
+	if a.String() == b.String() {
+		t.Errorf("Expected different keys for different focal points, got %s", a.String())
+	}
+}
+
+func TestTransformApply(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 800, 400))
+
+	tests := []struct {
+		name          string
+		transform     Transform
+		width, height int
+	}{
+		{"WidthOnly", Transform{Width: 200, Fit: FitCover}, 200, 100},
+		{"HeightOnly", Transform{Height: 100}, 200, 100},
+		{"Contain", Transform{Width: 300, Height: 300, Fit: FitContain}, 300, 150},
+		{"ContainDoesNotEnlarge", Transform{Width: 1600, Height: 1600, Fit: FitContain}, 800, 400},
+		{"Cover", Transform{Width: 300, Height: 300, Fit: FitCover, FocusX: 0.5, FocusY: 0.5}, 300, 300},
+		{"Fill", Transform{Width: 300, Height: 300, Fit: FitFill}, 300, 300},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bounds := tt.transform.Apply(img).Bounds()
+			if bounds.Dx() != tt.width || bounds.Dy() != tt.height {
+				t.Errorf("Expected %dx%d, got %dx%d", tt.width, tt.height, bounds.Dx(), bounds.Dy())
+			}
+		})
+	}
+}
+
+func TestTransformFocalPoint(t *testing.T) {
+	// The left half is red and the right half blue
+	img := image.NewNRGBA(image.Rect(0, 0, 200, 100))
+	for y := 0; y < 100; y++ {
+		for x := 0; x < 200; x++ {
+			c := color.NRGBA{R: 255, A: 255}
+			if x >= 100 {
+				c = color.NRGBA{B: 255, A: 255}
+			}
+			img.Set(x, y, c)
+		}
+	}
+
+	tests := []struct {
+		focus float64
+		want  color.NRGBA
+	}{
+		{0, color.NRGBA{R: 255, A: 255}},
+		{1, color.NRGBA{B: 255, A: 255}},
+	}
+	for _, tt := range tests {
+		cropped := Transform{Width: 50, Height: 50, Fit: FitCover, FocusX: tt.focus, FocusY: 0.5}.Apply(img)
+		if got := cropped.At(25, 25); got != tt.want {
+			t.Errorf("Expected focus %v to keep %v, got %v", tt.focus, tt.want, got)
+		}
+	}
+}
+
+func TestTransformSourceSize(t *testing.T) {
+	tests := []struct {
+		transform Transform
+		want      int
+	}{
+		{Transform{Width: 200}, 200},
+		{Transform{Height: 200}, 400},
+		{Transform{Width: 200, Height: 200, Fit: FitContain}, 200},
+		{Transform{Width: 200, Height: 200, Fit: FitCover}, 400},
+	}
+	for _, tt := range tests {
+		if got := tt.transform.SourceSize(800, 400); got != tt.want {
+			t.Errorf("Expected %+v to need %d pixels, got %d", tt.transform, tt.want, got)
+		}
+	}
+}
+
+func TestDecoderTransform(t *testing.T) {
+	decoder := NewDecoder(DefaultLimits())
+	content := encodeTestImage(t, "png", 600, 300)
+
+	result, err := decoder.Transform(context.Background(), bytes.NewReader(content), Edits{}, Transform{Width: 120, Height: 120, Fit: FitCover, Quality: 70})
+	if err != nil {
+		t.Fatalf("Failed to transform: %v", err)
+	}
+	if result.MIMEType != "image/jpeg" || result.Width != 120 || result.Height != 120 {
+		t.Errorf("Expected a 120x120 JPEG, got a %dx%d %s", result.Width, result.Height, result.MIMEType)
+	}
+}
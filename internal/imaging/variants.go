@@ -0,0 +1,130 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"slices"
+
+	"golang.org/x/image/draw"
+)
+
+// VariantSizes are the bounds, in pixels on the longer side, of the resized
+// variants generated for each upload
+var VariantSizes = []int{256, 512, 1024, 2048}
+
+// variantQuality is the JPEG quality of opaque variants
+const variantQuality = 85
+
+// Variant is an encoded, resized copy of an image
+type Variant struct {
+	// Size is the bound the variant was made for. An image smaller than the
+	// bound is copied at its own size
+	Size      int
+	Width     int
+	Height    int
+	MIMEType  string
+	Extension string
+	Data      []byte
+}
+
+// Variants decodes r like Inspect, applies edits and makes a variant for
+// each of sizes while it still holds the decode slot. Sizes beyond the
+// first one that fits the whole image are skipped, as they would be
+// identical. The Info describes the image as decoded, before the edits
+func (d *Decoder) Variants(ctx context.Context, r io.ReadSeeker, sizes []int, edits Edits) (Info, []Variant, error) {
+	var variants []Variant
+	info, err := d.decode(ctx, r, func(img image.Image) error {
+		edited, err := edits.Apply(img)
+		if err != nil {
+			return err
+		}
+		variants, err = makeVariants(edited, sizes)
+		return err
+	})
+	return info, variants, err
+}
+
+// makeVariants resizes img for each size. The largest variant is made from
+// the original and each smaller one from the previous, which is much faster
+// than resizing the original every time and looks the same
+func makeVariants(img image.Image, sizes []int) ([]Variant, error) {
+	sizes = slices.Clone(sizes)
+	slices.Sort(sizes)
+	bounds := img.Bounds()
+	longest := max(bounds.Dx(), bounds.Dy())
+	for i, size := range sizes {
+		if size >= longest {
+			sizes = sizes[:i+1]
+			break
+		}
+	}
+
+	variants := make([]Variant, len(sizes))
+	source := img
+	for i := len(sizes) - 1; i >= 0; i-- {
+		source = Thumbnail(source, sizes[i])
+		variant, err := encode(source, variantQuality)
+		if err != nil {
+			return nil, err
+		}
+		variant.Size = sizes[i]
+		variants[i] = variant
+	}
+	return variants, nil
+}
+
+// Thumbnail scales img so its longer side is at most size pixels, keeping
+// the aspect ratio, with Catmull-Rom resampling. Images are not enlarged
+func Thumbnail(img image.Image, size int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > size || height > size {
+		if width >= height {
+			width, height = size, max(1, height*size/width)
+		} else {
+			width, height = max(1, width*size/height), size
+		}
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, bounds, draw.Src, nil)
+	return dst
+}
+
+// encode encodes opaque images as JPEG at quality and the others as PNG,
+// which keeps their transparency
+func encode(img image.Image, quality int) (Variant, error) {
+	var buf bytes.Buffer
+	format := "jpeg"
+	if isOpaque(img) {
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return Variant{}, err
+		}
+	} else {
+		format = "png"
+		if err := png.Encode(&buf, img); err != nil {
+			return Variant{}, err
+		}
+	}
+
+	bounds := img.Bounds()
+	return Variant{
+		Width:     bounds.Dx(),
+		Height:    bounds.Dy(),
+		MIMEType:  formats[format].mimeType,
+		Extension: formats[format].extension,
+		Data:      buf.Bytes(),
+	}, nil
+}
+
+// isOpaque reports whether every pixel of img is fully opaque
+func isOpaque(img image.Image) bool {
+	if img, ok := img.(interface{ Opaque() bool }); ok {
+		return img.Opaque()
+	}
+	return false
+}
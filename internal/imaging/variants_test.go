@@ -0,0 +1,78 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+)
+
+func TestVariants(t *testing.T) {
+	ctx := context.Background()
+	decoder := NewDecoder(DefaultLimits())
+
+	t.Run("ResizesToEachSize", func(t *testing.T) {
+		content := encodeTestImage(t, "png", 600, 300)
+
+		info, variants, err := decoder.Variants(ctx, bytes.NewReader(content), []int{256, 100}, Edits{})
+		if err != nil {
+			t.Fatalf("Failed to make variants: %v", err)
+		}
+		if info.Width != 600 || info.Height != 300 {
+			t.Errorf("Expected the original to be described, got %dx%d", info.Width, info.Height)
+		}
+		if len(variants) != 2 {
+			t.Fatalf("Expected 2 variants, got %d", len(variants))
+		}
+
+		want := []struct{ size, width, height int }{{100, 100, 50}, {256, 256, 128}}
+		for i, variant := range variants {
+			if variant.Size != want[i].size || variant.Width != want[i].width || variant.Height != want[i].height {
+				t.Errorf("Expected a %dx%d variant for %d, got %dx%d for %d", want[i].width, want[i].height, want[i].size, variant.Width, variant.Height, variant.Size)
+			}
+			if variant.MIMEType != "image/jpeg" || variant.Extension != ".jpg" {
+				t.Errorf("Expected an opaque image to make JPEG variants, got %s", variant.MIMEType)
+			}
+
+			decoded, err := decoder.Inspect(ctx, bytes.NewReader(variant.Data))
+			if err != nil {
+				t.Fatalf("Failed to decode variant: %v", err)
+			}
+			if decoded.Width != variant.Width || decoded.Height != variant.Height {
+				t.Errorf("Expected the encoded variant to be %dx%d, got %dx%d", variant.Width, variant.Height, decoded.Width, decoded.Height)
+			}
+		}
+	})
+
+	t.Run("DoesNotEnlarge", func(t *testing.T) {
+		content := encodeTestImage(t, "png", 200, 300)
+
+		_, variants, err := decoder.Variants(ctx, bytes.NewReader(content), VariantSizes, Edits{})
+		if err != nil {
+			t.Fatalf("Failed to make variants: %v", err)
+		}
+		if len(variants) != 2 {
+			t.Fatalf("Expected the 256 and 512 variants, got %d variants", len(variants))
+		}
+		if variants[1].Size != 512 || variants[1].Width != 200 || variants[1].Height != 300 {
+			t.Errorf("Expected the 512 variant to keep the original size, got %dx%d for %d", variants[1].Width, variants[1].Height, variants[1].Size)
+		}
+	})
+
+	t.Run("KeepsTransparency", func(t *testing.T) {
+		img := image.NewNRGBA(image.Rect(0, 0, 400, 400))
+		img.Set(10, 10, color.NRGBA{R: 255, A: 255})
+		var content bytes.Buffer
+		png.Encode(&content, img)
+
+		_, variants, err := decoder.Variants(ctx, bytes.NewReader(content.Bytes()), []int{256}, Edits{})
+		if err != nil {
+			t.Fatalf("Failed to make variants: %v", err)
+		}
+		if variants[0].MIMEType != "image/png" || variants[0].Extension != ".png" {
+			t.Errorf("Expected a transparent image to make PNG variants, got %s", variants[0].MIMEType)
+		}
+	})
+}
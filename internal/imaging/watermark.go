@@ -0,0 +1,194 @@
+package imaging
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Position is the corner, or the centre, of an image a watermark is put in
+type Position string
+
+// Positions a watermark can be given
+const (
+	PositionTopLeft     Position = "top-left"
+	PositionTopRight    Position = "top-right"
+	PositionBottomLeft  Position = "bottom-left"
+	PositionBottomRight Position = "bottom-right"
+	PositionCenter      Position = "center"
+)
+
+// watermarkMargin is the gap between a watermark and the edges of the
+// image, as a fraction of the image's shorter side
+const watermarkMargin = 0.02
+
+// minWatermarkText is the smallest font size in pixels text is drawn at.
+// Images too small for it, such as thumbnails, are left unmarked
+const minWatermarkText = 6
+
+// WatermarkOptions describes a watermark
+type WatermarkOptions struct {
+	// Text is drawn in white with a dark shadow. Either Text or Logo is set
+	Text string
+	// Logo is drawn as it is, keeping its transparency
+	Logo     image.Image
+	Position Position
+	// Opacity is from 0, invisible, to 1, opaque
+	Opacity float64
+	// Scale is the size of the watermark relative to the image: it fits in
+	// a box of Scale times the image's width and height
+	Scale float64
+}
+
+// Watermark draws a text or logo mark over images
+type Watermark struct {
+	opts WatermarkOptions
+	font *opentype.Font
+}
+
+// NewWatermark checks opts and creates a watermark
+func NewWatermark(opts WatermarkOptions) (*Watermark, error) {
+	switch {
+	case (opts.Text == "") == (opts.Logo == nil):
+		return nil, errors.New("a watermark needs either text or a logo")
+	case opts.Opacity <= 0 || opts.Opacity > 1 || math.IsNaN(opts.Opacity):
+		return nil, fmt.Errorf("watermark opacity must be above 0 and at most 1, got %g", opts.Opacity)
+	case opts.Scale <= 0 || opts.Scale > 1 || math.IsNaN(opts.Scale):
+		return nil, fmt.Errorf("watermark scale must be above 0 and at most 1, got %g", opts.Scale)
+	}
+	switch opts.Position {
+	case PositionTopLeft, PositionTopRight, PositionBottomLeft, PositionBottomRight, PositionCenter:
+	default:
+		return nil, fmt.Errorf("watermark position must be top-left, top-right, bottom-left, bottom-right or center, got %q", opts.Position)
+	}
+
+	w := &Watermark{opts: opts}
+	if opts.Text != "" {
+		f, err := opentype.Parse(goregular.TTF)
+		if err != nil {
+			return nil, err
+		}
+		w.font = f
+	}
+	return w, nil
+}
+
+// Apply returns a copy of img with the watermark drawn over it
+func (w *Watermark) Apply(img image.Image) image.Image {
+	bounds := img.Bounds()
+	box := image.Pt(
+		int(math.Round(w.opts.Scale*float64(bounds.Dx()))),
+		int(math.Round(w.opts.Scale*float64(bounds.Dy()))),
+	)
+	var mark image.Image
+	if w.opts.Logo != nil {
+		mark = w.logo(box)
+	} else {
+		mark = w.text(box)
+	}
+	if mark == nil {
+		return img
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, bounds.Min, draw.Src)
+	at := w.place(dst.Bounds().Size(), mark.Bounds().Size())
+	opacity := image.NewUniform(color.Alpha{A: uint8(math.Round(w.opts.Opacity * 255))})
+	draw.DrawMask(dst, mark.Bounds().Add(at), mark, image.Point{}, opacity, image.Point{}, draw.Over)
+	return dst
+}
+
+// logo scales the logo to fit in box, or returns nil if box is empty
+func (w *Watermark) logo(box image.Point) image.Image {
+	size := w.opts.Logo.Bounds().Size()
+	scale := math.Min(float64(box.X)/float64(size.X), float64(box.Y)/float64(size.Y))
+	width := int(math.Round(scale * float64(size.X)))
+	height := int(math.Round(scale * float64(size.Y)))
+	if width < 1 || height < 1 {
+		return nil
+	}
+	mark := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(mark, mark.Bounds(), w.opts.Logo, w.opts.Logo.Bounds(), draw.Src, nil)
+	return mark
+}
+
+// text draws the text at the largest size that fits in box, or returns nil
+// if that is too small to read
+func (w *Watermark) text(box image.Point) image.Image {
+	// The text is measured at a reference size and scaled from there
+	const reference = 100
+	face, err := opentype.NewFace(w.font, &opentype.FaceOptions{Size: reference, DPI: 72})
+	if err != nil {
+		return nil
+	}
+	width := font.MeasureString(face, w.opts.Text).Ceil()
+	height := face.Metrics().Height.Ceil()
+	face.Close()
+	if width == 0 {
+		return nil
+	}
+	size := reference * math.Min(float64(box.X)/float64(width), float64(box.Y)/float64(height))
+	if size < minWatermarkText {
+		return nil
+	}
+
+	face, err = opentype.NewFace(w.font, &opentype.FaceOptions{Size: size, DPI: 72})
+	if err != nil {
+		return nil
+	}
+	defer face.Close()
+	metrics := face.Metrics()
+	shadow := max(1, int(size/24))
+	mark := image.NewNRGBA(image.Rect(0, 0,
+		font.MeasureString(face, w.opts.Text).Ceil()+shadow,
+		metrics.Height.Ceil()+shadow,
+	))
+
+	// A dark shadow keeps the white text readable on light images
+	drawer := font.Drawer{Dst: mark, Face: face}
+	for _, layer := range []struct {
+		offset int
+		color  color.Color
+	}{{shadow, color.NRGBA{A: 160}}, {0, color.White}} {
+		drawer.Src = image.NewUniform(layer.color)
+		drawer.Dot = fixed.P(layer.offset, metrics.Ascent.Ceil()+layer.offset)
+		drawer.DrawString(w.opts.Text)
+	}
+	return mark
+}
+
+// place returns where a mark of size goes on an image of size bounds
+func (w *Watermark) place(bounds, size image.Point) image.Point {
+	margin := int(math.Round(watermarkMargin * float64(min(bounds.X, bounds.Y))))
+	left, top := margin, margin
+	right, bottom := bounds.X-size.X-margin, bounds.Y-size.Y-margin
+	switch w.opts.Position {
+	case PositionTopLeft:
+		return image.Pt(left, top)
+	case PositionTopRight:
+		return image.Pt(right, top)
+	case PositionBottomLeft:
+		return image.Pt(left, bottom)
+	case PositionCenter:
+		return image.Pt((bounds.X-size.X)/2, (bounds.Y-size.Y)/2)
+	default:
+		return image.Pt(right, bottom)
+	}
+}
+
+// String is a canonical form of the watermark, for use in cache keys
+func (w *Watermark) String() string {
+	kind := "logo"
+	if w.opts.Text != "" {
+		kind = "text=" + w.opts.Text
+	}
+	return fmt.Sprintf("%s-%s-o%g-s%g", kind, w.opts.Position, w.opts.Opacity, w.opts.Scale)
+}
@@ -0,0 +1,140 @@
+package imaging
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"testing"
+)
+
+// uniform returns a width by height image of one colour
+func uniform(width, height int, c color.Color) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func TestNewWatermark(t *testing.T) {
+	logo := uniform(10, 10, color.Black)
+	invalid := map[string]WatermarkOptions{
+		"Neither":        {Position: PositionCenter, Opacity: 0.5, Scale: 0.2},
+		"Both":           {Text: "©", Logo: logo, Position: PositionCenter, Opacity: 0.5, Scale: 0.2},
+		"Opacity":        {Text: "©", Position: PositionCenter, Opacity: 1.5, Scale: 0.2},
+		"Scale":          {Text: "©", Position: PositionCenter, Opacity: 0.5},
+		"Position":       {Text: "©", Position: "middle", Opacity: 0.5, Scale: 0.2},
+		"OpacityMissing": {Logo: logo, Position: PositionCenter, Scale: 0.2},
+	}
+	for name, opts := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, err := NewWatermark(opts); err == nil {
+				t.Errorf("Expected %+v to be rejected", opts)
+			}
+		})
+	}
+}
+
+func TestWatermarkApply(t *testing.T) {
+	white := color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+	red := color.NRGBA{R: 255, A: 255}
+
+	t.Run("Logo", func(t *testing.T) {
+		watermark, err := NewWatermark(WatermarkOptions{Logo: uniform(10, 10, red), Position: PositionBottomRight, Opacity: 1, Scale: 0.2})
+		if err != nil {
+			t.Fatalf("Failed to create watermark: %v", err)
+		}
+		src := uniform(200, 100, white)
+		marked := watermark.Apply(src)
+
+		// The logo fits in 40x20, so it is 20x20, 2 pixels from the edges
+		if got := marked.At(188, 88); got != color.Color(red) {
+			t.Errorf("Expected the logo in the bottom right, got %v", got)
+		}
+		for _, p := range []image.Point{{5, 5}, {170, 88}, {188, 70}, {199, 99}} {
+			if got := marked.At(p.X, p.Y); got != color.Color(white) {
+				t.Errorf("Expected %v to be unmarked, got %v", p, got)
+			}
+		}
+		if src.At(188, 88) != color.Color(white) {
+			t.Errorf("Expected the source image to be left unchanged")
+		}
+	})
+
+	t.Run("Opacity", func(t *testing.T) {
+		watermark, err := NewWatermark(WatermarkOptions{Logo: uniform(10, 10, red), Position: PositionTopLeft, Opacity: 0.5, Scale: 0.5})
+		if err != nil {
+			t.Fatalf("Failed to create watermark: %v", err)
+		}
+		marked := watermark.Apply(uniform(100, 100, white))
+		r, g, _, _ := marked.At(20, 20).RGBA()
+		if r>>8 != 255 || g>>8 < 120 || g>>8 > 135 {
+			t.Errorf("Expected the logo blended halfway into white, got %v", marked.At(20, 20))
+		}
+	})
+
+	t.Run("Text", func(t *testing.T) {
+		watermark, err := NewWatermark(WatermarkOptions{Text: "© Gallery", Position: PositionTopRight, Opacity: 1, Scale: 0.5})
+		if err != nil {
+			t.Fatalf("Failed to create watermark: %v", err)
+		}
+		gray := color.NRGBA{R: 128, G: 128, B: 128, A: 255}
+		marked := watermark.Apply(uniform(200, 100, gray))
+
+		// Only the top right quarter, where the text goes, changes
+		var changed int
+		bounds := marked.Bounds()
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				if marked.At(x, y) == color.Color(gray) {
+					continue
+				}
+				changed++
+				if x < 96 || y > 54 {
+					t.Fatalf("Expected only the top right to change, got a change at %d,%d", x, y)
+				}
+			}
+		}
+		if changed == 0 {
+			t.Errorf("Expected the text to be drawn")
+		}
+	})
+
+	t.Run("TooSmall", func(t *testing.T) {
+		watermark, err := NewWatermark(WatermarkOptions{Text: "© Gallery", Position: PositionCenter, Opacity: 1, Scale: 0.1})
+		if err != nil {
+			t.Fatalf("Failed to create watermark: %v", err)
+		}
+		src := uniform(16, 16, white)
+		if marked := watermark.Apply(src); marked != image.Image(src) {
+			t.Errorf("Expected an image too small for legible text to be left unmarked")
+		}
+	})
+}
+
+func TestDecoderTransformWatermark(t *testing.T) {
+	watermark, err := NewWatermark(WatermarkOptions{Logo: uniform(10, 10, color.Black), Position: PositionCenter, Opacity: 1, Scale: 0.5})
+	if err != nil {
+		t.Fatalf("Failed to create watermark: %v", err)
+	}
+	var content bytes.Buffer
+	jpeg.Encode(&content, uniform(64, 64, color.White), &jpeg.Options{Quality: 100})
+
+	transform := Transform{Quality: 100, Watermark: watermark}
+	result, err := NewDecoder(DefaultLimits()).Transform(context.Background(), bytes.NewReader(content.Bytes()), Edits{}, transform)
+	if err != nil {
+		t.Fatalf("Failed to transform: %v", err)
+	}
+	decoded, err := jpeg.Decode(bytes.NewReader(result.Data))
+	if err != nil {
+		t.Fatalf("Failed to decode result: %v", err)
+	}
+	if r, _, _, _ := decoded.At(32, 32).RGBA(); r > 0x2000 {
+		t.Errorf("Expected the logo in the centre, got %v", decoded.At(32, 32))
+	}
+
+	if transform.String() == (Transform{Quality: 100}).String() {
+		t.Errorf("Expected the watermark to be part of the cache key")
+	}
+}
@@ -0,0 +1,253 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Signatures that start the payload of metadata segments and chunks
+var (
+	exifSignature      = []byte("Exif\x00\x00")
+	xmpSignature       = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	photoshopSignature = []byte("Photoshop 3.0\x00")
+	pngSignature       = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// pngXMPKeyword is the keyword of the iTXt chunk holding XMP
+const pngXMPKeyword = "XML:com.adobe.xmp"
+
+// JPEG markers
+const (
+	markerSOI   = 0xD8
+	markerEOI   = 0xD9
+	markerSOS   = 0xDA
+	markerAPP1  = 0xE1
+	markerAPP13 = 0xED
+)
+
+// readJPEG collects the metadata segments of a JPEG file, which all come
+// before the image data
+func readJPEG(r io.Reader) (blocks, error) {
+	var found blocks
+	br := bufio.NewReader(r)
+
+	var soi [2]byte
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi[0] != 0xFF || soi[1] != markerSOI {
+		return found, errors.New("missing JPEG start of image")
+	}
+
+	for {
+		marker, err := nextMarker(br)
+		if err != nil {
+			return found, err
+		}
+		if marker == markerSOS || marker == markerEOI {
+			return found, nil
+		}
+		// Restart markers and TEM stand alone, without a length
+		if marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 {
+			continue
+		}
+
+		var header [2]byte
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return found, err
+		}
+		length := int(binary.BigEndian.Uint16(header[:])) - 2
+		if length < 0 {
+			return found, errors.New("malformed JPEG segment length")
+		}
+		if marker != markerAPP1 && marker != markerAPP13 {
+			if _, err := br.Discard(length); err != nil {
+				return found, err
+			}
+			continue
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return found, err
+		}
+		switch {
+		case marker == markerAPP1 && bytes.HasPrefix(payload, exifSignature):
+			found.exif = payload[len(exifSignature):]
+		case marker == markerAPP1 && bytes.HasPrefix(payload, xmpSignature):
+			found.xmp = payload[len(xmpSignature):]
+		case marker == markerAPP13 && bytes.HasPrefix(payload, photoshopSignature):
+			if iptc, ok := photoshopIPTC(payload[len(photoshopSignature):]); ok {
+				found.iptc = iptc
+			}
+		}
+	}
+}
+
+// nextMarker reads up to and including the next marker byte, skipping the
+// fill bytes that may precede it
+func nextMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, errors.New("malformed JPEG marker")
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// readPNG collects the eXIf chunk and the XMP iTXt chunk of a PNG file.
+// Other chunks, the image data included, are skipped over
+func readPNG(r io.ReadSeeker) (blocks, error) {
+	var found blocks
+
+	signature := make([]byte, len(pngSignature))
+	if _, err := io.ReadFull(r, signature); err != nil || !bytes.Equal(signature, pngSignature) {
+		return found, errors.New("missing PNG signature")
+	}
+
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return found, err
+		}
+		length := int64(binary.BigEndian.Uint32(header[:4]))
+		kind := string(header[4:])
+		if kind == "IEND" {
+			return found, nil
+		}
+		if (kind != "eXIf" && kind != "iTXt") || length > maxBlockSize {
+			// Skip the data and the CRC
+			if _, err := r.Seek(length+4, io.SeekCurrent); err != nil {
+				return found, err
+			}
+			continue
+		}
+
+		data := make([]byte, length+4)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return found, err
+		}
+		data = data[:length]
+		switch kind {
+		case "eXIf":
+			found.exif = data
+		case "iTXt":
+			if xmp, ok, err := pngXMP(data); err != nil {
+				return found, err
+			} else if ok {
+				found.xmp = xmp
+			}
+		}
+	}
+}
+
+// pngXMP returns the text of an iTXt chunk if it holds XMP
+func pngXMP(data []byte) ([]byte, bool, error) {
+	keyword, rest, ok := bytes.Cut(data, []byte{0})
+	if !ok || string(keyword) != pngXMPKeyword || len(rest) < 2 {
+		return nil, false, nil
+	}
+	compressed := rest[0] == 1
+	// Skip the compression flag and method, the language tag and the
+	// translated keyword
+	fields := bytes.SplitN(rest[2:], []byte{0}, 3)
+	if len(fields) != 3 {
+		return nil, false, errors.New("malformed PNG iTXt chunk")
+	}
+	text := fields[2]
+	if !compressed {
+		return text, true, nil
+	}
+
+	zr, err := zlib.NewReader(bytes.NewReader(text))
+	if err != nil {
+		return nil, false, err
+	}
+	defer zr.Close()
+	text, err = io.ReadAll(io.LimitReader(zr, maxBlockSize))
+	return text, err == nil, err
+}
+
+// readWebP collects the EXIF and XMP chunks of a WebP file
+func readWebP(r io.ReadSeeker) (blocks, error) {
+	var found blocks
+
+	var header [12]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:4]) != "RIFF" || string(header[8:]) != "WEBP" {
+		return found, errors.New("missing WebP header")
+	}
+
+	for {
+		var chunk [8]byte
+		if _, err := io.ReadFull(r, chunk[:]); err == io.EOF {
+			return found, nil
+		} else if err != nil {
+			return found, err
+		}
+		kind := string(chunk[:4])
+		length := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		// Chunks are padded to an even length
+		padded := length + length%2
+		if (kind != "EXIF" && kind != "XMP ") || length > maxBlockSize {
+			if _, err := r.Seek(padded, io.SeekCurrent); err != nil {
+				return found, err
+			}
+			continue
+		}
+
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return found, err
+		}
+		if _, err := r.Seek(padded-length, io.SeekCurrent); err != nil {
+			return found, err
+		}
+		if kind == "EXIF" {
+			// Some writers keep the JPEG signature in front of the TIFF data
+			found.exif = bytes.TrimPrefix(data, exifSignature)
+		} else {
+			found.xmp = data
+		}
+	}
+}
+
+// TIFF tags that hold IPTC and XMP blocks in IFD0 of a TIFF file
+const (
+	tagXMP  = 700
+	tagIPTC = 0x83BB
+)
+
+// readTIFF reads a TIFF file, whose own IFDs hold the EXIF fields. The
+// whole file is read, as IFDs may be anywhere in it
+func readTIFF(r io.Reader) (blocks, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return blocks{}, err
+	}
+	found := blocks{exif: data}
+
+	t, err := newTIFF(data)
+	if err != nil {
+		return found, fmt.Errorf("TIFF: %w", err)
+	}
+	ifd0, err := t.first()
+	if err != nil {
+		return found, fmt.Errorf("TIFF: %w", err)
+	}
+	if f, ok := ifd0[tagXMP]; ok {
+		found.xmp = f.value
+	}
+	if f, ok := ifd0[tagIPTC]; ok {
+		found.iptc = f.value
+	}
+	return found, nil
+}
@@ -0,0 +1,317 @@
+package metadata
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"image_gallery/internal/models"
+)
+
+// TIFF field types
+const (
+	typeByte      = 1
+	typeASCII     = 2
+	typeShort     = 3
+	typeLong      = 4
+	typeRational  = 5
+	typeUndefined = 7
+	typeSRational = 10
+	typeIFD       = 13
+)
+
+// typeSizes are the sizes in bytes of one value of each field type
+var typeSizes = map[uint16]int{1: 1, 2: 1, 3: 2, 4: 4, 5: 8, 6: 1, 7: 1, 8: 2, 9: 4, 10: 8, 11: 4, 12: 8, 13: 4}
+
+// Tags read from IFD0, the Exif IFD and the GPS IFD
+const (
+	tagImageDescription   = 0x010E
+	tagMake               = 0x010F
+	tagModel              = 0x0110
+	tagOrientation        = 0x0112
+	tagExifIFD            = 0x8769
+	tagGPSIFD             = 0x8825
+	tagExposureTime       = 0x829A
+	tagFNumber            = 0x829D
+	tagISO                = 0x8827
+	tagDateTimeOriginal   = 0x9003
+	tagOffsetTimeOriginal = 0x9011
+	tagFocalLength        = 0x920A
+	tagLensModel          = 0xA434
+
+	tagGPSLatitudeRef  = 1
+	tagGPSLatitude     = 2
+	tagGPSLongitudeRef = 3
+	tagGPSLongitude    = 4
+	tagGPSAltitudeRef  = 5
+	tagGPSAltitude     = 6
+)
+
+// maxIFDEntries bounds the entries read from one IFD, so a corrupt count
+// cannot make the parser walk megabytes of garbage
+const maxIFDEntries = 1000
+
+var errMalformedTIFF = errors.New("malformed TIFF structure")
+
+// tiff reads the IFDs of a TIFF structure, the layout of EXIF blocks
+type tiff struct {
+	data  []byte
+	order binary.ByteOrder
+}
+
+// field is an IFD entry
+type field struct {
+	typ   uint16
+	count uint32
+	value []byte
+}
+
+// ifd maps tags to their fields
+type ifd map[uint16]field
+
+func newTIFF(data []byte) (*tiff, error) {
+	if len(data) < 8 {
+		return nil, errMalformedTIFF
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, errMalformedTIFF
+	}
+	if order.Uint16(data[2:]) != 42 {
+		return nil, errMalformedTIFF
+	}
+	return &tiff{data: data, order: order}, nil
+}
+
+// first returns IFD0
+func (t *tiff) first() (ifd, error) {
+	return t.ifd(t.order.Uint32(t.data[4:]))
+}
+
+// ifd reads the IFD at offset
+func (t *tiff) ifd(offset uint32) (ifd, error) {
+	if uint64(offset)+2 > uint64(len(t.data)) {
+		return nil, errMalformedTIFF
+	}
+	count := int(t.order.Uint16(t.data[offset:]))
+	if count > maxIFDEntries || int(offset)+2+count*12 > len(t.data) {
+		return nil, errMalformedTIFF
+	}
+
+	fields := make(ifd, count)
+	for i := 0; i < count; i++ {
+		entry := t.data[int(offset)+2+i*12:]
+		typ := t.order.Uint16(entry[2:])
+		size, ok := typeSizes[typ]
+		if !ok {
+			continue
+		}
+		n := t.order.Uint32(entry[4:])
+		length := uint64(size) * uint64(n)
+		// Values of up to four bytes are stored in the entry itself
+		value := entry[8:12]
+		if length > 4 {
+			at := uint64(t.order.Uint32(entry[8:]))
+			if at+length > uint64(len(t.data)) {
+				continue
+			}
+			value = t.data[at : at+length]
+		}
+		fields[t.order.Uint16(entry)] = field{typ: typ, count: n, value: value[:length]}
+	}
+	return fields, nil
+}
+
+// sub reads the IFD a pointer tag of d refers to
+func (t *tiff) sub(d ifd, tag uint16) (ifd, bool) {
+	offset, ok := t.uint(d, tag)
+	if !ok {
+		return nil, false
+	}
+	sub, err := t.ifd(uint32(offset))
+	return sub, err == nil
+}
+
+// string reads an ASCII field, trimmed of padding
+func (t *tiff) string(d ifd, tag uint16) string {
+	f, ok := d[tag]
+	if !ok || (f.typ != typeASCII && f.typ != typeUndefined) {
+		return ""
+	}
+	s, _, _ := strings.Cut(string(f.value), "\x00")
+	return strings.TrimSpace(s)
+}
+
+// uint reads the first value of an integer field
+func (t *tiff) uint(d ifd, tag uint16) (uint64, bool) {
+	f, ok := d[tag]
+	if !ok || f.count == 0 {
+		return 0, false
+	}
+	switch f.typ {
+	case typeByte:
+		return uint64(f.value[0]), true
+	case typeShort:
+		return uint64(t.order.Uint16(f.value)), true
+	case typeLong, typeIFD:
+		return uint64(t.order.Uint32(f.value)), true
+	}
+	return 0, false
+}
+
+// rational reads the ith value of a rational field as its numerator and
+// denominator
+func (t *tiff) rational(d ifd, tag uint16, i int) (int64, int64, bool) {
+	f, ok := d[tag]
+	if !ok || uint32(i) >= f.count {
+		return 0, 0, false
+	}
+	value := f.value[i*8:]
+	switch f.typ {
+	case typeRational:
+		return int64(t.order.Uint32(value)), int64(t.order.Uint32(value[4:])), true
+	case typeSRational:
+		return int64(int32(t.order.Uint32(value))), int64(int32(t.order.Uint32(value[4:]))), true
+	}
+	return 0, 0, false
+}
+
+// float reads the ith value of a rational field
+func (t *tiff) float(d ifd, tag uint16, i int) (float64, bool) {
+	num, den, ok := t.rational(d, tag, i)
+	if !ok || den == 0 {
+		return 0, false
+	}
+	return float64(num) / float64(den), true
+}
+
+// exif is what is read from an EXIF block
+type exif struct {
+	metadata    models.Metadata
+	description string
+}
+
+// parseEXIF reads the fields the gallery keeps from an EXIF block, a TIFF
+// structure. Fields that are missing or malformed are skipped
+func parseEXIF(data []byte) (exif, error) {
+	var result exif
+	t, err := newTIFF(data)
+	if err != nil {
+		return result, err
+	}
+	ifd0, err := t.first()
+	if err != nil {
+		return result, err
+	}
+
+	m := &result.metadata
+	m.CameraMake = t.string(ifd0, tagMake)
+	m.CameraModel = t.string(ifd0, tagModel)
+	result.description = t.string(ifd0, tagImageDescription)
+	if orientation, ok := t.uint(ifd0, tagOrientation); ok && orientation >= 1 && orientation <= 8 {
+		m.Orientation = int(orientation)
+	}
+
+	if sub, ok := t.sub(ifd0, tagExifIFD); ok {
+		m.LensModel = t.string(sub, tagLensModel)
+		if num, den, ok := t.rational(sub, tagExposureTime, 0); ok && num > 0 && den > 0 {
+			m.ExposureTime = formatExposure(num, den)
+		}
+		if f, ok := t.float(sub, tagFNumber, 0); ok {
+			m.FNumber = math.Round(f*10) / 10
+		}
+		if iso, ok := t.uint(sub, tagISO); ok {
+			m.ISO = int(iso)
+		}
+		if f, ok := t.float(sub, tagFocalLength, 0); ok {
+			m.FocalLength = math.Round(f*10) / 10
+		}
+		if taken, ok := parseEXIFTime(t.string(sub, tagDateTimeOriginal), t.string(sub, tagOffsetTimeOriginal)); ok {
+			m.DateTimeOriginal = &taken
+		}
+	}
+
+	if sub, ok := t.sub(ifd0, tagGPSIFD); ok {
+		m.GPS = parseGPS(t, sub)
+	}
+	return result, nil
+}
+
+// formatExposure writes an exposure time in seconds as photographers do:
+// "1/250" below a second and a decimal above
+func formatExposure(num, den int64) string {
+	if num >= den {
+		return fmt.Sprintf("%g", math.Round(float64(num)/float64(den)*10)/10)
+	}
+	if num == 1 {
+		return fmt.Sprintf("1/%d", den)
+	}
+	return fmt.Sprintf("1/%d", int64(math.Round(float64(den)/float64(num))))
+}
+
+// parseEXIFTime reads an EXIF time, "2006:01:02 15:04:05", with its offset
+// such as "+02:00" if the camera recorded one
+func parseEXIFTime(value, offset string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+	if offset != "" {
+		if t, err := time.Parse("2006:01:02 15:04:05-07:00", value+offset); err == nil {
+			return t, true
+		}
+	}
+	t, err := time.Parse("2006:01:02 15:04:05", value)
+	return t, err == nil
+}
+
+// parseGPS reads a position from the GPS IFD, or nil without one
+func parseGPS(t *tiff, d ifd) *models.GPS {
+	latitude, ok := degrees(t, d, tagGPSLatitude)
+	if !ok {
+		return nil
+	}
+	longitude, ok := degrees(t, d, tagGPSLongitude)
+	if !ok {
+		return nil
+	}
+	if t.string(d, tagGPSLatitudeRef) == "S" {
+		latitude = -latitude
+	}
+	if t.string(d, tagGPSLongitudeRef) == "W" {
+		longitude = -longitude
+	}
+	if math.Abs(latitude) > 90 || math.Abs(longitude) > 180 {
+		return nil
+	}
+
+	gps := &models.GPS{Latitude: latitude, Longitude: longitude}
+	if altitude, ok := t.float(d, tagGPSAltitude, 0); ok {
+		// A reference of 1 means below sea level
+		if ref, ok := t.uint(d, tagGPSAltitudeRef); ok && ref == 1 {
+			altitude = -altitude
+		}
+		gps.Altitude = &altitude
+	}
+	return gps
+}
+
+// degrees reads a GPS coordinate stored as degrees, minutes and seconds
+func degrees(t *tiff, d ifd, tag uint16) (float64, bool) {
+	var total float64
+	for i, scale := range []float64{1, 60, 3600} {
+		value, ok := t.float(d, tag, i)
+		if !ok {
+			return 0, false
+		}
+		total += value / scale
+	}
+	return total, true
+}
@@ -0,0 +1,93 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strings"
+	"unicode/utf8"
+)
+
+// IPTC datasets of the application record read by the gallery
+const (
+	iptcApplicationRecord = 2
+	iptcKeywords          = 25
+	iptcCaption           = 120
+)
+
+// iptc is what is read from an IPTC block
+type iptc struct {
+	caption  string
+	keywords []string
+}
+
+// parseIPTC reads captions and keywords from IPTC IIM datasets. Parsing
+// stops at the first malformed dataset, keeping what was read before it
+func parseIPTC(data []byte) iptc {
+	var result iptc
+	for len(data) >= 5 && data[0] == 0x1C {
+		record, dataset := data[1], data[2]
+		length := int(binary.BigEndian.Uint16(data[3:]))
+		data = data[5:]
+		// Extended datasets, with the high bit set, are not used for text
+		if length&0x8000 != 0 || length > len(data) {
+			break
+		}
+		value := iptcString(data[:length])
+		data = data[length:]
+
+		if record != iptcApplicationRecord || value == "" {
+			continue
+		}
+		switch dataset {
+		case iptcCaption:
+			result.caption = value
+		case iptcKeywords:
+			result.keywords = append(result.keywords, value)
+		}
+	}
+	return result
+}
+
+// iptcString decodes an IPTC text value. Most writers use UTF-8; older ones
+// wrote Latin-1, which is converted
+func iptcString(value []byte) string {
+	value = bytes.TrimRight(value, "\x00")
+	if utf8.Valid(value) {
+		return strings.TrimSpace(string(value))
+	}
+	runes := make([]rune, len(value))
+	for i, b := range value {
+		runes[i] = rune(b)
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// photoshopIPTC finds the IPTC block in Photoshop image resources, as
+// stored in a JPEG APP13 segment after the "Photoshop 3.0" signature
+func photoshopIPTC(data []byte) ([]byte, bool) {
+	const iptcResource = 0x0404
+	for len(data) >= 12 && string(data[:4]) == "8BIM" {
+		id := binary.BigEndian.Uint16(data[4:])
+		// The name is a Pascal string padded to an even length
+		nameLength := int(data[6]) + 1
+		nameLength += nameLength % 2
+		if 6+nameLength+4 > len(data) {
+			break
+		}
+		data = data[6+nameLength:]
+		size := int(binary.BigEndian.Uint32(data))
+		data = data[4:]
+		if size > len(data) {
+			break
+		}
+		if id == iptcResource {
+			return data[:size], true
+		}
+		size += size % 2
+		if size > len(data) {
+			break
+		}
+		data = data[size:]
+	}
+	return nil, false
+}
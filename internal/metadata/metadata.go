@@ -0,0 +1,111 @@
+// Package metadata reads and strips the camera and caption metadata
+// embedded in image files: EXIF, IPTC and XMP blocks in JPEG, PNG, WebP and
+// TIFF files
+package metadata
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"image_gallery/internal/models"
+)
+
+// maxBlockSize bounds a metadata block read from a PNG or WebP chunk. JPEG
+// segments cannot be larger than 64 KB anyway
+const maxBlockSize = 4 << 20
+
+// blocks are the raw metadata blocks found in a file
+type blocks struct {
+	exif []byte
+	iptc []byte
+	xmp  []byte
+}
+
+// Extract reads the metadata of an image file in format, a decoder name
+// such as "jpeg". It returns nil when the file has none. Metadata is best
+// effort: a malformed block is reported in the error, alongside whatever
+// the other blocks gave
+func Extract(r io.ReadSeeker, format string) (*models.Metadata, error) {
+	found, err := readBlocks(r, format)
+	metadata, parseErr := found.parse()
+	if err = errors.Join(err, parseErr); err != nil {
+		err = fmt.Errorf("failed to read %s metadata: %w", format, err)
+	}
+	return metadata, err
+}
+
+// Orientation returns the EXIF orientation of an image file in format, from
+// 1 to 8. Files without a valid orientation get 1, which needs no change
+func Orientation(r io.ReadSeeker, format string) int {
+	found, _ := readBlocks(r, format)
+	if found.exif == nil {
+		return 1
+	}
+	parsed, err := parseEXIF(found.exif)
+	if err != nil || parsed.metadata.Orientation == 0 {
+		return 1
+	}
+	return parsed.metadata.Orientation
+}
+
+// readBlocks collects the metadata blocks of a file in format. Formats that
+// cannot carry metadata have none
+func readBlocks(r io.ReadSeeker, format string) (blocks, error) {
+	switch format {
+	case "jpeg":
+		return readJPEG(r)
+	case "png":
+		return readPNG(r)
+	case "webp":
+		return readWebP(r)
+	case "tiff":
+		return readTIFF(r)
+	}
+	return blocks{}, nil
+}
+
+// parse reads the blocks into metadata, nil if they hold nothing the
+// gallery keeps. Captions and keywords are taken from XMP first, then IPTC
+// and then, for the caption, the EXIF image description
+func (b blocks) parse() (*models.Metadata, error) {
+	var metadata models.Metadata
+	var description string
+	var errs []error
+
+	if b.exif != nil {
+		parsed, err := parseEXIF(b.exif)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("EXIF: %w", err))
+		}
+		metadata = parsed.metadata
+		description = parsed.description
+	}
+
+	if b.xmp != nil {
+		parsed, err := parseXMP(b.xmp)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("XMP: %w", err))
+		}
+		metadata.Caption = parsed.caption
+		metadata.Keywords = parsed.keywords
+	}
+
+	if b.iptc != nil {
+		parsed := parseIPTC(b.iptc)
+		if metadata.Caption == "" {
+			metadata.Caption = parsed.caption
+		}
+		if metadata.Keywords == nil {
+			metadata.Keywords = parsed.keywords
+		}
+	}
+
+	if metadata.Caption == "" {
+		metadata.Caption = description
+	}
+	if metadata.IsZero() {
+		return nil, errors.Join(errs...)
+	}
+	return &metadata, errors.Join(errs...)
+}
@@ -0,0 +1,379 @@
+package metadata
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"testing"
+	"time"
+)
+
+// entry is an IFD entry for building test EXIF blocks
+type entry struct {
+	tag   uint16
+	typ   uint16
+	count uint32
+	data  []byte
+}
+
+func ascii(tag uint16, s string) entry {
+	return entry{tag, typeASCII, uint32(len(s) + 1), append([]byte(s), 0)}
+}
+
+func short(tag uint16, v uint16) entry {
+	return entry{tag, typeShort, 1, binary.LittleEndian.AppendUint16(nil, v)}
+}
+
+func long(tag uint16, v uint32) entry {
+	return entry{tag, typeLong, 1, binary.LittleEndian.AppendUint32(nil, v)}
+}
+
+func rationals(tag uint16, values ...uint32) entry {
+	var data []byte
+	for _, v := range values {
+		data = binary.LittleEndian.AppendUint32(data, v)
+	}
+	return entry{tag, typeRational, uint32(len(values) / 2), data}
+}
+
+// ifdSize is the size of an IFD with its out of line values
+func ifdSize(entries []entry) int {
+	size := 2 + 12*len(entries) + 4
+	for _, e := range entries {
+		if len(e.data) > 4 {
+			size += len(e.data) + len(e.data)%2
+		}
+	}
+	return size
+}
+
+// appendIFD appends an IFD, followed by its out of line values, to out
+func appendIFD(out []byte, entries []entry) []byte {
+	offset := len(out)
+	values := offset + 2 + 12*len(entries) + 4
+	var data []byte
+
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(entries)))
+	for _, e := range entries {
+		out = binary.LittleEndian.AppendUint16(out, e.tag)
+		out = binary.LittleEndian.AppendUint16(out, e.typ)
+		out = binary.LittleEndian.AppendUint32(out, e.count)
+		if len(e.data) <= 4 {
+			out = append(out, append(e.data, make([]byte, 4-len(e.data))...)...)
+			continue
+		}
+		out = binary.LittleEndian.AppendUint32(out, uint32(values+len(data)))
+		data = append(data, e.data...)
+		if len(data)%2 == 1 {
+			data = append(data, 0)
+		}
+	}
+	out = binary.LittleEndian.AppendUint32(out, 0)
+	return append(out, data...)
+}
+
+// buildEXIF builds a little-endian EXIF block with an Exif IFD and a GPS
+// IFD, either of which may be empty
+func buildEXIF(ifd0, exifIFD, gpsIFD []entry) []byte {
+	pointers := 0
+	if len(exifIFD) > 0 {
+		pointers++
+	}
+	if len(gpsIFD) > 0 {
+		pointers++
+	}
+	// The sub-IFDs follow IFD0 and its pointers to them
+	next := 8 + ifdSize(ifd0) + 12*pointers
+	if len(exifIFD) > 0 {
+		ifd0 = append(ifd0, long(tagExifIFD, uint32(next)))
+		next += ifdSize(exifIFD)
+	}
+	if len(gpsIFD) > 0 {
+		ifd0 = append(ifd0, long(tagGPSIFD, uint32(next)))
+	}
+
+	out := binary.LittleEndian.AppendUint32([]byte("II*\x00"), 8)
+	out = appendIFD(out, ifd0)
+	if len(exifIFD) > 0 {
+		out = appendIFD(out, exifIFD)
+	}
+	if len(gpsIFD) > 0 {
+		out = appendIFD(out, gpsIFD)
+	}
+	return out
+}
+
+// testEXIF is an EXIF block with every field the gallery reads
+func testEXIF() []byte {
+	return buildEXIF(
+		[]entry{ascii(tagMake, "Canon"), ascii(tagModel, "Canon EOS R5"), ascii(tagImageDescription, "EXIF description")},
+		[]entry{
+			rationals(tagExposureTime, 1, 250),
+			rationals(tagFNumber, 28, 10),
+			short(tagISO, 400),
+			ascii(tagDateTimeOriginal, "2024:05:06 07:08:09"),
+			ascii(tagOffsetTimeOriginal, "+02:00"),
+			rationals(tagFocalLength, 35, 1),
+			ascii(tagLensModel, "RF24-70mm F2.8 L IS USM"),
+		},
+		[]entry{
+			ascii(tagGPSLatitudeRef, "S"),
+			rationals(tagGPSLatitude, 33, 1, 51, 1, 3546, 100),
+			ascii(tagGPSLongitudeRef, "E"),
+			rationals(tagGPSLongitude, 151, 1, 12, 1, 4068, 100),
+			entry{tagGPSAltitudeRef, typeByte, 1, []byte{1}},
+			rationals(tagGPSAltitude, 5, 1),
+		},
+	)
+}
+
+const testXMP = `<?xpacket begin="" id="W5M0MpCehiHzreSzNTczkc9d"?>
+<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/">
+   <dc:description>
+    <rdf:Alt>
+     <rdf:li xml:lang="fr">Le port au coucher du soleil</rdf:li>
+     <rdf:li xml:lang="x-default">The harbour at sunset</rdf:li>
+    </rdf:Alt>
+   </dc:description>
+   <dc:subject>
+    <rdf:Bag>
+     <rdf:li>harbour</rdf:li>
+     <rdf:li>sunset</rdf:li>
+    </rdf:Bag>
+   </dc:subject>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>
+<?xpacket end="w"?>`
+
+// testIPTC is Photoshop image resources holding an IPTC caption and keywords
+func testIPTC() []byte {
+	dataset := func(number byte, value string) []byte {
+		return append([]byte{0x1C, 2, number, byte(len(value) >> 8), byte(len(value))}, value...)
+	}
+	var iptc []byte
+	iptc = append(iptc, dataset(iptcCaption, "IPTC caption")...)
+	iptc = append(iptc, dataset(iptcKeywords, "boats")...)
+	iptc = append(iptc, dataset(iptcKeywords, "Caf\xe9")...)
+
+	resources := append([]byte("8BIM\x04\x04\x00\x00"), binary.BigEndian.AppendUint32(nil, uint32(len(iptc)))...)
+	return append(resources, iptc...)
+}
+
+// withSegments inserts JPEG segments after the start of image marker
+func withSegments(t *testing.T, segments ...[]byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatalf("Failed to encode JPEG: %v", err)
+	}
+	encoded := buf.Bytes()
+
+	out := append([]byte(nil), encoded[:2]...)
+	for _, segment := range segments {
+		out = append(out, segment...)
+	}
+	return append(out, encoded[2:]...)
+}
+
+// segment builds a JPEG segment from its marker and payload parts
+func segment(marker byte, parts ...[]byte) []byte {
+	payload := bytes.Join(parts, nil)
+	return append([]byte{0xFF, marker, byte((len(payload) + 2) >> 8), byte(len(payload) + 2)}, payload...)
+}
+
+// chunk builds a PNG chunk
+func chunk(kind string, data []byte) []byte {
+	out := binary.BigEndian.AppendUint32(nil, uint32(len(data)))
+	out = append(out, kind...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(append([]byte(kind), data...)))
+}
+
+func TestExtract(t *testing.T) {
+	t.Run("JPEG", func(t *testing.T) {
+		content := withSegments(t,
+			segment(markerAPP1, exifSignature, testEXIF()),
+			segment(markerAPP1, xmpSignature, []byte(testXMP)),
+			segment(markerAPP13, photoshopSignature, testIPTC()),
+		)
+
+		metadata, err := Extract(bytes.NewReader(content), "jpeg")
+		if err != nil {
+			t.Fatalf("Failed to extract: %v", err)
+		}
+		if metadata == nil {
+			t.Fatalf("Expected metadata")
+		}
+		if metadata.CameraMake != "Canon" || metadata.CameraModel != "Canon EOS R5" || metadata.LensModel != "RF24-70mm F2.8 L IS USM" {
+			t.Errorf("Expected the camera and lens, got %+v", metadata)
+		}
+		if metadata.ExposureTime != "1/250" || metadata.FNumber != 2.8 || metadata.ISO != 400 || metadata.FocalLength != 35 {
+			t.Errorf("Expected 1/250 s at f/2.8, ISO 400 and 35 mm, got %+v", metadata)
+		}
+		want := time.Date(2024, 5, 6, 7, 8, 9, 0, time.FixedZone("", 2*60*60))
+		if metadata.DateTimeOriginal == nil || !metadata.DateTimeOriginal.Equal(want) {
+			t.Errorf("Expected to be taken at %v, got %v", want, metadata.DateTimeOriginal)
+		}
+
+		gps := metadata.GPS
+		if gps == nil {
+			t.Fatalf("Expected a GPS position")
+		}
+		if gps.Latitude > -33.8598 || gps.Latitude < -33.8599 || gps.Longitude < 151.2112 || gps.Longitude > 151.2113 {
+			t.Errorf("Expected -33.8598, 151.2112, got %v, %v", gps.Latitude, gps.Longitude)
+		}
+		if gps.Altitude == nil || *gps.Altitude != -5 {
+			t.Errorf("Expected an altitude of -5 m, got %v", gps.Altitude)
+		}
+
+		// XMP is preferred over IPTC and EXIF
+		if metadata.Caption != "The harbour at sunset" {
+			t.Errorf("Expected the x-default XMP caption, got %q", metadata.Caption)
+		}
+		if len(metadata.Keywords) != 2 || metadata.Keywords[0] != "harbour" || metadata.Keywords[1] != "sunset" {
+			t.Errorf("Expected the XMP keywords, got %v", metadata.Keywords)
+		}
+	})
+
+	t.Run("IPTC", func(t *testing.T) {
+		content := withSegments(t, segment(markerAPP13, photoshopSignature, testIPTC()))
+
+		metadata, err := Extract(bytes.NewReader(content), "jpeg")
+		if err != nil {
+			t.Fatalf("Failed to extract: %v", err)
+		}
+		if metadata == nil || metadata.Caption != "IPTC caption" {
+			t.Fatalf("Expected the IPTC caption, got %+v", metadata)
+		}
+		if len(metadata.Keywords) != 2 || metadata.Keywords[1] != "Café" {
+			t.Errorf("Expected the IPTC keywords with Latin-1 decoded, got %q", metadata.Keywords)
+		}
+	})
+
+	t.Run("PNG", func(t *testing.T) {
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)))
+		encoded := buf.Bytes()
+
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write([]byte(testXMP))
+		zw.Close()
+		itxt := append([]byte(pngXMPKeyword+"\x00\x01\x00\x00\x00"), compressed.Bytes()...)
+
+		// The chunks go after the signature and IHDR
+		ihdrEnd := len(pngSignature) + 8 + 13 + 4
+		content := append([]byte(nil), encoded[:ihdrEnd]...)
+		content = append(content, chunk("eXIf", testEXIF())...)
+		content = append(content, chunk("iTXt", itxt)...)
+		content = append(content, encoded[ihdrEnd:]...)
+
+		metadata, err := Extract(bytes.NewReader(content), "png")
+		if err != nil {
+			t.Fatalf("Failed to extract: %v", err)
+		}
+		if metadata == nil || metadata.CameraModel != "Canon EOS R5" || metadata.Caption != "The harbour at sunset" {
+			t.Errorf("Expected the EXIF and XMP metadata, got %+v", metadata)
+		}
+	})
+
+	t.Run("WebP", func(t *testing.T) {
+		encoded, err := os.ReadFile("../imaging/testdata/1x1.webp")
+		if err != nil {
+			t.Fatalf("Failed to read test image: %v", err)
+		}
+		exif := append(append([]byte(nil), exifSignature...), testEXIF()...)
+		content := append([]byte(nil), encoded...)
+		content = append(content, "EXIF"...)
+		content = binary.LittleEndian.AppendUint32(content, uint32(len(exif)))
+		content = append(content, exif...)
+		if len(exif)%2 == 1 {
+			content = append(content, 0)
+		}
+		binary.LittleEndian.PutUint32(content[4:], uint32(len(content)-8))
+
+		metadata, err := Extract(bytes.NewReader(content), "webp")
+		if err != nil {
+			t.Fatalf("Failed to extract: %v", err)
+		}
+		if metadata == nil || metadata.ISO != 400 {
+			t.Errorf("Expected the EXIF metadata, got %+v", metadata)
+		}
+	})
+
+	t.Run("TIFF", func(t *testing.T) {
+		metadata, err := Extract(bytes.NewReader(testEXIF()), "tiff")
+		if err != nil {
+			t.Fatalf("Failed to extract: %v", err)
+		}
+		if metadata == nil || metadata.CameraMake != "Canon" || metadata.Caption != "EXIF description" {
+			t.Errorf("Expected the TIFF's own fields, got %+v", metadata)
+		}
+	})
+
+	t.Run("None", func(t *testing.T) {
+		metadata, err := Extract(bytes.NewReader(withSegments(t)), "jpeg")
+		if err != nil || metadata != nil {
+			t.Errorf("Expected no metadata, got %+v, %v", metadata, err)
+		}
+	})
+
+	t.Run("MalformedEXIF", func(t *testing.T) {
+		content := withSegments(t,
+			segment(markerAPP1, exifSignature, []byte("II*\x00\xff\xff\xff\xff")),
+			segment(markerAPP1, xmpSignature, []byte(testXMP)),
+		)
+
+		metadata, err := Extract(bytes.NewReader(content), "jpeg")
+		if err == nil {
+			t.Errorf("Expected the malformed EXIF block to be reported")
+		}
+		if metadata == nil || metadata.Caption != "The harbour at sunset" {
+			t.Errorf("Expected the XMP metadata despite the EXIF error, got %+v", metadata)
+		}
+	})
+}
+
+func TestFormatExposure(t *testing.T) {
+	tests := []struct {
+		num, den int64
+		want     string
+	}{
+		{1, 250, "1/250"},
+		{10, 1250, "1/125"},
+		{1, 1, "1"},
+		{25, 10, "2.5"},
+	}
+	for _, tt := range tests {
+		if got := formatExposure(tt.num, tt.den); got != tt.want {
+			t.Errorf("Expected %d/%d to be %s, got %s", tt.num, tt.den, tt.want, got)
+		}
+	}
+}
+
+func TestOrientation(t *testing.T) {
+	tests := []struct {
+		name    string
+		content []byte
+		want    int
+	}{
+		{"Rotated", withSegments(t, segment(markerAPP1, exifSignature, buildEXIF([]entry{short(tagOrientation, 6)}, nil, nil))), 6},
+		{"Invalid", withSegments(t, segment(markerAPP1, exifSignature, buildEXIF([]entry{short(tagOrientation, 9)}, nil, nil))), 1},
+		{"Missing", withSegments(t), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Orientation(bytes.NewReader(tt.content), "jpeg"); got != tt.want {
+				t.Errorf("Expected orientation %d, got %d", tt.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,461 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+
+	"image_gallery/internal/models"
+)
+
+// ErrMalformed means metadata could not be removed from a file because its
+// structure is damaged. Such a file is not stored, as it could still hold
+// what the policy removes
+var ErrMalformed = errors.New("malformed metadata")
+
+// Tags removed by the strip policies, besides those read by parseEXIF
+const (
+	tagSoftware           = 0x0131
+	tagDateTime           = 0x0132
+	tagArtist             = 0x013B
+	tagHostComputer       = 0x013C
+	tagCopyright          = 0x8298
+	tagPhotoshop          = 0x8649
+	tagMakerNote          = 0x927C
+	tagInteropIFD         = 0xA005
+	tagCameraOwnerName    = 0xA430
+	tagBodySerialNumber   = 0xA431
+	tagLensSerialNumber   = 0xA435
+	tagCameraSerialNumber = 0xC62F
+)
+
+// privateIFD0Tags and privateExifTags are removed by MetadataStripGPS from
+// IFD0 and the Exif IFD. Maker notes go too, as they hold serial numbers
+var (
+	privateIFD0Tags = map[uint16]bool{tagGPSIFD: true, tagCameraSerialNumber: true}
+	privateExifTags = map[uint16]bool{tagBodySerialNumber: true, tagLensSerialNumber: true, tagCameraOwnerName: true, tagMakerNote: true}
+)
+
+// metadataTIFFTags are removed from IFD0 of TIFF files by MetadataStripAll.
+// The tags describing the image data stay
+var metadataTIFFTags = map[uint16]bool{
+	tagImageDescription: true, tagMake: true, tagModel: true, tagSoftware: true,
+	tagDateTime: true, tagArtist: true, tagHostComputer: true, tagCopyright: true,
+	tagXMP: true, tagIPTC: true, tagPhotoshop: true, tagExifIFD: true, tagGPSIFD: true,
+	tagCameraSerialNumber: true,
+}
+
+// Markers of JPEG segments kept by MetadataStripAll: JFIF, ICC profiles and
+// the Adobe segment, which decoders need to read the colours right
+const (
+	markerAPP0  = 0xE0
+	markerAPP2  = 0xE2
+	markerAPP14 = 0xEE
+	markerCOM   = 0xFE
+)
+
+// WebP VP8X flags marking the presence of EXIF and XMP chunks
+const (
+	webpFlagEXIF = 0x08
+	webpFlagXMP  = 0x04
+)
+
+// Strip removes the metadata of an image file in format that policy says to
+// and returns the file. Only metadata segments and chunks change; the image
+// data is copied byte for byte, so nothing is re-encoded. Files in formats
+// without metadata, and any file under MetadataKeep, are returned as read
+func Strip(r io.Reader, format string, policy models.MetadataPolicy) ([]byte, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if policy != models.MetadataStripGPS && policy != models.MetadataStripAll {
+		return data, nil
+	}
+
+	var stripped []byte
+	switch format {
+	case "jpeg":
+		stripped, err = stripJPEG(data, policy)
+	case "png":
+		stripped, err = stripPNG(data, policy)
+	case "webp":
+		stripped, err = stripWebP(data, policy)
+	case "tiff":
+		stripped, err = stripTIFF(data, policy)
+	default:
+		return data, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+	return stripped, nil
+}
+
+// stripJPEG rewrites the segments before the image data. Segments after
+// the start of scan are copied unchanged
+func stripJPEG(data []byte, policy models.MetadataPolicy) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != markerSOI {
+		return nil, errors.New("missing JPEG start of image")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+
+	pos := 2
+	for {
+		// Skip the fill bytes before the marker
+		if pos >= len(data) || data[pos] != 0xFF {
+			return nil, errors.New("malformed JPEG marker")
+		}
+		for pos+1 < len(data) && data[pos+1] == 0xFF {
+			pos++
+		}
+		if pos+1 >= len(data) {
+			return nil, errors.New("truncated JPEG")
+		}
+		marker := data[pos+1]
+		if marker == markerSOS || marker == markerEOI {
+			return append(out, data[pos:]...), nil
+		}
+		if marker >= 0xD0 && marker <= 0xD7 || marker == 0x01 {
+			out = append(out, data[pos:pos+2]...)
+			pos += 2
+			continue
+		}
+
+		if pos+4 > len(data) {
+			return nil, errors.New("truncated JPEG")
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return nil, errors.New("malformed JPEG segment length")
+		}
+		segment := data[pos : pos+2+length]
+		payload := segment[4:]
+		pos += 2 + length
+
+		isAPP := marker >= 0xE0 && marker <= 0xEF
+		switch {
+		case marker == markerAPP1 && bytes.HasPrefix(payload, exifSignature):
+			if block := stripEXIF(payload[len(exifSignature):], policy); block != nil {
+				out = appendSegment(out, marker, exifSignature, block)
+			}
+		case marker == markerAPP1 && bytes.HasPrefix(payload, xmpSignature):
+			if block := stripXMP(payload[len(xmpSignature):], policy); block != nil {
+				if len(xmpSignature)+len(block)+2 > 0xFFFF {
+					return nil, errors.New("XMP packet too large for a JPEG segment")
+				}
+				out = appendSegment(out, marker, xmpSignature, block)
+			}
+		case marker == markerAPP1:
+			// Extended XMP and other APP1 payloads cannot be checked
+		case marker == markerAPP0 || marker == markerAPP2 || marker == markerAPP14:
+			out = append(out, segment...)
+		case policy == models.MetadataStripAll && (isAPP || marker == markerCOM):
+		default:
+			out = append(out, segment...)
+		}
+	}
+}
+
+// appendSegment appends a JPEG segment made of payload parts
+func appendSegment(out []byte, marker byte, parts ...[]byte) []byte {
+	length := 2
+	for _, part := range parts {
+		length += len(part)
+	}
+	out = append(out, 0xFF, marker, byte(length>>8), byte(length))
+	for _, part := range parts {
+		out = append(out, part...)
+	}
+	return out
+}
+
+// stripPNG rewrites the eXIf chunk and the text chunks, which hold XMP and
+// other metadata
+func stripPNG(data []byte, policy models.MetadataPolicy) ([]byte, error) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, errors.New("missing PNG signature")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, pngSignature...)
+
+	pos := len(pngSignature)
+	for pos < len(data) {
+		if pos+12 > len(data) {
+			return nil, errors.New("truncated PNG chunk")
+		}
+		length := int(binary.BigEndian.Uint32(data[pos:]))
+		kind := string(data[pos+4 : pos+8])
+		end := pos + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, errors.New("malformed PNG chunk length")
+		}
+		chunk := data[pos:end]
+		body := chunk[8 : 8+length]
+		pos = end
+
+		isText := kind == "tEXt" || kind == "zTXt" || kind == "iTXt"
+		switch {
+		case kind == "eXIf":
+			if block := stripEXIF(body, policy); block != nil {
+				out = appendChunk(out, kind, block)
+			}
+		case kind == "iTXt" && bytes.HasPrefix(body, []byte(pngXMPKeyword+"\x00")):
+			xmp, _, err := pngXMP(body)
+			if err != nil {
+				return nil, err
+			}
+			block := stripXMP(xmp, policy)
+			switch {
+			case block == nil:
+			case bytes.Equal(block, xmp):
+				out = append(out, chunk...)
+			default:
+				// An uncompressed iTXt chunk without language tags
+				text := append([]byte(pngXMPKeyword+"\x00\x00\x00\x00\x00"), block...)
+				out = appendChunk(out, kind, text)
+			}
+		case policy == models.MetadataStripAll && isText:
+		default:
+			out = append(out, chunk...)
+		}
+		if kind == "IEND" {
+			break
+		}
+	}
+	return out, nil
+}
+
+// appendChunk appends a PNG chunk with its CRC
+func appendChunk(out []byte, kind string, body []byte) []byte {
+	out = binary.BigEndian.AppendUint32(out, uint32(len(body)))
+	start := len(out)
+	out = append(out, kind...)
+	out = append(out, body...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[start:]))
+}
+
+// stripWebP rewrites the EXIF and XMP chunks and updates the flags that
+// announce them
+func stripWebP(data []byte, policy models.MetadataPolicy) ([]byte, error) {
+	if len(data) < 12 || string(data[:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errors.New("missing WebP header")
+	}
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:12]...)
+
+	flags := -1
+	var hasEXIF, hasXMP bool
+	pos := 12
+	for pos+8 <= len(data) {
+		kind := string(data[pos : pos+4])
+		length := int(binary.LittleEndian.Uint32(data[pos+4:]))
+		end := pos + 8 + length + length%2
+		if length < 0 || pos+8+length > len(data) {
+			return nil, errors.New("malformed WebP chunk length")
+		}
+		chunk := data[pos:min(end, len(data))]
+		body := chunk[8 : 8+length]
+		pos = end
+
+		switch kind {
+		case "VP8X":
+			if length > 0 {
+				flags = len(out) + 8
+			}
+			out = append(out, chunk...)
+		case "EXIF":
+			// Some writers keep the JPEG signature in front of the TIFF data
+			block := stripEXIF(bytes.TrimPrefix(body, exifSignature), policy)
+			if block != nil {
+				out = appendRIFFChunk(out, kind, block)
+				hasEXIF = true
+			}
+		case "XMP ":
+			if block := stripXMP(body, policy); block != nil {
+				out = appendRIFFChunk(out, kind, block)
+				hasXMP = true
+			}
+		default:
+			out = append(out, chunk...)
+		}
+	}
+
+	if flags >= 0 {
+		out[flags] &^= webpFlagEXIF | webpFlagXMP
+		if hasEXIF {
+			out[flags] |= webpFlagEXIF
+		}
+		if hasXMP {
+			out[flags] |= webpFlagXMP
+		}
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
+
+// appendRIFFChunk appends a RIFF chunk, padded to an even length
+func appendRIFFChunk(out []byte, kind string, body []byte) []byte {
+	out = append(out, kind...)
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(body)))
+	out = append(out, body...)
+	if len(body)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+// stripTIFF removes metadata tags from IFD0 of a TIFF file in place. Later
+// IFDs, the pages of multi-page files, are left as they are
+func stripTIFF(data []byte, policy models.MetadataPolicy) ([]byte, error) {
+	data = bytes.Clone(data)
+	t, err := newTIFF(data)
+	if err != nil {
+		return nil, err
+	}
+	ifd0 := t.order.Uint32(data[4:])
+
+	if policy == models.MetadataStripAll {
+		return data, t.removeTags(ifd0, metadataTIFFTags)
+	}
+
+	fields, err := t.first()
+	if err != nil {
+		return nil, err
+	}
+	// A packet that needs changing cannot be replaced in place, so it goes
+	remove := privateIFD0Tags
+	if f, ok := fields[tagXMP]; ok && !bytes.Equal(stripXMP(f.value, policy), f.value) {
+		remove = map[uint16]bool{tagXMP: true}
+		for tag := range privateIFD0Tags {
+			remove[tag] = true
+		}
+	}
+	if offset, ok := t.uint(fields, tagExifIFD); ok {
+		if err := t.removeTags(uint32(offset), privateExifTags); err != nil {
+			return nil, err
+		}
+	}
+	return data, t.removeTags(ifd0, remove)
+}
+
+// stripEXIF returns what policy leaves of an EXIF block, or nil if nothing
+// is left. MetadataStripAll keeps only the orientation
+func stripEXIF(block []byte, policy models.MetadataPolicy) []byte {
+	if policy == models.MetadataStripAll {
+		parsed, err := parseEXIF(block)
+		if err != nil {
+			return nil
+		}
+		return orientationEXIF(parsed.metadata.Orientation)
+	}
+
+	// A block that cannot be read cannot be checked, so it goes
+	edited := bytes.Clone(block)
+	t, err := newTIFF(edited)
+	if err != nil {
+		return nil
+	}
+	ifd0, err := t.first()
+	if err != nil {
+		return nil
+	}
+	if offset, ok := t.uint(ifd0, tagExifIFD); ok {
+		if err := t.removeTags(uint32(offset), privateExifTags); err != nil {
+			return nil
+		}
+	}
+	if err := t.removeTags(t.order.Uint32(edited[4:]), privateIFD0Tags); err != nil {
+		return nil
+	}
+	return edited
+}
+
+// orientationEXIF builds an EXIF block holding only an orientation, or nil
+// for the normal orientation, which needs no block
+func orientationEXIF(orientation int) []byte {
+	if orientation <= 1 {
+		return nil
+	}
+	block := []byte("II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00")
+	block = binary.LittleEndian.AppendUint16(block, uint16(orientation))
+	return append(block, 0, 0, 0, 0, 0, 0)
+}
+
+// removeTags deletes the entries of the IFD at offset whose tags are in
+// remove and blanks their values in place, along with any IFDs they point
+// to. The structure keeps its size, so offsets elsewhere stay valid
+func (t *tiff) removeTags(offset uint32, remove map[uint16]bool) error {
+	start := int(offset)
+	if start+2 > len(t.data) {
+		return errMalformedTIFF
+	}
+	count := int(t.order.Uint16(t.data[start:]))
+	end := start + 2 + count*12
+	if count > maxIFDEntries || end+4 > len(t.data) {
+		return errMalformedTIFF
+	}
+	next := t.order.Uint32(t.data[end:])
+
+	kept := 0
+	for i := 0; i < count; i++ {
+		entry := t.data[start+2+i*12 : start+2+(i+1)*12]
+		if remove[t.order.Uint16(entry)] {
+			t.blank(entry, 0)
+			continue
+		}
+		// Entries only move towards the start, over ones already read
+		copy(t.data[start+2+kept*12:], entry)
+		kept++
+	}
+
+	t.order.PutUint16(t.data[start:], uint16(kept))
+	t.order.PutUint32(t.data[start+2+kept*12:], next)
+	clear(t.data[start+2+kept*12+4 : end+4])
+	return nil
+}
+
+// blank zeroes the value of an IFD entry stored outside it and, for entries
+// pointing to IFDs, the IFD pointed to
+func (t *tiff) blank(entry []byte, depth int) {
+	typ := t.order.Uint16(entry[2:])
+	size, ok := typeSizes[typ]
+	if !ok {
+		return
+	}
+	length := uint64(size) * uint64(t.order.Uint32(entry[4:]))
+	if length > 4 {
+		at := uint64(t.order.Uint32(entry[8:]))
+		if at+length <= uint64(len(t.data)) {
+			clear(t.data[at : at+length])
+		}
+	}
+
+	switch t.order.Uint16(entry) {
+	case tagExifIFD, tagGPSIFD, tagInteropIFD:
+		if depth < 4 && length == 4 {
+			t.blankIFD(t.order.Uint32(entry[8:]), depth+1)
+		}
+	}
+}
+
+// blankIFD zeroes an IFD and the values of its entries
+func (t *tiff) blankIFD(offset uint32, depth int) {
+	start := int(offset)
+	if start+2 > len(t.data) {
+		return
+	}
+	count := int(t.order.Uint16(t.data[start:]))
+	end := start + 2 + count*12
+	if count > maxIFDEntries || end+4 > len(t.data) {
+		return
+	}
+	for i := 0; i < count; i++ {
+		t.blank(t.data[start+2+i*12:start+2+(i+1)*12], depth)
+	}
+	clear(t.data[start : end+4])
+}
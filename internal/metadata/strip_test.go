@@ -0,0 +1,215 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"reflect"
+	"testing"
+
+	"image_gallery/internal/models"
+)
+
+// testSerial is the body serial number in privateEXIF
+const testSerial = "SN-0123456789"
+
+// privateEXIF is an EXIF block with a GPS position, a serial number and an
+// orientation
+func privateEXIF() []byte {
+	return buildEXIF(
+		[]entry{ascii(tagMake, "Canon"), ascii(tagModel, "Canon EOS R5"), short(tagOrientation, 6)},
+		[]entry{short(tagISO, 400), ascii(tagBodySerialNumber, testSerial)},
+		[]entry{
+			ascii(tagGPSLatitudeRef, "S"),
+			rationals(tagGPSLatitude, 33, 1, 51, 1, 3546, 100),
+			ascii(tagGPSLongitudeRef, "E"),
+			rationals(tagGPSLongitude, 151, 1, 12, 1, 4068, 100),
+		},
+	)
+}
+
+// privateXMPPacket is an XMP packet with a caption and a GPS position
+const privateXMPPacket = `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+ <rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+  <rdf:Description rdf:about="" xmlns:dc="http://purl.org/dc/elements/1.1/"
+    xmlns:exif="http://ns.adobe.com/exif/1.0/" exif:GPSLatitude="33,51.591S">
+   <dc:description><rdf:Alt><rdf:li xml:lang="x-default">Harbour &amp; bridge</rdf:li></rdf:Alt></dc:description>
+  </rdf:Description>
+ </rdf:RDF>
+</x:xmpmeta>`
+
+// imageData returns what follows the start of scan of a JPEG
+func imageData(t *testing.T, content []byte) []byte {
+	t.Helper()
+	i := bytes.Index(content, []byte{0xFF, markerSOS})
+	if i < 0 {
+		t.Fatalf("Expected a start of scan")
+	}
+	return content[i:]
+}
+
+func TestStrip(t *testing.T) {
+	jpegContent := withSegments(t,
+		segment(markerAPP1, exifSignature, privateEXIF()),
+		segment(markerAPP1, xmpSignature, []byte(privateXMPPacket)),
+		segment(markerAPP13, photoshopSignature, testIPTC()),
+		segment(markerCOM, []byte("Shot by Jane Doe")),
+	)
+
+	t.Run("JPEG_StripGPS", func(t *testing.T) {
+		stripped, err := Strip(bytes.NewReader(jpegContent), "jpeg", models.MetadataStripGPS)
+		if err != nil {
+			t.Fatalf("Failed to strip: %v", err)
+		}
+		if !bytes.Equal(imageData(t, stripped), imageData(t, jpegContent)) {
+			t.Errorf("Expected the image data to be copied unchanged")
+		}
+		if _, err := jpeg.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("Expected a valid JPEG, got %v", err)
+		}
+		if bytes.Contains(stripped, []byte(testSerial)) || bytes.Contains(stripped, []byte("GPSLatitude")) {
+			t.Errorf("Expected the serial number and the XMP position to be removed")
+		}
+
+		metadata, err := Extract(bytes.NewReader(stripped), "jpeg")
+		if err != nil {
+			t.Fatalf("Failed to extract: %v", err)
+		}
+		if metadata == nil || metadata.GPS != nil {
+			t.Fatalf("Expected metadata without a GPS position, got %+v", metadata)
+		}
+		if metadata.CameraModel != "Canon EOS R5" || metadata.ISO != 400 || metadata.Orientation != 6 {
+			t.Errorf("Expected the camera, ISO and orientation to be kept, got %+v", metadata)
+		}
+		if metadata.Caption != "Harbour & bridge" {
+			t.Errorf("Expected the XMP caption to be kept, got %q", metadata.Caption)
+		}
+		if !bytes.Contains(stripped, []byte("Shot by Jane Doe")) {
+			t.Errorf("Expected the comment to be kept")
+		}
+	})
+
+	t.Run("JPEG_StripAll", func(t *testing.T) {
+		stripped, err := Strip(bytes.NewReader(jpegContent), "jpeg", models.MetadataStripAll)
+		if err != nil {
+			t.Fatalf("Failed to strip: %v", err)
+		}
+		if !bytes.Equal(imageData(t, stripped), imageData(t, jpegContent)) {
+			t.Errorf("Expected the image data to be copied unchanged")
+		}
+		for _, private := range []string{"Canon", "Harbour", "IPTC caption", "Jane Doe"} {
+			if bytes.Contains(stripped, []byte(private)) {
+				t.Errorf("Expected %q to be removed", private)
+			}
+		}
+
+		metadata, err := Extract(bytes.NewReader(stripped), "jpeg")
+		if err != nil {
+			t.Fatalf("Failed to extract: %v", err)
+		}
+		if metadata == nil || !reflect.DeepEqual(*metadata, models.Metadata{Orientation: 6}) {
+			t.Errorf("Expected only the orientation to be kept, got %+v", metadata)
+		}
+	})
+
+	t.Run("Keep", func(t *testing.T) {
+		kept, err := Strip(bytes.NewReader(jpegContent), "jpeg", models.MetadataKeep)
+		if err != nil {
+			t.Fatalf("Failed to strip: %v", err)
+		}
+		if !bytes.Equal(kept, jpegContent) {
+			t.Errorf("Expected the file unchanged")
+		}
+	})
+
+	t.Run("PNG_StripAll", func(t *testing.T) {
+		var buf bytes.Buffer
+		png.Encode(&buf, image.NewGray(image.Rect(0, 0, 8, 8)))
+		encoded := buf.Bytes()
+		ihdrEnd := len(pngSignature) + 8 + 13 + 4
+		content := append([]byte(nil), encoded[:ihdrEnd]...)
+		content = append(content, chunk("eXIf", privateEXIF())...)
+		content = append(content, chunk("tEXt", []byte("Author\x00Jane Doe"))...)
+		content = append(content, encoded[ihdrEnd:]...)
+
+		stripped, err := Strip(bytes.NewReader(content), "png", models.MetadataStripAll)
+		if err != nil {
+			t.Fatalf("Failed to strip: %v", err)
+		}
+		if _, err := png.Decode(bytes.NewReader(stripped)); err != nil {
+			t.Errorf("Expected a valid PNG, got %v", err)
+		}
+		if bytes.Contains(stripped, []byte("Jane Doe")) || bytes.Contains(stripped, []byte("Canon")) {
+			t.Errorf("Expected the text and camera to be removed")
+		}
+		if orientation := Orientation(bytes.NewReader(stripped), "png"); orientation != 6 {
+			t.Errorf("Expected orientation 6 to be kept, got %d", orientation)
+		}
+	})
+
+	t.Run("WebP_StripGPS", func(t *testing.T) {
+		encoded, err := os.ReadFile("../imaging/testdata/1x1.webp")
+		if err != nil {
+			t.Fatalf("Failed to read test image: %v", err)
+		}
+		exif := privateEXIF()
+		content := append([]byte(nil), encoded...)
+		content = append(content, "EXIF"...)
+		content = binary.LittleEndian.AppendUint32(content, uint32(len(exif)))
+		content = append(content, exif...)
+		binary.LittleEndian.PutUint32(content[4:], uint32(len(content)-8))
+
+		stripped, err := Strip(bytes.NewReader(content), "webp", models.MetadataStripGPS)
+		if err != nil {
+			t.Fatalf("Failed to strip: %v", err)
+		}
+		if size := binary.LittleEndian.Uint32(stripped[4:]); int(size) != len(stripped)-8 {
+			t.Errorf("Expected a RIFF size of %d, got %d", len(stripped)-8, size)
+		}
+		metadata, err := Extract(bytes.NewReader(stripped), "webp")
+		if err != nil {
+			t.Fatalf("Failed to extract: %v", err)
+		}
+		if metadata == nil || metadata.GPS != nil || metadata.CameraMake != "Canon" {
+			t.Errorf("Expected the camera without a GPS position, got %+v", metadata)
+		}
+	})
+
+	t.Run("TIFF", func(t *testing.T) {
+		stripped, err := Strip(bytes.NewReader(testEXIF()), "tiff", models.MetadataStripGPS)
+		if err != nil {
+			t.Fatalf("Failed to strip: %v", err)
+		}
+		metadata, err := Extract(bytes.NewReader(stripped), "tiff")
+		if err != nil {
+			t.Fatalf("Failed to extract: %v", err)
+		}
+		if metadata == nil || metadata.GPS != nil || metadata.LensModel == "" {
+			t.Errorf("Expected the lens without a GPS position, got %+v", metadata)
+		}
+
+		stripped, err = Strip(bytes.NewReader(testEXIF()), "tiff", models.MetadataStripAll)
+		if err != nil {
+			t.Fatalf("Failed to strip: %v", err)
+		}
+		if len(stripped) != len(testEXIF()) {
+			t.Errorf("Expected the file to keep its size, got %d bytes", len(stripped))
+		}
+		metadata, err = Extract(bytes.NewReader(stripped), "tiff")
+		if err != nil || metadata != nil {
+			t.Errorf("Expected no metadata, got %+v, %v", metadata, err)
+		}
+	})
+
+	t.Run("Malformed", func(t *testing.T) {
+		truncated := jpegContent[:20]
+		_, err := Strip(bytes.NewReader(truncated), "jpeg", models.MetadataStripGPS)
+		if !errors.Is(err, ErrMalformed) {
+			t.Errorf("Expected ErrMalformed, got %v", err)
+		}
+	})
+}
@@ -0,0 +1,178 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io"
+	"strings"
+
+	"image_gallery/internal/models"
+)
+
+// Namespaces of the XMP properties read or removed by the gallery
+const (
+	nsDC   = "http://purl.org/dc/elements/1.1/"
+	nsRDF  = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	nsXML  = "http://www.w3.org/XML/1998/namespace"
+	nsEXIF = "http://ns.adobe.com/exif/1.0/"
+)
+
+// xmp is what is read from an XMP packet
+type xmp struct {
+	caption  string
+	keywords []string
+}
+
+// parseXMP reads dc:description, the caption, and dc:subject, the keywords,
+// from an XMP packet. The caption is the x-default alternative when there
+// is one and the first otherwise
+func parseXMP(data []byte) (xmp, error) {
+	var result xmp
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+
+	// property is the dc property being read, lang the language of the
+	// rdf:li being read and text its content
+	var property, lang string
+	var text strings.Builder
+	var inItem, haveDefault bool
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return result, nil
+		}
+		if err != nil {
+			// The packet's trailer and padding are not always well formed;
+			// anything read before is kept
+			if result.caption == "" && result.keywords == nil {
+				return result, err
+			}
+			return result, nil
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			switch {
+			case token.Name.Space == nsDC && (token.Name.Local == "description" || token.Name.Local == "subject"):
+				property = token.Name.Local
+			case property != "" && token.Name.Space == nsRDF && token.Name.Local == "li":
+				inItem = true
+				lang = ""
+				text.Reset()
+				for _, attr := range token.Attr {
+					if attr.Name.Space == nsXML && attr.Name.Local == "lang" {
+						lang = attr.Value
+					}
+				}
+			}
+		case xml.CharData:
+			if inItem {
+				text.Write(token)
+			}
+		case xml.EndElement:
+			switch {
+			case inItem && token.Name.Space == nsRDF && token.Name.Local == "li":
+				inItem = false
+				value := strings.TrimSpace(text.String())
+				if value == "" {
+					break
+				}
+				switch property {
+				case "description":
+					if !haveDefault && (result.caption == "" || lang == "x-default") {
+						result.caption = value
+						haveDefault = lang == "x-default"
+					}
+				case "subject":
+					result.keywords = append(result.keywords, value)
+				}
+			case token.Name.Space == nsDC && token.Name.Local == property:
+				property = ""
+			}
+		}
+	}
+}
+
+// stripXMP returns what policy leaves of an XMP packet, or nil if nothing
+// is left. Under MetadataStripGPS a packet with private properties is
+// replaced by one holding only its caption and keywords
+func stripXMP(data []byte, policy models.MetadataPolicy) []byte {
+	if policy == models.MetadataStripAll {
+		return nil
+	}
+	if !privateXMP(data) {
+		return data
+	}
+	parsed, _ := parseXMP(data)
+	return buildXMP(parsed)
+}
+
+// privateXMP reports whether an XMP packet has location, serial number or
+// owner properties, as elements or attributes. A packet that cannot be read
+// counts as private
+func privateXMP(data []byte) bool {
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			return true
+		}
+		start, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if privateProperty(start.Name) {
+			return true
+		}
+		for _, attr := range start.Attr {
+			if privateProperty(attr.Name) {
+				return true
+			}
+		}
+	}
+}
+
+// privateProperty reports whether an XMP property is one MetadataStripGPS
+// removes
+func privateProperty(name xml.Name) bool {
+	switch {
+	case name.Space == nsEXIF && strings.HasPrefix(name.Local, "GPS"):
+		return true
+	case strings.Contains(name.Local, "SerialNumber"):
+		return true
+	case name.Local == "OwnerName" || name.Local == "CameraOwnerName":
+		return true
+	}
+	return false
+}
+
+// buildXMP writes an XMP packet holding a caption and keywords, or returns
+// nil if there are neither
+func buildXMP(x xmp) []byte {
+	if x.caption == "" && len(x.keywords) == 0 {
+		return nil
+	}
+	var b bytes.Buffer
+	b.WriteString(`<x:xmpmeta xmlns:x="adobe:ns:meta/"><rdf:RDF xmlns:rdf="` + nsRDF + `">`)
+	b.WriteString(`<rdf:Description rdf:about="" xmlns:dc="` + nsDC + `">`)
+	if x.caption != "" {
+		b.WriteString(`<dc:description><rdf:Alt><rdf:li xml:lang="x-default">`)
+		xml.EscapeText(&b, []byte(x.caption))
+		b.WriteString(`</rdf:li></rdf:Alt></dc:description>`)
+	}
+	if len(x.keywords) > 0 {
+		b.WriteString(`<dc:subject><rdf:Bag>`)
+		for _, keyword := range x.keywords {
+			b.WriteString(`<rdf:li>`)
+			xml.EscapeText(&b, []byte(keyword))
+			b.WriteString(`</rdf:li>`)
+		}
+		b.WriteString(`</rdf:Bag></dc:subject>`)
+	}
+	b.WriteString(`</rdf:Description></rdf:RDF></x:xmpmeta>`)
+	return b.Bytes()
+}
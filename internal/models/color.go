@@ -0,0 +1,96 @@
+package models
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// MinSwatchWeight is the smallest share of an image a swatch must cover for
+// the image to match its colour, so a speck of blue does not make a photo
+// one of "the blue ones"
+const MinSwatchWeight = 0.1
+
+// Swatch is one of the dominant colours of an image
+type Swatch struct {
+	// Color is the sRGB colour as "#rrggbb"
+	Color string `json:"color" dynamodbav:"color"`
+	// Weight is the share of the image the colour covers, from 0 to 1
+	Weight float64 `json:"weight" dynamodbav:"weight"`
+}
+
+// Color is an sRGB colour
+type Color struct {
+	R, G, B uint8
+}
+
+// ParseColor reads a colour written as "#rrggbb" or "#rgb". The # is
+// optional, as it has to be escaped in URLs
+func ParseColor(s string) (Color, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	value, err := strconv.ParseUint(hex, 16, 32)
+	if len(hex) != 6 || err != nil {
+		return Color{}, fmt.Errorf("colour must be #rrggbb or #rgb, got %q", s)
+	}
+	return Color{R: uint8(value >> 16), G: uint8(value >> 8), B: uint8(value)}, nil
+}
+
+// Hex writes the colour as "#rrggbb"
+func (c Color) Hex() string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// Distance is the CIE76 colour difference between c and other: the
+// distance of their CIELAB coordinates. Around 2 is just noticeable and
+// over 50 are different colours
+func (c Color) Distance(other Color) float64 {
+	l1, a1, b1 := c.lab()
+	l2, a2, b2 := other.lab()
+	return math.Sqrt((l1-l2)*(l1-l2) + (a1-a2)*(a1-a2) + (b1-b2)*(b1-b2))
+}
+
+// lab converts the colour to CIELAB under the D65 white point
+func (c Color) lab() (float64, float64, float64) {
+	linear := func(v uint8) float64 {
+		s := float64(v) / 255
+		if s <= 0.04045 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	r, g, b := linear(c.R), linear(c.G), linear(c.B)
+	x := (0.4124*r + 0.3576*g + 0.1805*b) / 0.95047
+	y := 0.2126*r + 0.7152*g + 0.0722*b
+	z := (0.0193*r + 0.1192*g + 0.9505*b) / 1.08883
+
+	f := func(t float64) float64 {
+		if t > 216.0/24389 {
+			return math.Cbrt(t)
+		}
+		return (24389.0/27*t + 16) / 116
+	}
+	fx, fy, fz := f(x), f(y), f(z)
+	return 116*fy - 16, 500 * (fx - fy), 200 * (fy - fz)
+}
+
+// ColorDistance is the distance from c to the closest colour of the image's
+// palette covering at least MinSwatchWeight of it. It reports false for
+// images without such a colour, such as those without a palette
+func (i Image) ColorDistance(c Color) (float64, bool) {
+	closest, found := math.Inf(1), false
+	for _, swatch := range i.Palette {
+		if swatch.Weight < MinSwatchWeight {
+			continue
+		}
+		color, err := ParseColor(swatch.Color)
+		if err != nil {
+			continue
+		}
+		closest, found = math.Min(closest, c.Distance(color)), true
+	}
+	return closest, found
+}
@@ -0,0 +1,88 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// EventType is the kind of change an ImageEvent records
+type EventType string
+
+const (
+	EventCreated EventType = "created"
+	EventUpdated EventType = "updated"
+	EventDeleted EventType = "deleted"
+)
+
+// ImageEvent records a change to an image. The outbox is split into shards
+// by image ID; within a shard, sequence numbers are assigned without gaps in
+// the order the changes were committed, so the events of one image are in
+// order. Events carry the fields that changed with their values before and
+// after the change
+type ImageEvent struct {
+	Shard    int       `json:"shard" dynamodbav:"shard"`
+	Sequence int64     `json:"sequence" dynamodbav:"sequence"`
+	Type     EventType `json:"type" dynamodbav:"eventType"`
+	ImageID  string    `json:"imageId" dynamodbav:"imageId"`
+	// ImageVersion is the version the change stored, or for a deletion the
+	// version that was deleted
+	ImageVersion int64 `json:"imageVersion" dynamodbav:"imageVersion"`
+	// Fields are the stored fields an update changed, by their JSON names
+	Fields []string `json:"fields,omitempty" dynamodbav:"fields,omitempty"`
+	// Before and After hold the JSON values of the changed fields on either
+	// side of the change, by JSON name. A creation has every field of the new
+	// record in After and a deletion every field of the old one in Before. A
+	// field missing from a side was not set there
+	Before     map[string]json.RawMessage `json:"before,omitempty" dynamodbav:"before,omitempty"`
+	After      map[string]json.RawMessage `json:"after,omitempty" dynamodbav:"after,omitempty"`
+	OccurredAt time.Time                  `json:"occurredAt" dynamodbav:"occurredAt"`
+}
+
+// ChangedFields returns the JSON names of the fields that differ between two
+// states of an image, sorted. The version counters change on every write and
+// are left out
+func ChangedFields(before, after Image) []string {
+	a, b := fieldValues(before), fieldValues(after)
+	var changed []string
+	for name, value := range b {
+		if old, ok := a[name]; !ok || !bytes.Equal(old, value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range a {
+		if _, ok := b[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// FieldValues returns the JSON values of the named stored fields of an
+// image that are set, or of all of them when names is nil. The version
+// counters are left out
+func FieldValues(image Image, names []string) map[string]json.RawMessage {
+	values := fieldValues(image)
+	if names == nil {
+		return values
+	}
+	picked := make(map[string]json.RawMessage, len(names))
+	for _, name := range names {
+		if value, ok := values[name]; ok {
+			picked[name] = value
+		}
+	}
+	return picked
+}
+
+// fieldValues returns the JSON form of each stored field of an image
+func fieldValues(image Image) map[string]json.RawMessage {
+	data, _ := json.Marshal(image)
+	var values map[string]json.RawMessage
+	json.Unmarshal(data, &values)
+	delete(values, "version")
+	delete(values, SchemaVersionField)
+	return values
+}
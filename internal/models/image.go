@@ -1,17 +1,220 @@
 package models
 
 import (
+	"errors"
+	"fmt"
+	"hash/fnv"
 	"time"
 )
 
 // Image represents image metadata stored in DynamoDB
 type Image struct {
-	ID          string    `json:"id" dynamodbav:"id"`
-	Title       string    `json:"title" dynamodbav:"title"`
-	Description string    `json:"description" dynamodbav:"description"`
-	S3Key       string    `json:"s3Key" dynamodbav:"s3Key"`
-	ContentType string    `json:"contentType" dynamodbav:"contentType"`
-	Size        int64     `json:"size" dynamodbav:"size"`
-	CreatedAt   time.Time `json:"createdAt" dynamodbav:"createdAt"`
-	UpdatedAt   time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
-}
\ No newline at end of file
+	ID            string    `json:"id" dynamodbav:"id"`
+	Title         string    `json:"title" dynamodbav:"title"`
+	Description   string    `json:"description" dynamodbav:"description"`
+	S3Key         string    `json:"s3Key" dynamodbav:"s3Key"`
+	ContentType   string    `json:"contentType" dynamodbav:"contentType"`
+	Size          int64     `json:"size" dynamodbav:"size"`
+	CreatedAt     time.Time `json:"createdAt" dynamodbav:"createdAt"`
+	UpdatedAt     time.Time `json:"updatedAt" dynamodbav:"updatedAt"`
+	Version       int64     `json:"version" dynamodbav:"version"`
+	SchemaVersion int       `json:"schemaVersion" dynamodbav:"schemaVersion"`
+	// Width, Height and PixelFormat come from decoding the upload. They are
+	// zero for images uploaded before uploads were decoded
+	Width       int    `json:"width" dynamodbav:"width"`
+	Height      int    `json:"height" dynamodbav:"height"`
+	PixelFormat string `json:"pixelFormat" dynamodbav:"pixelFormat"`
+	// ExpiresAt is when the image deletes itself, or nil to keep it. DynamoDB
+	// stores it in epoch seconds, and a day later in the time to live attribute
+	ExpiresAt *time.Time `json:"expiresAt,omitempty" dynamodbav:"expiresAt,omitempty,unixtime"`
+	// Status is set while an upload or delete is in progress
+	Status ImageStatus `json:"status,omitempty" dynamodbav:"status,omitempty"`
+	// Variants are resized copies stored next to the original, smallest
+	// first. Images uploaded before variants were generated have none
+	Variants []Variant `json:"variants,omitempty" dynamodbav:"variants,omitempty"`
+	// Placeholder is a data URI of a tiny, blurry copy shown while the image
+	// loads. It is empty for images with transparency and for images
+	// uploaded before placeholders were made
+	Placeholder string `json:"placeholder,omitempty" dynamodbav:"placeholder,omitempty"`
+	// Palette is the image's dominant colours, heaviest first. It is empty
+	// for images uploaded before palettes were made, until they are
+	// backfilled
+	Palette []Swatch `json:"palette,omitempty" dynamodbav:"palette,omitempty"`
+	// PerceptualHash is the 64-bit pHash of the image as uploaded, in hex.
+	// Edits do not change it, so a re-upload of the original still matches
+	PerceptualHash string `json:"perceptualHash,omitempty" dynamodbav:"perceptualHash,omitempty"`
+	// ColorHistogram is the share of the image in each of 64 colour bins,
+	// scaled to 255. Like the hash it is of the image as uploaded, and
+	// both are what similar images are found by
+	ColorHistogram []byte `json:"colorHistogram,omitempty" dynamodbav:"colorHistogram,omitempty"`
+	// DuplicateOf lists the images this one looked like a near-duplicate of
+	// when it was uploaded
+	DuplicateOf []string `json:"duplicateOf,omitempty" dynamodbav:"duplicateOf,omitempty"`
+	// Edits are applied whenever the image is served; the original blob is
+	// never changed. Nil serves the image as uploaded
+	Edits *Edits `json:"edits,omitempty" dynamodbav:"edits,omitempty"`
+	// Metadata is read from the uploaded file. It is nil for files without
+	// any and for images uploaded before metadata was extracted
+	Metadata *Metadata `json:"metadata,omitempty" dynamodbav:"metadata,omitempty"`
+	// MetadataPolicy is the policy the upload was stored under. It is empty
+	// for images uploaded before policies were applied
+	MetadataPolicy MetadataPolicy `json:"metadataPolicy,omitempty" dynamodbav:"metadataPolicy,omitempty"`
+	// NoWatermark serves the image and its variants without the gallery's
+	// watermark
+	NoWatermark bool `json:"noWatermark,omitempty" dynamodbav:"noWatermark,omitempty"`
+}
+
+// Edits is a recipe of lossless edits: the crop is taken first, then the
+// result is rotated and then flipped
+type Edits struct {
+	// Crop is a rectangle of the upright original in its own pixels, or nil
+	// to keep the whole image
+	Crop *Crop `json:"crop,omitempty" dynamodbav:"crop,omitempty"`
+	// Rotate is a clockwise rotation of 0, 90, 180 or 270 degrees
+	Rotate         int  `json:"rotate,omitempty" dynamodbav:"rotate,omitempty"`
+	FlipHorizontal bool `json:"flipHorizontal,omitempty" dynamodbav:"flipHorizontal,omitempty"`
+	FlipVertical   bool `json:"flipVertical,omitempty" dynamodbav:"flipVertical,omitempty"`
+}
+
+// Crop is a rectangle with its top left corner at X, Y
+type Crop struct {
+	X      int `json:"x" dynamodbav:"x"`
+	Y      int `json:"y" dynamodbav:"y"`
+	Width  int `json:"width" dynamodbav:"width"`
+	Height int `json:"height" dynamodbav:"height"`
+}
+
+// IsZero reports whether the edits leave the image unchanged. Nil edits are
+// zero
+func (e *Edits) IsZero() bool {
+	return e == nil || (e.Crop == nil && e.Rotate == 0 && !e.FlipHorizontal && !e.FlipVertical)
+}
+
+// Validate checks the edits against an image of width by height pixels.
+// The crop is only checked for being non-empty when the size is unknown
+func (e *Edits) Validate(width, height int) error {
+	if e == nil {
+		return nil
+	}
+	switch e.Rotate {
+	case 0, 90, 180, 270:
+	default:
+		return fmt.Errorf("rotate must be 0, 90, 180 or 270, got %d", e.Rotate)
+	}
+	if crop := e.Crop; crop != nil {
+		if crop.X < 0 || crop.Y < 0 || crop.Width <= 0 || crop.Height <= 0 {
+			return errors.New("crop must have a non-negative position and a positive size")
+		}
+		if width > 0 && height > 0 && (crop.X+crop.Width > width || crop.Y+crop.Height > height) {
+			return fmt.Errorf("crop must lie within the %dx%d image", width, height)
+		}
+	}
+	return nil
+}
+
+// String is a canonical form of the edits, empty when they are zero
+func (e *Edits) String() string {
+	if e.IsZero() {
+		return ""
+	}
+	s := fmt.Sprintf("r%d", e.Rotate)
+	if e.Crop != nil {
+		s += fmt.Sprintf("-c%d,%d,%d,%d", e.Crop.X, e.Crop.Y, e.Crop.Width, e.Crop.Height)
+	}
+	if e.FlipHorizontal {
+		s += "-fh"
+	}
+	if e.FlipVertical {
+		s += "-fv"
+	}
+	return s
+}
+
+// Dimensions returns the size of the image as served, after its edits.
+// Both are zero when the size of the original is unknown
+func (i Image) Dimensions() (int, int) {
+	width, height := i.Width, i.Height
+	if i.Edits == nil || width == 0 || height == 0 {
+		return width, height
+	}
+	if crop := i.Edits.Crop; crop != nil {
+		width, height = crop.Width, crop.Height
+	}
+	if i.Edits.Rotate == 90 || i.Edits.Rotate == 270 {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// Variant is a resized copy of an image, generated on upload
+type Variant struct {
+	// Size is the bound on the longer side the variant was made for; Width
+	// and Height are smaller when the original was
+	Size        int    `json:"size" dynamodbav:"size"`
+	Width       int    `json:"width" dynamodbav:"width"`
+	Height      int    `json:"height" dynamodbav:"height"`
+	Key         string `json:"key" dynamodbav:"key"`
+	ContentType string `json:"contentType" dynamodbav:"contentType"`
+}
+
+// VariantKey is the storage key of the variant of image id made for size
+// with edits applied. The base name is the image ID, like the original's
+// key. Edited variants are kept under a hash of the edits, so a browser
+// never shows a variant cached before the edits changed
+func VariantKey(id string, size int, extension string, edits *Edits) string {
+	if edits.IsZero() {
+		return fmt.Sprintf("variants/%d/%s%s", size, id, extension)
+	}
+	hash := fnv.New32a()
+	hash.Write([]byte(edits.String()))
+	return fmt.Sprintf("variants/%d/%08x/%s%s", size, hash.Sum32(), id, extension)
+}
+
+// Keys returns the storage keys of the original and its variants
+func (i Image) Keys() []string {
+	keys := []string{i.S3Key}
+	for _, variant := range i.Variants {
+		keys = append(keys, variant.Key)
+	}
+	return keys
+}
+
+// Thumbnail returns the key of the smallest variant made for at least size
+// pixels, the largest variant if none is, or the original if the image has
+// no variants
+func (i Image) Thumbnail(size int) string {
+	for _, variant := range i.Variants {
+		if variant.Size >= size {
+			return variant.Key
+		}
+	}
+	if len(i.Variants) > 0 {
+		return i.Variants[len(i.Variants)-1].Key
+	}
+	return i.S3Key
+}
+
+// ImageStatus tracks an image through the steps of an upload or delete that
+// touch both storage and metadata
+type ImageStatus string
+
+const (
+	// StatusReady is a completed upload. Records written before statuses
+	// were introduced have it too
+	StatusReady ImageStatus = ""
+	// StatusUploading is recorded before the blob is uploaded
+	StatusUploading ImageStatus = "uploading"
+	// StatusDeleting is recorded before the blob is deleted
+	StatusDeleting ImageStatus = "deleting"
+)
+
+// Pending reports whether an upload or delete of the image has not finished.
+// Pending images are not shown
+func (i Image) Pending() bool {
+	return i.Status != StatusReady
+}
+
+// Expired reports whether the image has reached its expiry time
+func (i Image) Expired(now time.Time) bool {
+	return i.ExpiresAt != nil && !now.Before(*i.ExpiresAt)
+}
@@ -62,4 +62,210 @@ func TestImageSerialization(t *testing.T) {
 			t.Errorf("Expected UpdatedAt %v, got %v", testImage.UpdatedAt, unmarshaledImage.UpdatedAt)
 		}
 	})
-}
\ No newline at end of file
+}
+func TestImageExpired(t *testing.T) {
+	now := time.Now()
+	past := now.Add(-time.Minute)
+	future := now.Add(time.Minute)
+
+	tests := []struct {
+		name      string
+		expiresAt *time.Time
+		want      bool
+	}{
+		{"NoExpiry", nil, false},
+		{"Past", &past, true},
+		{"Now", &now, true},
+		{"Future", &future, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image := Image{ID: "test-id", ExpiresAt: tt.expiresAt}
+			if got := image.Expired(now); got != tt.want {
+				t.Errorf("Expected Expired to be %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestImageThumbnail(t *testing.T) {
+	image := Image{
+		ID:    "test-id",
+		S3Key: "test-id.jpg",
+		Variants: []Variant{
+			{Size: 256, Key: VariantKey("test-id", 256, ".jpg", nil)},
+			{Size: 1024, Key: VariantKey("test-id", 1024, ".jpg", nil)},
+		},
+	}
+
+	tests := []struct {
+		size int
+		want string
+	}{
+		{100, "variants/256/test-id.jpg"},
+		{256, "variants/256/test-id.jpg"},
+		{512, "variants/1024/test-id.jpg"},
+		{2048, "variants/1024/test-id.jpg"},
+	}
+	for _, tt := range tests {
+		if got := image.Thumbnail(tt.size); got != tt.want {
+			t.Errorf("Expected Thumbnail(%d) to be %s, got %s", tt.size, tt.want, got)
+		}
+	}
+
+	if got := (Image{S3Key: "old.jpg"}).Thumbnail(256); got != "old.jpg" {
+		t.Errorf("Expected images without variants to use the original, got %s", got)
+	}
+
+	keys := image.Keys()
+	if len(keys) != 3 || keys[0] != "test-id.jpg" || keys[2] != "variants/1024/test-id.jpg" {
+		t.Errorf("Expected the original and variant keys, got %v", keys)
+	}
+}
+
+func TestEdits(t *testing.T) {
+	t.Run("Validate", func(t *testing.T) {
+		valid := []*Edits{
+			nil,
+			{Rotate: 270, FlipVertical: true},
+			{Crop: &Crop{X: 10, Y: 20, Width: 90, Height: 80}},
+		}
+		for _, edits := range valid {
+			if err := edits.Validate(100, 100); err != nil {
+				t.Errorf("Expected %+v to be valid, got %v", edits, err)
+			}
+		}
+
+		invalid := []*Edits{
+			{Rotate: 45},
+			{Crop: &Crop{X: -1, Y: 0, Width: 10, Height: 10}},
+			{Crop: &Crop{X: 0, Y: 0, Width: 0, Height: 10}},
+			{Crop: &Crop{X: 50, Y: 0, Width: 51, Height: 10}},
+		}
+		for _, edits := range invalid {
+			if err := edits.Validate(100, 100); err == nil {
+				t.Errorf("Expected %+v to be rejected", edits)
+			}
+		}
+	})
+
+	t.Run("Dimensions", func(t *testing.T) {
+		image := Image{Width: 400, Height: 300, Edits: &Edits{Crop: &Crop{Width: 200, Height: 100}, Rotate: 90}}
+		if width, height := image.Dimensions(); width != 100 || height != 200 {
+			t.Errorf("Expected 100x200, got %dx%d", width, height)
+		}
+	})
+
+	t.Run("VariantKey", func(t *testing.T) {
+		edited := VariantKey("test-id", 256, ".jpg", &Edits{Rotate: 90})
+		if edited == VariantKey("test-id", 256, ".jpg", nil) {
+			t.Errorf("Expected edited variants to have their own key, got %s", edited)
+		}
+		if other := VariantKey("test-id", 256, ".jpg", &Edits{Rotate: 180}); other == edited {
+			t.Errorf("Expected different edits to have different keys, got %s", other)
+		}
+		if got := VariantKey("test-id", 256, ".jpg", &Edits{}); got != "variants/256/test-id.jpg" {
+			t.Errorf("Expected zero edits to use the plain key, got %s", got)
+		}
+	})
+}
+
+func TestMetadataPolicy(t *testing.T) {
+	t.Run("Parse", func(t *testing.T) {
+		for _, name := range []string{"keep", "strip-gps", "strip-all"} {
+			if policy, err := ParseMetadataPolicy(name); err != nil || string(policy) != name {
+				t.Errorf("Expected %s to parse, got %q, %v", name, policy, err)
+			}
+		}
+		if _, err := ParseMetadataPolicy("strip"); err == nil {
+			t.Errorf("Expected an unknown policy to be rejected")
+		}
+	})
+
+	t.Run("Redact", func(t *testing.T) {
+		metadata := &Metadata{CameraModel: "X100V", GPS: &GPS{Latitude: 51.5}, Orientation: 6}
+
+		if redacted := MetadataKeep.Redact(metadata); redacted.GPS == nil {
+			t.Errorf("Expected keep to leave the GPS position")
+		}
+		if redacted := MetadataStripGPS.Redact(metadata); redacted.GPS != nil || redacted.CameraModel != "X100V" {
+			t.Errorf("Expected strip-gps to remove only the GPS position, got %+v", redacted)
+		}
+		if redacted := MetadataStripAll.Redact(metadata); redacted.CameraModel != "" || redacted.Orientation != 6 {
+			t.Errorf("Expected strip-all to keep only the orientation, got %+v", redacted)
+		}
+		if metadata.GPS == nil {
+			t.Errorf("Expected the metadata to be left unchanged")
+		}
+		if redacted := MetadataStripGPS.Redact(&Metadata{GPS: &GPS{}}); redacted != nil {
+			t.Errorf("Expected nothing to be left, got %+v", redacted)
+		}
+	})
+}
+
+func TestColor(t *testing.T) {
+	t.Run("Parse", func(t *testing.T) {
+		for _, s := range []string{"#1e88e5", "1E88E5", " #1e88e5 "} {
+			if color, err := ParseColor(s); err != nil || color != (Color{R: 0x1e, G: 0x88, B: 0xe5}) {
+				t.Errorf("Expected %q to parse, got %+v, %v", s, color, err)
+			}
+		}
+		if color, err := ParseColor("#f80"); err != nil || color.Hex() != "#ff8800" {
+			t.Errorf("Expected the short form to parse, got %+v, %v", color, err)
+		}
+		for _, s := range []string{"", "#12345", "#ggg", "blue", "#+12345"} {
+			if _, err := ParseColor(s); err == nil {
+				t.Errorf("Expected %q to be rejected", s)
+			}
+		}
+	})
+
+	t.Run("Distance", func(t *testing.T) {
+		blue, navy, red := Color{B: 255}, Color{B: 128}, Color{R: 255}
+		if d := blue.Distance(blue); d != 0 {
+			t.Errorf("Expected no distance to itself, got %g", d)
+		}
+		if blue.Distance(navy) >= blue.Distance(red) {
+			t.Errorf("Expected navy closer to blue than red is")
+		}
+		// Black to white spans the whole lightness scale
+		if d := (Color{}).Distance(Color{R: 255, G: 255, B: 255}); d < 99.9 || d > 100.1 {
+			t.Errorf("Expected a distance of 100 from black to white, got %g", d)
+		}
+	})
+
+	t.Run("ColorDistance", func(t *testing.T) {
+		image := Image{Palette: []Swatch{
+			{Color: "#ff0000", Weight: 0.9},
+			{Color: "#0000ff", Weight: 0.05},
+		}}
+		if d, ok := image.ColorDistance(Color{R: 255}); !ok || d != 0 {
+			t.Errorf("Expected the red swatch to match, got %g, %v", d, ok)
+		}
+		if d, _ := image.ColorDistance(Color{B: 255}); d < 100 {
+			t.Errorf("Expected the speck of blue to be ignored, got %g", d)
+		}
+		if _, ok := (Image{}).ColorDistance(Color{}); ok {
+			t.Errorf("Expected an image without a palette not to match")
+		}
+	})
+}
+
+func TestChangedFields(t *testing.T) {
+	before := Image{ID: "a", Title: "A", Version: 1, SchemaVersion: 2, Placeholder: "data:image/png;base64,AA=="}
+	after := before
+	after.Title = "Renamed"
+	after.Placeholder = ""
+	after.NoWatermark = true
+	after.Version = 2
+	after.SchemaVersion = CurrentSchemaVersion
+
+	got := ChangedFields(before, after)
+	if len(got) != 3 || got[0] != "noWatermark" || got[1] != "placeholder" || got[2] != "title" {
+		t.Errorf("Expected noWatermark, placeholder and title, got %v", got)
+	}
+	if got := ChangedFields(before, before); len(got) != 0 {
+		t.Errorf("Expected no changes, got %v", got)
+	}
+}
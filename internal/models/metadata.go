@@ -0,0 +1,123 @@
+package models
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Metadata is the camera and caption metadata embedded in an uploaded file,
+// read from its EXIF, IPTC and XMP blocks. Fields the file does not carry
+// are left empty
+type Metadata struct {
+	CameraMake  string `json:"cameraMake,omitempty" dynamodbav:"cameraMake,omitempty"`
+	CameraModel string `json:"cameraModel,omitempty" dynamodbav:"cameraModel,omitempty"`
+	LensModel   string `json:"lensModel,omitempty" dynamodbav:"lensModel,omitempty"`
+	// ExposureTime is in seconds, as a fraction such as "1/250"
+	ExposureTime string  `json:"exposureTime,omitempty" dynamodbav:"exposureTime,omitempty"`
+	FNumber      float64 `json:"fNumber,omitempty" dynamodbav:"fNumber,omitempty"`
+	ISO          int     `json:"iso,omitempty" dynamodbav:"iso,omitempty"`
+	// FocalLength is in millimetres
+	FocalLength float64 `json:"focalLength,omitempty" dynamodbav:"focalLength,omitempty"`
+	// DateTimeOriginal is when the photo was taken. Cameras that do not
+	// record their time zone get UTC, so the clock time reads as shot
+	DateTimeOriginal *time.Time `json:"dateTimeOriginal,omitempty" dynamodbav:"dateTimeOriginal,omitempty"`
+	GPS              *GPS       `json:"gps,omitempty" dynamodbav:"gps,omitempty"`
+	Caption          string     `json:"caption,omitempty" dynamodbav:"caption,omitempty"`
+	Keywords         []string   `json:"keywords,omitempty" dynamodbav:"keywords,omitempty"`
+	// Orientation is the EXIF orientation, from 1 to 8, the camera stored
+	// the pixels in. Variants are turned upright and the image's Width and
+	// Height are those of the upright image
+	Orientation int `json:"orientation,omitempty" dynamodbav:"orientation,omitempty"`
+}
+
+// GPS is where a photo was taken, in decimal degrees north and east
+type GPS struct {
+	Latitude  float64 `json:"latitude" dynamodbav:"latitude"`
+	Longitude float64 `json:"longitude" dynamodbav:"longitude"`
+	// Altitude is in metres above sea level, or nil when not recorded
+	Altitude *float64 `json:"altitude,omitempty" dynamodbav:"altitude,omitempty"`
+}
+
+// IsZero reports whether no metadata was found. Nil metadata is zero
+func (m *Metadata) IsZero() bool {
+	return m == nil || (m.CameraMake == "" && m.CameraModel == "" && m.LensModel == "" &&
+		m.ExposureTime == "" && m.FNumber == 0 && m.ISO == 0 && m.FocalLength == 0 &&
+		m.DateTimeOriginal == nil && m.GPS == nil && m.Caption == "" && len(m.Keywords) == 0 &&
+		m.Orientation <= 1)
+}
+
+// Camera names the camera, without repeating the make when the model
+// already starts with it, as many do
+func (m *Metadata) Camera() string {
+	switch {
+	case m.CameraModel == "":
+		return m.CameraMake
+	case m.CameraMake == "" || len(m.CameraModel) >= len(m.CameraMake) && strings.EqualFold(m.CameraModel[:len(m.CameraMake)], m.CameraMake):
+		return m.CameraModel
+	default:
+		return m.CameraMake + " " + m.CameraModel
+	}
+}
+
+// Exposure summarises the exposure settings, such as "1/250 s · f/2.8 ·
+// ISO 400 · 35 mm", leaving out those not recorded
+func (m *Metadata) Exposure() string {
+	var parts []string
+	if m.ExposureTime != "" {
+		parts = append(parts, m.ExposureTime+" s")
+	}
+	if m.FNumber > 0 {
+		parts = append(parts, fmt.Sprintf("f/%g", m.FNumber))
+	}
+	if m.ISO > 0 {
+		parts = append(parts, fmt.Sprintf("ISO %d", m.ISO))
+	}
+	if m.FocalLength > 0 {
+		parts = append(parts, fmt.Sprintf("%g mm", m.FocalLength))
+	}
+	return strings.Join(parts, " · ")
+}
+
+// MetadataPolicy is what is removed from the metadata embedded in an upload
+// before it is stored
+type MetadataPolicy string
+
+const (
+	// MetadataKeep stores uploads as they are
+	MetadataKeep MetadataPolicy = "keep"
+	// MetadataStripGPS removes the GPS position, serial numbers, the owner's
+	// name and maker notes, which hold serial numbers, and keeps the rest
+	MetadataStripGPS MetadataPolicy = "strip-gps"
+	// MetadataStripAll removes all metadata except the orientation, which
+	// is needed to display the image the right way up
+	MetadataStripAll MetadataPolicy = "strip-all"
+)
+
+// ParseMetadataPolicy reads a policy by name
+func ParseMetadataPolicy(s string) (MetadataPolicy, error) {
+	switch policy := MetadataPolicy(s); policy {
+	case MetadataKeep, MetadataStripGPS, MetadataStripAll:
+		return policy, nil
+	}
+	return "", fmt.Errorf("metadata policy must be keep, strip-gps or strip-all, got %q", s)
+}
+
+// Redact returns what the policy leaves of metadata read from an upload, so
+// the record does not keep what was removed from the file
+func (p MetadataPolicy) Redact(m *Metadata) *Metadata {
+	if m == nil {
+		return nil
+	}
+	redacted := *m
+	switch p {
+	case MetadataStripGPS:
+		redacted.GPS = nil
+	case MetadataStripAll:
+		redacted = Metadata{Orientation: m.Orientation}
+	}
+	if redacted.IsZero() {
+		return nil
+	}
+	return &redacted
+}
@@ -0,0 +1,206 @@
+package models
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"path"
+	"time"
+)
+
+// CurrentSchemaVersion is the schema version of Image records written by
+// this build. Bump it together with a new entry in migrations, in the same
+// change, whenever the stored shape of Image changes, also when older
+// records need nothing filled in: their entry uses unchanged, lists the
+// fields it introduced and says what their absence means.
+//
+// Versions 4 to 15 were registered after the fields they describe had
+// shipped, so records written in between are stamped 3 but may already
+// carry some of those fields. Those versions only re-label records, so
+// such records read the same as any other
+const CurrentSchemaVersion = 16
+
+// SchemaVersionField is the stored attribute holding a record's schema
+// version. Records written before it existed are version 2 if they carry
+// the version counter and version 1 otherwise
+const SchemaVersionField = "schemaVersion"
+
+// Record is a stored image record decoded into generic values, as found in
+// images.json or a DynamoDB item, before it is converted to an Image
+type Record map[string]any
+
+// Migration upgrades a record from schema version From to From+1
+type Migration struct {
+	From        int
+	Description string
+	// Fields are the stored fields version From+1 introduced, by JSON name,
+	// with a dot for a field within one
+	Fields  []string
+	Migrate func(Record) error
+}
+
+// migrations is the registry of record migrations, ordered by From
+var migrations = []Migration{
+	{
+		From:        1,
+		Description: "add the version counter used for optimistic concurrency",
+		Fields:      []string{"version"},
+		Migrate: func(r Record) error {
+			if _, ok := r["version"]; !ok {
+				r["version"] = 0
+			}
+			return nil
+		},
+	},
+	{
+		From:        2,
+		Description: "fill in missing content types and update times",
+		Fields:      []string{"schemaVersion"},
+		Migrate: func(r Record) error {
+			if s, _ := r["contentType"].(string); s == "" {
+				if key, _ := r["s3Key"].(string); key != "" {
+					if contentType := mime.TypeByExtension(path.Ext(key)); contentType != "" {
+						r["contentType"] = contentType
+					}
+				}
+			}
+			if s, _ := r["updatedAt"].(string); s == "" || s == (time.Time{}).Format(time.RFC3339) {
+				if createdAt, ok := r["createdAt"]; ok {
+					r["updatedAt"] = createdAt
+				}
+			}
+			return nil
+		},
+	},
+	{
+		From:        3,
+		Description: "add expiresAt; records without it never expire",
+		Fields:      []string{"expiresAt"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        4,
+		Description: "add the upload and delete status; records without it are finished",
+		Fields:      []string{"status"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        5,
+		Description: "add width, height and pixel format; records without them have unknown dimensions",
+		Fields:      []string{"width", "height", "pixelFormat"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        6,
+		Description: "add resized variants; records without them are served from the original",
+		Fields:      []string{"variants"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        7,
+		Description: "add edits; records without them are served as uploaded",
+		Fields:      []string{"edits"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        8,
+		Description: "add metadata extracted from the upload; records without it show none",
+		Fields:      []string{"metadata"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        9,
+		Description: "add the EXIF orientation to metadata; records without it have none recorded, as images are turned upright from the file itself",
+		Fields:      []string{"metadata.orientation"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        10,
+		Description: "add the metadata policy; records without it were stored with their metadata untouched",
+		Fields:      []string{"metadataPolicy"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        11,
+		Description: "add the watermark opt-out; records without it are watermarked",
+		Fields:      []string{"noWatermark"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        12,
+		Description: "add the loading placeholder; records without it load without one",
+		Fields:      []string{"placeholder"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        13,
+		Description: "add the colour palette; records without it are filled in by backfill-palettes",
+		Fields:      []string{"palette"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        14,
+		Description: "add the perceptual hash and duplicate links; records without a hash are filled in by backfill-features",
+		Fields:      []string{"perceptualHash", "duplicateOf"},
+		Migrate:     unchanged,
+	},
+	{
+		From:        15,
+		Description: "add the colour histogram; records without it are filled in by backfill-features",
+		Fields:      []string{"colorHistogram"},
+		Migrate:     unchanged,
+	},
+}
+
+// unchanged is the migration of a change that only added fields whose zero
+// value is right for the records written before it. Such a migration only
+// re-labels the record, and its Fields say what the version added
+func unchanged(Record) error {
+	return nil
+}
+
+// Migrations returns the registered migrations in order
+func Migrations() []Migration {
+	return append([]Migration(nil), migrations...)
+}
+
+// SchemaVersionOf returns the schema version stored in a record
+func SchemaVersionOf(r Record) int {
+	switch v := r[SchemaVersionField].(type) {
+	case float64:
+		return int(v)
+	case int:
+		return v
+	case int64:
+		return int(v)
+	case json.Number:
+		n, _ := v.Int64()
+		return int(n)
+	}
+	if _, ok := r["version"]; ok {
+		return 2
+	}
+	return 1
+}
+
+// MigrateRecord upgrades r in place to CurrentSchemaVersion and returns the
+// version it was stored with. Records from a newer schema are rejected
+// rather than silently losing the fields this build does not know about
+func MigrateRecord(r Record) (int, error) {
+	from := SchemaVersionOf(r)
+	if from > CurrentSchemaVersion {
+		return from, fmt.Errorf("record %v has schema version %d, newer than the supported %d", r["id"], from, CurrentSchemaVersion)
+	}
+
+	for _, migration := range migrations {
+		if migration.From < from {
+			continue
+		}
+		if err := migration.Migrate(r); err != nil {
+			return from, fmt.Errorf("failed to migrate record %v from schema version %d: %w", r["id"], migration.From, err)
+		}
+	}
+	r[SchemaVersionField] = CurrentSchemaVersion
+
+	return from, nil
+}
@@ -0,0 +1,337 @@
+package models
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func loadRecord(t *testing.T, name string) Record {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatalf("Failed to read fixture: %v", err)
+	}
+
+	var record Record
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&record); err != nil {
+		t.Fatalf("Failed to parse fixture: %v", err)
+	}
+	return record
+}
+
+func recordToImage(t *testing.T, record Record) Image {
+	t.Helper()
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatalf("Failed to marshal record: %v", err)
+	}
+	var image Image
+	if err := json.Unmarshal(data, &image); err != nil {
+		t.Fatalf("Failed to unmarshal record: %v", err)
+	}
+	return image
+}
+
+func TestMigrationRegistry(t *testing.T) {
+	if len(migrations) != CurrentSchemaVersion-1 {
+		t.Fatalf("Expected %d migrations, got %d", CurrentSchemaVersion-1, len(migrations))
+	}
+	for i, migration := range migrations {
+		if migration.From != i+1 {
+			t.Errorf("Expected migration %d to start at schema version %d, got %d", i, i+1, migration.From)
+		}
+		if migration.Description == "" || migration.Migrate == nil || len(migration.Fields) == 0 {
+			t.Errorf("Migration from schema version %d is incomplete", migration.From)
+		}
+	}
+}
+
+// TestMigrationsCoverStoredFields fails when a field is stored without a
+// schema version that introduces it
+func TestMigrationsCoverStoredFields(t *testing.T) {
+	// The fields of version 1 records
+	introduced := map[string]bool{"id": true, "title": true, "description": true, "s3Key": true, "contentType": true, "size": true, "createdAt": true, "updatedAt": true}
+	for _, migration := range migrations {
+		for _, field := range migration.Fields {
+			introduced[strings.Split(field, ".")[0]] = true
+		}
+	}
+
+	image := reflect.TypeFor[Image]()
+	for i := range image.NumField() {
+		name := strings.Split(image.Field(i).Tag.Get("json"), ",")[0]
+		if !introduced[name] {
+			t.Errorf("Field %s is stored but no schema version introduces it; bump CurrentSchemaVersion and register a migration", name)
+		}
+		delete(introduced, name)
+	}
+	for name := range introduced {
+		t.Errorf("Schema versions introduce %s, which Image does not store", name)
+	}
+}
+
+func TestMigrateRecord(t *testing.T) {
+	// There is a fixture for every schema version before the current one
+	tests := []struct {
+		fixture string
+		from    int
+		want    Image
+		// kept reports whether the fields the version introduced survived
+		kept func(Image) bool
+	}{
+		{
+			fixture: "image_v1.json",
+			from:    1,
+			want: Image{
+				ID:          "v1-image",
+				ContentType: "image/png",
+				Size:        2048,
+				CreatedAt:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+				Version:     0,
+			},
+		},
+		{
+			fixture: "image_v2.json",
+			from:    2,
+			want: Image{
+				ID:          "v2-image",
+				ContentType: "image/jpeg",
+				Size:        4096,
+				CreatedAt:   time.Date(2024, 3, 4, 5, 6, 7, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 3, 5, 5, 6, 7, 0, time.UTC),
+				Version:     4,
+			},
+		},
+		{
+			fixture: "image_v3.json",
+			from:    3,
+			want: Image{
+				ID:          "v3-image",
+				ContentType: "image/gif",
+				Size:        8192,
+				CreatedAt:   time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 5, 7, 7, 8, 9, 0, time.UTC),
+				Version:     2,
+			},
+		},
+		{
+			fixture: "image_v4.json",
+			from:    4,
+			want: Image{
+				ID:          "v4-image",
+				ContentType: "image/jpeg",
+				Size:        4096,
+				CreatedAt:   time.Date(2024, 6, 4, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 4, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool {
+				return image.ExpiresAt != nil && image.ExpiresAt.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+			},
+		},
+		{
+			fixture: "image_v5.json",
+			from:    5,
+			want: Image{
+				ID:          "v5-image",
+				ContentType: "image/jpeg",
+				Size:        5120,
+				CreatedAt:   time.Date(2024, 6, 5, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 5, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool { return image.Status == StatusDeleting },
+		},
+		{
+			fixture: "image_v6.json",
+			from:    6,
+			want: Image{
+				ID:          "v6-image",
+				ContentType: "image/jpeg",
+				Size:        6144,
+				CreatedAt:   time.Date(2024, 6, 6, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 6, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool {
+				return image.Width == 640 && image.Height == 480 && image.PixelFormat == "ycbcr"
+			},
+		},
+		{
+			fixture: "image_v7.json",
+			from:    7,
+			want: Image{
+				ID:          "v7-image",
+				ContentType: "image/jpeg",
+				Size:        7168,
+				CreatedAt:   time.Date(2024, 6, 7, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 7, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool { return len(image.Variants) == 1 && image.Variants[0].Key == "v7-image_256.jpg" },
+		},
+		{
+			fixture: "image_v8.json",
+			from:    8,
+			want: Image{
+				ID:          "v8-image",
+				ContentType: "image/jpeg",
+				Size:        8192,
+				CreatedAt:   time.Date(2024, 6, 8, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 8, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool { return image.Edits != nil && image.Edits.Rotate == 90 },
+		},
+		{
+			fixture: "image_v9.json",
+			from:    9,
+			want: Image{
+				ID:          "v9-image",
+				ContentType: "image/jpeg",
+				Size:        9216,
+				CreatedAt:   time.Date(2024, 6, 9, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 9, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool { return image.Metadata != nil && image.Metadata.CameraMake == "Canon" },
+		},
+		{
+			fixture: "image_v10.json",
+			from:    10,
+			want: Image{
+				ID:          "v10-image",
+				ContentType: "image/jpeg",
+				Size:        10240,
+				CreatedAt:   time.Date(2024, 6, 10, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 10, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool { return image.Metadata != nil && image.Metadata.Orientation == 6 },
+		},
+		{
+			fixture: "image_v11.json",
+			from:    11,
+			want: Image{
+				ID:          "v11-image",
+				ContentType: "image/jpeg",
+				Size:        11264,
+				CreatedAt:   time.Date(2024, 6, 11, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 11, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool { return image.MetadataPolicy == MetadataStripGPS },
+		},
+		{
+			fixture: "image_v12.json",
+			from:    12,
+			want: Image{
+				ID:          "v12-image",
+				ContentType: "image/jpeg",
+				Size:        12288,
+				CreatedAt:   time.Date(2024, 6, 12, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 12, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool { return image.NoWatermark },
+		},
+		{
+			fixture: "image_v13.json",
+			from:    13,
+			want: Image{
+				ID:          "v13-image",
+				ContentType: "image/jpeg",
+				Size:        13312,
+				CreatedAt:   time.Date(2024, 6, 13, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 13, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool { return image.Placeholder == "data:image/png;base64,AA==" },
+		},
+		{
+			fixture: "image_v14.json",
+			from:    14,
+			want: Image{
+				ID:          "v14-image",
+				ContentType: "image/jpeg",
+				Size:        14336,
+				CreatedAt:   time.Date(2024, 6, 14, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 14, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool { return len(image.Palette) == 1 && image.Palette[0].Color == "#336699" },
+		},
+		{
+			fixture: "image_v15.json",
+			from:    15,
+			want: Image{
+				ID:          "v15-image",
+				ContentType: "image/jpeg",
+				Size:        15360,
+				CreatedAt:   time.Date(2024, 6, 15, 10, 0, 0, 0, time.UTC),
+				UpdatedAt:   time.Date(2024, 7, 15, 10, 0, 0, 0, time.UTC),
+				Version:     1,
+			},
+			kept: func(image Image) bool {
+				return image.PerceptualHash == "c3a1f0e07c3c1e0f" && len(image.DuplicateOf) == 1
+			},
+		},
+	}
+
+	if len(tests) != CurrentSchemaVersion-1 {
+		t.Errorf("Expected fixtures for schema versions 1 to %d, got %d", CurrentSchemaVersion-1, len(tests))
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			record := loadRecord(t, tt.fixture)
+
+			from, err := MigrateRecord(record)
+			if err != nil {
+				t.Fatalf("Failed to migrate: %v", err)
+			}
+			if from != tt.from {
+				t.Errorf("Expected stored schema version %d, got %d", tt.from, from)
+			}
+
+			image := recordToImage(t, record)
+			if image.SchemaVersion != CurrentSchemaVersion {
+				t.Errorf("Expected schema version %d, got %d", CurrentSchemaVersion, image.SchemaVersion)
+			}
+			if image.ID != tt.want.ID || image.ContentType != tt.want.ContentType || image.Size != tt.want.Size || image.Version != tt.want.Version {
+				t.Errorf("Expected %+v, got %+v", tt.want, image)
+			}
+			if !image.CreatedAt.Equal(tt.want.CreatedAt) || !image.UpdatedAt.Equal(tt.want.UpdatedAt) {
+				t.Errorf("Expected times %v/%v, got %v/%v", tt.want.CreatedAt, tt.want.UpdatedAt, image.CreatedAt, image.UpdatedAt)
+			}
+
+			if tt.kept != nil && !tt.kept(image) {
+				t.Errorf("Expected the fields of schema version %d to be kept, got %+v", tt.from, image)
+			}
+
+			// Migrating again is a no-op
+			again := fmt.Sprint(record)
+			if from, err := MigrateRecord(record); err != nil || from != CurrentSchemaVersion || fmt.Sprint(record) != again {
+				t.Errorf("Expected a migrated record to be left unchanged, got %v, %v", from, err)
+			}
+		})
+	}
+
+	t.Run("RejectsNewerSchema", func(t *testing.T) {
+		record := Record{"id": "future", SchemaVersionField: float64(CurrentSchemaVersion + 1)}
+		if _, err := MigrateRecord(record); err == nil {
+			t.Errorf("Expected an error for a record from a newer schema")
+		}
+	})
+}
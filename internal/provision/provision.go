@@ -0,0 +1,563 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"image_gallery/internal/services"
+)
+
+// S3API is the subset of the S3 client used for provisioning
+type S3API interface {
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error)
+	GetPublicAccessBlock(ctx context.Context, params *s3.GetPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.GetPublicAccessBlockOutput, error)
+	PutPublicAccessBlock(ctx context.Context, params *s3.PutPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.PutPublicAccessBlockOutput, error)
+	GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error)
+	PutBucketVersioning(ctx context.Context, params *s3.PutBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.PutBucketVersioningOutput, error)
+	GetBucketCors(ctx context.Context, params *s3.GetBucketCorsInput, optFns ...func(*s3.Options)) (*s3.GetBucketCorsOutput, error)
+	PutBucketCors(ctx context.Context, params *s3.PutBucketCorsInput, optFns ...func(*s3.Options)) (*s3.PutBucketCorsOutput, error)
+	GetBucketLifecycleConfiguration(ctx context.Context, params *s3.GetBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLifecycleConfigurationOutput, error)
+	PutBucketLifecycleConfiguration(ctx context.Context, params *s3.PutBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.PutBucketLifecycleConfigurationOutput, error)
+}
+
+// DynamoDBAPI is the subset of the DynamoDB client used for provisioning
+type DynamoDBAPI interface {
+	DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error)
+	CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error)
+	DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error)
+	UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error)
+}
+
+// Spec describes the AWS resources the gallery expects
+type Spec struct {
+	BucketName string
+	TableName  string
+	// Region is used as the bucket location constraint
+	Region string
+	// CORSAllowedOrigins may read images directly from the bucket
+	CORSAllowedOrigins []string
+	// NoncurrentVersionDays is how long overwritten or deleted blobs are kept
+	NoncurrentVersionDays int32
+	// AbortMultipartDays is how long incomplete multipart uploads are kept
+	AbortMultipartDays int32
+}
+
+// Status describes the outcome of provisioning one resource
+type Status string
+
+const (
+	StatusOK      Status = "ok"
+	StatusCreated Status = "created"
+	StatusUpdated Status = "updated"
+	StatusDrift   Status = "drift"
+	StatusSkipped Status = "skipped"
+)
+
+// Result reports the state of a single resource
+type Result struct {
+	Resource string
+	Status   Status
+	Detail   string
+}
+
+func (r Result) String() string {
+	if r.Detail == "" {
+		return fmt.Sprintf("%-8s %s", r.Status, r.Resource)
+	}
+	return fmt.Sprintf("%-8s %s: %s", r.Status, r.Resource, r.Detail)
+}
+
+// Provisioner creates or verifies the gallery's S3 bucket and DynamoDB table
+type Provisioner struct {
+	s3Client       S3API
+	dynamoDBClient DynamoDBAPI
+	spec           Spec
+	// pollInterval is how often table status is checked while waiting
+	pollInterval time.Duration
+}
+
+// NewProvisioner creates a new provisioner for the given spec
+func NewProvisioner(s3Client S3API, dynamoDBClient DynamoDBAPI, spec Spec) *Provisioner {
+	return &Provisioner{
+		s3Client:       s3Client,
+		dynamoDBClient: dynamoDBClient,
+		spec:           spec,
+		pollInterval:   2 * time.Second,
+	}
+}
+
+// step checks one resource and, when fix is requested, brings it in line
+// with the spec. It returns an empty diff when the resource matches
+type step struct {
+	resource string
+	check    func(ctx context.Context) (diff string, err error)
+	fix      func(ctx context.Context, diff string) (Status, error)
+}
+
+// Check compares the expected resources against what exists without
+// changing anything
+func (p *Provisioner) Check(ctx context.Context) ([]Result, error) {
+	return p.run(ctx, false)
+}
+
+// Apply creates missing resources and corrects drifted settings. It is safe
+// to run repeatedly
+func (p *Provisioner) Apply(ctx context.Context) ([]Result, error) {
+	return p.run(ctx, true)
+}
+
+func (p *Provisioner) run(ctx context.Context, fix bool) ([]Result, error) {
+	var results []Result
+
+	for _, s := range p.steps() {
+		diff, err := s.check(ctx)
+		if isNotImplemented(err) {
+			results = append(results, Result{Resource: s.resource, Status: StatusSkipped, Detail: "not supported by this endpoint"})
+			continue
+		}
+		if err != nil {
+			return results, fmt.Errorf("failed to check %s: %w", s.resource, err)
+		}
+
+		if diff == "" {
+			results = append(results, Result{Resource: s.resource, Status: StatusOK})
+			continue
+		}
+
+		if !fix {
+			results = append(results, Result{Resource: s.resource, Status: StatusDrift, Detail: diff})
+			continue
+		}
+
+		status, err := s.fix(ctx, diff)
+		if isNotImplemented(err) {
+			results = append(results, Result{Resource: s.resource, Status: StatusSkipped, Detail: "not supported by this endpoint"})
+			continue
+		}
+		if err != nil {
+			return results, fmt.Errorf("failed to provision %s: %w", s.resource, err)
+		}
+		results = append(results, Result{Resource: s.resource, Status: status, Detail: diff})
+	}
+
+	return results, nil
+}
+
+func (p *Provisioner) steps() []step {
+	bucket := "s3://" + p.spec.BucketName
+	table := "dynamodb://" + p.spec.TableName
+
+	return []step{
+		{resource: bucket, check: p.checkBucket, fix: p.createBucket},
+		{resource: bucket + " public access block", check: p.checkPublicAccessBlock, fix: p.putPublicAccessBlock},
+		{resource: bucket + " versioning", check: p.checkVersioning, fix: p.putVersioning},
+		{resource: bucket + " cors", check: p.checkCORS, fix: p.putCORS},
+		{resource: bucket + " lifecycle", check: p.checkLifecycle, fix: p.putLifecycle},
+		{resource: table, check: p.checkTable, fix: p.createTable},
+		{resource: table + " time to live", check: p.checkTimeToLive, fix: p.enableTimeToLive},
+	}
+}
+
+// S3 bucket
+
+func (p *Provisioner) checkBucket(ctx context.Context) (string, error) {
+	_, err := p.s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: aws.String(p.spec.BucketName)})
+	if isAPIError(err, "NotFound", "NoSuchBucket") {
+		return "bucket does not exist", nil
+	}
+	return "", err
+}
+
+func (p *Provisioner) createBucket(ctx context.Context, _ string) (Status, error) {
+	input := &s3.CreateBucketInput{Bucket: aws.String(p.spec.BucketName)}
+	// us-east-1 is the default location and must not be sent explicitly
+	if p.spec.Region != "" && p.spec.Region != "us-east-1" {
+		input.CreateBucketConfiguration = &s3types.CreateBucketConfiguration{
+			LocationConstraint: s3types.BucketLocationConstraint(p.spec.Region),
+		}
+	}
+
+	_, err := p.s3Client.CreateBucket(ctx, input)
+	if isAPIError(err, "BucketAlreadyOwnedByYou") {
+		return StatusOK, nil
+	}
+	return StatusCreated, err
+}
+
+// Images are served through the application, so the bucket stays private
+func (p *Provisioner) checkPublicAccessBlock(ctx context.Context) (string, error) {
+	result, err := p.s3Client.GetPublicAccessBlock(ctx, &s3.GetPublicAccessBlockInput{Bucket: aws.String(p.spec.BucketName)})
+	// Without the bucket each of its settings is missing too; the bucket step creates it first
+	if isAPIError(err, "NoSuchPublicAccessBlockConfiguration", "NoSuchBucket") {
+		return "public access is not blocked", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	cfg := result.PublicAccessBlockConfiguration
+	if cfg == nil || !aws.ToBool(cfg.BlockPublicAcls) || !aws.ToBool(cfg.BlockPublicPolicy) ||
+		!aws.ToBool(cfg.IgnorePublicAcls) || !aws.ToBool(cfg.RestrictPublicBuckets) {
+		return "public access is only partially blocked", nil
+	}
+	return "", nil
+}
+
+func (p *Provisioner) putPublicAccessBlock(ctx context.Context, _ string) (Status, error) {
+	_, err := p.s3Client.PutPublicAccessBlock(ctx, &s3.PutPublicAccessBlockInput{
+		Bucket: aws.String(p.spec.BucketName),
+		PublicAccessBlockConfiguration: &s3types.PublicAccessBlockConfiguration{
+			BlockPublicAcls:       aws.Bool(true),
+			BlockPublicPolicy:     aws.Bool(true),
+			IgnorePublicAcls:      aws.Bool(true),
+			RestrictPublicBuckets: aws.Bool(true),
+		},
+	})
+	return StatusUpdated, err
+}
+
+func (p *Provisioner) checkVersioning(ctx context.Context) (string, error) {
+	result, err := p.s3Client.GetBucketVersioning(ctx, &s3.GetBucketVersioningInput{Bucket: aws.String(p.spec.BucketName)})
+	if isAPIError(err, "NoSuchBucket") {
+		return "versioning is not enabled", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if result.Status != s3types.BucketVersioningStatusEnabled {
+		return fmt.Sprintf("versioning is %q, expected %q", result.Status, s3types.BucketVersioningStatusEnabled), nil
+	}
+	return "", nil
+}
+
+func (p *Provisioner) putVersioning(ctx context.Context, _ string) (Status, error) {
+	_, err := p.s3Client.PutBucketVersioning(ctx, &s3.PutBucketVersioningInput{
+		Bucket: aws.String(p.spec.BucketName),
+		VersioningConfiguration: &s3types.VersioningConfiguration{
+			Status: s3types.BucketVersioningStatusEnabled,
+		},
+	})
+	return StatusUpdated, err
+}
+
+// expectedCORSRule allows browsers on the configured origins to read images
+func (p *Provisioner) expectedCORSRule() s3types.CORSRule {
+	return s3types.CORSRule{
+		ID:             aws.String("image-gallery-read"),
+		AllowedMethods: []string{"GET", "HEAD"},
+		AllowedOrigins: p.spec.CORSAllowedOrigins,
+		AllowedHeaders: []string{"*"},
+		MaxAgeSeconds:  aws.Int32(3600),
+	}
+}
+
+func (p *Provisioner) checkCORS(ctx context.Context) (string, error) {
+	result, err := p.s3Client.GetBucketCors(ctx, &s3.GetBucketCorsInput{Bucket: aws.String(p.spec.BucketName)})
+	if isAPIError(err, "NoSuchCORSConfiguration", "NoSuchBucket") {
+		return "no CORS configuration", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	expected := p.expectedCORSRule()
+	for _, rule := range result.CORSRules {
+		if aws.ToString(rule.ID) != aws.ToString(expected.ID) {
+			continue
+		}
+		if !sameStrings(rule.AllowedMethods, expected.AllowedMethods) {
+			return fmt.Sprintf("allowed methods %v, expected %v", rule.AllowedMethods, expected.AllowedMethods), nil
+		}
+		if !sameStrings(rule.AllowedOrigins, expected.AllowedOrigins) {
+			return fmt.Sprintf("allowed origins %v, expected %v", rule.AllowedOrigins, expected.AllowedOrigins), nil
+		}
+		return "", nil
+	}
+	return fmt.Sprintf("rule %q is missing", aws.ToString(expected.ID)), nil
+}
+
+func (p *Provisioner) putCORS(ctx context.Context, _ string) (Status, error) {
+	_, err := p.s3Client.PutBucketCors(ctx, &s3.PutBucketCorsInput{
+		Bucket:            aws.String(p.spec.BucketName),
+		CORSConfiguration: &s3types.CORSConfiguration{CORSRules: []s3types.CORSRule{p.expectedCORSRule()}},
+	})
+	return StatusUpdated, err
+}
+
+// expectedLifecycleRules clean up after failed uploads and expire old
+// versions of overwritten or deleted images
+func (p *Provisioner) expectedLifecycleRules() []s3types.LifecycleRule {
+	return []s3types.LifecycleRule{
+		{
+			ID:     aws.String("abort-incomplete-uploads"),
+			Status: s3types.ExpirationStatusEnabled,
+			Filter: &s3types.LifecycleRuleFilterMemberPrefix{Value: ""},
+			AbortIncompleteMultipartUpload: &s3types.AbortIncompleteMultipartUpload{
+				DaysAfterInitiation: aws.Int32(p.spec.AbortMultipartDays),
+			},
+		},
+		{
+			ID:     aws.String("expire-noncurrent-versions"),
+			Status: s3types.ExpirationStatusEnabled,
+			Filter: &s3types.LifecycleRuleFilterMemberPrefix{Value: ""},
+			NoncurrentVersionExpiration: &s3types.NoncurrentVersionExpiration{
+				NoncurrentDays: aws.Int32(p.spec.NoncurrentVersionDays),
+			},
+		},
+	}
+}
+
+func (p *Provisioner) checkLifecycle(ctx context.Context) (string, error) {
+	result, err := p.s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(p.spec.BucketName)})
+	if isAPIError(err, "NoSuchLifecycleConfiguration", "NoSuchBucket") {
+		return "no lifecycle configuration", nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	actual := make(map[string]s3types.LifecycleRule)
+	for _, rule := range result.Rules {
+		actual[aws.ToString(rule.ID)] = rule
+	}
+
+	var diffs []string
+	for _, expected := range p.expectedLifecycleRules() {
+		id := aws.ToString(expected.ID)
+		rule, ok := actual[id]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("rule %q is missing", id))
+		case rule.Status != expected.Status:
+			diffs = append(diffs, fmt.Sprintf("rule %q is %s", id, rule.Status))
+		case expected.AbortIncompleteMultipartUpload != nil &&
+			(rule.AbortIncompleteMultipartUpload == nil ||
+				aws.ToInt32(rule.AbortIncompleteMultipartUpload.DaysAfterInitiation) != aws.ToInt32(expected.AbortIncompleteMultipartUpload.DaysAfterInitiation)):
+			diffs = append(diffs, fmt.Sprintf("rule %q has different days", id))
+		case expected.NoncurrentVersionExpiration != nil &&
+			(rule.NoncurrentVersionExpiration == nil ||
+				aws.ToInt32(rule.NoncurrentVersionExpiration.NoncurrentDays) != aws.ToInt32(expected.NoncurrentVersionExpiration.NoncurrentDays)):
+			diffs = append(diffs, fmt.Sprintf("rule %q has different days", id))
+		}
+	}
+	return strings.Join(diffs, "; "), nil
+}
+
+func (p *Provisioner) putLifecycle(ctx context.Context, _ string) (Status, error) {
+	// Keep rules we do not manage; PutBucketLifecycleConfiguration replaces the whole set
+	rules := p.expectedLifecycleRules()
+	managed := make(map[string]bool)
+	for _, rule := range rules {
+		managed[aws.ToString(rule.ID)] = true
+	}
+
+	result, err := p.s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{Bucket: aws.String(p.spec.BucketName)})
+	if err != nil && !isAPIError(err, "NoSuchLifecycleConfiguration") {
+		return "", err
+	}
+	if result != nil {
+		for _, rule := range result.Rules {
+			if !managed[aws.ToString(rule.ID)] {
+				rules = append(rules, rule)
+			}
+		}
+	}
+
+	_, err = p.s3Client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(p.spec.BucketName),
+		LifecycleConfiguration: &s3types.BucketLifecycleConfiguration{Rules: rules},
+	})
+	return StatusUpdated, err
+}
+
+// DynamoDB table
+
+func (p *Provisioner) describeTable(ctx context.Context) (*dynamodbtypes.TableDescription, error) {
+	result, err := p.dynamoDBClient.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: aws.String(p.spec.TableName)})
+	if isAPIError(err, "ResourceNotFoundException") {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return result.Table, nil
+}
+
+func (p *Provisioner) checkTable(ctx context.Context) (string, error) {
+	table, err := p.describeTable(ctx)
+	if err != nil {
+		return "", err
+	}
+	if table == nil {
+		return "table does not exist", nil
+	}
+
+	for _, key := range table.KeySchema {
+		if key.KeyType == dynamodbtypes.KeyTypeHash && aws.ToString(key.AttributeName) != "id" {
+			return "", fmt.Errorf("table hash key is %q, expected \"id\"; it must be recreated by hand", aws.ToString(key.AttributeName))
+		}
+	}
+	return "", nil
+}
+
+func (p *Provisioner) createTable(ctx context.Context, _ string) (Status, error) {
+	_, err := p.dynamoDBClient.CreateTable(ctx, &dynamodb.CreateTableInput{
+		TableName:            aws.String(p.spec.TableName),
+		AttributeDefinitions: []dynamodbtypes.AttributeDefinition{{AttributeName: aws.String("id"), AttributeType: dynamodbtypes.ScalarAttributeTypeS}},
+		KeySchema:            []dynamodbtypes.KeySchemaElement{{AttributeName: aws.String("id"), KeyType: dynamodbtypes.KeyTypeHash}},
+		BillingMode:          dynamodbtypes.BillingModePayPerRequest,
+	})
+	if isAPIError(err, "ResourceInUseException") {
+		return StatusOK, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return StatusCreated, p.waitForTable(ctx)
+}
+
+// checkTimeToLive verifies that DynamoDB's time to live removes old outbox
+// events and expired image records
+func (p *Provisioner) checkTimeToLive(ctx context.Context) (string, error) {
+	table, err := p.describeTable(ctx)
+	if err != nil {
+		return "", err
+	}
+	if table == nil {
+		return "time to live is not enabled", nil
+	}
+
+	description, err := p.describeTimeToLive(ctx)
+	if err != nil {
+		return "", err
+	}
+	if !timeToLiveEnabled(description) {
+		return "time to live is not enabled", nil
+	}
+	if name := aws.ToString(description.AttributeName); name != services.TimeToLiveAttribute {
+		return fmt.Sprintf("time to live is on %q, expected %q", name, services.TimeToLiveAttribute), nil
+	}
+	return "", nil
+}
+
+// enableTimeToLive enables time to live on the table's attribute. A table
+// has at most one, and DynamoDB takes up to an hour to disable it before it
+// can be moved, so time to live on another attribute is reported rather
+// than changed
+func (p *Provisioner) enableTimeToLive(ctx context.Context, _ string) (Status, error) {
+	description, err := p.describeTimeToLive(ctx)
+	if err != nil {
+		return "", err
+	}
+	name := aws.ToString(description.AttributeName)
+	switch {
+	case timeToLiveEnabled(description):
+		return "", fmt.Errorf("time to live is on %q and a table can only have one: disable it, wait for DynamoDB to finish (up to an hour), then apply again to enable it on %q", name, services.TimeToLiveAttribute)
+	case description != nil && description.TimeToLiveStatus == dynamodbtypes.TimeToLiveStatusDisabling:
+		return "", fmt.Errorf("time to live on %q is still being disabled; apply again once DynamoDB has finished, which takes up to an hour", name)
+	}
+
+	_, err = p.dynamoDBClient.UpdateTimeToLive(ctx, &dynamodb.UpdateTimeToLiveInput{
+		TableName: aws.String(p.spec.TableName),
+		TimeToLiveSpecification: &dynamodbtypes.TimeToLiveSpecification{
+			AttributeName: aws.String(services.TimeToLiveAttribute),
+			Enabled:       aws.Bool(true),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	return StatusUpdated, nil
+}
+
+func (p *Provisioner) describeTimeToLive(ctx context.Context) (*dynamodbtypes.TimeToLiveDescription, error) {
+	result, err := p.dynamoDBClient.DescribeTimeToLive(ctx, &dynamodb.DescribeTimeToLiveInput{TableName: aws.String(p.spec.TableName)})
+	if err != nil {
+		return nil, err
+	}
+	return result.TimeToLiveDescription, nil
+}
+
+// timeToLiveEnabled reports whether time to live is on or being turned on
+func timeToLiveEnabled(description *dynamodbtypes.TimeToLiveDescription) bool {
+	return description != nil &&
+		description.TimeToLiveStatus != dynamodbtypes.TimeToLiveStatusDisabled &&
+		description.TimeToLiveStatus != dynamodbtypes.TimeToLiveStatusDisabling
+}
+
+// waitForTable polls until the table and all of its indexes are active
+func (p *Provisioner) waitForTable(ctx context.Context) error {
+	for {
+		table, err := p.describeTable(ctx)
+		if err != nil {
+			return err
+		}
+		if table != nil && table.TableStatus == dynamodbtypes.TableStatusActive && indexesActive(table) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.pollInterval):
+		}
+	}
+}
+
+func indexesActive(table *dynamodbtypes.TableDescription) bool {
+	for _, index := range table.GlobalSecondaryIndexes {
+		if index.IndexStatus != "" && index.IndexStatus != dynamodbtypes.IndexStatusActive {
+			return false
+		}
+	}
+	return true
+}
+
+// isAPIError reports whether err is an AWS API error with one of the codes
+func isAPIError(err error, codes ...string) bool {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return false
+	}
+	for _, code := range codes {
+		if apiErr.ErrorCode() == code {
+			return true
+		}
+	}
+	return false
+}
+
+// isNotImplemented reports whether the endpoint (e.g. MinIO) does not
+// support an operation
+func isNotImplemented(err error) bool {
+	return isAPIError(err, "NotImplemented", "UnknownOperationException")
+}
+
+// sameStrings compares two string sets ignoring order
+func sameStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
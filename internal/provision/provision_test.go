@@ -0,0 +1,300 @@
+package provision
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	s3types "github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+
+	"image_gallery/internal/services"
+)
+
+// mockS3Client keeps the configuration of a single bucket in memory
+type mockS3Client struct {
+	exists       bool
+	publicAccess *s3types.PublicAccessBlockConfiguration
+	versioning   s3types.BucketVersioningStatus
+	cors         []s3types.CORSRule
+	lifecycle    []s3types.LifecycleRule
+	writes       int
+}
+
+func notFound(code string) error {
+	return &smithy.GenericAPIError{Code: code}
+}
+
+func (m *mockS3Client) HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	if !m.exists {
+		return nil, notFound("NotFound")
+	}
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (m *mockS3Client) CreateBucket(ctx context.Context, params *s3.CreateBucketInput, optFns ...func(*s3.Options)) (*s3.CreateBucketOutput, error) {
+	m.writes++
+	m.exists = true
+	return &s3.CreateBucketOutput{}, nil
+}
+
+func (m *mockS3Client) GetPublicAccessBlock(ctx context.Context, params *s3.GetPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.GetPublicAccessBlockOutput, error) {
+	if !m.exists {
+		return nil, notFound("NoSuchBucket")
+	}
+	if m.publicAccess == nil {
+		return nil, notFound("NoSuchPublicAccessBlockConfiguration")
+	}
+	return &s3.GetPublicAccessBlockOutput{PublicAccessBlockConfiguration: m.publicAccess}, nil
+}
+
+func (m *mockS3Client) PutPublicAccessBlock(ctx context.Context, params *s3.PutPublicAccessBlockInput, optFns ...func(*s3.Options)) (*s3.PutPublicAccessBlockOutput, error) {
+	m.writes++
+	m.publicAccess = params.PublicAccessBlockConfiguration
+	return &s3.PutPublicAccessBlockOutput{}, nil
+}
+
+func (m *mockS3Client) GetBucketVersioning(ctx context.Context, params *s3.GetBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.GetBucketVersioningOutput, error) {
+	if !m.exists {
+		return nil, notFound("NoSuchBucket")
+	}
+	return &s3.GetBucketVersioningOutput{Status: m.versioning}, nil
+}
+
+func (m *mockS3Client) PutBucketVersioning(ctx context.Context, params *s3.PutBucketVersioningInput, optFns ...func(*s3.Options)) (*s3.PutBucketVersioningOutput, error) {
+	m.writes++
+	m.versioning = params.VersioningConfiguration.Status
+	return &s3.PutBucketVersioningOutput{}, nil
+}
+
+func (m *mockS3Client) GetBucketCors(ctx context.Context, params *s3.GetBucketCorsInput, optFns ...func(*s3.Options)) (*s3.GetBucketCorsOutput, error) {
+	if !m.exists {
+		return nil, notFound("NoSuchBucket")
+	}
+	if m.cors == nil {
+		return nil, notFound("NoSuchCORSConfiguration")
+	}
+	return &s3.GetBucketCorsOutput{CORSRules: m.cors}, nil
+}
+
+func (m *mockS3Client) PutBucketCors(ctx context.Context, params *s3.PutBucketCorsInput, optFns ...func(*s3.Options)) (*s3.PutBucketCorsOutput, error) {
+	m.writes++
+	m.cors = params.CORSConfiguration.CORSRules
+	return &s3.PutBucketCorsOutput{}, nil
+}
+
+func (m *mockS3Client) GetBucketLifecycleConfiguration(ctx context.Context, params *s3.GetBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.GetBucketLifecycleConfigurationOutput, error) {
+	if !m.exists {
+		return nil, notFound("NoSuchBucket")
+	}
+	if m.lifecycle == nil {
+		return nil, notFound("NoSuchLifecycleConfiguration")
+	}
+	return &s3.GetBucketLifecycleConfigurationOutput{Rules: m.lifecycle}, nil
+}
+
+func (m *mockS3Client) PutBucketLifecycleConfiguration(ctx context.Context, params *s3.PutBucketLifecycleConfigurationInput, optFns ...func(*s3.Options)) (*s3.PutBucketLifecycleConfigurationOutput, error) {
+	m.writes++
+	m.lifecycle = params.LifecycleConfiguration.Rules
+	return &s3.PutBucketLifecycleConfigurationOutput{}, nil
+}
+
+// mockDynamoDBClient keeps a single table description in memory
+type mockDynamoDBClient struct {
+	table  *dynamodbtypes.TableDescription
+	ttl    *dynamodbtypes.TimeToLiveDescription
+	writes int
+}
+
+func (m *mockDynamoDBClient) DescribeTable(ctx context.Context, params *dynamodb.DescribeTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	if m.table == nil {
+		return nil, notFound("ResourceNotFoundException")
+	}
+	return &dynamodb.DescribeTableOutput{Table: m.table}, nil
+}
+
+func (m *mockDynamoDBClient) CreateTable(ctx context.Context, params *dynamodb.CreateTableInput, optFns ...func(*dynamodb.Options)) (*dynamodb.CreateTableOutput, error) {
+	m.writes++
+	m.table = &dynamodbtypes.TableDescription{
+		TableName:   params.TableName,
+		KeySchema:   params.KeySchema,
+		TableStatus: dynamodbtypes.TableStatusActive,
+	}
+	return &dynamodb.CreateTableOutput{TableDescription: m.table}, nil
+}
+
+func (m *mockDynamoDBClient) DescribeTimeToLive(ctx context.Context, params *dynamodb.DescribeTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DescribeTimeToLiveOutput, error) {
+	if m.ttl == nil {
+		return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: &dynamodbtypes.TimeToLiveDescription{TimeToLiveStatus: dynamodbtypes.TimeToLiveStatusDisabled}}, nil
+	}
+	return &dynamodb.DescribeTimeToLiveOutput{TimeToLiveDescription: m.ttl}, nil
+}
+
+func (m *mockDynamoDBClient) UpdateTimeToLive(ctx context.Context, params *dynamodb.UpdateTimeToLiveInput, optFns ...func(*dynamodb.Options)) (*dynamodb.UpdateTimeToLiveOutput, error) {
+	m.writes++
+	m.ttl = &dynamodbtypes.TimeToLiveDescription{
+		AttributeName:    params.TimeToLiveSpecification.AttributeName,
+		TimeToLiveStatus: dynamodbtypes.TimeToLiveStatusEnabled,
+	}
+	return &dynamodb.UpdateTimeToLiveOutput{TimeToLiveSpecification: params.TimeToLiveSpecification}, nil
+}
+
+func testSpec() Spec {
+	return Spec{
+		BucketName:            "test-bucket",
+		TableName:             "test-table",
+		Region:                "eu-west-1",
+		CORSAllowedOrigins:    []string{"*"},
+		NoncurrentVersionDays: 30,
+		AbortMultipartDays:    7,
+	}
+}
+
+func countStatus(results []Result, status Status) int {
+	count := 0
+	for _, result := range results {
+		if result.Status == status {
+			count++
+		}
+	}
+	return count
+}
+
+func TestProvisioner(t *testing.T) {
+	s3Client := &mockS3Client{}
+	dynamoDBClient := &mockDynamoDBClient{}
+	provisioner := NewProvisioner(s3Client, dynamoDBClient, testSpec())
+	ctx := context.Background()
+
+	t.Run("CheckEmptyAccount", func(t *testing.T) {
+		results, err := provisioner.Check(ctx)
+		if err != nil {
+			t.Fatalf("Failed to check: %v", err)
+		}
+		if s3Client.writes != 0 || dynamoDBClient.writes != 0 {
+			t.Errorf("Check must not change anything")
+		}
+		// Every bucket setting is reported, not just the bucket itself
+		for _, result := range results[:5] {
+			if result.Status != StatusDrift {
+				t.Errorf("Expected drift for %s, got %v", result.Resource, result)
+			}
+		}
+	})
+
+	t.Run("Apply", func(t *testing.T) {
+		if _, err := provisioner.Apply(ctx); err != nil {
+			t.Fatalf("Failed to apply: %v", err)
+		}
+		if !s3Client.exists || dynamoDBClient.table == nil {
+			t.Fatalf("Expected bucket and table to be created")
+		}
+		if s3Client.versioning != s3types.BucketVersioningStatusEnabled {
+			t.Errorf("Expected versioning to be enabled, got %q", s3Client.versioning)
+		}
+		if dynamoDBClient.ttl == nil || aws.ToString(dynamoDBClient.ttl.AttributeName) != services.TimeToLiveAttribute {
+			t.Errorf("Expected time to live on %s, got %v", services.TimeToLiveAttribute, dynamoDBClient.ttl)
+		}
+	})
+
+	t.Run("ApplyIsIdempotent", func(t *testing.T) {
+		s3Writes, dynamoDBWrites := s3Client.writes, dynamoDBClient.writes
+
+		results, err := provisioner.Apply(ctx)
+		if err != nil {
+			t.Fatalf("Failed to apply: %v", err)
+		}
+		if s3Client.writes != s3Writes || dynamoDBClient.writes != dynamoDBWrites {
+			t.Errorf("Second apply changed resources")
+		}
+		if countStatus(results, StatusOK) != len(results) {
+			t.Errorf("Expected all resources ok, got %v", results)
+		}
+	})
+
+	t.Run("CheckDetectsDrift", func(t *testing.T) {
+		s3Client.cors[0].AllowedOrigins = []string{"https://example.com"}
+		dynamoDBClient.ttl = nil
+
+		results, err := provisioner.Check(ctx)
+		if err != nil {
+			t.Fatalf("Failed to check: %v", err)
+		}
+		if drift := countStatus(results, StatusDrift); drift != 2 {
+			t.Errorf("Expected 2 drifted resources, got %d: %v", drift, results)
+		}
+	})
+
+	t.Run("ApplyFixesDrift", func(t *testing.T) {
+		if _, err := provisioner.Apply(ctx); err != nil {
+			t.Fatalf("Failed to apply: %v", err)
+		}
+		if dynamoDBClient.ttl == nil {
+			t.Errorf("Expected time to live to be enabled again")
+		}
+		if !sameStrings(s3Client.cors[0].AllowedOrigins, []string{"*"}) {
+			t.Errorf("Expected CORS origins to be restored, got %v", s3Client.cors[0].AllowedOrigins)
+		}
+	})
+}
+
+func TestProvisionerReportsTimeToLiveOnAnotherAttribute(t *testing.T) {
+	ctx := context.Background()
+	dynamoDBClient := &mockDynamoDBClient{
+		table: &dynamodbtypes.TableDescription{TableStatus: dynamodbtypes.TableStatusActive},
+		ttl: &dynamodbtypes.TimeToLiveDescription{
+			AttributeName:    aws.String("expiresAt"),
+			TimeToLiveStatus: dynamodbtypes.TimeToLiveStatusEnabled,
+		},
+	}
+	provisioner := NewProvisioner(&mockS3Client{exists: true}, dynamoDBClient, testSpec())
+
+	results, err := provisioner.Check(ctx)
+	if err != nil {
+		t.Fatalf("Failed to check: %v", err)
+	}
+	if last := results[len(results)-1]; last.Status != StatusDrift {
+		t.Errorf("Expected time to live on expiresAt to be drift, got %v", last)
+	}
+
+	// Moving it takes DynamoDB up to an hour, so apply says what to do
+	// rather than leaving the table without time to live half way
+	_, err = provisioner.Apply(ctx)
+	if err == nil || !strings.Contains(err.Error(), `time to live is on "expiresAt"`) {
+		t.Errorf("Expected apply to explain the time to live to disable, got %v", err)
+	}
+	if aws.ToString(dynamoDBClient.ttl.AttributeName) != "expiresAt" || dynamoDBClient.ttl.TimeToLiveStatus != dynamodbtypes.TimeToLiveStatusEnabled {
+		t.Errorf("Expected time to live to be left alone, got %v", dynamoDBClient.ttl)
+	}
+}
+
+func TestProvisionerKeepsUnmanagedLifecycleRules(t *testing.T) {
+	s3Client := &mockS3Client{
+		exists: true,
+		lifecycle: []s3types.LifecycleRule{
+			{ID: aws.String("custom-rule"), Status: s3types.ExpirationStatusEnabled},
+		},
+	}
+	provisioner := NewProvisioner(s3Client, &mockDynamoDBClient{}, testSpec())
+
+	if _, err := provisioner.Apply(context.Background()); err != nil {
+		t.Fatalf("Failed to apply: %v", err)
+	}
+
+	found := false
+	for _, rule := range s3Client.lifecycle {
+		if aws.ToString(rule.ID) == "custom-rule" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Apply removed an unmanaged lifecycle rule")
+	}
+	if len(s3Client.lifecycle) != 3 {
+		t.Errorf("Expected 3 lifecycle rules, got %d", len(s3Client.lifecycle))
+	}
+}
@@ -0,0 +1,82 @@
+package saga
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// RecoveryReport summarizes a Recover pass
+type RecoveryReport struct {
+	// RolledBack counts unfinished uploads whose blob and record were removed
+	RolledBack int `json:"rolledBack"`
+	// RolledForward counts unfinished deletes that were completed
+	RolledForward int `json:"rolledForward"`
+	// Failed maps image IDs to the reason they could not be recovered
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Recover finishes the uploads and deletes left pending by a crash or a
+// failed compensation. Deletes are completed, as the image may already have
+// lost its blob. Uploads are rolled back, but only once they were started
+// before uploadCutoff, so uploads still running elsewhere are left alone
+func Recover(ctx context.Context, storage services.StorageService, db services.DatabaseService, uploadCutoff time.Time) (RecoveryReport, error) {
+	report := RecoveryReport{Failed: make(map[string]string)}
+
+	images, err := db.ListImages(ctx)
+	if err != nil {
+		return report, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	for _, image := range images {
+		switch image.Status {
+		case models.StatusDeleting:
+			if err := Delete(ctx, storage, db, image); err != nil {
+				report.Failed[image.ID] = err.Error()
+				continue
+			}
+			report.RolledForward++
+		case models.StatusUploading:
+			if !image.UpdatedAt.Before(uploadCutoff) {
+				continue
+			}
+			if err := rollBackUpload(ctx, storage, db, image); err != nil {
+				report.Failed[image.ID] = err.Error()
+				continue
+			}
+			report.RolledBack++
+		}
+	}
+
+	return report, nil
+}
+
+// RunRecovery recovers once and then every interval until ctx is done, so
+// uploads that were too recent for one pass are handled by a later one
+func RunRecovery(ctx context.Context, storage services.StorageService, db services.DatabaseService, interval time.Duration) error {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		report, err := Recover(ctx, storage, db, time.Now().Add(-interval))
+		if err != nil {
+			log.Printf("Recovery: %v", err)
+		}
+		if report.RolledBack > 0 || report.RolledForward > 0 || len(report.Failed) > 0 {
+			log.Printf("Recovery: rolled back %d uploads, completed %d deletes, %d failed", report.RolledBack, report.RolledForward, len(report.Failed))
+			for id, reason := range report.Failed {
+				log.Printf("Recovery of %s failed: %v", id, reason)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
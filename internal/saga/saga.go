@@ -0,0 +1,310 @@
+// Package saga keeps image blobs and metadata records consistent. Storage
+// and database writes cannot share a transaction, so uploads and deletes
+// record a pending status first, undo completed steps when a later one
+// fails, and leave anything they could not finish to Recover
+package saga
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"mime/multipart"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// Upload stores a new image. The record is saved as uploading, the blob and
+// the content of each of image.Variants, from variants by key, are uploaded
+// and the record is then marked ready; it returns the ready record. If a
+// step fails the earlier ones are undone
+func Upload(ctx context.Context, storage services.StorageService, db services.DatabaseService, image models.Image, content multipart.File, variants map[string][]byte) (models.Image, error) {
+	pending := image
+	pending.Status = models.StatusUploading
+	pending.Version = 0
+	if err := db.SaveImage(ctx, pending); err != nil {
+		return image, fmt.Errorf("failed to save image metadata: %w", err)
+	}
+
+	// Compensations run even if the request was cancelled
+	cleanup := context.WithoutCancel(ctx)
+
+	if err := storage.UploadImage(ctx, image.S3Key, content, image.ContentType); err != nil {
+		if err := deleteRecord(cleanup, db, image.ID); err != nil {
+			log.Printf("Upload of %s: failed to remove pending record, leaving it for recovery: %v", image.ID, err)
+		}
+		return image, fmt.Errorf("failed to upload image: %w", err)
+	}
+	for _, variant := range image.Variants {
+		data := bytesFile{bytes.NewReader(variants[variant.Key])}
+		if err := storage.UploadImage(ctx, variant.Key, data, variant.ContentType); err != nil {
+			if err := rollBackUpload(cleanup, storage, db, image); err != nil {
+				log.Printf("Upload of %s: failed to roll back, leaving it for recovery: %v", image.ID, err)
+			}
+			return image, fmt.Errorf("failed to upload image variant: %w", err)
+		}
+	}
+
+	ready := image
+	ready.Status = models.StatusReady
+	ready.Version = pending.Version + 1
+	if err := db.SaveImage(ctx, ready); err != nil {
+		if err := rollBackUpload(cleanup, storage, db, image); err != nil {
+			log.Printf("Upload of %s: failed to roll back, leaving it for recovery: %v", image.ID, err)
+		}
+		return image, fmt.Errorf("failed to save image metadata: %w", err)
+	}
+
+	ready.Version++
+	return ready, nil
+}
+
+// ReplaceVariants stores new variants for an image, such as after its
+// edits change. The new variants are uploaded under keys that differ from
+// the current ones, then updated is saved, which fails with
+// services.ErrVersionConflict unless updated.Version is current, and
+// finally the variants of previous that updated no longer uses are
+// deleted. If the save fails the new variants are deleted again; old
+// variants that cannot be deleted are only logged, as nothing refers to
+// them any more
+func ReplaceVariants(ctx context.Context, storage services.StorageService, db services.DatabaseService, previous, updated models.Image, variants map[string][]byte) (models.Image, error) {
+	current := make(map[string]bool, len(previous.Variants))
+	for _, variant := range previous.Variants {
+		current[variant.Key] = true
+	}
+
+	cleanup := context.WithoutCancel(ctx)
+
+	var uploaded []string
+	for _, variant := range updated.Variants {
+		if current[variant.Key] {
+			continue
+		}
+		data := bytesFile{bytes.NewReader(variants[variant.Key])}
+		if err := storage.UploadImage(ctx, variant.Key, data, variant.ContentType); err != nil {
+			deleteKeys(cleanup, storage, updated.ID, uploaded)
+			return updated, fmt.Errorf("failed to upload image variant: %w", err)
+		}
+		uploaded = append(uploaded, variant.Key)
+	}
+
+	if err := db.SaveImage(ctx, updated); err != nil {
+		deleteKeys(cleanup, storage, updated.ID, uploaded)
+		return updated, err
+	}
+	updated.Version++
+
+	kept := make(map[string]bool, len(updated.Variants))
+	for _, variant := range updated.Variants {
+		kept[variant.Key] = true
+	}
+	var unused []string
+	for _, variant := range previous.Variants {
+		if !kept[variant.Key] {
+			unused = append(unused, variant.Key)
+		}
+	}
+	deleteKeys(cleanup, storage, updated.ID, unused)
+	return updated, nil
+}
+
+// deleteKeys deletes blobs that nothing refers to, logging failures
+func deleteKeys(ctx context.Context, storage services.StorageService, id string, keys []string) {
+	for _, key := range keys {
+		if err := deleteBlob(ctx, storage, key); err != nil {
+			log.Printf("Variants of %s: failed to delete unused %s: %v", id, key, err)
+		}
+	}
+}
+
+// Delete removes an image. The record is marked as deleting, the blobs are
+// deleted and then the record. If the first blob cannot be deleted the
+// record is restored. Once any blob is gone the image cannot be served
+// again, so a later failure leaves the record marked, hidden, for Recover
+// to finish, as does a failure to delete the record. A record already
+// marked is only rolled forward, and any failure is returned. image must be
+// the current record, otherwise services.ErrVersionConflict is returned
+func Delete(ctx context.Context, storage services.StorageService, db services.DatabaseService, image models.Image) error {
+	if image.Status == models.StatusDeleting {
+		return rollForwardDelete(ctx, storage, db, image)
+	}
+
+	deleting := image
+	deleting.Status = models.StatusDeleting
+	if err := db.SaveImage(ctx, deleting); err != nil {
+		return fmt.Errorf("failed to mark image for deletion: %w", err)
+	}
+	image.Version++
+
+	cleanup := context.WithoutCancel(ctx)
+
+	gone, err := deleteBlobs(ctx, storage, image)
+	if err != nil && gone > 0 {
+		log.Printf("Delete of %s: failed to delete blobs, leaving it for recovery: %v", image.ID, err)
+		return nil
+	}
+	if err != nil {
+		restored := image
+		restored.Status = models.StatusReady
+		if err := db.SaveImage(cleanup, restored); err != nil {
+			log.Printf("Delete of %s: failed to restore record, leaving it for recovery: %v", image.ID, err)
+		}
+		return fmt.Errorf("failed to delete image from storage: %w", err)
+	}
+
+	if err := deleteRecord(cleanup, db, image.ID); err != nil {
+		log.Printf("Delete of %s: failed to delete record, leaving it for recovery: %v", image.ID, err)
+	}
+	return nil
+}
+
+// DeleteImages removes several images the way Delete does. An image is only
+// restored when none of its blobs was deleted; when a batch fails as a
+// whole it is not known which were, and the images are left for Recover.
+// Each image must be the current record; one that changed or was deleted
+// since it was read fails with services.ErrVersionConflict. Images that
+// could not be deleted are reported in a *services.BatchError keyed by ID
+func DeleteImages(ctx context.Context, storage services.StorageService, db services.DatabaseService, images []models.Image) error {
+	failed := make(map[string]error)
+
+	deleting := make([]models.Image, 0, len(images))
+	for _, image := range images {
+		image.Status = models.StatusDeleting
+		deleting = append(deleting, image)
+	}
+	if err := db.BatchUpdateImages(ctx, deleting); err != nil {
+		var batchErr *services.BatchError
+		if !errors.As(err, &batchErr) {
+			return fmt.Errorf("failed to mark images for deletion: %w", err)
+		}
+		for id, itemErr := range batchErr.Errors {
+			failed[id] = itemErr
+		}
+	}
+
+	marked := make([]models.Image, 0, len(deleting))
+	keys := make([]string, 0, len(deleting))
+	for _, image := range deleting {
+		if _, ok := failed[image.ID]; !ok {
+			image.Version++
+			marked = append(marked, image)
+			keys = append(keys, image.Keys()...)
+		}
+	}
+
+	cleanup := context.WithoutCancel(ctx)
+
+	blobErr := storage.DeleteImages(ctx, keys)
+	var blobFailures *services.BatchError
+	if blobErr != nil && !errors.As(blobErr, &blobFailures) {
+		log.Printf("Batch delete: failed to delete blobs, leaving %d images for recovery: %v", len(marked), blobErr)
+		marked = nil
+	}
+
+	var restore []models.Image
+	ids := make([]string, 0, len(marked))
+	for _, image := range marked {
+		failures, err := failedBlobs(blobFailures, image)
+		switch {
+		case failures == len(image.Keys()):
+			failed[image.ID] = fmt.Errorf("failed to delete image from storage: %w", err)
+			image.Status = models.StatusReady
+			restore = append(restore, image)
+		case failures > 0:
+			log.Printf("Batch delete of %s: failed to delete blobs, leaving it for recovery: %v", image.ID, err)
+		default:
+			ids = append(ids, image.ID)
+		}
+	}
+
+	if len(restore) > 0 {
+		if err := db.BatchUpdateImages(cleanup, restore); err != nil {
+			log.Printf("Batch delete: failed to restore records, leaving them for recovery: %v", err)
+		}
+	}
+	if err := db.BatchDeleteImages(cleanup, ids); err != nil {
+		log.Printf("Batch delete: failed to delete records, leaving them for recovery: %v", err)
+	}
+
+	if len(failed) > 0 {
+		return &services.BatchError{Errors: failed}
+	}
+	return nil
+}
+
+// failedBlobs returns how many of an image's blobs failed to delete, with
+// the error of the first
+func failedBlobs(failures *services.BatchError, image models.Image) (int, error) {
+	if failures == nil {
+		return 0, nil
+	}
+	count := 0
+	var first error
+	for _, key := range image.Keys() {
+		if err, ok := failures.Errors[key]; ok {
+			count++
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return count, first
+}
+
+// rollForwardDelete finishes the delete of a record marked as deleting
+func rollForwardDelete(ctx context.Context, storage services.StorageService, db services.DatabaseService, image models.Image) error {
+	if _, err := deleteBlobs(ctx, storage, image); err != nil {
+		return fmt.Errorf("failed to delete image from storage: %w", err)
+	}
+	return deleteRecord(ctx, db, image.ID)
+}
+
+// rollBackUpload removes the blobs and record of an unfinished upload
+func rollBackUpload(ctx context.Context, storage services.StorageService, db services.DatabaseService, image models.Image) error {
+	if _, err := deleteBlobs(ctx, storage, image); err != nil {
+		return err
+	}
+	return deleteRecord(ctx, db, image.ID)
+}
+
+// deleteBlobs deletes the original and variants of an image, any of which
+// may already be gone, in order. It returns how many are gone before the
+// first that failed
+func deleteBlobs(ctx context.Context, storage services.StorageService, image models.Image) (int, error) {
+	for i, key := range image.Keys() {
+		if err := deleteBlob(ctx, storage, key); err != nil {
+			return i, err
+		}
+	}
+	return len(image.Keys()), nil
+}
+
+// deleteBlob deletes a blob that may already be gone
+func deleteBlob(ctx context.Context, storage services.StorageService, key string) error {
+	err := storage.DeleteImage(ctx, key)
+	if errors.Is(err, services.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// deleteRecord deletes a record that may already be gone
+func deleteRecord(ctx context.Context, db services.DatabaseService, id string) error {
+	err := db.DeleteImage(ctx, id)
+	if errors.Is(err, services.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// bytesFile adapts generated content to the multipart.File that
+// StorageService uploads
+type bytesFile struct {
+	*bytes.Reader
+}
+
+func (bytesFile) Close() error {
+	return nil
+}
@@ -0,0 +1,473 @@
+package saga
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"mime/multipart"
+	"testing"
+	"time"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+var errInjected = errors.New("injected failure")
+
+// faultyStorage fails uploads or deletes of chosen keys
+type faultyStorage struct {
+	services.StorageService
+	failUpload    bool
+	failUploadKey string
+	failDelete    map[string]bool
+}
+
+func (s *faultyStorage) UploadImage(ctx context.Context, key string, content multipart.File, contentType string) error {
+	if s.failUpload || key == s.failUploadKey {
+		return errInjected
+	}
+	return s.StorageService.UploadImage(ctx, key, content, contentType)
+}
+
+func (s *faultyStorage) DeleteImage(ctx context.Context, key string) error {
+	if s.failDelete[key] {
+		return errInjected
+	}
+	return s.StorageService.DeleteImage(ctx, key)
+}
+
+func (s *faultyStorage) DeleteImages(ctx context.Context, keys []string) error {
+	failed := make(map[string]error)
+	for _, key := range keys {
+		if err := s.DeleteImage(ctx, key); err != nil && !errors.Is(err, services.ErrNotFound) {
+			failed[key] = err
+		}
+	}
+	if len(failed) > 0 {
+		return &services.BatchError{Errors: failed}
+	}
+	return nil
+}
+
+// faultyDB fails saves with a chosen status and deletes
+type faultyDB struct {
+	services.DatabaseService
+	failSave   map[models.ImageStatus]bool
+	failDelete bool
+}
+
+func (d *faultyDB) SaveImage(ctx context.Context, image models.Image) error {
+	if d.failSave[image.Status] {
+		return errInjected
+	}
+	return d.DatabaseService.SaveImage(ctx, image)
+}
+
+func (d *faultyDB) DeleteImage(ctx context.Context, id string) error {
+	if d.failDelete {
+		return errInjected
+	}
+	return d.DatabaseService.DeleteImage(ctx, id)
+}
+
+func (d *faultyDB) BatchDeleteImages(ctx context.Context, ids []string) error {
+	if d.failDelete {
+		return errInjected
+	}
+	return d.DatabaseService.BatchDeleteImages(ctx, ids)
+}
+
+func newBackends(t *testing.T) (*faultyStorage, *faultyDB) {
+	t.Helper()
+
+	dir := t.TempDir()
+	storage, err := services.NewLocalStorageService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local storage: %v", err)
+	}
+	db, err := services.NewLocalDBService(dir)
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+	return &faultyStorage{StorageService: storage, failDelete: make(map[string]bool)},
+		&faultyDB{DatabaseService: db, failSave: make(map[models.ImageStatus]bool)}
+}
+
+func newImage(id string) models.Image {
+	now := time.Now()
+	return models.Image{ID: id, Title: "Image " + id, S3Key: id + ".jpg", ContentType: "image/jpeg", CreatedAt: now, UpdatedAt: now}
+}
+
+func content(id string) multipart.File {
+	return bytesFile{bytes.NewReader([]byte("content of " + id))}
+}
+
+// assertGone checks that neither the blob nor the record of id is left
+func assertGone(t *testing.T, storage services.StorageService, db services.DatabaseService, id string) {
+	t.Helper()
+
+	ctx := context.Background()
+	if _, err := db.GetImage(ctx, id); !errors.Is(err, services.ErrNotFound) {
+		t.Errorf("Expected record %s to be gone, got %v", id, err)
+	}
+	if _, _, err := storage.GetImage(ctx, id+".jpg"); !errors.Is(err, services.ErrNotFound) {
+		t.Errorf("Expected blob %s to be gone, got %v", id, err)
+	}
+}
+
+func TestUpload(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Success", func(t *testing.T) {
+		storage, db := newBackends(t)
+
+		image, err := Upload(ctx, storage, db, newImage("a"), content("a"), nil)
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		stored, err := db.GetImage(ctx, "a")
+		if err != nil {
+			t.Fatalf("Failed to get image: %v", err)
+		}
+		if stored.Pending() || stored.Version != image.Version {
+			t.Errorf("Expected ready record at version %d, got %+v", image.Version, stored)
+		}
+		if _, _, err := storage.GetImage(ctx, "a.jpg"); err != nil {
+			t.Errorf("Expected blob to be stored, got %v", err)
+		}
+	})
+
+	t.Run("StoresVariants", func(t *testing.T) {
+		storage, db := newBackends(t)
+
+		image := newImage("a")
+		key := models.VariantKey("a", 256, ".jpg", nil)
+		image.Variants = []models.Variant{{Size: 256, Key: key, ContentType: "image/jpeg"}}
+		image, err := Upload(ctx, storage, db, image, content("a"), map[string][]byte{key: []byte("thumbnail of a")})
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		data, _, err := storage.GetImage(ctx, key)
+		if err != nil || string(data) != "thumbnail of a" {
+			t.Fatalf("Expected the variant to be stored, got %q, %v", data, err)
+		}
+
+		if err := Delete(ctx, storage, db, image); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+		assertGone(t, storage, db, "a")
+		if _, _, err := storage.GetImage(ctx, key); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("Expected the variant to be deleted, got %v", err)
+		}
+	})
+
+	t.Run("VariantFailureRemovesEverything", func(t *testing.T) {
+		storage, db := newBackends(t)
+		image := newImage("a")
+		key := models.VariantKey("a", 256, ".jpg", nil)
+		image.Variants = []models.Variant{{Size: 256, Key: key, ContentType: "image/jpeg"}}
+		storage.failUploadKey = key
+
+		if _, err := Upload(ctx, storage, db, image, content("a"), map[string][]byte{key: []byte("thumbnail of a")}); !errors.Is(err, errInjected) {
+			t.Fatalf("Expected the upload error, got %v", err)
+		}
+		assertGone(t, storage, db, "a")
+	})
+
+	t.Run("BlobFailureRemovesRecord", func(t *testing.T) {
+		storage, db := newBackends(t)
+		storage.failUpload = true
+
+		if _, err := Upload(ctx, storage, db, newImage("a"), content("a"), nil); !errors.Is(err, errInjected) {
+			t.Fatalf("Expected the upload error, got %v", err)
+		}
+		assertGone(t, storage, db, "a")
+	})
+
+	t.Run("MetadataFailureRemovesBlob", func(t *testing.T) {
+		storage, db := newBackends(t)
+		db.failSave[models.StatusReady] = true
+
+		if _, err := Upload(ctx, storage, db, newImage("a"), content("a"), nil); !errors.Is(err, errInjected) {
+			t.Fatalf("Expected the save error, got %v", err)
+		}
+		assertGone(t, storage, db, "a")
+	})
+
+	t.Run("FailedCompensationIsRecovered", func(t *testing.T) {
+		storage, db := newBackends(t)
+		db.failSave[models.StatusReady] = true
+		db.failDelete = true
+
+		if _, err := Upload(ctx, storage, db, newImage("a"), content("a"), nil); err == nil {
+			t.Fatalf("Expected the upload to fail")
+		}
+		if image, err := db.GetImage(ctx, "a"); err != nil || image.Status != models.StatusUploading {
+			t.Fatalf("Expected a pending record, got %+v, %v", image, err)
+		}
+
+		db.failDelete = false
+		report, err := Recover(ctx, storage, db, time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatalf("Failed to recover: %v", err)
+		}
+		if report.RolledBack != 1 {
+			t.Errorf("Expected 1 rolled back upload, got %+v", report)
+		}
+		assertGone(t, storage, db, "a")
+	})
+}
+
+func TestReplaceVariants(t *testing.T) {
+	ctx := context.Background()
+
+	// upload stores a with a plain 256 variant
+	upload := func(t *testing.T, storage services.StorageService, db services.DatabaseService) models.Image {
+		t.Helper()
+		image := newImage("a")
+		key := models.VariantKey("a", 256, ".jpg", nil)
+		image.Variants = []models.Variant{{Size: 256, Key: key, ContentType: "image/jpeg"}}
+		image, err := Upload(ctx, storage, db, image, content("a"), map[string][]byte{key: []byte("thumbnail of a")})
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		return image
+	}
+	edited := func(previous models.Image) (models.Image, string) {
+		updated := previous
+		updated.Edits = &models.Edits{Rotate: 90}
+		key := models.VariantKey("a", 256, ".jpg", updated.Edits)
+		updated.Variants = []models.Variant{{Size: 256, Key: key, ContentType: "image/jpeg"}}
+		return updated, key
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		storage, db := newBackends(t)
+		previous := upload(t, storage, db)
+		updated, key := edited(previous)
+
+		saved, err := ReplaceVariants(ctx, storage, db, previous, updated, map[string][]byte{key: []byte("rotated thumbnail of a")})
+		if err != nil {
+			t.Fatalf("Failed to replace variants: %v", err)
+		}
+		if saved.Version != previous.Version+1 {
+			t.Errorf("Expected version %d, got %d", previous.Version+1, saved.Version)
+		}
+		if _, _, err := storage.GetImage(ctx, key); err != nil {
+			t.Errorf("Expected the new variant to be stored, got %v", err)
+		}
+		if _, _, err := storage.GetImage(ctx, previous.Variants[0].Key); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("Expected the old variant to be deleted, got %v", err)
+		}
+		if _, _, err := storage.GetImage(ctx, "a.jpg"); err != nil {
+			t.Errorf("Expected the original to be kept, got %v", err)
+		}
+	})
+
+	t.Run("StaleImage", func(t *testing.T) {
+		storage, db := newBackends(t)
+		previous := upload(t, storage, db)
+		updated, key := edited(previous)
+		updated.Version--
+
+		if _, err := ReplaceVariants(ctx, storage, db, previous, updated, map[string][]byte{key: []byte("rotated thumbnail of a")}); !errors.Is(err, services.ErrVersionConflict) {
+			t.Fatalf("Expected a version conflict, got %v", err)
+		}
+		if _, _, err := storage.GetImage(ctx, key); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("Expected the new variant to be removed, got %v", err)
+		}
+		if _, _, err := storage.GetImage(ctx, previous.Variants[0].Key); err != nil {
+			t.Errorf("Expected the old variant to be kept, got %v", err)
+		}
+	})
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+
+	upload := func(t *testing.T, storage services.StorageService, db services.DatabaseService, id string) models.Image {
+		t.Helper()
+		image, err := Upload(ctx, storage, db, newImage(id), content(id), nil)
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		return image
+	}
+
+	t.Run("Success", func(t *testing.T) {
+		storage, db := newBackends(t)
+		image := upload(t, storage, db, "a")
+
+		if err := Delete(ctx, storage, db, image); err != nil {
+			t.Fatalf("Failed to delete: %v", err)
+		}
+		assertGone(t, storage, db, "a")
+	})
+
+	t.Run("StaleImage", func(t *testing.T) {
+		storage, db := newBackends(t)
+		image := upload(t, storage, db, "a")
+		image.Version--
+
+		if err := Delete(ctx, storage, db, image); !errors.Is(err, services.ErrVersionConflict) {
+			t.Fatalf("Expected a version conflict, got %v", err)
+		}
+		if _, _, err := storage.GetImage(ctx, "a.jpg"); err != nil {
+			t.Errorf("Expected blob to be kept, got %v", err)
+		}
+	})
+
+	t.Run("BlobFailureRestoresRecord", func(t *testing.T) {
+		storage, db := newBackends(t)
+		image := upload(t, storage, db, "a")
+		storage.failDelete["a.jpg"] = true
+
+		if err := Delete(ctx, storage, db, image); !errors.Is(err, errInjected) {
+			t.Fatalf("Expected the delete error, got %v", err)
+		}
+		stored, err := db.GetImage(ctx, "a")
+		if err != nil {
+			t.Fatalf("Failed to get image: %v", err)
+		}
+		if stored.Pending() {
+			t.Errorf("Expected the record to be restored, got status %q", stored.Status)
+		}
+	})
+
+	t.Run("VariantFailureRollsForward", func(t *testing.T) {
+		storage, db := newBackends(t)
+		image := newImage("a")
+		image.Variants = []models.Variant{{Size: 256, Key: "a_256.jpg", ContentType: "image/jpeg"}}
+		image, err := Upload(ctx, storage, db, image, content("a"), map[string][]byte{"a_256.jpg": []byte("variant")})
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		storage.failDelete["a_256.jpg"] = true
+
+		// The original is gone, so the record must not be restored to point
+		// at it
+		if err := Delete(ctx, storage, db, image); err != nil {
+			t.Fatalf("Expected the delete to succeed for the client, got %v", err)
+		}
+		if stored, err := db.GetImage(ctx, "a"); err != nil || stored.Status != models.StatusDeleting {
+			t.Fatalf("Expected a record marked as deleting, got %+v, %v", stored, err)
+		}
+
+		storage.failDelete["a_256.jpg"] = false
+		if report, err := Recover(ctx, storage, db, time.Now()); err != nil || report.RolledForward != 1 {
+			t.Fatalf("Expected 1 completed delete, got %+v, %v", report, err)
+		}
+		assertGone(t, storage, db, "a")
+		if _, _, err := storage.GetImage(ctx, "a_256.jpg"); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("Expected the variant to be gone, got %v", err)
+		}
+	})
+
+	t.Run("MetadataFailureIsRecovered", func(t *testing.T) {
+		storage, db := newBackends(t)
+		image := upload(t, storage, db, "a")
+		db.failDelete = true
+
+		if err := Delete(ctx, storage, db, image); err != nil {
+			t.Fatalf("Expected the delete to succeed for the client, got %v", err)
+		}
+		if stored, err := db.GetImage(ctx, "a"); err != nil || stored.Status != models.StatusDeleting {
+			t.Fatalf("Expected a record marked as deleting, got %+v, %v", stored, err)
+		}
+
+		db.failDelete = false
+		report, err := Recover(ctx, storage, db, time.Now())
+		if err != nil {
+			t.Fatalf("Failed to recover: %v", err)
+		}
+		if report.RolledForward != 1 {
+			t.Errorf("Expected 1 completed delete, got %+v", report)
+		}
+		assertGone(t, storage, db, "a")
+	})
+
+	t.Run("Batch", func(t *testing.T) {
+		storage, db := newBackends(t)
+		images := []models.Image{upload(t, storage, db, "a"), upload(t, storage, db, "b")}
+		storage.failDelete["b.jpg"] = true
+
+		err := DeleteImages(ctx, storage, db, images)
+		var batchErr *services.BatchError
+		if !errors.As(err, &batchErr) || len(batchErr.Errors) != 1 || batchErr.Errors["b"] == nil {
+			t.Fatalf("Expected only b to fail, got %v", err)
+		}
+		assertGone(t, storage, db, "a")
+		if stored, err := db.GetImage(ctx, "b"); err != nil || stored.Pending() {
+			t.Errorf("Expected b to be restored, got %+v, %v", stored, err)
+		}
+	})
+
+	t.Run("BatchVariantFailureRollsForward", func(t *testing.T) {
+		storage, db := newBackends(t)
+		image := newImage("a")
+		image.Variants = []models.Variant{{Size: 256, Key: "a_256.jpg", ContentType: "image/jpeg"}}
+		image, err := Upload(ctx, storage, db, image, content("a"), map[string][]byte{"a_256.jpg": []byte("variant")})
+		if err != nil {
+			t.Fatalf("Failed to upload: %v", err)
+		}
+		storage.failDelete["a_256.jpg"] = true
+
+		if err := DeleteImages(ctx, storage, db, []models.Image{image}); err != nil {
+			t.Fatalf("Expected the delete to succeed for the client, got %v", err)
+		}
+		if stored, err := db.GetImage(ctx, "a"); err != nil || stored.Status != models.StatusDeleting {
+			t.Errorf("Expected a record marked as deleting, got %+v, %v", stored, err)
+		}
+	})
+
+	t.Run("BatchSkipsConcurrentChanges", func(t *testing.T) {
+		storage, db := newBackends(t)
+		images := []models.Image{upload(t, storage, db, "a"), upload(t, storage, db, "b"), upload(t, storage, db, "c")}
+
+		// a is edited and b deleted after the batch read them
+		edited := images[0]
+		edited.Title = "Edited"
+		if err := db.SaveImage(ctx, edited); err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+		if err := db.DeleteImage(ctx, "b"); err != nil {
+			t.Fatalf("Failed to delete image: %v", err)
+		}
+
+		err := DeleteImages(ctx, storage, db, images)
+		var batchErr *services.BatchError
+		if !errors.As(err, &batchErr) || len(batchErr.Errors) != 2 ||
+			!errors.Is(batchErr.Errors["a"], services.ErrVersionConflict) || !errors.Is(batchErr.Errors["b"], services.ErrVersionConflict) {
+			t.Fatalf("Expected conflicts for a and b, got %v", err)
+		}
+		if stored, err := db.GetImage(ctx, "a"); err != nil || stored.Title != "Edited" || stored.Pending() {
+			t.Errorf("Expected the edit of a to be kept, got %+v, %v", stored, err)
+		}
+		if _, err := db.GetImage(ctx, "b"); !errors.Is(err, services.ErrNotFound) {
+			t.Errorf("Expected b to stay deleted, got %v", err)
+		}
+		assertGone(t, storage, db, "c")
+	})
+}
+
+func TestRecoverLeavesRecentUploads(t *testing.T) {
+	ctx := context.Background()
+	storage, db := newBackends(t)
+
+	pending := newImage("a")
+	pending.Status = models.StatusUploading
+	if err := db.SaveImage(ctx, pending); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+
+	report, err := Recover(ctx, storage, db, pending.UpdatedAt.Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to recover: %v", err)
+	}
+	if report.RolledBack != 0 {
+		t.Errorf("Expected the recent upload to be left alone, got %+v", report)
+	}
+	if _, err := db.GetImage(ctx, "a"); err != nil {
+		t.Errorf("Expected the pending record to be kept, got %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package services
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"image_gallery/internal/models"
+)
+
+// CacheOptions controls a CachedDatabaseService
+type CacheOptions struct {
+	// RecordTTL is how long a record read by GetImage or BatchGetImages is
+	// served from the cache
+	RecordTTL time.Duration
+	// ListTTL is how long the result of ListImages is served from the cache
+	ListTTL time.Duration
+	// MaxRecords bounds the number of cached records; the least recently
+	// used are evicted first
+	MaxRecords int
+}
+
+// CacheStats are the counters of a CachedDatabaseService
+type CacheStats struct {
+	RecordHits    int64 `json:"recordHits"`
+	RecordMisses  int64 `json:"recordMisses"`
+	ListHits      int64 `json:"listHits"`
+	ListMisses    int64 `json:"listMisses"`
+	Invalidations int64 `json:"invalidations"`
+	Evictions     int64 `json:"evictions"`
+	Records       int   `json:"records"`
+}
+
+// CachedDatabaseService is a DatabaseService decorator that caches records
+// and the image list in memory. Its own writes invalidate what they touch;
+// writes made elsewhere, such as by other servers, are seen once the entries
+// expire or are dropped with Invalidate
+type CachedDatabaseService struct {
+	db   DatabaseService
+	opts CacheOptions
+	now  func() time.Time
+
+	mutex   sync.Mutex
+	records map[string]*list.Element
+	lru     *list.List
+	list    []models.Image
+	listAt  time.Time
+	listOK  bool
+	// generation is bumped by every invalidation, so a read that started
+	// before an invalidation does not store its stale result
+	generation uint64
+	stats      CacheStats
+}
+
+// cachedRecord is an element of the LRU list
+type cachedRecord struct {
+	image    models.Image
+	storedAt time.Time
+}
+
+// Verify that CachedDatabaseService implements DatabaseService
+var _ DatabaseService = (*CachedDatabaseService)(nil)
+
+// NewCachedDatabaseService wraps db with a cache. Zero options get defaults
+func NewCachedDatabaseService(db DatabaseService, opts CacheOptions) *CachedDatabaseService {
+	if opts.RecordTTL <= 0 {
+		opts.RecordTTL = 30 * time.Second
+	}
+	if opts.ListTTL <= 0 {
+		opts.ListTTL = 10 * time.Second
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = 10000
+	}
+	return &CachedDatabaseService{
+		db:      db,
+		opts:    opts,
+		now:     time.Now,
+		records: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// Unwrap returns the wrapped service, for type assertions on optional
+// interfaces such as EventLog
+func (c *CachedDatabaseService) Unwrap() DatabaseService {
+	return c.db
+}
+
+// Stats returns the current counters
+func (c *CachedDatabaseService) Stats() CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	stats := c.stats
+	stats.Records = c.lru.Len()
+	return stats
+}
+
+// Invalidate drops the given records and the cached list. It is the hook
+// for changes made outside this service
+func (c *CachedDatabaseService) Invalidate(ids ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.invalidateLocked(ids)
+}
+
+// InvalidateAll empties the cache
+func (c *CachedDatabaseService) InvalidateAll() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.records = make(map[string]*list.Element)
+	c.lru.Init()
+	c.list, c.listOK = nil, false
+	c.generation++
+	c.stats.Invalidations++
+}
+
+func (c *CachedDatabaseService) invalidateLocked(ids []string) {
+	for _, id := range ids {
+		if element, ok := c.records[id]; ok {
+			c.lru.Remove(element)
+			delete(c.records, id)
+		}
+	}
+	c.list, c.listOK = nil, false
+	c.generation++
+	c.stats.Invalidations++
+}
+
+// SaveImage saves the image and invalidates its cached record and the list
+func (c *CachedDatabaseService) SaveImage(ctx context.Context, image models.Image) error {
+	// Invalidate even on failure, as the write may have been applied
+	defer c.Invalidate(image.ID)
+	return c.db.SaveImage(ctx, image)
+}
+
+// GetImage returns a cached record or reads it through
+func (c *CachedDatabaseService) GetImage(ctx context.Context, id string) (models.Image, error) {
+	if image, ok := c.cachedRecord(id); ok {
+		return image, nil
+	}
+
+	generation := c.currentGeneration()
+	image, err := c.db.GetImage(ctx, id)
+	if err != nil {
+		return image, err
+	}
+	c.storeRecords(generation, []models.Image{image})
+	return image, nil
+}
+
+// ListImages returns the cached list or reads it through
+func (c *CachedDatabaseService) ListImages(ctx context.Context) ([]models.Image, error) {
+	c.mutex.Lock()
+	if c.listOK && c.now().Sub(c.listAt) < c.opts.ListTTL {
+		c.stats.ListHits++
+		images := append([]models.Image(nil), c.list...)
+		c.mutex.Unlock()
+		return images, nil
+	}
+	c.stats.ListMisses++
+	generation := c.generation
+	c.mutex.Unlock()
+
+	images, err := c.db.ListImages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mutex.Lock()
+	if generation == c.generation {
+		// Callers may modify the returned slice, so the cache keeps its own
+		c.list = append([]models.Image(nil), images...)
+		c.listAt = c.now()
+		c.listOK = true
+	}
+	c.mutex.Unlock()
+
+	c.storeRecords(generation, images)
+	return images, nil
+}
+
+// DeleteImage deletes the image and invalidates its cached record and the
+// list
+func (c *CachedDatabaseService) DeleteImage(ctx context.Context, id string) error {
+	defer c.Invalidate(id)
+	return c.db.DeleteImage(ctx, id)
+}
+
+// BatchGetImages serves cached records and reads the others through, in
+// request order
+func (c *CachedDatabaseService) BatchGetImages(ctx context.Context, ids []string) ([]models.Image, error) {
+	cached := make(map[string]models.Image, len(ids))
+	var missing []string
+	for _, id := range ids {
+		if image, ok := c.cachedRecord(id); ok {
+			cached[id] = image
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return orderImages(ids, cached), nil
+	}
+
+	generation := c.currentGeneration()
+	fetched, err := c.db.BatchGetImages(ctx, missing)
+	c.storeRecords(generation, fetched)
+	for _, image := range fetched {
+		cached[image.ID] = image
+	}
+	return orderImages(ids, cached), err
+}
+
+// BatchSaveImages saves the images and invalidates their records and the
+// list
+func (c *CachedDatabaseService) BatchSaveImages(ctx context.Context, images []models.Image) error {
+	ids := make([]string, len(images))
+	for i, image := range images {
+		ids[i] = image.ID
+	}
+	defer c.Invalidate(ids...)
+	return c.db.BatchSaveImages(ctx, images)
+}
+
+// BatchUpdateImages saves the images and invalidates their records and the
+// list
+func (c *CachedDatabaseService) BatchUpdateImages(ctx context.Context, images []models.Image) error {
+	ids := make([]string, len(images))
+	for i, image := range images {
+		ids[i] = image.ID
+	}
+	defer c.Invalidate(ids...)
+	return c.db.BatchUpdateImages(ctx, images)
+}
+
+// BatchDeleteImages deletes the images and invalidates their records and
+// the list
+func (c *CachedDatabaseService) BatchDeleteImages(ctx context.Context, ids []string) error {
+	defer c.Invalidate(ids...)
+	return c.db.BatchDeleteImages(ctx, ids)
+}
+
+// cachedRecord returns a fresh cached record and counts the hit or miss
+func (c *CachedDatabaseService) cachedRecord(id string) (models.Image, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, ok := c.records[id]
+	if ok {
+		record := element.Value.(*cachedRecord)
+		if c.now().Sub(record.storedAt) < c.opts.RecordTTL {
+			c.lru.MoveToFront(element)
+			c.stats.RecordHits++
+			return record.image, true
+		}
+		c.lru.Remove(element)
+		delete(c.records, id)
+	}
+	c.stats.RecordMisses++
+	return models.Image{}, false
+}
+
+func (c *CachedDatabaseService) currentGeneration() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.generation
+}
+
+// storeRecords caches images read when the cache was at generation, unless
+// it has been invalidated since
+func (c *CachedDatabaseService) storeRecords(generation uint64, images []models.Image) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if generation != c.generation {
+		return
+	}
+
+	now := c.now()
+	for _, image := range images {
+		if element, ok := c.records[image.ID]; ok {
+			element.Value = &cachedRecord{image: image, storedAt: now}
+			c.lru.MoveToFront(element)
+			continue
+		}
+		c.records[image.ID] = c.lru.PushFront(&cachedRecord{image: image, storedAt: now})
+	}
+
+	for c.lru.Len() > c.opts.MaxRecords {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.records, oldest.Value.(*cachedRecord).image.ID)
+		c.stats.Evictions++
+	}
+}
+
+// orderImages returns the found images in the order of ids
+func orderImages(ids []string, found map[string]models.Image) []models.Image {
+	images := make([]models.Image, 0, len(ids))
+	for _, id := range ids {
+		if image, ok := found[id]; ok {
+			images = append(images, image)
+		}
+	}
+	return images
+}
@@ -0,0 +1,211 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"image_gallery/internal/models"
+)
+
+// countingDB counts the reads that reach the wrapped service
+type countingDB struct {
+	DatabaseService
+	gets, lists, batchGets int
+}
+
+func (d *countingDB) GetImage(ctx context.Context, id string) (models.Image, error) {
+	d.gets++
+	return d.DatabaseService.GetImage(ctx, id)
+}
+
+func (d *countingDB) ListImages(ctx context.Context) ([]models.Image, error) {
+	d.lists++
+	return d.DatabaseService.ListImages(ctx)
+}
+
+func (d *countingDB) BatchGetImages(ctx context.Context, ids []string) ([]models.Image, error) {
+	d.batchGets++
+	return d.DatabaseService.BatchGetImages(ctx, ids)
+}
+
+func TestCachedDatabaseService(t *testing.T) {
+	ctx := context.Background()
+
+	newCache := func(t *testing.T, opts CacheOptions) (*CachedDatabaseService, *countingDB, *time.Time) {
+		t.Helper()
+		local, err := NewLocalDBService(t.TempDir())
+		if err != nil {
+			t.Fatalf("Failed to create local DB service: %v", err)
+		}
+		for _, id := range []string{"a", "b"} {
+			if err := local.SaveImage(ctx, models.Image{ID: id, Title: "Image " + id, S3Key: id + ".jpg"}); err != nil {
+				t.Fatalf("Failed to save image: %v", err)
+			}
+		}
+
+		db := &countingDB{DatabaseService: local}
+		cache := NewCachedDatabaseService(db, opts)
+		now := time.Now()
+		cache.now = func() time.Time { return now }
+		return cache, db, &now
+	}
+
+	t.Run("GetImageIsCached", func(t *testing.T) {
+		cache, db, _ := newCache(t, CacheOptions{})
+
+		for i := 0; i < 3; i++ {
+			if _, err := cache.GetImage(ctx, "a"); err != nil {
+				t.Fatalf("Failed to get image: %v", err)
+			}
+		}
+		if db.gets != 1 {
+			t.Errorf("Expected 1 read through, got %d", db.gets)
+		}
+		if stats := cache.Stats(); stats.RecordHits != 2 || stats.RecordMisses != 1 || stats.Records != 1 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("MissingImagesAreNotCached", func(t *testing.T) {
+		cache, db, _ := newCache(t, CacheOptions{})
+
+		for i := 0; i < 2; i++ {
+			if _, err := cache.GetImage(ctx, "missing"); !errors.Is(err, ErrNotFound) {
+				t.Fatalf("Expected ErrNotFound, got %v", err)
+			}
+		}
+		if db.gets != 2 {
+			t.Errorf("Expected 2 reads through, got %d", db.gets)
+		}
+	})
+
+	t.Run("EntriesExpire", func(t *testing.T) {
+		cache, db, now := newCache(t, CacheOptions{RecordTTL: time.Minute, ListTTL: time.Second})
+
+		cache.GetImage(ctx, "a")
+		cache.ListImages(ctx)
+		*now = now.Add(2 * time.Second)
+		cache.GetImage(ctx, "a")
+		cache.ListImages(ctx)
+		if db.gets != 1 || db.lists != 2 {
+			t.Errorf("Expected the list to expire before the record, got %d gets and %d lists", db.gets, db.lists)
+		}
+
+		*now = now.Add(time.Minute)
+		cache.GetImage(ctx, "a")
+		if db.gets != 2 {
+			t.Errorf("Expected the record to expire, got %d gets", db.gets)
+		}
+	})
+
+	t.Run("WritesInvalidate", func(t *testing.T) {
+		cache, db, _ := newCache(t, CacheOptions{})
+
+		image, _ := cache.GetImage(ctx, "a")
+		cache.ListImages(ctx)
+
+		image.Title = "Renamed"
+		if err := cache.SaveImage(ctx, image); err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+		got, _ := cache.GetImage(ctx, "a")
+		if got.Title != "Renamed" || db.gets != 2 {
+			t.Errorf("Expected a fresh read after saving, got %q after %d gets", got.Title, db.gets)
+		}
+
+		if err := cache.DeleteImage(ctx, "b"); err != nil {
+			t.Fatalf("Failed to delete image: %v", err)
+		}
+		images, _ := cache.ListImages(ctx)
+		if len(images) != 1 || db.lists != 2 {
+			t.Errorf("Expected a fresh list after deleting, got %d images after %d lists", len(images), db.lists)
+		}
+	})
+
+	t.Run("ExternalInvalidation", func(t *testing.T) {
+		cache, db, _ := newCache(t, CacheOptions{})
+
+		cache.GetImage(ctx, "a")
+		cache.Invalidate("a")
+		cache.GetImage(ctx, "a")
+		cache.InvalidateAll()
+		cache.GetImage(ctx, "a")
+		if db.gets != 3 {
+			t.Errorf("Expected every invalidation to force a read, got %d gets", db.gets)
+		}
+		if stats := cache.Stats(); stats.Invalidations != 2 {
+			t.Errorf("Expected 2 invalidations, got %d", stats.Invalidations)
+		}
+	})
+
+	t.Run("ListIsCopied", func(t *testing.T) {
+		cache, _, _ := newCache(t, CacheOptions{})
+
+		images, _ := cache.ListImages(ctx)
+		images[0].Title = "Changed by caller"
+		images, _ = cache.ListImages(ctx)
+		for _, image := range images {
+			if image.Title == "Changed by caller" {
+				t.Errorf("Expected the cached list to be unaffected by callers")
+			}
+		}
+	})
+
+	t.Run("ListFillsRecords", func(t *testing.T) {
+		cache, db, _ := newCache(t, CacheOptions{})
+
+		cache.ListImages(ctx)
+		images, err := cache.BatchGetImages(ctx, []string{"b", "a"})
+		if err != nil {
+			t.Fatalf("Failed to batch get images: %v", err)
+		}
+		if db.batchGets != 0 {
+			t.Errorf("Expected records to be served from the list, got %d batch reads", db.batchGets)
+		}
+		if len(images) != 2 || images[0].ID != "b" || images[1].ID != "a" {
+			t.Errorf("Expected images in request order, got %+v", images)
+		}
+	})
+
+	t.Run("BatchGetReportsMissing", func(t *testing.T) {
+		cache, _, _ := newCache(t, CacheOptions{})
+
+		cache.GetImage(ctx, "a")
+		images, err := cache.BatchGetImages(ctx, []string{"a", "missing", "b"})
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) || len(batchErr.Errors) != 1 {
+			t.Fatalf("Expected a batch error for the missing ID, got %v", err)
+		}
+		if len(images) != 2 || images[0].ID != "a" || images[1].ID != "b" {
+			t.Errorf("Expected the found images in request order, got %+v", images)
+		}
+	})
+
+	t.Run("EvictsLeastRecentlyUsed", func(t *testing.T) {
+		cache, db, _ := newCache(t, CacheOptions{MaxRecords: 1})
+
+		cache.GetImage(ctx, "a")
+		cache.GetImage(ctx, "b")
+		cache.GetImage(ctx, "a")
+		if db.gets != 3 {
+			t.Errorf("Expected a to be evicted, got %d gets", db.gets)
+		}
+		if stats := cache.Stats(); stats.Evictions != 2 || stats.Records != 1 {
+			t.Errorf("Unexpected stats %+v", stats)
+		}
+	})
+
+	t.Run("StaleReadsAreNotStored", func(t *testing.T) {
+		cache, db, _ := newCache(t, CacheOptions{})
+
+		generation := cache.currentGeneration()
+		stale, _ := db.GetImage(ctx, "a")
+		cache.Invalidate("a")
+		cache.storeRecords(generation, []models.Image{stale})
+		if stats := cache.Stats(); stats.Records != 0 {
+			t.Errorf("Expected a read from before the invalidation to be dropped, got %d records", stats.Records)
+		}
+	})
+}
@@ -8,15 +8,58 @@ import (
 
 // DatabaseService defines the common interface for database services
 type DatabaseService interface {
-	// SaveImage saves image metadata to database
+	// SaveImage saves image metadata to database. image.Version must match the
+	// stored version (0 for a new record); the record is stored with the next
+	// version, otherwise ErrVersionConflict is returned
 	SaveImage(ctx context.Context, image models.Image) error
 	
-	// GetImage retrieves an image by ID
+	// GetImage retrieves an image by ID, or returns ErrNotFound
 	GetImage(ctx context.Context, id string) (models.Image, error)
 	
 	// ListImages retrieves all images
 	ListImages(ctx context.Context) ([]models.Image, error)
 	
-	// DeleteImage removes image metadata from database
+	// DeleteImage removes image metadata from database, or returns ErrNotFound
 	DeleteImage(ctx context.Context, id string) error
-}
\ No newline at end of file
+	
+	// BatchGetImages retrieves the images with the given IDs in request order.
+	// IDs that could not be read are reported in a *BatchError alongside the
+	// images that were found
+	BatchGetImages(ctx context.Context, ids []string) ([]models.Image, error)
+	
+	// BatchSaveImages stores each image at the version after the stored one,
+	// ignoring image.Version. Failed images are reported in a *BatchError
+	BatchSaveImages(ctx context.Context, images []models.Image) error
+	
+	// BatchUpdateImages stores each image as SaveImage does: image.Version must
+	// match the stored version (0 for a new record). Images that changed or
+	// were deleted since they were read fail with ErrVersionConflict, and
+	// every failed image is reported in a *BatchError
+	BatchUpdateImages(ctx context.Context, images []models.Image) error
+	
+	// BatchDeleteImages removes the metadata of the given IDs. Missing IDs are
+	// not an error; failed IDs are reported in a *BatchError
+	BatchDeleteImages(ctx context.Context, ids []string) error
+}
+
+// RecordMigrator is implemented by databases that can rewrite the records
+// stored with an older schema version. Reads already migrate records in
+// memory; MigrateRecords persists the result
+type RecordMigrator interface {
+	MigrateRecords(ctx context.Context, dryRun bool) (MigrationReport, error)
+}
+
+// MigrationReport summarizes a MigrateRecords run
+type MigrationReport struct {
+	DryRun  bool `json:"dryRun"`
+	Scanned int  `json:"scanned"`
+	// Outdated counts the outdated records by their stored schema version
+	Outdated map[int]int `json:"outdated"`
+	Migrated int         `json:"migrated"`
+	// Failed maps record IDs to the reason they could not be migrated
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+func newMigrationReport(dryRun bool) MigrationReport {
+	return MigrationReport{DryRun: dryRun, Outdated: make(map[int]int), Failed: make(map[string]string)}
+}
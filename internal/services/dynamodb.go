@@ -3,15 +3,40 @@ package services
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strconv"
+	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	
+
 	"image_gallery/internal/models"
 )
 
+// Table layout shared with provisioning
+const (
+	// KindAttribute tells image records apart from other items in the table
+	KindAttribute = "kind"
+
+	// imageKind is the KindAttribute value of image records
+	imageKind = "image"
+)
+
+// ImageExpiryGrace is how long after an image expires DynamoDB's time to
+// live removes its record. The sweeper normally purges it well before, blob
+// first; time to live only catches records no sweeper got to
+const ImageExpiryGrace = 24 * time.Hour
+
+// Limits and retry policy for batch requests
+const (
+	dynamoDBBatchGetLimit = 100
+	batchMaxAttempts      = 5
+	batchBaseDelay        = 50 * time.Millisecond
+)
+
 // DynamoDBService handles operations with AWS DynamoDB
 type DynamoDBService struct {
 	client    *dynamodb.Client
@@ -29,21 +54,68 @@ func NewDynamoDBService(client *dynamodb.Client, tableName string) *DynamoDBServ
 // Verify that DynamoDBService implements DatabaseService
 var _ DatabaseService = (*DynamoDBService)(nil)
 
-// SaveImage saves image metadata to DynamoDB
+// SaveImage saves image metadata to DynamoDB if its version matches the
+// stored one, recording the change in the outbox in the same transaction
 func (d *DynamoDBService) SaveImage(ctx context.Context, image models.Image) error {
-	item, err := attributevalue.MarshalMap(image)
+	before, err := d.currentImage(ctx, image.ID)
 	if err != nil {
 		return err
 	}
+	if (before == nil && image.Version != 0) || (before != nil && before.Version != image.Version) {
+		return ErrVersionConflict
+	}
 
-	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: aws.String(d.tableName),
-		Item:      item,
-	})
+	input, err := d.savePutItemInput(image)
+	if err != nil {
+		return err
+	}
+	after := image
+	after.Version++
+	after.SchemaVersion = models.CurrentSchemaVersion
 
+	change := outboxChange{before: before, after: &after, write: transactPut(input)}
+	err = transactWithEvents(ctx, d.client.GetItem, d.client.TransactWriteItems, d.tableName, shardOf(image.ID, outboxShards), []outboxChange{change}, batchBaseDelay)
+	if errors.Is(err, ErrConflict) {
+		return ErrVersionConflict
+	}
 	return err
 }
 
+// savePutItemInput builds a PutItem request that stores the next version of
+// the image, conditional on the stored version still matching image.Version
+func (d *DynamoDBService) savePutItemInput(image models.Image) (*dynamodb.PutItemInput, error) {
+	expectedVersion := image.Version
+	image.Version++
+	image.SchemaVersion = models.CurrentSchemaVersion
+
+	item, err := attributevalue.MarshalMap(image)
+	if err != nil {
+		return nil, err
+	}
+	item[KindAttribute] = &types.AttributeValueMemberS{Value: imageKind}
+	if image.ExpiresAt != nil {
+		item[TimeToLiveAttribute] = &types.AttributeValueMemberN{Value: strconv.FormatInt(image.ExpiresAt.Add(ImageExpiryGrace).Unix(), 10)}
+	}
+
+	input := &dynamodb.PutItemInput{
+		TableName:                aws.String(d.tableName),
+		Item:                     item,
+		ExpressionAttributeNames: map[string]string{"#version": "version"},
+	}
+
+	// Records written before versioning have no version attribute
+	if expectedVersion == 0 {
+		input.ConditionExpression = aws.String("attribute_not_exists(#version)")
+	} else {
+		input.ConditionExpression = aws.String("#version = :expected")
+		input.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":expected": &types.AttributeValueMemberN{Value: strconv.FormatInt(expectedVersion, 10)},
+		}
+	}
+
+	return input, nil
+}
+
 // GetImage retrieves an image by ID
 func (d *DynamoDBService) GetImage(ctx context.Context, id string) (models.Image, error) {
 	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
@@ -53,15 +125,14 @@ func (d *DynamoDBService) GetImage(ctx context.Context, id string) (models.Image
 		},
 	})
 	if err != nil {
-		return models.Image{}, err
+		return models.Image{}, awsError(err)
 	}
 
 	if result.Item == nil {
-		return models.Image{}, errors.New("image not found")
+		return models.Image{}, fmt.Errorf("image %s: %w", id, ErrNotFound)
 	}
 
-	var image models.Image
-	err = attributevalue.UnmarshalMap(result.Item, &image)
+	image, _, err := decodeImageItem(result.Item)
 	if err != nil {
 		return models.Image{}, err
 	}
@@ -71,30 +142,352 @@ func (d *DynamoDBService) GetImage(ctx context.Context, id string) (models.Image
 
 // ListImages retrieves all images
 func (d *DynamoDBService) ListImages(ctx context.Context) ([]models.Image, error) {
-	result, err := d.client.Scan(ctx, &dynamodb.ScanInput{
-		TableName: aws.String(d.tableName),
+	// Skip the outbox items; records written before the kind attribute
+	// existed are images
+	paginator := dynamodb.NewScanPaginator(d.client, &dynamodb.ScanInput{
+		TableName:                aws.String(d.tableName),
+		FilterExpression:         aws.String("attribute_not_exists(#kind) OR #kind = :image"),
+		ExpressionAttributeNames: map[string]string{"#kind": KindAttribute},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":image": &types.AttributeValueMemberS{Value: imageKind},
+		},
 	})
-	if err != nil {
-		return nil, err
-	}
 
 	var images []models.Image
-	err = attributevalue.UnmarshalListOfMaps(result.Items, &images)
-	if err != nil {
-		return nil, err
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, awsError(err)
+		}
+		for _, item := range page.Items {
+			image, _, err := decodeImageItem(item)
+			if err != nil {
+				return nil, err
+			}
+			images = append(images, image)
+		}
 	}
 
 	return images, nil
 }
 
-// DeleteImage removes image metadata from DynamoDB
+// DeleteImage removes image metadata from DynamoDB, recording the deletion
+// in the outbox in the same transaction
 func (d *DynamoDBService) DeleteImage(ctx context.Context, id string) error {
-	_, err := d.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
-		TableName: aws.String(d.tableName),
-		Key: map[string]types.AttributeValue{
-			"id": &types.AttributeValueMemberS{Value: id},
-		},
+	for attempt := 0; ; attempt++ {
+		before, err := d.currentImage(ctx, id)
+		if err != nil {
+			return err
+		}
+		if before == nil {
+			return fmt.Errorf("image %s: %w", id, ErrNotFound)
+		}
+
+		change := outboxChange{before: before, write: transactDelete(d.tableName, *before)}
+		err = transactWithEvents(ctx, d.client.GetItem, d.client.TransactWriteItems, d.tableName, shardOf(id, outboxShards), []outboxChange{change}, batchBaseDelay)
+
+		// The image changed after it was read; delete the new version
+		if errors.Is(err, ErrConflict) && attempt+1 < batchMaxAttempts {
+			continue
+		}
+		return err
+	}
+}
+
+// BatchGetImages retrieves the images with the given IDs using BatchGetItem
+func (d *DynamoDBService) BatchGetImages(ctx context.Context, ids []string) ([]models.Image, error) {
+	items, failed := batchGetItems(ctx, d.client.BatchGetItem, d.tableName, ids, batchBaseDelay)
+
+	images := make([]models.Image, 0, len(ids))
+	for _, id := range ids {
+		if _, ok := failed[id]; ok {
+			continue
+		}
+		item, ok := items[id]
+		if !ok {
+			failed[id] = fmt.Errorf("image %s: %w", id, ErrNotFound)
+			continue
+		}
+
+		image, _, err := decodeImageItem(item)
+		if err != nil {
+			failed[id] = err
+			continue
+		}
+		images = append(images, image)
+	}
+
+	return images, newBatchError(failed)
+}
+
+// BatchSaveImages stores several images in transactions that also record
+// their events
+func (d *DynamoDBService) BatchSaveImages(ctx context.Context, images []models.Image) error {
+	// A transaction cannot write the same item twice; the last image wins
+	byID := make(map[string]models.Image, len(images))
+	var ids []string
+	for _, image := range images {
+		if _, ok := byID[image.ID]; !ok {
+			ids = append(ids, image.ID)
+		}
+		byID[image.ID] = image
+	}
+
+	failed := d.transactBatch(ctx, ids, func(id string, before *models.Image) (*outboxChange, error) {
+		image := byID[id]
+		image.Version = 0
+		if before != nil {
+			image.Version = before.Version
+		}
+
+		input, err := d.savePutItemInput(image)
+		if err != nil {
+			return nil, err
+		}
+		after := image
+		after.Version++
+		after.SchemaVersion = models.CurrentSchemaVersion
+		return &outboxChange{before: before, after: &after, write: transactPut(input)}, nil
+	})
+	return newBatchError(failed)
+}
+
+// BatchUpdateImages stores several images in transactions that also record
+// their events, each conditional on its version as in SaveImage. A
+// transaction lost to a concurrent change is retried from fresh reads, which
+// then fail only the image that changed
+func (d *DynamoDBService) BatchUpdateImages(ctx context.Context, images []models.Image) error {
+	// A transaction cannot write the same item twice; the last image wins
+	byID := make(map[string]models.Image, len(images))
+	var ids []string
+	for _, image := range images {
+		if _, ok := byID[image.ID]; !ok {
+			ids = append(ids, image.ID)
+		}
+		byID[image.ID] = image
+	}
+
+	failed := d.transactBatch(ctx, ids, func(id string, before *models.Image) (*outboxChange, error) {
+		image := byID[id]
+		if (before == nil && image.Version != 0) || (before != nil && before.Version != image.Version) {
+			return nil, ErrVersionConflict
+		}
+
+		input, err := d.savePutItemInput(image)
+		if err != nil {
+			return nil, err
+		}
+		after := image
+		after.Version++
+		after.SchemaVersion = models.CurrentSchemaVersion
+		return &outboxChange{before: before, after: &after, write: transactPut(input)}, nil
 	})
+	for id, err := range failed {
+		if errors.Is(err, ErrConflict) {
+			failed[id] = ErrVersionConflict
+		}
+	}
+	return newBatchError(failed)
+}
 
-	return err
-}
\ No newline at end of file
+// BatchDeleteImages removes several images in transactions that also record
+// their events
+func (d *DynamoDBService) BatchDeleteImages(ctx context.Context, ids []string) error {
+	seen := make(map[string]bool, len(ids))
+	var unique []string
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	failed := d.transactBatch(ctx, unique, func(id string, before *models.Image) (*outboxChange, error) {
+		if before == nil {
+			return nil, nil
+		}
+		return &outboxChange{before: before, write: transactDelete(d.tableName, *before)}, nil
+	})
+	return newBatchError(failed)
+}
+
+// MigrateRecords rewrites every image item stored with an older schema version
+func (d *DynamoDBService) MigrateRecords(ctx context.Context, dryRun bool) (MigrationReport, error) {
+	return d.migrateItems(ctx, d.client, d.client.PutItem, dryRun)
+}
+
+// Verify that DynamoDBService implements RecordMigrator
+var _ RecordMigrator = (*DynamoDBService)(nil)
+
+// putItemFunc matches the DynamoDB client method
+type putItemFunc func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+
+// migrateItems scans the table and writes back each outdated image item.
+// The write is conditional on the stored version, so a record changed
+// concurrently is left to the writer, which stores the current schema anyway.
+// Migrations do not change what a record means and are not put in the outbox
+func (d *DynamoDBService) migrateItems(ctx context.Context, scan dynamodb.ScanAPIClient, put putItemFunc, dryRun bool) (MigrationReport, error) {
+	report := newMigrationReport(dryRun)
+
+	paginator := dynamodb.NewScanPaginator(scan, &dynamodb.ScanInput{TableName: aws.String(d.tableName)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return report, awsError(err)
+		}
+
+		for _, item := range page.Items {
+			if kind, ok := item[KindAttribute].(*types.AttributeValueMemberS); ok && kind.Value != imageKind {
+				continue
+			}
+			report.Scanned++
+
+			id := itemID(item)
+			image, from, err := decodeImageItem(item)
+			if err != nil {
+				report.Failed[id] = err.Error()
+				continue
+			}
+			if from == models.CurrentSchemaVersion {
+				continue
+			}
+			report.Outdated[from]++
+			if dryRun {
+				continue
+			}
+
+			input, err := d.savePutItemInput(image)
+			if err == nil {
+				_, err = put(ctx, input)
+			}
+			var conditionErr *types.ConditionalCheckFailedException
+			switch {
+			case errors.As(err, &conditionErr):
+				report.Failed[id] = "changed during migration, rerun to check"
+			case err != nil:
+				report.Failed[id] = awsError(err).Error()
+			default:
+				report.Migrated++
+			}
+		}
+	}
+
+	return report, nil
+}
+
+// decodeImageItem converts a stored item to an Image, migrating it from
+// older schema versions. It also returns the schema version it was stored with
+func decodeImageItem(item map[string]types.AttributeValue) (models.Image, int, error) {
+	var image models.Image
+
+	// Current records need no migration and are decoded directly
+	if n, ok := item[models.SchemaVersionField].(*types.AttributeValueMemberN); ok && n.Value == strconv.Itoa(models.CurrentSchemaVersion) {
+		err := attributevalue.UnmarshalMap(item, &image)
+		return image, models.CurrentSchemaVersion, err
+	}
+
+	var record models.Record
+	if err := attributevalue.UnmarshalMap(item, &record); err != nil {
+		return image, 0, err
+	}
+	from, err := models.MigrateRecord(record)
+	if err != nil {
+		return image, from, err
+	}
+
+	migrated, err := attributevalue.MarshalMap(record)
+	if err != nil {
+		return image, from, err
+	}
+	err = attributevalue.UnmarshalMap(migrated, &image)
+	return image, from, err
+}
+
+// batchGetItemFunc matches the DynamoDB client method
+type batchGetItemFunc func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error)
+
+// batchGetItems reads items by ID in chunks, retrying unprocessed keys with
+// exponential backoff. It returns the items found keyed by ID and the IDs
+// that could not be read
+func batchGetItems(ctx context.Context, get batchGetItemFunc, tableName string, ids []string, baseDelay time.Duration) (map[string]map[string]types.AttributeValue, map[string]error) {
+	items := make(map[string]map[string]types.AttributeValue)
+	failed := make(map[string]error)
+
+	// BatchGetItem rejects duplicate keys
+	seen := make(map[string]bool)
+	var keys []map[string]types.AttributeValue
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			keys = append(keys, map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}})
+		}
+	}
+
+	for start := 0; start < len(keys); start += dynamoDBBatchGetLimit {
+		pending := keys[start:min(start+dynamoDBBatchGetLimit, len(keys))]
+
+		for attempt := 0; len(pending) > 0; attempt++ {
+			if attempt == batchMaxAttempts {
+				for _, key := range pending {
+					failed[itemID(key)] = fmt.Errorf("%w: unprocessed after %d attempts", ErrUnavailable, attempt)
+				}
+				break
+			}
+			if err := batchBackoff(ctx, attempt, baseDelay); err != nil {
+				for _, key := range pending {
+					failed[itemID(key)] = err
+				}
+				break
+			}
+
+			// Strongly consistent, so reads see the writes that just
+			// committed; the outbox relies on this
+			result, err := get(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: map[string]types.KeysAndAttributes{tableName: {Keys: pending, ConsistentRead: aws.Bool(true)}},
+			})
+			if err != nil {
+				err = awsError(err)
+				for _, key := range pending {
+					failed[itemID(key)] = err
+				}
+				break
+			}
+
+			for _, item := range result.Responses[tableName] {
+				items[itemID(item)] = item
+			}
+			pending = result.UnprocessedKeys[tableName].Keys
+		}
+	}
+
+	return items, failed
+}
+
+// batchBackoff waits before a retry; the first attempt is not delayed. The
+// delay doubles with each attempt and is jittered, so writers that lost the
+// same race do not retry in step
+func batchBackoff(ctx context.Context, attempt int, baseDelay time.Duration) error {
+	if attempt == 0 {
+		return nil
+	}
+
+	delay := baseDelay << (attempt - 1)
+	if delay > 0 {
+		delay = delay/2 + rand.N(delay/2+1)
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// itemID returns the id attribute of an item or key
+func itemID(item map[string]types.AttributeValue) string {
+	if id, ok := item["id"].(*types.AttributeValueMemberS); ok {
+		return id.Value
+	}
+	return ""
+}
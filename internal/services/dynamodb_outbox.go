@@ -0,0 +1,443 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+
+	"image_gallery/internal/models"
+)
+
+// Outbox items share the table with the images and are told apart by kind
+const (
+	// TimeToLiveAttribute is the table's TTL attribute, in Unix seconds.
+	// Events carry it to age out of the outbox, and expiring images to be
+	// removed ImageExpiryGrace after they expire
+	TimeToLiveAttribute = "ttl"
+
+	eventKind             = "event"
+	outboxCounterKind     = "outbox-sequence"
+	offsetKind            = "offset"
+	sequenceAttribute     = "sequence"
+	dynamoDBTransactLimit = 100
+)
+
+// outboxShards is the number of outbox counters. Each write advances the
+// counter of its image's shard, so concurrent writes only contend when
+// their images share a shard
+const outboxShards = 16
+
+// outboxMaxAttempts bounds the retries of a write that keeps losing the
+// race for its shard's counter
+const outboxMaxAttempts = 10
+
+// transactImageLimit is the number of image changes per transaction: each
+// takes two items, the change and its event, plus one for the counter
+const transactImageLimit = (dynamoDBTransactLimit - 1) / 2
+
+// getItemFunc and transactWriteItemsFunc match the DynamoDB client methods
+type getItemFunc func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error)
+type transactWriteItemsFunc func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error)
+
+// outboxChange is a write to one image and the states its event records
+type outboxChange struct {
+	before *models.Image
+	after  *models.Image
+	write  types.TransactWriteItem
+}
+
+// changeConflictError reports that the condition of a change failed
+type changeConflictError struct {
+	index int
+}
+
+func (e *changeConflictError) Error() string {
+	return fmt.Sprintf("change %d: %v", e.index, ErrConflict)
+}
+
+func (e *changeConflictError) Unwrap() error {
+	return ErrConflict
+}
+
+func counterID(shard int) string {
+	return fmt.Sprintf("outbox#sequence#%02d", shard)
+}
+
+func eventID(shard int, sequence int64) string {
+	return fmt.Sprintf("event#%02d#%020d", shard, sequence)
+}
+
+func offsetID(consumer string, shard int) string {
+	return fmt.Sprintf("offset#%s#%02d", consumer, shard)
+}
+
+// transactWithEvents writes the changes, an event item for each and the
+// advanced counter of their outbox shard in one transaction. All changes
+// must be to images of that shard. The counter update is conditional on the
+// value read before, so sequences have no gaps or duplicates; losing that
+// race retries with the new value
+func transactWithEvents(ctx context.Context, get getItemFunc, transact transactWriteItemsFunc, tableName string, shard int, changes []outboxChange, baseDelay time.Duration) error {
+	for attempt := 0; ; attempt++ {
+		if attempt == outboxMaxAttempts {
+			return fmt.Errorf("outbox shard %d busy after %d attempts: %w", shard, attempt, ErrUnavailable)
+		}
+		if err := batchBackoff(ctx, attempt, baseDelay); err != nil {
+			return err
+		}
+
+		sequence, err := readSequence(ctx, get, tableName, shard)
+		if err != nil {
+			return err
+		}
+		input, err := outboxTransaction(tableName, shard, changes, sequence, time.Now().UTC())
+		if err != nil {
+			return err
+		}
+
+		_, err = transact(ctx, input)
+		var canceled *types.TransactionCanceledException
+		if !errors.As(err, &canceled) {
+			return awsError(err)
+		}
+
+		// Items are ordered counter, change 0, event 0, change 1, event 1...
+		retry := false
+		for i, reason := range canceled.CancellationReasons {
+			switch aws.ToString(reason.Code) {
+			case "ConditionalCheckFailed":
+				if i > 0 && (i-1)%2 == 0 {
+					return &changeConflictError{index: (i - 1) / 2}
+				}
+				retry = true
+			case "TransactionConflict", "ThrottlingError", "ProvisionedThroughputExceeded", "RequestLimitExceeded":
+				retry = true
+			}
+		}
+		if !retry {
+			return awsError(err)
+		}
+	}
+}
+
+// outboxTransaction builds the transaction for changes whose events follow
+// sequence in shard
+func outboxTransaction(tableName string, shard int, changes []outboxChange, sequence int64, now time.Time) (*dynamodb.TransactWriteItemsInput, error) {
+	next := sequence + int64(len(changes))
+	counter := &types.Update{
+		TableName:        aws.String(tableName),
+		Key:              map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: counterID(shard)}},
+		UpdateExpression: aws.String("SET #sequence = :next, #kind = :kind"),
+		ExpressionAttributeNames: map[string]string{
+			"#sequence": sequenceAttribute,
+			"#kind":     KindAttribute,
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":next": &types.AttributeValueMemberN{Value: strconv.FormatInt(next, 10)},
+			":kind": &types.AttributeValueMemberS{Value: outboxCounterKind},
+		},
+	}
+	if sequence == 0 {
+		counter.ConditionExpression = aws.String("attribute_not_exists(id)")
+	} else {
+		counter.ConditionExpression = aws.String("#sequence = :current")
+		counter.ExpressionAttributeValues[":current"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(sequence, 10)}
+	}
+
+	items := []types.TransactWriteItem{{Update: counter}}
+	for i, change := range changes {
+		event := newImageEvent(change.before, change.after, now)
+		event.Shard = shard
+		event.Sequence = sequence + int64(i) + 1
+
+		item, err := attributevalue.MarshalMap(event)
+		if err != nil {
+			return nil, err
+		}
+		item["id"] = &types.AttributeValueMemberS{Value: eventID(shard, event.Sequence)}
+		item[KindAttribute] = &types.AttributeValueMemberS{Value: eventKind}
+		item[TimeToLiveAttribute] = &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(OutboxRetention).Unix(), 10)}
+
+		items = append(items, change.write, types.TransactWriteItem{Put: &types.Put{
+			TableName:           aws.String(tableName),
+			Item:                item,
+			ConditionExpression: aws.String("attribute_not_exists(id)"),
+		}})
+	}
+
+	return &dynamodb.TransactWriteItemsInput{TransactItems: items}, nil
+}
+
+// readSequence returns the sequence of the latest event of a shard, or 0
+func readSequence(ctx context.Context, get getItemFunc, tableName string, shard int) (int64, error) {
+	result, err := get(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(tableName),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: counterID(shard)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, awsError(err)
+	}
+	return itemSequence(result.Item)
+}
+
+func itemSequence(item map[string]types.AttributeValue) (int64, error) {
+	n, ok := item[sequenceAttribute].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, nil
+	}
+	return strconv.ParseInt(n.Value, 10, 64)
+}
+
+// transactPut converts a conditional PutItem request for use in a transaction
+func transactPut(input *dynamodb.PutItemInput) types.TransactWriteItem {
+	return types.TransactWriteItem{Put: &types.Put{
+		TableName:                 input.TableName,
+		Item:                      input.Item,
+		ConditionExpression:       input.ConditionExpression,
+		ExpressionAttributeNames:  input.ExpressionAttributeNames,
+		ExpressionAttributeValues: input.ExpressionAttributeValues,
+	}}
+}
+
+// transactDelete deletes an image if it still has the given version
+func transactDelete(tableName string, image models.Image) types.TransactWriteItem {
+	remove := &types.Delete{
+		TableName:                aws.String(tableName),
+		Key:                      map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: image.ID}},
+		ExpressionAttributeNames: map[string]string{"#version": "version"},
+	}
+
+	// Records written before versioning have no version attribute
+	if image.Version == 0 {
+		remove.ConditionExpression = aws.String("attribute_exists(id) AND attribute_not_exists(#version)")
+	} else {
+		remove.ConditionExpression = aws.String("#version = :expected")
+		remove.ExpressionAttributeValues = map[string]types.AttributeValue{
+			":expected": &types.AttributeValueMemberN{Value: strconv.FormatInt(image.Version, 10)},
+		}
+	}
+
+	return types.TransactWriteItem{Delete: remove}
+}
+
+// currentImage reads an image with a strongly consistent read, returning
+// nil if it does not exist
+func (d *DynamoDBService) currentImage(ctx context.Context, id string) (*models.Image, error) {
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, awsError(err)
+	}
+	if result.Item == nil {
+		return nil, nil
+	}
+
+	image, _, err := decodeImageItem(result.Item)
+	if err != nil {
+		return nil, err
+	}
+	return &image, nil
+}
+
+// transactBatch applies a change to each ID in transactions of up to
+// transactImageLimit images of one outbox shard. build returns the change
+// for an ID given its current state, or nil to skip it. A transaction that
+// fails because an image changed concurrently is rebuilt from fresh reads
+// and retried
+func (d *DynamoDBService) transactBatch(ctx context.Context, ids []string, build func(id string, before *models.Image) (*outboxChange, error)) map[string]error {
+	failed := make(map[string]error)
+
+	byShard := make([][]string, outboxShards)
+	for _, id := range ids {
+		shard := shardOf(id, outboxShards)
+		byShard[shard] = append(byShard[shard], id)
+	}
+
+	for shard, ids := range byShard {
+		for start := 0; start < len(ids); start += transactImageLimit {
+			d.transactChunk(ctx, shard, ids[start:min(start+transactImageLimit, len(ids))], build, failed)
+		}
+	}
+
+	return failed
+}
+
+// transactChunk applies the changes of one transaction of transactBatch,
+// recording the IDs that fail in failed
+func (d *DynamoDBService) transactChunk(ctx context.Context, shard int, chunk []string, build func(id string, before *models.Image) (*outboxChange, error), failed map[string]error) {
+	for attempt := 0; ; attempt++ {
+		current, err := d.BatchGetImages(ctx, chunk)
+		var batchErr *BatchError
+		if errors.As(err, &batchErr) {
+			for id, itemErr := range batchErr.Errors {
+				if !errors.Is(itemErr, ErrNotFound) {
+					failed[id] = itemErr
+				}
+			}
+		} else if err != nil {
+			for _, id := range chunk {
+				failed[id] = err
+			}
+			return
+		}
+
+		byID := make(map[string]*models.Image, len(current))
+		for i := range current {
+			byID[current[i].ID] = &current[i]
+		}
+
+		var changes []outboxChange
+		var changed []string
+		for _, id := range chunk {
+			if _, ok := failed[id]; ok {
+				continue
+			}
+			change, err := build(id, byID[id])
+			if err != nil {
+				failed[id] = err
+				continue
+			}
+			if change != nil {
+				changes = append(changes, *change)
+				changed = append(changed, id)
+			}
+		}
+		if len(changes) == 0 {
+			return
+		}
+
+		err = transactWithEvents(ctx, d.client.GetItem, d.client.TransactWriteItems, d.tableName, shard, changes, batchBaseDelay)
+		var conflict *changeConflictError
+		if errors.As(err, &conflict) && attempt+1 < batchMaxAttempts {
+			continue
+		}
+		if err != nil {
+			for _, id := range changed {
+				failed[id] = err
+			}
+		}
+		return
+	}
+}
+
+// Verify that DynamoDBService implements EventLog
+var _ EventLog = (*DynamoDBService)(nil)
+
+// Shards returns the number of outbox shards
+func (d *DynamoDBService) Shards() int {
+	return outboxShards
+}
+
+// ReadEvents returns up to limit outbox events of a shard after the given
+// sequence
+func (d *DynamoDBService) ReadEvents(ctx context.Context, shard int, after int64, limit int) ([]models.ImageEvent, error) {
+	latest, err := d.LatestSequence(ctx, shard)
+	if err != nil {
+		return nil, err
+	}
+
+	count := min(int64(limit), latest-after)
+	if count <= 0 {
+		return []models.ImageEvent{}, nil
+	}
+
+	ids := make([]string, count)
+	for i := range ids {
+		ids[i] = eventID(shard, after+int64(i)+1)
+	}
+	items, failed := batchGetItems(ctx, d.client.BatchGetItem, d.tableName, ids, batchBaseDelay)
+	if len(failed) > 0 {
+		return nil, newBatchError(failed)
+	}
+
+	return decodeEvents(ids, items, time.Now())
+}
+
+// decodeEvents decodes the event items in sequence order, stopping at the
+// first one that is gone. The outbox has no gaps, so a missing event has
+// expired. Time to live deletes expired items late and in no particular
+// order, so an event past its expiry counts as gone whether or not it has
+// been deleted yet
+func decodeEvents(ids []string, items map[string]map[string]types.AttributeValue, now time.Time) ([]models.ImageEvent, error) {
+	events := make([]models.ImageEvent, 0, len(ids))
+	for _, id := range ids {
+		item, ok := items[id]
+		if !ok || itemExpired(item, now) {
+			break
+		}
+		var event models.ImageEvent
+		if err := attributevalue.UnmarshalMap(item, &event); err != nil {
+			return nil, fmt.Errorf("failed to decode %s: %w", id, err)
+		}
+		events = append(events, event)
+	}
+
+	if len(events) == 0 && len(ids) > 0 {
+		return nil, ErrEventsExpired
+	}
+	return events, nil
+}
+
+// itemExpired reports whether an item's time to live has passed
+func itemExpired(item map[string]types.AttributeValue, now time.Time) bool {
+	n, ok := item[TimeToLiveAttribute].(*types.AttributeValueMemberN)
+	if !ok {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(n.Value, 10, 64)
+	return err == nil && expiresAt <= now.Unix()
+}
+
+// LatestSequence returns the sequence of the most recent event of a shard
+func (d *DynamoDBService) LatestSequence(ctx context.Context, shard int) (int64, error) {
+	if err := checkShard(shard, outboxShards); err != nil {
+		return 0, err
+	}
+	return readSequence(ctx, d.client.GetItem, d.tableName, shard)
+}
+
+// LoadOffset returns the stored offset of a consumer in a shard, or
+// ErrNotFound
+func (d *DynamoDBService) LoadOffset(ctx context.Context, consumer string, shard int) (int64, error) {
+	if err := checkShard(shard, outboxShards); err != nil {
+		return 0, err
+	}
+	result, err := d.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(d.tableName),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: offsetID(consumer, shard)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return 0, awsError(err)
+	}
+	if result.Item == nil {
+		return 0, fmt.Errorf("offset of %s in shard %d: %w", consumer, shard, ErrNotFound)
+	}
+	return itemSequence(result.Item)
+}
+
+// SaveOffset stores the offset of a consumer in a shard
+func (d *DynamoDBService) SaveOffset(ctx context.Context, consumer string, shard int, offset int64) error {
+	if err := checkShard(shard, outboxShards); err != nil {
+		return err
+	}
+	_, err := d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.tableName),
+		Item: map[string]types.AttributeValue{
+			"id":              &types.AttributeValueMemberS{Value: offsetID(consumer, shard)},
+			KindAttribute:     &types.AttributeValueMemberS{Value: offsetKind},
+			sequenceAttribute: &types.AttributeValueMemberN{Value: strconv.FormatInt(offset, 10)},
+		},
+	})
+	return awsError(err)
+}
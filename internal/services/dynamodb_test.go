@@ -1,23 +1,25 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"strconv"
 	"testing"
 	"time"
-	
+
 	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
-	
+
 	"image_gallery/internal/models"
 )
 
 // Define custom errors for our mock
 var (
-	ErrMissingKey = errors.New("missing required key 'id'")
+	ErrMissingKey     = errors.New("missing required key 'id'")
 	ErrInvalidKeyType = errors.New("ID must be a string")
 )
 
@@ -30,27 +32,27 @@ type mockDynamoDBClient struct {
 func (m *mockDynamoDBClient) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
 	// Extract the table name
 	tableName := aws.ToString(params.TableName)
-	
+
 	// Initialize the items map if not already done
 	if m.items == nil {
 		m.items = make(map[string]map[string]types.AttributeValue)
 	}
-	
+
 	// Extract the item ID (we assume the primary key is called "id")
 	idAttr, ok := params.Item["id"]
 	if !ok {
 		return nil, ErrMissingKey
 	}
-	
+
 	// Convert the ID to a string (we assume it's a string value)
 	idVal, ok := idAttr.(*types.AttributeValueMemberS)
 	if !ok {
 		return nil, ErrInvalidKeyType
 	}
-	
+
 	// Store the item
 	m.items[tableName+"/"+idVal.Value] = params.Item
-	
+
 	return &dynamodb.PutItemOutput{}, nil
 }
 
@@ -58,26 +60,26 @@ func (m *mockDynamoDBClient) PutItem(ctx context.Context, params *dynamodb.PutIt
 func (m *mockDynamoDBClient) GetItem(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
 	// Extract the table name
 	tableName := aws.ToString(params.TableName)
-	
+
 	// Extract the item ID (we assume the primary key is called "id")
 	idAttr, ok := params.Key["id"]
 	if !ok {
 		return nil, ErrMissingKey
 	}
-	
+
 	// Convert the ID to a string (we assume it's a string value)
 	idVal, ok := idAttr.(*types.AttributeValueMemberS)
 	if !ok {
 		return nil, ErrInvalidKeyType
 	}
-	
+
 	// Check if the item exists
 	item, ok := m.items[tableName+"/"+idVal.Value]
 	if !ok {
 		// Item not found, return an empty result (not an error)
 		return &dynamodb.GetItemOutput{}, nil
 	}
-	
+
 	// Return the item
 	return &dynamodb.GetItemOutput{
 		Item: item,
@@ -88,17 +90,17 @@ func (m *mockDynamoDBClient) GetItem(ctx context.Context, params *dynamodb.GetIt
 func (m *mockDynamoDBClient) Scan(ctx context.Context, params *dynamodb.ScanInput, optFns ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
 	// Extract the table name
 	tableName := aws.ToString(params.TableName)
-	
+
 	// Collect all items for the table
 	var items []map[string]types.AttributeValue
 	prefix := tableName + "/"
-	
+
 	for key, item := range m.items {
 		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
 			items = append(items, item)
 		}
 	}
-	
+
 	// Return the items
 	return &dynamodb.ScanOutput{
 		Items: items,
@@ -109,22 +111,22 @@ func (m *mockDynamoDBClient) Scan(ctx context.Context, params *dynamodb.ScanInpu
 func (m *mockDynamoDBClient) DeleteItem(ctx context.Context, params *dynamodb.DeleteItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
 	// Extract the table name
 	tableName := aws.ToString(params.TableName)
-	
+
 	// Extract the item ID (we assume the primary key is called "id")
 	idAttr, ok := params.Key["id"]
 	if !ok {
 		return nil, ErrMissingKey
 	}
-	
+
 	// Convert the ID to a string (we assume it's a string value)
 	idVal, ok := idAttr.(*types.AttributeValueMemberS)
 	if !ok {
 		return nil, ErrInvalidKeyType
 	}
-	
+
 	// Delete the item
 	delete(m.items, tableName+"/"+idVal.Value)
-	
+
 	return &dynamodb.DeleteItemOutput{}, nil
 }
 
@@ -222,6 +224,40 @@ func (d *TestDynamoDBServiceImpl) DeleteImage(ctx context.Context, id string) er
 	return err
 }
 
+func (d *TestDynamoDBServiceImpl) BatchGetImages(ctx context.Context, ids []string) ([]models.Image, error) {
+	images := make([]models.Image, 0, len(ids))
+	for _, id := range ids {
+		image, err := d.GetImage(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+func (d *TestDynamoDBServiceImpl) BatchSaveImages(ctx context.Context, images []models.Image) error {
+	for _, image := range images {
+		if err := d.SaveImage(ctx, image); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *TestDynamoDBServiceImpl) BatchUpdateImages(ctx context.Context, images []models.Image) error {
+	return d.BatchSaveImages(ctx, images)
+}
+
+func (d *TestDynamoDBServiceImpl) BatchDeleteImages(ctx context.Context, ids []string) error {
+	for _, id := range ids {
+		if err := d.DeleteImage(ctx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // Helper functions for converting between models.Image and DynamoDB items
 func createMockImageItem(image models.Image) (map[string]types.AttributeValue, error) {
 	// In a real application, we would use attributevalue.MarshalMap
@@ -324,7 +360,7 @@ func TestDynamoDBService(t *testing.T) {
 	mockClient := &mockDynamoDBClient{
 		items: make(map[string]map[string]types.AttributeValue),
 	}
-	
+
 	// Create a DynamoDB service with the mock client
 	tableName := "test-table"
 	// Create our test service
@@ -332,7 +368,7 @@ func TestDynamoDBService(t *testing.T) {
 		client:    mockClient,
 		tableName: tableName,
 	}
-	
+
 	// Test SaveImage and GetImage
 	t.Run("SaveAndGetImage", func(t *testing.T) {
 		// Create a test image
@@ -347,21 +383,21 @@ func TestDynamoDBService(t *testing.T) {
 			CreatedAt:   now,
 			UpdatedAt:   now,
 		}
-		
+
 		ctx := context.Background()
-		
+
 		// Save the image
 		err := service.SaveImage(ctx, testImage)
 		if err != nil {
 			t.Fatalf("Failed to save image: %v", err)
 		}
-		
+
 		// Get the image
 		retrievedImage, err := service.GetImage(ctx, testImage.ID)
 		if err != nil {
 			t.Fatalf("Failed to get image: %v", err)
 		}
-		
+
 		// Compare fields
 		if retrievedImage.ID != testImage.ID {
 			t.Errorf("Expected ID %s, got %s", testImage.ID, retrievedImage.ID)
@@ -381,7 +417,7 @@ func TestDynamoDBService(t *testing.T) {
 		if retrievedImage.Size != testImage.Size {
 			t.Errorf("Expected Size %d, got %d", testImage.Size, retrievedImage.Size)
 		}
-		
+
 		// Note: Time comparison is tricky with DynamoDB since it may not preserve time precision
 		// We'll use string comparison for dates to avoid issues with time zones and precision
 		if !retrievedImage.CreatedAt.Equal(testImage.CreatedAt) {
@@ -391,7 +427,7 @@ func TestDynamoDBService(t *testing.T) {
 			t.Errorf("Expected UpdatedAt %v, got %v", testImage.UpdatedAt, retrievedImage.UpdatedAt)
 		}
 	})
-	
+
 	// Test ListImages
 	t.Run("ListImages", func(t *testing.T) {
 		// Create a few test images
@@ -418,9 +454,9 @@ func TestDynamoDBService(t *testing.T) {
 				UpdatedAt:   now,
 			},
 		}
-		
+
 		ctx := context.Background()
-		
+
 		// Save the images
 		for _, img := range testImages {
 			err := service.SaveImage(ctx, img)
@@ -428,31 +464,31 @@ func TestDynamoDBService(t *testing.T) {
 				t.Fatalf("Failed to save image: %v", err)
 			}
 		}
-		
+
 		// List the images
 		retrievedImages, err := service.ListImages(ctx)
 		if err != nil {
 			t.Fatalf("Failed to list images: %v", err)
 		}
-		
+
 		// Verify we got at least 3 images (from both test runs)
 		if len(retrievedImages) < 3 {
 			t.Errorf("Expected at least 3 images, got %d", len(retrievedImages))
 		}
-		
+
 		// Check that our new images are in the list
 		foundImages := make(map[string]bool)
 		for _, img := range retrievedImages {
 			foundImages[img.ID] = true
 		}
-		
+
 		for _, img := range testImages {
 			if !foundImages[img.ID] {
 				t.Errorf("Image with ID %s not found in list", img.ID)
 			}
 		}
 	})
-	
+
 	// Test DeleteImage
 	t.Run("DeleteImage", func(t *testing.T) {
 		// Create a test image
@@ -467,25 +503,385 @@ func TestDynamoDBService(t *testing.T) {
 			CreatedAt:   now,
 			UpdatedAt:   now,
 		}
-		
+
 		ctx := context.Background()
-		
+
 		// Save the image
 		err := service.SaveImage(ctx, testImage)
 		if err != nil {
 			t.Fatalf("Failed to save image: %v", err)
 		}
-		
+
 		// Delete the image
 		err = service.DeleteImage(ctx, testImage.ID)
 		if err != nil {
 			t.Fatalf("Failed to delete image: %v", err)
 		}
-		
+
 		// Try to get the deleted image, should return a "not found" error
 		_, err = service.GetImage(ctx, testImage.ID)
 		if err == nil {
 			t.Errorf("Expected error when getting deleted image, got nil")
 		}
 	})
-}
\ No newline at end of file
+}
+
+func TestDynamoDBSaveCondition(t *testing.T) {
+	service := &DynamoDBService{tableName: "test-table"}
+
+	t.Run("NewRecord", func(t *testing.T) {
+		input, err := service.savePutItemInput(models.Image{ID: "test-id-1"})
+		if err != nil {
+			t.Fatalf("Failed to build input: %v", err)
+		}
+		if got := aws.ToString(input.ConditionExpression); got != "attribute_not_exists(#version)" {
+			t.Errorf("Unexpected condition for new record: %s", got)
+		}
+		if v, ok := input.Item["version"].(*types.AttributeValueMemberN); !ok || v.Value != "1" {
+			t.Errorf("Expected stored version 1, got %v", input.Item["version"])
+		}
+		if v, ok := input.Item[KindAttribute].(*types.AttributeValueMemberS); !ok || v.Value != imageKind {
+			t.Errorf("Expected kind %q, got %v", imageKind, input.Item[KindAttribute])
+		}
+	})
+
+	t.Run("ExistingRecord", func(t *testing.T) {
+		input, err := service.savePutItemInput(models.Image{ID: "test-id-1", Version: 4})
+		if err != nil {
+			t.Fatalf("Failed to build input: %v", err)
+		}
+		if got := aws.ToString(input.ConditionExpression); got != "#version = :expected" {
+			t.Errorf("Unexpected condition for existing record: %s", got)
+		}
+		if v, ok := input.ExpressionAttributeValues[":expected"].(*types.AttributeValueMemberN); !ok || v.Value != "4" {
+			t.Errorf("Expected condition on version 4, got %v", input.ExpressionAttributeValues[":expected"])
+		}
+		if v, ok := input.Item["version"].(*types.AttributeValueMemberN); !ok || v.Value != "5" {
+			t.Errorf("Expected stored version 5, got %v", input.Item["version"])
+		}
+	})
+	t.Run("Expiry", func(t *testing.T) {
+		expiresAt := time.Unix(1717243200, 0)
+		input, err := service.savePutItemInput(models.Image{ID: "test-id-1", ExpiresAt: &expiresAt})
+		if err != nil {
+			t.Fatalf("Failed to build input: %v", err)
+		}
+		if v, ok := input.Item["expiresAt"].(*types.AttributeValueMemberN); !ok || v.Value != "1717243200" {
+			t.Errorf("Expected expiry in epoch seconds, got %v", input.Item["expiresAt"])
+		}
+		// Time to live only removes the record once the sweeper has had a day
+		if v, ok := input.Item[TimeToLiveAttribute].(*types.AttributeValueMemberN); !ok || v.Value != "1717329600" {
+			t.Errorf("Expected time to live a day after the expiry, got %v", input.Item[TimeToLiveAttribute])
+		}
+
+		image, _, err := decodeImageItem(input.Item)
+		if err != nil {
+			t.Fatalf("Failed to decode item: %v", err)
+		}
+		if image.ExpiresAt == nil || !image.ExpiresAt.Equal(expiresAt) {
+			t.Errorf("Expected expiry %v, got %v", expiresAt, image.ExpiresAt)
+		}
+	})
+
+	t.Run("NoExpiry", func(t *testing.T) {
+		input, err := service.savePutItemInput(models.Image{ID: "test-id-1"})
+		if err != nil {
+			t.Fatalf("Failed to build input: %v", err)
+		}
+		if _, ok := input.Item["expiresAt"]; ok {
+			t.Errorf("Expected no expiry attribute, got %v", input.Item["expiresAt"])
+		}
+		if _, ok := input.Item[TimeToLiveAttribute]; ok {
+			t.Errorf("Expected no time to live, got %v", input.Item[TimeToLiveAttribute])
+		}
+	})
+}
+
+func TestBatchGetItems(t *testing.T) {
+	stored := map[string]bool{"a": true, "b": true}
+	var calls int
+	get := func(ctx context.Context, params *dynamodb.BatchGetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+		calls++
+		keys := params.RequestItems["test-table"].Keys
+		output := &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{}}
+
+		// Leave the last key unprocessed on the first call
+		if calls == 1 {
+			output.UnprocessedKeys = map[string]types.KeysAndAttributes{"test-table": {Keys: keys[len(keys)-1:]}}
+			keys = keys[:len(keys)-1]
+		}
+		for _, key := range keys {
+			if stored[itemID(key)] {
+				output.Responses["test-table"] = append(output.Responses["test-table"], key)
+			}
+		}
+		return output, nil
+	}
+
+	items, failed := batchGetItems(context.Background(), get, "test-table", []string{"a", "missing", "b", "a"}, 0)
+	if len(failed) != 0 {
+		t.Errorf("Expected no failures, got %v", failed)
+	}
+	if len(items) != 2 || items["a"] == nil || items["b"] == nil {
+		t.Errorf("Expected items a and b, got %v", items)
+	}
+	if calls != 2 {
+		t.Errorf("Expected one retry, got %d calls", calls)
+	}
+}
+func TestDynamoDBMigrateItems(t *testing.T) {
+	client := &mockDynamoDBClient{items: map[string]map[string]types.AttributeValue{
+		// Written before optimistic concurrency and schema versions
+		"test-table/legacy": {
+			"id":          &types.AttributeValueMemberS{Value: "legacy"},
+			"title":       &types.AttributeValueMemberS{Value: "Legacy"},
+			"s3Key":       &types.AttributeValueMemberS{Value: "legacy.png"},
+			"contentType": &types.AttributeValueMemberS{Value: ""},
+			"size":        &types.AttributeValueMemberN{Value: "10"},
+			"createdAt":   &types.AttributeValueMemberS{Value: "2024-01-02T03:04:05Z"},
+		},
+		"test-table/current": {
+			"id":            &types.AttributeValueMemberS{Value: "current"},
+			"title":         &types.AttributeValueMemberS{Value: "Current"},
+			"version":       &types.AttributeValueMemberN{Value: "2"},
+			"schemaVersion": &types.AttributeValueMemberN{Value: strconv.Itoa(models.CurrentSchemaVersion)},
+		},
+	}}
+	service := &DynamoDBService{tableName: "test-table"}
+	ctx := context.Background()
+
+	t.Run("DecodeMigrates", func(t *testing.T) {
+		image, from, err := decodeImageItem(client.items["test-table/legacy"])
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+		if from != 1 || image.SchemaVersion != models.CurrentSchemaVersion {
+			t.Errorf("Expected migration from schema version 1, got %d to %d", from, image.SchemaVersion)
+		}
+		if image.ContentType != "image/png" || image.Size != 10 || !image.UpdatedAt.Equal(image.CreatedAt) {
+			t.Errorf("Expected migrated fields, got %+v", image)
+		}
+	})
+
+	t.Run("DecodeKeepsLaterFields", func(t *testing.T) {
+		// Written after expiry and histograms were added but before the
+		// schema version that records them
+		image, from, err := decodeImageItem(map[string]types.AttributeValue{
+			"id":             &types.AttributeValueMemberS{Value: "recent"},
+			"version":        &types.AttributeValueMemberN{Value: "3"},
+			"schemaVersion":  &types.AttributeValueMemberN{Value: "3"},
+			"expiresAt":      &types.AttributeValueMemberN{Value: "1717243200"},
+			"colorHistogram": &types.AttributeValueMemberB{Value: []byte{1, 2, 3}},
+			"palette": &types.AttributeValueMemberL{Value: []types.AttributeValue{
+				&types.AttributeValueMemberM{Value: map[string]types.AttributeValue{
+					"color":  &types.AttributeValueMemberS{Value: "#102030"},
+					"weight": &types.AttributeValueMemberN{Value: "0.5"},
+				}},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to decode: %v", err)
+		}
+		if from != 3 || image.SchemaVersion != models.CurrentSchemaVersion {
+			t.Errorf("Expected migration from schema version 3, got %d to %d", from, image.SchemaVersion)
+		}
+		if image.ExpiresAt == nil || image.ExpiresAt.Unix() != 1717243200 || !bytes.Equal(image.ColorHistogram, []byte{1, 2, 3}) ||
+			len(image.Palette) != 1 || image.Palette[0].Color != "#102030" {
+			t.Errorf("Expected fields to survive migration, got %+v", image)
+		}
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		report, err := service.migrateItems(ctx, client, client.PutItem, true)
+		if err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		if report.Scanned != 2 || report.Outdated[1] != 1 || report.Migrated != 0 {
+			t.Errorf("Unexpected dry-run report: %+v", report)
+		}
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		var puts []*dynamodb.PutItemInput
+		put := func(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+			puts = append(puts, params)
+			return client.PutItem(ctx, params, optFns...)
+		}
+
+		report, err := service.migrateItems(ctx, client, put, false)
+		if err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		if report.Migrated != 1 || len(puts) != 1 {
+			t.Fatalf("Expected one migrated item, got %+v", report)
+		}
+		if condition := aws.ToString(puts[0].ConditionExpression); condition != "attribute_not_exists(#version)" {
+			t.Errorf("Expected write conditional on the unversioned record, got %q", condition)
+		}
+
+		stored := client.items["test-table/legacy"]
+		if n, ok := stored["schemaVersion"].(*types.AttributeValueMemberN); !ok || n.Value != strconv.Itoa(models.CurrentSchemaVersion) {
+			t.Errorf("Expected stored schema version %d, got %v", models.CurrentSchemaVersion, stored["schemaVersion"])
+		}
+	})
+}
+
+func TestOutboxTransaction(t *testing.T) {
+	before := models.Image{ID: "a", Title: "Before", Version: 1}
+	after := models.Image{ID: "a", Title: "After", Version: 2}
+	write := types.TransactWriteItem{Put: &types.Put{TableName: aws.String("test-table")}}
+	changes := []outboxChange{{before: &before, after: &after, write: write}, {before: &after, write: write}}
+
+	input, err := outboxTransaction("test-table", 3, changes, 7, time.Now())
+	if err != nil {
+		t.Fatalf("Failed to build transaction: %v", err)
+	}
+	if len(input.TransactItems) != 5 {
+		t.Fatalf("Expected counter, 2 changes and 2 events, got %d items", len(input.TransactItems))
+	}
+
+	counter := input.TransactItems[0].Update
+	if id := counter.Key["id"].(*types.AttributeValueMemberS).Value; id != counterID(3) {
+		t.Errorf("Expected the counter of shard 3, got %s", id)
+	}
+	if next := counter.ExpressionAttributeValues[":next"].(*types.AttributeValueMemberN).Value; next != "9" {
+		t.Errorf("Expected counter to advance to 9, got %s", next)
+	}
+	if current := counter.ExpressionAttributeValues[":current"].(*types.AttributeValueMemberN).Value; current != "7" {
+		t.Errorf("Expected counter update conditional on 7, got %s", current)
+	}
+
+	for i, want := range []string{"updated", "deleted"} {
+		event := input.TransactItems[2+2*i].Put.Item
+		if id := event["id"].(*types.AttributeValueMemberS).Value; id != eventID(3, int64(8+i)) {
+			t.Errorf("Expected event id %s, got %s", eventID(3, int64(8+i)), id)
+		}
+		if eventType := event["eventType"].(*types.AttributeValueMemberS).Value; eventType != want {
+			t.Errorf("Expected %s event, got %s", want, eventType)
+		}
+		if _, ok := event[TimeToLiveAttribute].(*types.AttributeValueMemberN); !ok {
+			t.Errorf("Expected events to carry a time to live, got %v", event)
+		}
+	}
+	fields := input.TransactItems[2].Put.Item["fields"].(*types.AttributeValueMemberL).Value
+	if len(fields) != 1 || fields[0].(*types.AttributeValueMemberS).Value != "title" {
+		t.Errorf("Expected the update to list the title, got %v", fields)
+	}
+
+	// Updates carry the changed values on both sides, deletions the record
+	var update, deletion models.ImageEvent
+	if err := attributevalue.UnmarshalMap(input.TransactItems[2].Put.Item, &update); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if len(update.Before) != 1 || string(update.Before["title"]) != `"Before"` || string(update.After["title"]) != `"After"` {
+		t.Errorf("Expected the title before and after, got %s and %s", update.Before, update.After)
+	}
+	if err := attributevalue.UnmarshalMap(input.TransactItems[4].Put.Item, &deletion); err != nil {
+		t.Fatalf("Failed to decode event: %v", err)
+	}
+	if string(deletion.Before["id"]) != `"a"` || string(deletion.Before["title"]) != `"After"` || deletion.After != nil {
+		t.Errorf("Expected the deleted record before and nothing after, got %s and %s", deletion.Before, deletion.After)
+	}
+}
+
+func TestShardOf(t *testing.T) {
+	counts := make([]int, outboxShards)
+	for i := range 1600 {
+		shard := shardOf(fmt.Sprintf("image-%d", i), outboxShards)
+		if shard != shardOf(fmt.Sprintf("image-%d", i), outboxShards) {
+			t.Fatalf("Expected the same shard for the same ID")
+		}
+		counts[shard]++
+	}
+	for shard, count := range counts {
+		if count < 50 {
+			t.Errorf("Expected IDs spread over the shards, got %d in shard %d", count, shard)
+		}
+	}
+}
+
+func TestTransactWithEvents(t *testing.T) {
+	get := func(ctx context.Context, params *dynamodb.GetItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	changes := []outboxChange{{after: &models.Image{ID: "a"}, write: types.TransactWriteItem{Put: &types.Put{}}}}
+	canceled := func(codes ...string) error {
+		err := &types.TransactionCanceledException{}
+		for _, code := range codes {
+			err.CancellationReasons = append(err.CancellationReasons, types.CancellationReason{Code: aws.String(code)})
+		}
+		return err
+	}
+
+	t.Run("RetriesCounterContention", func(t *testing.T) {
+		calls := 0
+		transact := func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+			calls++
+			if calls == 1 {
+				return nil, canceled("ConditionalCheckFailed", "None", "None")
+			}
+			return &dynamodb.TransactWriteItemsOutput{}, nil
+		}
+
+		if err := transactWithEvents(context.Background(), get, transact, "test-table", 0, changes, 0); err != nil {
+			t.Fatalf("Expected success after retry, got %v", err)
+		}
+		if calls != 2 {
+			t.Errorf("Expected 2 attempts, got %d", calls)
+		}
+	})
+
+	t.Run("ReportsChangeConflicts", func(t *testing.T) {
+		transact := func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+			return nil, canceled("None", "ConditionalCheckFailed", "None")
+		}
+
+		err := transactWithEvents(context.Background(), get, transact, "test-table", 0, changes, 0)
+		var conflict *changeConflictError
+		if !errors.As(err, &conflict) || conflict.index != 0 || !errors.Is(err, ErrConflict) {
+			t.Errorf("Expected a conflict on change 0, got %v", err)
+		}
+	})
+
+	t.Run("GivesUpWhenBusy", func(t *testing.T) {
+		transact := func(ctx context.Context, params *dynamodb.TransactWriteItemsInput, optFns ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+			return nil, canceled("None", "None", "TransactionConflict")
+		}
+
+		if err := transactWithEvents(context.Background(), get, transact, "test-table", 0, changes, 0); !errors.Is(err, ErrUnavailable) {
+			t.Errorf("Expected ErrUnavailable, got %v", err)
+		}
+	})
+}
+
+func TestDecodeEvents(t *testing.T) {
+	now := time.Now()
+	ids := []string{eventID(0, 5), eventID(0, 6), eventID(0, 7)}
+	event := func(sequence int, expiresAt time.Time) map[string]types.AttributeValue {
+		return map[string]types.AttributeValue{
+			"sequence":          &types.AttributeValueMemberN{Value: strconv.Itoa(sequence)},
+			"eventType":         &types.AttributeValueMemberS{Value: "created"},
+			"imageId":           &types.AttributeValueMemberS{Value: "a"},
+			TimeToLiveAttribute: &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		}
+	}
+
+	if _, err := decodeEvents(ids, nil, now); !errors.Is(err, ErrEventsExpired) {
+		t.Errorf("Expected ErrEventsExpired when the first event is gone, got %v", err)
+	}
+
+	items := map[string]map[string]types.AttributeValue{
+		eventID(0, 5): event(5, now.Add(time.Hour)),
+		eventID(0, 7): event(7, now.Add(time.Hour)),
+	}
+	events, err := decodeEvents(ids, items, now)
+	if err != nil || len(events) != 1 || events[0].Sequence != 5 || events[0].ImageID != "a" {
+		t.Errorf("Expected only event 5 before the gap, got %+v, %v", events, err)
+	}
+
+	// Time to live may not have deleted an expired event yet
+	items[eventID(0, 5)] = event(5, now.Add(-time.Second))
+	if _, err := decodeEvents(ids, items, now); !errors.Is(err, ErrEventsExpired) {
+		t.Errorf("Expected an expired event to count as gone, got %v", err)
+	}
+}
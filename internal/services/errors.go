@@ -0,0 +1,109 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aws/smithy-go"
+)
+
+// Errors shared by all storage and database backends. Backends wrap them
+// with context, so callers should test for them with errors.Is
+var (
+	// ErrNotFound means the requested image or object does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrConflict means the write was rejected because of the stored state
+	ErrConflict = errors.New("conflict")
+
+	// ErrInvalidKey means an ID or storage key is malformed
+	ErrInvalidKey = errors.New("invalid key")
+
+	// ErrUnavailable means the backend is temporarily unable to serve the request
+	ErrUnavailable = errors.New("service unavailable")
+
+	// ErrTooLarge means the content exceeds a size limit
+	ErrTooLarge = errors.New("too large")
+)
+
+// ErrVersionConflict is returned by SaveImage when the stored record has
+// changed since the caller read it
+var ErrVersionConflict = fmt.Errorf("image version %w", ErrConflict)
+
+// BatchError collects the per-item failures of a batch operation, keyed by
+// image ID or storage key. Items that are not listed succeeded
+type BatchError struct {
+	Errors map[string]error
+}
+
+func (e *BatchError) Error() string {
+	keys := make([]string, 0, len(e.Errors))
+	for key := range e.Errors {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	first := keys[0]
+	if len(keys) == 1 {
+		return fmt.Sprintf("batch item %s: %v", first, e.Errors[first])
+	}
+	return fmt.Sprintf("%d batch items failed, including %s: %v", len(keys), first, e.Errors[first])
+}
+
+// Unwrap lets errors.Is match the error of any failed item
+func (e *BatchError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// newBatchError returns a *BatchError for the failed items, or nil if there
+// are none
+func newBatchError(errs map[string]error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &BatchError{Errors: errs}
+}
+
+// ValidateKey rejects storage keys that are empty or could escape the bucket
+// or storage directory with ErrInvalidKey
+func ValidateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "\\") {
+		return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return fmt.Errorf("%w: %q", ErrInvalidKey, key)
+		}
+	}
+	return nil
+}
+
+// awsError translates AWS API errors that have a shared meaning into the
+// service errors; everything else is returned unchanged
+func awsError(err error) error {
+	var apiErr smithy.APIError
+	if !errors.As(err, &apiErr) {
+		return err
+	}
+
+	switch apiErr.ErrorCode() {
+	case "NoSuchKey", "NotFound":
+		return fmt.Errorf("%w: %v", ErrNotFound, err)
+	case "ConditionalCheckFailedException", "TransactionConflictException", "PreconditionFailed":
+		return fmt.Errorf("%w: %v", ErrConflict, err)
+	case "EntityTooLarge", "ItemCollectionSizeLimitExceededException":
+		return fmt.Errorf("%w: %v", ErrTooLarge, err)
+	case "NoSuchBucket", "ResourceNotFoundException", "SlowDown", "ServiceUnavailable",
+		"InternalError", "InternalServerError", "ProvisionedThroughputExceededException",
+		"RequestLimitExceeded", "ThrottlingException":
+		return fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+
+	return err
+}
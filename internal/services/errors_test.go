@@ -0,0 +1,53 @@
+package services
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/smithy-go"
+)
+
+func TestValidateKey(t *testing.T) {
+	valid := []string{"abc.jpg", "thumbs/abc.jpg"}
+	for _, key := range valid {
+		if err := ValidateKey(key); err != nil {
+			t.Errorf("Expected key %q to be valid, got %v", key, err)
+		}
+	}
+
+	invalid := []string{"", "/etc/passwd", "../secret", "a/../../b", "a//b", `a\b`, "a/."}
+	for _, key := range invalid {
+		if err := ValidateKey(key); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey for %q, got %v", key, err)
+		}
+	}
+}
+
+func TestAWSError(t *testing.T) {
+	tests := []struct {
+		code string
+		want error
+	}{
+		{"NoSuchKey", ErrNotFound},
+		{"ConditionalCheckFailedException", ErrConflict},
+		{"EntityTooLarge", ErrTooLarge},
+		{"ProvisionedThroughputExceededException", ErrUnavailable},
+		{"ResourceNotFoundException", ErrUnavailable},
+	}
+
+	for _, tt := range tests {
+		err := awsError(&smithy.GenericAPIError{Code: tt.code})
+		if !errors.Is(err, tt.want) {
+			t.Errorf("awsError(%s) = %v, want %v", tt.code, err, tt.want)
+		}
+	}
+
+	// Unknown errors pass through unchanged
+	other := &smithy.GenericAPIError{Code: "AccessDenied"}
+	if err := awsError(other); err != other {
+		t.Errorf("Expected unknown error to pass through, got %v", err)
+	}
+	if err := awsError(nil); err != nil {
+		t.Errorf("Expected nil, got %v", err)
+	}
+}
@@ -1,21 +1,35 @@
 package services
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"image_gallery/internal/models"
 )
 
 // LocalDBService is a local implementation of DynamoDBService for development
 type LocalDBService struct {
-	storagePath string
-	images      map[string]models.Image
-	mutex       sync.RWMutex
+	storagePath  string
+	images       map[string]models.Image
+	outbox       []models.ImageEvent
+	sequence     int64
+	mutex        sync.RWMutex
+	fileMutex    sync.Mutex
+	offsetsMutex sync.Mutex
+}
+
+// localData is the layout of images.json. The outbox is kept in the same
+// file as the images so a change and its event are written together
+type localData struct {
+	Images   []models.Record     `json:"images"`
+	Outbox   []models.ImageEvent `json:"outbox"`
+	Sequence int64               `json:"sequence"`
 }
 
 // Verify that LocalDBService implements DatabaseService
@@ -56,52 +70,203 @@ func (d *LocalDBService) loadData() error {
 		return err
 	}
 
-	var images []models.Image
-	if err := json.Unmarshal(data, &images); err != nil {
-		return fmt.Errorf("failed to parse images data: %w", err)
+	stored, err := decodeLocalData(data)
+	if err != nil {
+		return err
 	}
 
-	// Add all images to our map
+	// Add all images to our map, migrated to the current schema
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 	
-	for _, img := range images {
+	for _, record := range stored.Images {
+		img, _, err := decodeLocalRecord(record)
+		if err != nil {
+			return err
+		}
 		d.images[img.ID] = img
 	}
+	d.outbox = stored.Outbox
+	d.sequence = stored.Sequence
 
 	return nil
 }
 
+// decodeLocalData parses the data file. Files written before the outbox
+// existed hold just the array of images
+func decodeLocalData(data []byte) (localData, error) {
+	var stored localData
+	trimmed := bytes.TrimSpace(data)
+
+	decoder := json.NewDecoder(bytes.NewReader(trimmed))
+	decoder.UseNumber()
+
+	var err error
+	if len(trimmed) > 0 && trimmed[0] == '[' {
+		err = decoder.Decode(&stored.Images)
+	} else {
+		err = decoder.Decode(&stored)
+	}
+	if err != nil {
+		return stored, fmt.Errorf("failed to parse images data: %w", err)
+	}
+	return stored, nil
+}
+
+// decodeLocalRecord converts a stored record to an Image, migrating it from
+// older schema versions. It also returns the schema version it was stored with
+func decodeLocalRecord(record models.Record) (models.Image, int, error) {
+	var image models.Image
+
+	from, err := models.MigrateRecord(record)
+	if err != nil {
+		return image, from, err
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return image, from, err
+	}
+	err = json.Unmarshal(data, &image)
+	return image, from, err
+}
+
+// MigrateRecords rewrites the data file if any record in it has an older
+// schema version. The records were already migrated in memory when loaded
+func (d *LocalDBService) MigrateRecords(ctx context.Context, dryRun bool) (MigrationReport, error) {
+	report := newMigrationReport(dryRun)
+
+	data, err := os.ReadFile(filepath.Join(d.storagePath, "images.json"))
+	if os.IsNotExist(err) {
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+
+	stored, err := decodeLocalData(data)
+	if err != nil {
+		return report, err
+	}
+
+	outdated := 0
+	for _, record := range stored.Images {
+		report.Scanned++
+		if from := models.SchemaVersionOf(record); from != models.CurrentSchemaVersion {
+			report.Outdated[from]++
+			outdated++
+		}
+	}
+
+	if dryRun || outdated == 0 {
+		return report, nil
+	}
+
+	if err := d.saveData(); err != nil {
+		return report, err
+	}
+	report.Migrated = outdated
+	return report, nil
+}
+
+// Verify that LocalDBService implements RecordMigrator
+var _ RecordMigrator = (*LocalDBService)(nil)
+
 // saveData saves image data to the local JSON file
 func (d *LocalDBService) saveData() error {
 	filePath := filepath.Join(d.storagePath, "images.json")
 	
+	// Serialize writers so an older snapshot never overwrites a newer one
+	d.fileMutex.Lock()
+	defer d.fileMutex.Unlock()
+	
 	// Convert map to slice
 	d.mutex.RLock()
 	images := make([]models.Image, 0, len(d.images))
 	for _, img := range d.images {
 		images = append(images, img)
 	}
-	d.mutex.RUnlock()
+	stored := struct {
+		Images   []models.Image      `json:"images"`
+		Outbox   []models.ImageEvent `json:"outbox"`
+		Sequence int64               `json:"sequence"`
+	}{images, d.outbox, d.sequence}
 	
 	// Marshal to JSON
-	data, err := json.MarshalIndent(images, "", "  ")
+	data, err := json.MarshalIndent(stored, "", "  ")
+	d.mutex.RUnlock()
 	if err != nil {
 		return fmt.Errorf("failed to marshal images data: %w", err)
 	}
 	
 	// Save to file
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
+	if err := writeFileAtomic(filePath, data); err != nil {
 		return fmt.Errorf("failed to write images data: %w", err)
 	}
 	
 	return nil
 }
 
-// SaveImage saves image metadata to local storage
+// writeFileAtomic replaces a file by renaming a fully written temporary file
+// over it, so readers and crashes never see a partial file
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// localOutboxLimit caps the events kept in images.json, which is rewritten
+// on every change. Consumers further behind get ErrEventsExpired
+const localOutboxLimit = 10000
+
+// appendEvent records a change in the outbox and drops events older than
+// the retention period or beyond localOutboxLimit. The caller must hold
+// d.mutex
+func (d *LocalDBService) appendEvent(before, after *models.Image) {
+	now := time.Now().UTC()
+
+	d.sequence++
+	event := newImageEvent(before, after, now)
+	event.Sequence = d.sequence
+	d.outbox = append(d.outbox, event)
+
+	expired := max(0, len(d.outbox)-localOutboxLimit)
+	for expired < len(d.outbox) && d.outbox[expired].OccurredAt.Before(now.Add(-OutboxRetention)) {
+		expired++
+	}
+	d.outbox = d.outbox[expired:]
+}
+
+// SaveImage saves image metadata to local storage if its version matches the stored one
 func (d *LocalDBService) SaveImage(ctx context.Context, image models.Image) error {
 	d.mutex.Lock()
+	current, exists := d.images[image.ID]
+	if current.Version != image.Version {
+		d.mutex.Unlock()
+		return ErrVersionConflict
+	}
+	image.Version++
+	image.SchemaVersion = models.CurrentSchemaVersion
 	d.images[image.ID] = image
+	d.appendEvent(existingImage(current, exists), &image)
 	d.mutex.Unlock()
 	
 	return d.saveData()
@@ -114,7 +279,7 @@ func (d *LocalDBService) GetImage(ctx context.Context, id string) (models.Image,
 	d.mutex.RUnlock()
 	
 	if !exists {
-		return models.Image{}, fmt.Errorf("image not found")
+		return models.Image{}, fmt.Errorf("image %s: %w", id, ErrNotFound)
 	}
 	
 	return image, nil
@@ -139,14 +304,201 @@ func (d *LocalDBService) ListImages(ctx context.Context) ([]models.Image, error)
 // DeleteImage removes image metadata from local storage
 func (d *LocalDBService) DeleteImage(ctx context.Context, id string) error {
 	d.mutex.Lock()
-	_, exists := d.images[id]
+	current, exists := d.images[id]
 	if !exists {
 		d.mutex.Unlock()
-		return fmt.Errorf("image not found")
+		return fmt.Errorf("image %s: %w", id, ErrNotFound)
 	}
 	
 	delete(d.images, id)
+	d.appendEvent(&current, nil)
+	d.mutex.Unlock()
+	
+	return d.saveData()
+}
+
+// BatchGetImages retrieves the images with the given IDs
+func (d *LocalDBService) BatchGetImages(ctx context.Context, ids []string) ([]models.Image, error) {
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+	
+	images := make([]models.Image, 0, len(ids))
+	failed := make(map[string]error)
+	for _, id := range ids {
+		image, exists := d.images[id]
+		if !exists {
+			failed[id] = fmt.Errorf("image %s: %w", id, ErrNotFound)
+			continue
+		}
+		images = append(images, image)
+	}
+	
+	return images, newBatchError(failed)
+}
+
+// BatchSaveImages saves several images with a single write of the data file
+func (d *LocalDBService) BatchSaveImages(ctx context.Context, images []models.Image) error {
+	d.mutex.Lock()
+	for _, image := range images {
+		current, exists := d.images[image.ID]
+		image.Version = current.Version + 1
+		image.SchemaVersion = models.CurrentSchemaVersion
+		d.images[image.ID] = image
+		d.appendEvent(existingImage(current, exists), &image)
+	}
 	d.mutex.Unlock()
 	
 	return d.saveData()
-}
\ No newline at end of file
+}
+
+// BatchUpdateImages saves several images whose versions match the stored
+// ones with a single write of the data file
+func (d *LocalDBService) BatchUpdateImages(ctx context.Context, images []models.Image) error {
+	failed := make(map[string]error)
+	d.mutex.Lock()
+	for _, image := range images {
+		current, exists := d.images[image.ID]
+		if current.Version != image.Version {
+			failed[image.ID] = ErrVersionConflict
+			continue
+		}
+		image.Version++
+		image.SchemaVersion = models.CurrentSchemaVersion
+		d.images[image.ID] = image
+		d.appendEvent(existingImage(current, exists), &image)
+	}
+	d.mutex.Unlock()
+	
+	if len(failed) < len(images) {
+		if err := d.saveData(); err != nil {
+			return err
+		}
+	}
+	return newBatchError(failed)
+}
+
+// BatchDeleteImages removes several images with a single write of the data file
+func (d *LocalDBService) BatchDeleteImages(ctx context.Context, ids []string) error {
+	d.mutex.Lock()
+	for _, id := range ids {
+		if current, exists := d.images[id]; exists {
+			delete(d.images, id)
+			d.appendEvent(&current, nil)
+		}
+	}
+	d.mutex.Unlock()
+	
+	return d.saveData()
+}
+
+// existingImage returns a pointer to image if it exists, for event "before" states
+func existingImage(image models.Image, exists bool) *models.Image {
+	if !exists {
+		return nil
+	}
+	return &image
+}
+
+// Verify that LocalDBService implements EventLog
+var _ EventLog = (*LocalDBService)(nil)
+
+// Shards returns 1: the local outbox is written under one lock anyway
+func (d *LocalDBService) Shards() int {
+	return 1
+}
+
+// ReadEvents returns up to limit outbox events after the given sequence
+func (d *LocalDBService) ReadEvents(ctx context.Context, shard int, after int64, limit int) ([]models.ImageEvent, error) {
+	if err := checkShard(shard, 1); err != nil {
+		return nil, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	first := d.sequence + 1
+	if len(d.outbox) > 0 {
+		first = d.outbox[0].Sequence
+	}
+	if after+1 < first {
+		return nil, ErrEventsExpired
+	}
+	if after >= d.sequence {
+		return []models.ImageEvent{}, nil
+	}
+
+	events := make([]models.ImageEvent, 0, limit)
+	for _, event := range d.outbox[int(after+1-first):] {
+		if len(events) == limit {
+			break
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+// LatestSequence returns the sequence of the most recent event
+func (d *LocalDBService) LatestSequence(ctx context.Context, shard int) (int64, error) {
+	if err := checkShard(shard, 1); err != nil {
+		return 0, err
+	}
+	d.mutex.RLock()
+	defer d.mutex.RUnlock()
+
+	return d.sequence, nil
+}
+
+// LoadOffset returns the stored offset of a consumer, or ErrNotFound
+func (d *LocalDBService) LoadOffset(ctx context.Context, consumer string, shard int) (int64, error) {
+	if err := checkShard(shard, 1); err != nil {
+		return 0, err
+	}
+	d.offsetsMutex.Lock()
+	defer d.offsetsMutex.Unlock()
+
+	offsets, err := d.loadOffsets()
+	if err != nil {
+		return 0, err
+	}
+	offset, ok := offsets[consumer]
+	if !ok {
+		return 0, fmt.Errorf("offset of %s: %w", consumer, ErrNotFound)
+	}
+	return offset, nil
+}
+
+// SaveOffset stores the offset of a consumer in offsets.json
+func (d *LocalDBService) SaveOffset(ctx context.Context, consumer string, shard int, offset int64) error {
+	if err := checkShard(shard, 1); err != nil {
+		return err
+	}
+	d.offsetsMutex.Lock()
+	defer d.offsetsMutex.Unlock()
+
+	offsets, err := d.loadOffsets()
+	if err != nil {
+		return err
+	}
+	offsets[consumer] = offset
+
+	data, err := json.MarshalIndent(offsets, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(d.storagePath, "offsets.json"), data)
+}
+
+func (d *LocalDBService) loadOffsets() (map[string]int64, error) {
+	offsets := make(map[string]int64)
+
+	data, err := os.ReadFile(filepath.Join(d.storagePath, "offsets.json"))
+	if os.IsNotExist(err) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &offsets); err != nil {
+		return nil, fmt.Errorf("failed to parse offsets: %w", err)
+	}
+	return offsets, nil
+}
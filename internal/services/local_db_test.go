@@ -2,7 +2,10 @@ package services
 
 import (
 	"context"
+	"errors"
 	"os"
+	"path/filepath"
+	"strconv"
 	"testing"
 	"time"
 	
@@ -171,8 +174,13 @@ func TestLocalDBService(t *testing.T) {
 
 		// Try to get the deleted image, should fail
 		_, err = service.GetImage(ctx, testImage.ID)
-		if err == nil {
-			t.Errorf("Expected error when getting deleted image, got nil")
+		if !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound when getting deleted image, got %v", err)
+		}
+
+		// Deleting it again reports it missing
+		if err := service.DeleteImage(ctx, testImage.ID); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound when deleting missing image, got %v", err)
 		}
 	})
 
@@ -219,4 +227,253 @@ func TestLocalDBService(t *testing.T) {
 			t.Errorf("Expected Title %s, got %s", testImage.Title, retrievedImage.Title)
 		}
 	})
-}
\ No newline at end of file
+
+	// Test optimistic concurrency control
+	t.Run("VersionConflict", func(t *testing.T) {
+		now := time.Now().Truncate(time.Second)
+		testImage := models.Image{
+			ID:        "test-id-version",
+			Title:     "Version Test",
+			S3Key:     "version-test.jpg",
+			CreatedAt: now,
+			UpdatedAt: now,
+		}
+
+		ctx := context.Background()
+
+		// Creating the record stores version 1
+		if err := service.SaveImage(ctx, testImage); err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+		stored, err := service.GetImage(ctx, testImage.ID)
+		if err != nil {
+			t.Fatalf("Failed to get image: %v", err)
+		}
+		if stored.Version != 1 {
+			t.Errorf("Expected version 1, got %d", stored.Version)
+		}
+
+		// Two editors read version 1; the first save wins
+		first, second := stored, stored
+		first.Title = "First Editor"
+		second.Title = "Second Editor"
+
+		if err := service.SaveImage(ctx, first); err != nil {
+			t.Fatalf("Failed to save first edit: %v", err)
+		}
+		if err := service.SaveImage(ctx, second); !errors.Is(err, ErrVersionConflict) {
+			t.Errorf("Expected ErrVersionConflict for stale edit, got %v", err)
+		}
+
+		stored, err = service.GetImage(ctx, testImage.ID)
+		if err != nil {
+			t.Fatalf("Failed to get image: %v", err)
+		}
+		if stored.Title != "First Editor" || stored.Version != 2 {
+			t.Errorf("Expected first edit at version 2, got %q at version %d", stored.Title, stored.Version)
+		}
+	})
+
+	// Test batch operations
+	t.Run("BatchOperations", func(t *testing.T) {
+		ctx := context.Background()
+		now := time.Now().Truncate(time.Second)
+		testImages := []models.Image{
+			{ID: "test-id-batch-1", Title: "Batch 1", CreatedAt: now, UpdatedAt: now},
+			{ID: "test-id-batch-2", Title: "Batch 2", CreatedAt: now, UpdatedAt: now},
+		}
+
+		if err := service.BatchSaveImages(ctx, testImages); err != nil {
+			t.Fatalf("Failed to batch save images: %v", err)
+		}
+
+		images, err := service.BatchGetImages(ctx, []string{"test-id-batch-1", "test-id-missing", "test-id-batch-2"})
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			t.Fatalf("Expected *BatchError for the missing ID, got %v", err)
+		}
+		if len(batchErr.Errors) != 1 || !errors.Is(batchErr.Errors["test-id-missing"], ErrNotFound) {
+			t.Errorf("Expected only test-id-missing to fail, got %v", batchErr.Errors)
+		}
+		if len(images) != 2 || images[0].ID != "test-id-batch-1" || images[1].ID != "test-id-batch-2" {
+			t.Errorf("Expected both images in request order, got %v", images)
+		}
+
+		// A stale version fails only its own image
+		stale := images[0]
+		images[1].Title = "Batch 2 edited"
+		if err := service.SaveImage(ctx, stale); err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+		err = service.BatchUpdateImages(ctx, []models.Image{stale, images[1], {ID: "test-id-gone", Version: 3}})
+		if !errors.As(err, &batchErr) {
+			t.Fatalf("Expected *BatchError for the stale versions, got %v", err)
+		}
+		if len(batchErr.Errors) != 2 || !errors.Is(batchErr.Errors["test-id-batch-1"], ErrVersionConflict) || !errors.Is(batchErr.Errors["test-id-gone"], ErrVersionConflict) {
+			t.Errorf("Expected conflicts for test-id-batch-1 and test-id-gone, got %v", batchErr.Errors)
+		}
+		if stored, _ := service.GetImage(ctx, "test-id-batch-2"); stored.Title != "Batch 2 edited" || stored.Version != images[1].Version+1 {
+			t.Errorf("Expected test-id-batch-2 to be updated, got %q at version %d", stored.Title, stored.Version)
+		}
+
+		if err := service.BatchDeleteImages(ctx, []string{"test-id-batch-1", "test-id-batch-2", "test-id-missing"}); err != nil {
+			t.Fatalf("Failed to batch delete images: %v", err)
+		}
+		if _, err := service.GetImage(ctx, "test-id-batch-1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected batch deleted image to be gone, got %v", err)
+		}
+	})
+}
+func TestLocalDBServiceMigratesRecords(t *testing.T) {
+	tempDir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(tempDir, "db"), 0755); err != nil {
+		t.Fatalf("Failed to create DB dir: %v", err)
+	}
+
+	// One record from before optimistic concurrency, one from before schema
+	// versions and one current record
+	legacy := `[
+  {"id": "v1", "title": "One", "s3Key": "v1.png", "contentType": "", "size": 1, "createdAt": "2024-01-02T03:04:05Z", "updatedAt": "0001-01-01T00:00:00Z"},
+  {"id": "v2", "title": "Two", "s3Key": "v2.jpg", "contentType": "image/jpeg", "size": 2, "createdAt": "2024-01-02T03:04:05Z", "updatedAt": "2024-01-02T03:04:05Z", "version": 3},
+  {"id": "v3", "title": "Three", "s3Key": "v3.jpg", "contentType": "image/jpeg", "size": 3, "createdAt": "2024-01-02T03:04:05Z", "updatedAt": "2024-01-02T03:04:05Z", "version": 1, "schemaVersion": ` + strconv.Itoa(models.CurrentSchemaVersion) + `}
+]`
+	dataFile := filepath.Join(tempDir, "db", "images.json")
+	if err := os.WriteFile(dataFile, []byte(legacy), 0644); err != nil {
+		t.Fatalf("Failed to write legacy data: %v", err)
+	}
+
+	service, err := NewLocalDBService(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+	ctx := context.Background()
+
+	t.Run("MigratesOnRead", func(t *testing.T) {
+		image, err := service.GetImage(ctx, "v1")
+		if err != nil {
+			t.Fatalf("Failed to get image: %v", err)
+		}
+		if image.SchemaVersion != models.CurrentSchemaVersion || image.ContentType != "image/png" || !image.UpdatedAt.Equal(image.CreatedAt) {
+			t.Errorf("Expected migrated record, got %+v", image)
+		}
+	})
+
+	t.Run("DryRun", func(t *testing.T) {
+		report, err := service.MigrateRecords(ctx, true)
+		if err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		if report.Scanned != 3 || report.Outdated[1] != 1 || report.Outdated[2] != 1 || report.Migrated != 0 {
+			t.Errorf("Unexpected dry-run report: %+v", report)
+		}
+	})
+
+	t.Run("Migrate", func(t *testing.T) {
+		report, err := service.MigrateRecords(ctx, false)
+		if err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		if report.Migrated != 2 {
+			t.Errorf("Expected 2 migrated records, got %+v", report)
+		}
+
+		report, err = service.MigrateRecords(ctx, true)
+		if err != nil {
+			t.Fatalf("Failed to migrate: %v", err)
+		}
+		if len(report.Outdated) != 0 {
+			t.Errorf("Expected no outdated records after migrating, got %v", report.Outdated)
+		}
+	})
+}
+
+func TestLocalDBServiceOutbox(t *testing.T) {
+	tempDir := t.TempDir()
+	service, err := NewLocalDBService(tempDir)
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+	ctx := context.Background()
+
+	image := models.Image{ID: "a", Title: "A", S3Key: "a.jpg"}
+	if err := service.SaveImage(ctx, image); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	image.Version = 1
+	image.Title = "Renamed"
+	if err := service.SaveImage(ctx, image); err != nil {
+		t.Fatalf("Failed to update image: %v", err)
+	}
+	if err := service.BatchSaveImages(ctx, []models.Image{{ID: "b", Title: "B", S3Key: "b.jpg"}}); err != nil {
+		t.Fatalf("Failed to batch save: %v", err)
+	}
+	if err := service.BatchDeleteImages(ctx, []string{"a", "b", "missing"}); err != nil {
+		t.Fatalf("Failed to batch delete: %v", err)
+	}
+
+	// Rejected writes record nothing
+	if err := service.SaveImage(ctx, image); !errors.Is(err, ErrVersionConflict) {
+		t.Fatalf("Expected ErrVersionConflict, got %v", err)
+	}
+
+	want := []models.EventType{models.EventCreated, models.EventUpdated, models.EventCreated, models.EventDeleted, models.EventDeleted}
+
+	t.Run("RecordsEveryMutation", func(t *testing.T) {
+		events, err := service.ReadEvents(ctx, 0, 0, 100)
+		if err != nil {
+			t.Fatalf("Failed to read events: %v", err)
+		}
+		if len(events) != len(want) {
+			t.Fatalf("Expected %d events, got %d", len(want), len(events))
+		}
+		for i, event := range events {
+			if event.Type != want[i] || event.Sequence != int64(i+1) {
+				t.Errorf("Event %d: expected %s with sequence %d, got %s with %d", i, want[i], i+1, event.Type, event.Sequence)
+			}
+		}
+		if len(events[1].Fields) != 1 || events[1].Fields[0] != "title" || events[1].ImageVersion != 2 {
+			t.Errorf("Expected the title changed at version 2, got %+v", events[1])
+		}
+		if events[3].ImageID != "a" || events[3].ImageVersion != 2 {
+			t.Errorf("Expected deletion of version 2 of a, got %+v", events[3])
+		}
+	})
+
+	t.Run("ReadsFromOffset", func(t *testing.T) {
+		events, err := service.ReadEvents(ctx, 0, 3, 1)
+		if err != nil {
+			t.Fatalf("Failed to read events: %v", err)
+		}
+		if len(events) != 1 || events[0].Sequence != 4 {
+			t.Errorf("Expected event 4, got %+v", events)
+		}
+
+		events, err = service.ReadEvents(ctx, 0, int64(len(want)), 10)
+		if err != nil || len(events) != 0 {
+			t.Errorf("Expected no events after the latest, got %v, %v", events, err)
+		}
+	})
+
+	t.Run("PersistsOutboxAndOffsets", func(t *testing.T) {
+		if err := service.SaveOffset(ctx, "consumer", 0, 2); err != nil {
+			t.Fatalf("Failed to save offset: %v", err)
+		}
+
+		reopened, err := NewLocalDBService(tempDir)
+		if err != nil {
+			t.Fatalf("Failed to reopen local DB service: %v", err)
+		}
+		if latest, _ := reopened.LatestSequence(ctx, 0); latest != int64(len(want)) {
+			t.Errorf("Expected latest sequence %d, got %d", len(want), latest)
+		}
+		if offset, err := reopened.LoadOffset(ctx, "consumer", 0); err != nil || offset != 2 {
+			t.Errorf("Expected offset 2, got %d, %v", offset, err)
+		}
+		if _, err := reopened.LoadOffset(ctx, "unknown", 0); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for an unknown consumer, got %v", err)
+		}
+		if _, err := reopened.LoadOffset(ctx, "consumer", 1); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey for a shard the local outbox does not have, got %v", err)
+		}
+	})
+}
@@ -2,8 +2,10 @@ package services
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"mime/multipart"
 	"os"
 	"path/filepath"
@@ -36,6 +38,10 @@ var _ StorageService = (*LocalStorageService)(nil)
 
 // UploadImage saves an image to local storage
 func (s *LocalStorageService) UploadImage(ctx context.Context, key string, fileContent multipart.File, contentType string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
 	// Create destination file
 	filePath := filepath.Join(s.storagePath, key)
 	
@@ -68,17 +74,35 @@ func (s *LocalStorageService) GetImageURL(ctx context.Context, key string) (stri
 
 // DeleteImage removes an image from local storage
 func (s *LocalStorageService) DeleteImage(ctx context.Context, key string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
 	filePath := filepath.Join(s.storagePath, key)
-	return os.Remove(filePath)
+	if err := os.Remove(filePath); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("image %s: %w", key, ErrNotFound)
+		}
+		return fmt.Errorf("failed to delete file: %w", err)
+	}
+	
+	return nil
 }
 
 // GetImage gets an image from local storage
 func (s *LocalStorageService) GetImage(ctx context.Context, key string) ([]byte, string, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, "", err
+	}
+
 	filePath := filepath.Join(s.storagePath, key)
 	
 	// Read file
 	content, err := os.ReadFile(filePath)
 	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, "", fmt.Errorf("image %s: %w", key, ErrNotFound)
+		}
 		return nil, "", fmt.Errorf("failed to read file: %w", err)
 	}
 	
@@ -97,4 +121,16 @@ func (s *LocalStorageService) GetImage(ctx context.Context, key string) ([]byte,
 	}
 	
 	return content, contentType, nil
+}
+
+// DeleteImages removes several images from local storage
+func (s *LocalStorageService) DeleteImages(ctx context.Context, keys []string) error {
+	failed := make(map[string]error)
+	for _, key := range keys {
+		if err := s.DeleteImage(ctx, key); err != nil && !errors.Is(err, ErrNotFound) {
+			failed[key] = err
+		}
+	}
+	
+	return newBatchError(failed)
 }
\ No newline at end of file
@@ -3,6 +3,7 @@ package services
 import (
 	"bytes"
 	"context"
+	"errors"
 	"mime/multipart"
 	"os"
 	"path/filepath"
@@ -117,6 +118,44 @@ func TestLocalStorageService(t *testing.T) {
 			t.Errorf("Expected file %s to be deleted", filePath)
 		}
 	})
+
+	// Test DeleteImages
+	t.Run("DeleteImages", func(t *testing.T) {
+		for _, key := range []string{"batch1.jpg", "batch2.jpg"} {
+			if err := os.WriteFile(filepath.Join(tempDir, key), []byte("batch"), 0644); err != nil {
+				t.Fatalf("Failed to write test file: %v", err)
+			}
+		}
+
+		ctx := context.Background()
+		err := service.DeleteImages(ctx, []string{"batch1.jpg", "batch2.jpg", "missing.jpg", "../bad.jpg"})
+
+		var batchErr *BatchError
+		if !errors.As(err, &batchErr) {
+			t.Fatalf("Expected *BatchError for the invalid key, got %v", err)
+		}
+		if len(batchErr.Errors) != 1 || !errors.Is(batchErr.Errors["../bad.jpg"], ErrInvalidKey) {
+			t.Errorf("Expected only the invalid key to fail, got %v", batchErr.Errors)
+		}
+		if _, err := os.Stat(filepath.Join(tempDir, "batch1.jpg")); !os.IsNotExist(err) {
+			t.Errorf("Expected batch1.jpg to be deleted")
+		}
+	})
+
+	// Test typed errors
+	t.Run("Errors", func(t *testing.T) {
+		ctx := context.Background()
+
+		if _, _, err := service.GetImage(ctx, "missing.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound for missing image, got %v", err)
+		}
+		if err := service.DeleteImage(ctx, "missing.jpg"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected ErrNotFound when deleting missing image, got %v", err)
+		}
+		if _, _, err := service.GetImage(ctx, "../outside.jpg"); !errors.Is(err, ErrInvalidKey) {
+			t.Errorf("Expected ErrInvalidKey for path traversal, got %v", err)
+		}
+	})
 }
 
 // mockMultipartFile implements multipart.File for testing
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"image_gallery/internal/models"
+)
+
+// ErrEventsExpired is returned when events after the requested offset have
+// already been removed from the outbox
+var ErrEventsExpired = errors.New("events after offset have expired")
+
+// OutboxRetention is how long events are kept in the outbox
+const OutboxRetention = 7 * 24 * time.Hour
+
+// EventLog is implemented by databases that record an ImageEvent in an
+// outbox, in the same write as the data, for every mutation. The outbox is
+// split into Shards() shards by image ID, each with its own sequence, so
+// writes to different images do not all wait on one counter
+type EventLog interface {
+	// Shards returns the number of outbox shards, numbered from 0
+	Shards() int
+
+	// ReadEvents returns up to limit events of a shard with a sequence
+	// greater than after, oldest first, or ErrEventsExpired if the next one
+	// is gone
+	ReadEvents(ctx context.Context, shard int, after int64, limit int) ([]models.ImageEvent, error)
+
+	// LatestSequence returns the sequence of the most recent event of a
+	// shard, or 0
+	LatestSequence(ctx context.Context, shard int) (int64, error)
+
+	// LoadOffset returns the last sequence of a shard a consumer has
+	// processed, or ErrNotFound for a consumer that has never stored one
+	LoadOffset(ctx context.Context, consumer string, shard int) (int64, error)
+
+	// SaveOffset stores the last sequence of a shard a consumer has processed
+	SaveOffset(ctx context.Context, consumer string, shard int, offset int64) error
+}
+
+// shardOf returns the outbox shard of an image
+func shardOf(imageID string, shards int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(imageID))
+	return int(hash.Sum32() % uint32(shards))
+}
+
+// checkShard rejects a shard the outbox does not have
+func checkShard(shard, shards int) error {
+	if shard < 0 || shard >= shards {
+		return fmt.Errorf("outbox shard %d of %d: %w", shard, shards, ErrInvalidKey)
+	}
+	return nil
+}
+
+// newImageEvent describes the change from before to after. A nil before is
+// a creation and a nil after a deletion
+func newImageEvent(before, after *models.Image, now time.Time) models.ImageEvent {
+	event := models.ImageEvent{OccurredAt: now}
+	switch {
+	case before == nil:
+		event.Type = models.EventCreated
+		event.ImageID = after.ID
+		event.ImageVersion = after.Version
+		event.After = models.FieldValues(*after, nil)
+	case after == nil:
+		event.Type = models.EventDeleted
+		event.ImageID = before.ID
+		event.ImageVersion = before.Version
+		event.Before = models.FieldValues(*before, nil)
+	default:
+		event.Type = models.EventUpdated
+		event.ImageID = after.ID
+		event.ImageVersion = after.Version
+		event.Fields = models.ChangedFields(*before, *after)
+		event.Before = models.FieldValues(*before, event.Fields)
+		event.After = models.FieldValues(*after, event.Fields)
+	}
+	return event
+}
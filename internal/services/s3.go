@@ -8,8 +8,13 @@ import (
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
 )
 
+// s3DeleteObjectsLimit is the most keys a DeleteObjects request accepts
+const s3DeleteObjectsLimit = 1000
+
 // S3Service handles operations with AWS S3
 type S3Service struct {
 	client     *s3.Client
@@ -34,6 +39,10 @@ var _ StorageService = (*S3Service)(nil)
 
 // UploadImage uploads an image to S3
 func (s *S3Service) UploadImage(ctx context.Context, key string, fileContent multipart.File, contentType string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
 	// Read file content
 	buffer := new(bytes.Buffer)
 	if _, err := io.Copy(buffer, fileContent); err != nil {
@@ -48,7 +57,7 @@ func (s *S3Service) UploadImage(ctx context.Context, key string, fileContent mul
 		ContentType: aws.String(contentType),
 	})
 
-	return err
+	return awsError(err)
 }
 
 // GetImageURL generates a presigned URL to access the image
@@ -60,22 +69,30 @@ func (s *S3Service) GetImageURL(ctx context.Context, key string) (string, error)
 
 // DeleteImage removes an image from S3
 func (s *S3Service) DeleteImage(ctx context.Context, key string) error {
+	if err := ValidateKey(key); err != nil {
+		return err
+	}
+
 	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
 
-	return err
+	return awsError(err)
 }
 
 // GetImage gets an image from S3
 func (s *S3Service) GetImage(ctx context.Context, key string) ([]byte, string, error) {
+	if err := ValidateKey(key); err != nil {
+		return nil, "", err
+	}
+
 	result, err := s.client.GetObject(ctx, &s3.GetObjectInput{
 		Bucket: aws.String(s.bucketName),
 		Key:    aws.String(key),
 	})
 	if err != nil {
-		return nil, "", err
+		return nil, "", awsError(err)
 	}
 	defer result.Body.Close()
 
@@ -92,4 +109,44 @@ func (s *S3Service) GetImage(ctx context.Context, key string) ([]byte, string, e
 	}
 
 	return content, contentType, nil
+}
+
+// DeleteImages removes several images from S3 with DeleteObjects
+func (s *S3Service) DeleteImages(ctx context.Context, keys []string) error {
+	failed := make(map[string]error)
+
+	var objects []types.ObjectIdentifier
+	for _, key := range keys {
+		if err := ValidateKey(key); err != nil {
+			failed[key] = err
+			continue
+		}
+		objects = append(objects, types.ObjectIdentifier{Key: aws.String(key)})
+	}
+
+	for start := 0; start < len(objects); start += s3DeleteObjectsLimit {
+		chunk := objects[start:min(start+s3DeleteObjectsLimit, len(objects))]
+
+		// Quiet mode only reports the keys that failed
+		result, err := s.client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucketName),
+			Delete: &types.Delete{Objects: chunk, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			err = awsError(err)
+			for _, object := range chunk {
+				failed[aws.ToString(object.Key)] = err
+			}
+			continue
+		}
+
+		for _, objectErr := range result.Errors {
+			failed[aws.ToString(objectErr.Key)] = awsError(&smithy.GenericAPIError{
+				Code:    aws.ToString(objectErr.Code),
+				Message: aws.ToString(objectErr.Message),
+			})
+		}
+	}
+
+	return newBatchError(failed)
 }
\ No newline at end of file
@@ -146,6 +146,15 @@ func (s *TestS3ServiceImpl) DeleteImage(ctx context.Context, key string) error {
 	return err
 }
 
+func (s *TestS3ServiceImpl) DeleteImages(ctx context.Context, keys []string) error {
+	for _, key := range keys {
+		if err := s.DeleteImage(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *TestS3ServiceImpl) GetBucketName() string {
 	return s.bucketName
 }
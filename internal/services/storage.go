@@ -6,6 +6,7 @@ import (
 )
 
 // StorageService defines the common interface for storage services
+// Malformed keys yield ErrInvalidKey and missing objects ErrNotFound
 type StorageService interface {
 	// UploadImage uploads an image to storage
 	UploadImage(ctx context.Context, key string, fileContent multipart.File, contentType string) error
@@ -16,6 +17,10 @@ type StorageService interface {
 	// DeleteImage removes an image from storage
 	DeleteImage(ctx context.Context, key string) error
 	
+	// DeleteImages removes several images from storage. Missing keys are not
+	// an error; failed keys are reported in a *BatchError
+	DeleteImages(ctx context.Context, keys []string) error
+	
 	// GetImage gets an image from storage
 	GetImage(ctx context.Context, key string) ([]byte, string, error)
 	
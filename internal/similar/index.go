@@ -0,0 +1,326 @@
+// Package similar finds the images that look most like an image, by their
+// perceptual hashes and colour histograms. Its index of hashes also serves
+// the duplicate check of uploads and the report of near-duplicates
+package similar
+
+import (
+	"cmp"
+	"slices"
+	"sync"
+
+	"image_gallery/internal/duplicates"
+	"image_gallery/internal/models"
+)
+
+// MaxHashDistance is the largest Hamming distance, in bits, between the
+// perceptual hashes of similar images. Beyond it two images share little
+// of their structure, however close their colours are
+const MaxHashDistance = 24
+
+// hashWeight is the part of the distance between two images that comes
+// from their hashes; the rest comes from their colour histograms
+const hashWeight = 0.6
+
+// Result is an image similar to another
+type Result struct {
+	Image models.Image `json:"image"`
+	// Distance is from 0 for images that look the same to 1
+	Distance float64 `json:"distance"`
+}
+
+// Match is an indexed image near a query
+type Match struct {
+	ID string
+	// Distance is from 0 for images that look the same to 1
+	Distance float64
+}
+
+// substrings is how many parts each hash is split into for lookup, of
+// substringBits bits each
+const (
+	substrings    = 4
+	substringBits = 64 / substrings
+)
+
+// initialRadius is the hash distance a similarity search starts at. It is
+// widened towards MaxHashDistance only while fewer images than asked for
+// are found, as a wide search compares most of the index
+const initialRadius = 10
+
+// Index finds images by perceptual hash with multi-index hashing. Each hash
+// is split into substrings parts, and each part is the key of a table of
+// the images that have it. Two hashes within r bits of each other differ in
+// at most r/substrings bits in at least one part, so a search only looks up
+// the keys within that many bits of each of the query's parts and compares
+// the images found there. Only what a search compares is kept of each
+// image. It is safe for concurrent use
+type Index struct {
+	mutex   sync.RWMutex
+	entries map[string]entry
+	tables  [substrings]map[uint16][]string
+	// unhashed counts the images left out for want of a hash
+	unhashed int
+}
+
+// entry is an indexed image
+type entry struct {
+	id        string
+	hash      uint64
+	histogram []byte
+}
+
+// NewIndex indexes the images with a perceptual hash
+func NewIndex(images []models.Image) *Index {
+	index := &Index{entries: make(map[string]entry, len(images))}
+	for i := range index.tables {
+		index.tables[i] = make(map[uint16][]string)
+	}
+	for _, image := range images {
+		e, ok := newEntry(image)
+		if !ok {
+			index.unhashed++
+			continue
+		}
+		index.insert(e)
+	}
+	return index
+}
+
+// newEntry returns the entry of an image, or false if it has no hash
+func newEntry(image models.Image) (entry, bool) {
+	hash, err := duplicates.ParseHash(image.PerceptualHash)
+	if err != nil {
+		return entry{}, false
+	}
+	return entry{id: image.ID, hash: hash, histogram: slices.Clone(image.ColorHistogram)}, true
+}
+
+// part returns the ith part of a hash
+func part(hash uint64, i int) uint16 {
+	return uint16(hash >> (i * substringBits))
+}
+
+// Len is the number of images in the index
+func (x *Index) Len() int {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+	return len(x.entries)
+}
+
+// add inserts an entry into an index that may be in use
+func (x *Index) add(e entry) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.insert(e)
+}
+
+// insert adds an entry, replacing any with the same ID. The caller must
+// hold x.mutex, unless the index is not in use yet
+func (x *Index) insert(e entry) {
+	if _, ok := x.entries[e.id]; ok {
+		x.delete(e.id)
+	}
+	x.entries[e.id] = e
+	for i, table := range x.tables {
+		key := part(e.hash, i)
+		table[key] = append(table[key], e.id)
+	}
+}
+
+// remove takes the image with an ID out of an index that may be in use
+func (x *Index) remove(id string) {
+	x.mutex.Lock()
+	defer x.mutex.Unlock()
+	x.delete(id)
+}
+
+// delete takes the image with an ID out of the index. The caller must hold
+// x.mutex
+func (x *Index) delete(id string) {
+	e, ok := x.entries[id]
+	if !ok {
+		return
+	}
+	delete(x.entries, id)
+	for i, table := range x.tables {
+		key := part(e.hash, i)
+		ids := slices.DeleteFunc(table[key], func(other string) bool { return other == id })
+		if len(ids) == 0 {
+			delete(table, key)
+		} else {
+			table[key] = ids
+		}
+	}
+}
+
+// has reports whether the image with an ID is indexed. The caller must
+// hold x.mutex
+func (x *Index) has(id string) bool {
+	_, ok := x.entries[id]
+	return ok
+}
+
+// within calls visit for each image whose hash is within radius of hash,
+// with its distance, and returns how many images it compared. When there
+// are more keys to look up than images, as for a wide radius in a small
+// index, every image is compared instead. The caller must hold x.mutex
+func (x *Index) within(hash uint64, radius int, visit func(e entry, d int)) int {
+	if radius < 0 {
+		return 0
+	}
+	flips := radius / substrings
+	if substrings*probeCount(flips) >= len(x.entries) {
+		for _, e := range x.entries {
+			if d := duplicates.Distance(hash, e.hash); d <= radius {
+				visit(e, d)
+			}
+		}
+		return len(x.entries)
+	}
+
+	compared := make(map[string]bool)
+	for i, table := range x.tables {
+		neighbours(part(hash, i), flips, func(key uint16) {
+			for _, id := range table[key] {
+				if compared[id] {
+					continue
+				}
+				compared[id] = true
+				e := x.entries[id]
+				if d := duplicates.Distance(hash, e.hash); d <= radius {
+					visit(e, d)
+				}
+			}
+		})
+	}
+	return len(compared)
+}
+
+// neighbours calls visit for every key within flips bits of key, key first
+func neighbours(key uint16, flips int, visit func(uint16)) {
+	var flip func(value uint16, from, left int)
+	flip = func(value uint16, from, left int) {
+		visit(value)
+		if left == 0 {
+			return
+		}
+		for bit := from; bit < substringBits; bit++ {
+			flip(value^1<<bit, bit+1, left-1)
+		}
+	}
+	flip(key, 0, flips)
+}
+
+// probeCount is the number of keys within flips bits of a key
+func probeCount(flips int) int {
+	count, combinations := 0, 1
+	for j := 0; j <= min(flips, substringBits); j++ {
+		count += combinations
+		combinations = combinations * (substringBits - j) / (j + 1)
+	}
+	return count
+}
+
+// near returns the images within radius bits of hash
+func (x *Index) near(hash uint64, radius int) []duplicates.Match {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	var matches []duplicates.Match
+	x.within(hash, radius, func(e entry, d int) {
+		matches = append(matches, duplicates.Match{Image: models.Image{ID: e.id}, Distance: d})
+	})
+	return matches
+}
+
+// Similar returns up to n images most like image, closest first, leaving
+// out image itself. The search starts with the images within initialRadius
+// bits of its hash and widens up to MaxHashDistance only while it finds
+// fewer than n, so a closer hash wins over closer colours further out. An
+// image without a hash has none
+func (x *Index) Similar(image models.Image, n int) []Match {
+	hash, err := duplicates.ParseHash(image.PerceptualHash)
+	if err != nil || n <= 0 {
+		return nil
+	}
+
+	x.mutex.RLock()
+	var matches []Match
+	for radius := initialRadius; ; radius = min(2*radius, MaxHashDistance) {
+		matches = matches[:0]
+		x.within(hash, radius, func(e entry, d int) {
+			if e.id == image.ID {
+				return
+			}
+			matches = append(matches, Match{ID: e.id, Distance: distance(d, image.ColorHistogram, e.histogram)})
+		})
+		if len(matches) >= n || radius >= MaxHashDistance {
+			break
+		}
+	}
+	x.mutex.RUnlock()
+
+	slices.SortFunc(matches, func(a, b Match) int {
+		return cmp.Or(cmp.Compare(a.Distance, b.Distance), cmp.Compare(a.ID, b.ID))
+	})
+	return matches[:min(n, len(matches))]
+}
+
+// groups returns the IDs of the images within threshold bits of each
+// other, transitively: if A is near B and B near C, all three are one
+// group even when A and C are further apart. Each image is looked up in
+// the index, rather than compared with every other. Images near no other
+// are left out
+func (x *Index) groups(threshold int) [][]string {
+	x.mutex.RLock()
+	defer x.mutex.RUnlock()
+
+	// Union-find over the images found near each image
+	parent := make(map[string]string, len(x.entries))
+	for id := range x.entries {
+		parent[id] = id
+	}
+	var root func(string) string
+	root = func(id string) string {
+		if parent[id] != id {
+			parent[id] = root(parent[id])
+		}
+		return parent[id]
+	}
+	for _, e := range x.entries {
+		x.within(e.hash, threshold, func(other entry, _ int) {
+			if other.id != e.id {
+				parent[root(e.id)] = root(other.id)
+			}
+		})
+	}
+
+	members := make(map[string][]string)
+	for id := range parent {
+		members[root(id)] = append(members[root(id)], id)
+	}
+	var groups [][]string
+	for _, group := range members {
+		if len(group) > 1 {
+			slices.Sort(group)
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// distance combines the Hamming distance of two hashes with how little two
+// colour histograms overlap. Without both histograms it is the hashes'
+// alone
+func distance(hashDistance int, a, b []byte) float64 {
+	structure := float64(hashDistance) / 64
+	if len(a) == 0 || len(a) != len(b) {
+		return structure
+	}
+	overlap := 0
+	for i := range a {
+		overlap += int(min(a[i], b[i]))
+	}
+	colour := 1 - min(1, float64(overlap)/255)
+	return hashWeight*structure + (1-hashWeight)*colour
+}
@@ -0,0 +1,316 @@
+package similar
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+
+	"image_gallery/internal/duplicates"
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// DefaultMaxAge is how long a searcher uses an index before rebuilding it
+const DefaultMaxAge = time.Minute
+
+// maxCandidateFactor bounds how many times n candidates a query reads to
+// replace those deleted, expired or in progress since the index was built
+const maxCandidateFactor = 8
+
+// Searcher answers similarity queries, checks uploads for duplicates and
+// reports near-duplicates from one index of the visible images, rebuilt
+// from the database once it is older than its maximum age. Uploads are
+// added to the index as they are checked, so two close ones made in quick
+// succession find each other
+type Searcher struct {
+	databaseService services.DatabaseService
+	maxAge          time.Duration
+	// now is the clock, replaced in tests
+	now   func() time.Time
+	group singleflight.Group
+
+	mutex sync.Mutex
+	index *Index
+	built time.Time
+	// reserved are the uploads added to the index since it was built, by ID
+	reserved map[string]*reservation
+}
+
+// reservation is an upload added to the index when it was checked
+type reservation struct {
+	entry entry
+	title string
+	// finished is when the upload was stored, or zero while it is in
+	// progress
+	finished time.Time
+}
+
+// NewSearcher creates a searcher over the images in databaseService
+func NewSearcher(databaseService services.DatabaseService, maxAge time.Duration) *Searcher {
+	return &Searcher{
+		databaseService: databaseService,
+		maxAge:          maxAge,
+		now:             time.Now,
+		reserved:        make(map[string]*reservation),
+	}
+}
+
+// Similar returns up to n images most like image, closest first. The
+// results are read again, so an image changed since the index was built is
+// returned as it is now, and one deleted, expired or in progress is left
+// out and replaced by the next closest
+func (s *Searcher) Similar(ctx context.Context, image models.Image, n int) ([]Result, error) {
+	index, err := s.current(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for limit := 2 * n; ; limit *= 2 {
+		matches := index.Similar(image, limit)
+		if len(matches) == 0 {
+			return nil, nil
+		}
+		results, err := s.read(ctx, matches)
+		if err != nil {
+			return nil, err
+		}
+		if len(results) >= n || len(matches) < limit || limit >= maxCandidateFactor*n {
+			return results[:min(n, len(results))], nil
+		}
+	}
+}
+
+// Reserve returns the images within radius bits of an upload's hash,
+// closest first, and adds the upload to the index, so that uploads checked
+// after it find it while it is being stored. Uploads still in progress are
+// among the matches, with the title they were checked with. An upload
+// without a hash matches nothing and is not added. Release must be called
+// once the upload is stored or given up
+func (s *Searcher) Reserve(ctx context.Context, image models.Image, radius int) ([]duplicates.Match, error) {
+	e, ok := newEntry(image)
+	if !ok {
+		return nil, nil
+	}
+	if _, err := s.current(ctx); err != nil {
+		return nil, err
+	}
+
+	// Matching and adding under one lock is what keeps two close uploads
+	// from both missing each other
+	var matches, stored []duplicates.Match
+	s.mutex.Lock()
+	for _, match := range s.index.near(e.hash, radius) {
+		if r, ok := s.reserved[match.Image.ID]; ok && r.finished.IsZero() {
+			match.Image.Title = r.title
+			matches = append(matches, match)
+		} else {
+			stored = append(stored, match)
+		}
+	}
+	s.index.add(e)
+	s.reserved[e.id] = &reservation{entry: e, title: image.Title}
+	s.mutex.Unlock()
+
+	found, err := s.readMatches(ctx, stored)
+	if err != nil {
+		s.Release(e.id, false)
+		return nil, err
+	}
+	matches = append(matches, found...)
+	slices.SortFunc(matches, func(a, b duplicates.Match) int {
+		return cmp.Or(cmp.Compare(a.Distance, b.Distance), cmp.Compare(a.Image.ID, b.Image.ID))
+	})
+	return matches, nil
+}
+
+// Release ends the reservation of an upload. One that was stored stays in
+// the index until it is rebuilt from a listing that includes it; one that
+// was not is taken out
+func (s *Searcher) Release(id string, stored bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	r, ok := s.reserved[id]
+	if !ok {
+		return
+	}
+	if stored {
+		r.finished = s.now()
+		return
+	}
+	delete(s.reserved, id)
+	s.index.remove(id)
+}
+
+// Duplicates reports the groups of visible images within threshold bits
+// of each other
+func (s *Searcher) Duplicates(ctx context.Context, threshold int) (duplicates.Report, error) {
+	index, err := s.current(ctx)
+	if err != nil {
+		return duplicates.Report{}, err
+	}
+
+	groups := index.groups(threshold)
+	var ids []string
+	for _, group := range groups {
+		ids = append(ids, group...)
+	}
+	images, err := s.visible(ctx, ids)
+	if err != nil {
+		return duplicates.Report{}, fmt.Errorf("failed to read duplicate images: %w", err)
+	}
+
+	clusters := make([][]models.Image, len(groups))
+	for i, group := range groups {
+		for _, id := range group {
+			if image, ok := images[id]; ok {
+				clusters[i] = append(clusters[i], image)
+			}
+		}
+	}
+	index.mutex.RLock()
+	scanned, unhashed := len(index.entries)+index.unhashed, index.unhashed
+	index.mutex.RUnlock()
+	return duplicates.NewReport(threshold, scanned, unhashed, clusters), nil
+}
+
+// readMatches returns the current records of duplicate matches that are
+// still visible
+func (s *Searcher) readMatches(ctx context.Context, matches []duplicates.Match) ([]duplicates.Match, error) {
+	if len(matches) == 0 {
+		return nil, nil
+	}
+	ids := make([]string, len(matches))
+	for i, match := range matches {
+		ids[i] = match.Image.ID
+	}
+	images, err := s.visible(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read duplicate images: %w", err)
+	}
+
+	var found []duplicates.Match
+	for _, match := range matches {
+		if image, ok := images[match.Image.ID]; ok {
+			found = append(found, duplicates.Match{Image: image, Distance: match.Distance})
+		}
+	}
+	return found, nil
+}
+
+// read returns the current records of matches that are still visible
+func (s *Searcher) read(ctx context.Context, matches []Match) ([]Result, error) {
+	ids := make([]string, len(matches))
+	for i, match := range matches {
+		ids[i] = match.ID
+	}
+	images, err := s.visible(ctx, ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read similar images: %w", err)
+	}
+
+	var results []Result
+	for _, match := range matches {
+		if image, ok := images[match.ID]; ok {
+			results = append(results, Result{Image: image, Distance: match.Distance})
+		}
+	}
+	return results, nil
+}
+
+// visible reads the images with the given IDs and returns those that are
+// neither pending nor expired, by ID. Images that could not be read are
+// left out
+func (s *Searcher) visible(ctx context.Context, ids []string) (map[string]models.Image, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	images, err := s.databaseService.BatchGetImages(ctx, ids)
+	var batchErr *services.BatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		return nil, err
+	}
+
+	now := s.now()
+	visible := make(map[string]models.Image, len(images))
+	for _, image := range images {
+		if !image.Pending() && !image.Expired(now) {
+			visible[image.ID] = image
+		}
+	}
+	return visible, nil
+}
+
+// current returns the index. Only the first query waits for it to be
+// built; once it is older than the maximum age it is rebuilt in the
+// background and served until the new one is ready, so a slow scan does
+// not hold up queries
+func (s *Searcher) current(ctx context.Context) (*Index, error) {
+	s.mutex.Lock()
+	index, built := s.index, s.built
+	s.mutex.Unlock()
+
+	if index == nil {
+		// The build carries on if the request that started it goes away,
+		// as other queries may be waiting for it
+		result, err, _ := s.group.Do("index", func() (any, error) {
+			return s.rebuild(context.WithoutCancel(ctx))
+		})
+		if err != nil {
+			return nil, err
+		}
+		return result.(*Index), nil
+	}
+
+	if s.now().Sub(built) >= s.maxAge {
+		s.group.DoChan("index", func() (any, error) {
+			index, err := s.rebuild(context.Background())
+			if err != nil {
+				log.Printf("Failed to rebuild the similar images index: %v", err)
+			}
+			return index, err
+		})
+	}
+	return index, nil
+}
+
+// rebuild indexes the visible images and replaces the index. The listed
+// records are only kept until the index is built. Uploads reserved since
+// are carried over to the new index, unless they were stored before the
+// listing began and so are in it already
+func (s *Searcher) rebuild(ctx context.Context) (*Index, error) {
+	now := s.now()
+	images, err := s.databaseService.ListImages(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	visible := make([]models.Image, 0, len(images))
+	for _, image := range images {
+		if !image.Pending() && !image.Expired(now) {
+			visible = append(visible, image)
+		}
+	}
+	index := NewIndex(visible)
+
+	s.mutex.Lock()
+	for id, r := range s.reserved {
+		if !r.finished.IsZero() && r.finished.Before(now) {
+			delete(s.reserved, id)
+			continue
+		}
+		if !index.has(id) {
+			index.insert(r.entry)
+		}
+	}
+	s.index, s.built = index, now
+	s.mutex.Unlock()
+	return index, nil
+}
@@ -0,0 +1,321 @@
+package similar
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"image_gallery/internal/duplicates"
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// histogram puts share of an image in bin a and the rest in bin b
+func histogram(a, b int, share byte) []byte {
+	h := make([]byte, 64)
+	h[a] += share
+	h[b] += 255 - share
+	return h
+}
+
+func TestIndex(t *testing.T) {
+	t.Run("MatchesBruteForce", func(t *testing.T) {
+		random := rand.New(rand.NewPCG(1, 2))
+		base := random.Uint64()
+		var images []models.Image
+		for i := range 500 {
+			// Flip a few bits of one hash so the search has neighbours to find
+			hash := random.Uint64()
+			if i%2 == 0 {
+				hash = base
+				for range random.IntN(30) {
+					hash ^= 1 << random.IntN(64)
+				}
+			}
+			images = append(images, models.Image{ID: fmt.Sprintf("image-%03d", i), PerceptualHash: duplicates.FormatHash(hash)})
+		}
+		images = append(images, models.Image{ID: "unhashed"})
+		index := NewIndex(images)
+		if index.Len() != 500 {
+			t.Errorf("Expected 500 images indexed, got %d", index.Len())
+		}
+
+		for _, radius := range []int{0, 8, MaxHashDistance} {
+			found := make(map[string]int)
+			index.within(base, radius, func(e entry, d int) { found[e.id] = d })
+			want := 0
+			for _, image := range images[:500] {
+				hash, _ := duplicates.ParseHash(image.PerceptualHash)
+				d := duplicates.Distance(base, hash)
+				if d > radius {
+					continue
+				}
+				want++
+				if got, ok := found[image.ID]; !ok || got != d {
+					t.Errorf("Expected %s at %d within %d bits, got %d, %v", image.ID, d, radius, got, ok)
+				}
+			}
+			if len(found) != want {
+				t.Errorf("Expected %d images within %d bits, got %d", want, radius, len(found))
+			}
+		}
+	})
+
+	t.Run("Prunes", func(t *testing.T) {
+		random := rand.New(rand.NewPCG(3, 4))
+		var images []models.Image
+		for i := range 20000 {
+			images = append(images, models.Image{ID: fmt.Sprintf("image-%05d", i), PerceptualHash: duplicates.FormatHash(random.Uint64())})
+		}
+		index := NewIndex(images)
+
+		// A search within the starting radius compares a small share of the
+		// images, and only a search wide enough to need most of them
+		// compares them all
+		for range 20 {
+			if compared := index.within(random.Uint64(), initialRadius, func(entry, int) {}); compared > index.Len()/20 {
+				t.Errorf("Expected a search within %d bits to compare few of %d images, got %d", initialRadius, index.Len(), compared)
+			}
+		}
+		if compared := index.within(random.Uint64(), MaxHashDistance, func(entry, int) {}); compared != index.Len() {
+			t.Errorf("Expected a search within %d bits to compare every image once, got %d", MaxHashDistance, compared)
+		}
+	})
+
+	t.Run("WidensUntilEnoughAreFound", func(t *testing.T) {
+		query := models.Image{ID: "query", PerceptualHash: duplicates.FormatHash(0)}
+		index := NewIndex([]models.Image{
+			query,
+			{ID: "near", PerceptualHash: duplicates.FormatHash(0b11)},
+			// 20 bits away, beyond the starting radius
+			{ID: "far", PerceptualHash: duplicates.FormatHash(0xfffff)},
+		})
+		if results := index.Similar(query, 1); len(results) != 1 || results[0].ID != "near" {
+			t.Errorf("Expected only near, got %+v", results)
+		}
+		if results := index.Similar(query, 2); len(results) != 2 || results[1].ID != "far" {
+			t.Errorf("Expected near then far, got %+v", results)
+		}
+	})
+
+	t.Run("RanksByHashAndColour", func(t *testing.T) {
+		query := models.Image{ID: "query", PerceptualHash: duplicates.FormatHash(0), ColorHistogram: histogram(0, 63, 200)}
+		index := NewIndex([]models.Image{
+			query,
+			// Same structure, other colours
+			{ID: "recoloured", PerceptualHash: duplicates.FormatHash(0), ColorHistogram: histogram(10, 20, 200)},
+			// A little structure apart, the same colours
+			{ID: "close", PerceptualHash: duplicates.FormatHash(0b111), ColorHistogram: histogram(0, 63, 200)},
+			// No histogram: compared by hash alone
+			{ID: "uncoloured", PerceptualHash: duplicates.FormatHash(0xff)},
+			// Beyond MaxHashDistance, however alike the colours
+			{ID: "unrelated", PerceptualHash: duplicates.FormatHash(0xffffffff), ColorHistogram: histogram(0, 63, 200)},
+		})
+
+		results := index.Similar(query, 10)
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.ID)
+		}
+		if fmt.Sprint(ids) != "[close uncoloured recoloured]" {
+			t.Errorf("Expected close, uncoloured then recoloured, got %v", ids)
+		}
+		if len(results) > 0 && (results[0].Distance <= 0 || results[0].Distance >= 0.1) {
+			t.Errorf("Expected close to be a small distance away, got %v", results[0].Distance)
+		}
+		if results := index.Similar(query, 1); len(results) != 1 || results[0].ID != "close" {
+			t.Errorf("Expected only the closest, got %+v", results)
+		}
+		if results := index.Similar(models.Image{ID: "unhashed"}, 10); results != nil {
+			t.Errorf("Expected nothing for an image without a hash, got %+v", results)
+		}
+	})
+
+	t.Run("GroupsChains", func(t *testing.T) {
+		index := NewIndex([]models.Image{
+			// a, b and c are a chain: a and c are 8 bits apart, each 4 from b
+			{ID: "c", PerceptualHash: duplicates.FormatHash(0xff)},
+			{ID: "a", PerceptualHash: duplicates.FormatHash(0)},
+			{ID: "b", PerceptualHash: duplicates.FormatHash(0x0f)},
+			{ID: "x", PerceptualHash: duplicates.FormatHash(0xff00ff0000000000)},
+			{ID: "y", PerceptualHash: duplicates.FormatHash(0xff00ff0000000001)},
+			{ID: "alone", PerceptualHash: duplicates.FormatHash(0xffffffff00000000)},
+			{ID: "unhashed"},
+		})
+		groups := index.groups(4)
+		slices.SortFunc(groups, func(a, b []string) int { return len(b) - len(a) })
+		if fmt.Sprint(groups) != "[[a b c] [x y]]" {
+			t.Errorf("Expected the chain and x with y, got %v", groups)
+		}
+		if groups := index.groups(0); len(groups) != 0 {
+			t.Errorf("Expected no groups of identical hashes, got %v", groups)
+		}
+	})
+}
+
+func TestSearcher(t *testing.T) {
+	ctx := context.Background()
+	db, err := services.NewLocalDBService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	past := now.Add(-time.Hour)
+	for _, image := range []models.Image{
+		{ID: "query", PerceptualHash: duplicates.FormatHash(0)},
+		{ID: "a", Title: "A", PerceptualHash: duplicates.FormatHash(0b1)},
+		{ID: "b", PerceptualHash: duplicates.FormatHash(0b11)},
+		{ID: "expired", PerceptualHash: duplicates.FormatHash(0b1), ExpiresAt: &past},
+		{ID: "pending", PerceptualHash: duplicates.FormatHash(0b1), Status: models.StatusUploading},
+	} {
+		if err := db.SaveImage(ctx, image); err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+	}
+
+	searcher := NewSearcher(db, time.Minute)
+	searcher.now = func() time.Time { return now }
+	query, _ := db.GetImage(ctx, "query")
+
+	ids := func(results []Result) []string {
+		var ids []string
+		for _, result := range results {
+			ids = append(ids, result.Image.ID)
+		}
+		return ids
+	}
+	results, err := searcher.Similar(ctx, query, 10)
+	if err != nil || fmt.Sprint(ids(results)) != "[a b]" {
+		t.Fatalf("Expected a then b, got %v, %v", ids(results), err)
+	}
+
+	// Changes reach the results at once, but the index only when rebuilt
+	a, _ := db.GetImage(ctx, "a")
+	a.Title = "Renamed"
+	if err := db.SaveImage(ctx, a); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	if err := db.DeleteImage(ctx, "b"); err != nil {
+		t.Fatalf("Failed to delete image: %v", err)
+	}
+	if err := db.SaveImage(ctx, models.Image{ID: "c", PerceptualHash: duplicates.FormatHash(0b111)}); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	results, err = searcher.Similar(ctx, query, 10)
+	if err != nil || fmt.Sprint(ids(results)) != "[a]" || results[0].Image.Title != "Renamed" {
+		t.Errorf("Expected only the renamed a, got %+v, %v", results, err)
+	}
+
+	// A stale index is still served while it is rebuilt in the background
+	now = now.Add(time.Minute)
+	results, err = searcher.Similar(ctx, query, 10)
+	if err != nil || fmt.Sprint(ids(results)) != "[a]" {
+		t.Errorf("Expected the stale index to be served, got %v, %v", ids(results), err)
+	}
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		searcher.mutex.Lock()
+		built := searcher.built
+		searcher.mutex.Unlock()
+		if built.Equal(now) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the index to be rebuilt")
+		}
+	}
+	results, err = searcher.Similar(ctx, query, 10)
+	if err != nil || fmt.Sprint(ids(results)) != "[a c]" {
+		t.Errorf("Expected a then c after a rebuild, got %v, %v", ids(results), err)
+	}
+
+	// A result left out since the index was built is replaced by the next
+	if err := db.DeleteImage(ctx, "a"); err != nil {
+		t.Fatalf("Failed to delete image: %v", err)
+	}
+	results, err = searcher.Similar(ctx, query, 1)
+	if err != nil || fmt.Sprint(ids(results)) != "[c]" {
+		t.Errorf("Expected c in place of the deleted a, got %v, %v", ids(results), err)
+	}
+}
+
+func TestSearcherDuplicates(t *testing.T) {
+	ctx := context.Background()
+	db, err := services.NewLocalDBService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	for _, image := range []models.Image{
+		{ID: "far", PerceptualHash: duplicates.FormatHash(0xffff)},
+		{ID: "two", Title: "Two", PerceptualHash: duplicates.FormatHash(0b11)},
+		{ID: "same", PerceptualHash: duplicates.FormatHash(0)},
+		{ID: "pending", PerceptualHash: duplicates.FormatHash(0), Status: models.StatusUploading},
+		{ID: "unhashed"},
+	} {
+		if err := db.SaveImage(ctx, image); err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+	}
+	searcher := NewSearcher(db, time.Minute)
+	searcher.now = func() time.Time { return now }
+
+	ids := func(matches []duplicates.Match) []string {
+		var ids []string
+		for _, match := range matches {
+			ids = append(ids, match.Image.ID)
+		}
+		return ids
+	}
+	upload := models.Image{ID: "upload", Title: "Upload", PerceptualHash: duplicates.FormatHash(0)}
+	matches, err := searcher.Reserve(ctx, upload, 4)
+	if err != nil || fmt.Sprint(ids(matches)) != "[same two]" || matches[1].Distance != 2 || matches[1].Image.Title != "Two" {
+		t.Fatalf("Expected same then two, got %+v, %v", matches, err)
+	}
+
+	// An upload checked while another is in progress finds it
+	matches, err = searcher.Reserve(ctx, models.Image{ID: "second", PerceptualHash: duplicates.FormatHash(0b1)}, 1)
+	if err != nil || fmt.Sprint(ids(matches)) != "[same two upload]" || matches[2].Image.Title != "Upload" {
+		t.Errorf("Expected same, two and the upload in progress, got %+v, %v", matches, err)
+	}
+	searcher.Release("second", false)
+	matches, _ = searcher.Reserve(ctx, models.Image{ID: "third", PerceptualHash: duplicates.FormatHash(0b1)}, 1)
+	if fmt.Sprint(ids(matches)) != "[same two upload]" {
+		t.Errorf("Expected a released upload to be left out, got %v", ids(matches))
+	}
+	searcher.Release("third", false)
+	if matches, err := searcher.Reserve(ctx, models.Image{ID: "unhashed-upload"}, 4); matches != nil || err != nil {
+		t.Errorf("Expected nothing for an upload without a hash, got %+v, %v", matches, err)
+	}
+
+	// A stored upload stays in the index across a rebuild that began before
+	// it was stored
+	upload.Status = models.StatusReady
+	if err := db.SaveImage(ctx, upload); err != nil {
+		t.Fatalf("Failed to save image: %v", err)
+	}
+	searcher.Release("upload", true)
+	if _, err := searcher.rebuild(ctx); err != nil {
+		t.Fatalf("Failed to rebuild: %v", err)
+	}
+	if searcher.index.Len() != 4 || len(searcher.reserved) != 1 {
+		t.Errorf("Expected the upload to be indexed once and still reserved, got %d indexed and %d reserved", searcher.index.Len(), len(searcher.reserved))
+	}
+	now = now.Add(time.Second)
+	if _, err := searcher.rebuild(ctx); err != nil {
+		t.Fatalf("Failed to rebuild: %v", err)
+	}
+	if searcher.index.Len() != 4 || len(searcher.reserved) != 0 {
+		t.Errorf("Expected the upload to be indexed from the listing alone, got %d indexed and %d reserved", searcher.index.Len(), len(searcher.reserved))
+	}
+
+	report, err := searcher.Duplicates(ctx, 4)
+	if err != nil {
+		t.Fatalf("Failed to report duplicates: %v", err)
+	}
+	if report.Scanned != 5 || report.Unhashed != 1 || len(report.Clusters) != 1 || len(report.Clusters[0].Images) != 3 {
+		t.Errorf("Expected same, two and upload in one cluster of 5 scanned, got %+v", report)
+	}
+}
@@ -25,7 +25,7 @@ func TestListComponent(t *testing.T) {
 
 	// Render the component
 	var buf bytes.Buffer
-	err := List(images).Render(context.Background(), &buf)
+	err := List(images, "").Render(context.Background(), &buf)
 	if err != nil {
 		t.Fatalf("Failed to render list component: %v", err)
 	}
@@ -43,6 +43,113 @@ func TestListComponent(t *testing.T) {
 	}
 }
 
+func TestListComponentUsesThumbnails(t *testing.T) {
+	images := []models.Image{
+		{
+			ID:    "test-id-1",
+			Title: "Test Image 1",
+			S3Key: "/images/test1.jpg",
+			Variants: []models.Variant{
+				{Size: 256, Key: "/images/variants/256/test1.jpg"},
+				{Size: 1024, Key: "/images/variants/1024/test1.jpg"},
+			},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := List(images, "").Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render list component: %v", err)
+	}
+
+	output := buf.String()
+	if !strings.Contains(output, `src="/images/variants/256/test1.jpg"`) {
+		t.Errorf("Expected the list to show the 256 pixel variant, got %s", output)
+	}
+	if strings.Contains(output, `src="/images/test1.jpg"`) {
+		t.Errorf("Expected the list not to load the original")
+	}
+}
+
+func TestResponsiveImages(t *testing.T) {
+	image := models.Image{
+		ID:     "test-id-1",
+		Title:  "Test Image 1",
+		S3Key:  "/images/test1.jpg",
+		Width:  3000,
+		Height: 2000,
+		Variants: []models.Variant{
+			{Size: 256, Width: 256, Height: 171, Key: "/images/variants/256/test1.jpg", ContentType: "image/jpeg"},
+			{Size: 1024, Width: 1024, Height: 683, Key: "/images/variants/1024/test1.jpg", ContentType: "image/jpeg"},
+		},
+	}
+	srcset := `srcset="/images/variants/256/test1.jpg 256w, /images/variants/1024/test1.jpg 1024w"`
+
+	t.Run("List", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := List([]models.Image{image}, "").Render(context.Background(), &buf); err != nil {
+			t.Fatalf("Failed to render list component: %v", err)
+		}
+
+		output := buf.String()
+		for _, want := range []string{"<picture>", `<source type="image/jpeg" ` + srcset, `sizes="(min-width: 768px) 33vw, 100vw"`, `height="171" width="256"`, `loading="lazy"`, `decoding="async"`} {
+			if !strings.Contains(output, want) {
+				t.Errorf("List component output does not contain %s", want)
+			}
+		}
+	})
+
+	t.Run("View", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := View(image, nil).Render(context.Background(), &buf); err != nil {
+			t.Fatalf("Failed to render view component: %v", err)
+		}
+
+		output := buf.String()
+		for _, want := range []string{`src="/images/variants/1024/test1.jpg"`, srcset, `height="683" width="1024"`, `loading="lazy"`} {
+			if !strings.Contains(output, want) {
+				t.Errorf("View component output does not contain %s", want)
+			}
+		}
+	})
+
+	t.Run("WithoutVariants", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := ResponsiveImage(models.Image{S3Key: "/images/old.jpg"}, 256, "100vw", "").Render(context.Background(), &buf); err != nil {
+			t.Fatalf("Failed to render image: %v", err)
+		}
+
+		output := buf.String()
+		if !strings.Contains(output, `src="/images/old.jpg"`) || strings.Contains(output, "srcset") || strings.Contains(output, "width=") {
+			t.Errorf("Expected a plain image of unknown size, got %s", output)
+		}
+		if strings.Contains(output, "style=") {
+			t.Errorf("Expected no placeholder, got %s", output)
+		}
+	})
+
+	t.Run("Placeholder", func(t *testing.T) {
+		withPlaceholder := image
+		withPlaceholder.Placeholder = "data:image/jpeg;base64,/9j/4AAQ"
+		var buf bytes.Buffer
+		if err := List([]models.Image{withPlaceholder}, "").Render(context.Background(), &buf); err != nil {
+			t.Fatalf("Failed to render list component: %v", err)
+		}
+		if want := `style="background: center / cover no-repeat url(data:image/jpeg;base64,/9j/4AAQ)"`; !strings.Contains(buf.String(), want) {
+			t.Errorf("List component output does not contain %s", want)
+		}
+
+		// Anything that could break out of the url() is dropped
+		withPlaceholder.Placeholder = "data:image/jpeg;base64,x);background:url(https://example.com/track"
+		buf.Reset()
+		if err := ResponsiveImage(withPlaceholder, 256, "100vw", "").Render(context.Background(), &buf); err != nil {
+			t.Fatalf("Failed to render image: %v", err)
+		}
+		if strings.Contains(buf.String(), "style=") {
+			t.Errorf("Expected the malformed placeholder to be dropped, got %s", buf.String())
+		}
+	})
+}
+
 func TestViewComponent(t *testing.T) {
 	// Create test image
 	now := time.Now().Truncate(time.Second)
@@ -57,7 +164,7 @@ func TestViewComponent(t *testing.T) {
 
 	// Render the component
 	var buf bytes.Buffer
-	err := View(image).Render(context.Background(), &buf)
+	err := View(image, nil).Render(context.Background(), &buf)
 	if err != nil {
 		t.Fatalf("Failed to render view component: %v", err)
 	}
@@ -75,6 +182,139 @@ func TestViewComponent(t *testing.T) {
 	}
 }
 
+func TestViewComponentShowsImageInfo(t *testing.T) {
+	image := models.Image{
+		ID:          "test-id-1",
+		Title:       "Test Image 1",
+		S3Key:       "/images/test1.png",
+		ContentType: "image/png",
+		Width:       640,
+		Height:      480,
+		PixelFormat: "NRGBA8",
+	}
+
+	var buf bytes.Buffer
+	if err := View(image, nil).Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render view component: %v", err)
+	}
+
+	output := buf.String()
+	for _, want := range []string{"640 × 480 px", "image/png", "NRGBA8"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("View component output does not contain %q", want)
+		}
+	}
+
+	// An edited image shows the size it is served at
+	image.Edits = &models.Edits{Rotate: 90}
+	buf.Reset()
+	if err := View(image, nil).Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render view component: %v", err)
+	}
+	if output := buf.String(); !strings.Contains(output, "480 × 640 px") {
+		t.Errorf("Expected the edited size, got %q", output)
+	}
+}
+
+func TestViewComponentShowsMetadata(t *testing.T) {
+	altitude := 12.0
+	taken := time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)
+	image := models.Image{
+		ID:    "test-id-1",
+		Title: "Test Image 1",
+		S3Key: "/images/test1.jpg",
+		Metadata: &models.Metadata{
+			CameraMake:       "Canon",
+			CameraModel:      "Canon EOS R5",
+			ExposureTime:     "1/250",
+			FNumber:          2.8,
+			ISO:              400,
+			DateTimeOriginal: &taken,
+			GPS:              &models.GPS{Latitude: -33.85983, Longitude: 151.2113, Altitude: &altitude},
+			Keywords:         []string{"harbour"},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := View(image, nil).Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render view component: %v", err)
+	}
+
+	output := buf.String()
+	for _, want := range []string{`class="collapse" id="metadata"`, "Canon EOS R5", "1/250 s · f/2.8 · ISO 400", "May 6, 2024 at 07:08", "33.85983° S, 151.21130° E, 12 m", "harbour"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("View component output does not contain %q", want)
+		}
+	}
+	if strings.Contains(output, "Canon Canon") {
+		t.Errorf("Expected the camera make not to be repeated")
+	}
+
+	buf.Reset()
+	image.Metadata = nil
+	View(image, nil).Render(context.Background(), &buf)
+	if strings.Contains(buf.String(), `id="metadata"`) {
+		t.Errorf("Expected no metadata panel for an image without metadata")
+	}
+}
+
+func TestViewComponentShowsPalette(t *testing.T) {
+	image := models.Image{
+		ID:    "test-id-1",
+		Title: "Test Image 1",
+		S3Key: "/images/test1.jpg",
+		Palette: []models.Swatch{
+			{Color: "#1e88e5", Weight: 0.75},
+			{Color: "url(evil)", Weight: 0.25},
+		},
+	}
+
+	var buf bytes.Buffer
+	if err := View(image, nil).Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render view component: %v", err)
+	}
+
+	output := buf.String()
+	for _, want := range []string{`href="/?color=%231e88e5"`, `style="background-color: #1e88e5; flex-grow: 0.750"`, `title="#1e88e5, 75%"`} {
+		if !strings.Contains(output, want) {
+			t.Errorf("View component output does not contain %q", want)
+		}
+	}
+	if strings.Contains(output, "background-color: url") {
+		t.Errorf("Expected an invalid colour to get no style")
+	}
+
+	buf.Reset()
+	image.Palette = nil
+	View(image, nil).Render(context.Background(), &buf)
+	if strings.Contains(buf.String(), "palette-strip") {
+		t.Errorf("Expected no palette for an image without one")
+	}
+}
+
+func TestViewComponentShowsDuplicateWarning(t *testing.T) {
+	image := models.Image{ID: "test-id-2", Title: "Again", S3Key: "/images/test2.jpg", DuplicateOf: []string{"test-id-1", "test-id-0"}}
+
+	var buf bytes.Buffer
+	if err := View(image, nil).Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render view component: %v", err)
+	}
+
+	output := buf.String()
+	for _, want := range []string{"near-duplicate of", `href="/image/test-id-1"`, `href="/image/test-id-0"`} {
+		if !strings.Contains(output, want) {
+			t.Errorf("View component output does not contain %q", want)
+		}
+	}
+
+	buf.Reset()
+	image.DuplicateOf = nil
+	View(image, nil).Render(context.Background(), &buf)
+	if strings.Contains(buf.String(), "near-duplicate") {
+		t.Errorf("Expected no warning for an image without duplicates")
+	}
+}
+
 func TestEditComponent(t *testing.T) {
 	// Create test image
 	now := time.Now().Truncate(time.Second)
@@ -105,12 +345,50 @@ func TestEditComponent(t *testing.T) {
 	if !strings.Contains(output, "/images/test1.jpg") {
 		t.Errorf("Edit component output does not contain image URL")
 	}
+	if !strings.Contains(output, `action="/image/test-id-1/edits"`) {
+		t.Errorf("Edit component output does not contain the adjust form")
+	}
+	if strings.Contains(output, "/edits/reset") {
+		t.Errorf("Edit component output offers a reset for an unedited image")
+	}
+	if !strings.Contains(output, `name="noWatermark" value="true">`) {
+		t.Errorf("Edit component output does not contain an unchecked watermark opt-out")
+	}
+
+	image.NoWatermark = true
+	buf.Reset()
+	if err := Edit(image).Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render edit component: %v", err)
+	}
+	if !strings.Contains(buf.String(), `name="noWatermark" value="true" checked`) {
+		t.Errorf("Edit component output does not check the watermark opt-out")
+	}
+}
+
+func TestEditsForm(t *testing.T) {
+	image := models.Image{
+		ID:    "test-id-1",
+		S3Key: "test1.jpg",
+		Edits: &models.Edits{Rotate: 180, FlipVertical: true, Crop: &models.Crop{X: 5, Y: 6, Width: 70, Height: 80}},
+	}
+
+	var buf bytes.Buffer
+	if err := EditsForm(image).Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render edits form: %v", err)
+	}
+
+	output := buf.String()
+	for _, want := range []string{`value="180" selected`, `id="flipVertical" name="flipVertical" value="true" checked`, `name="cropWidth" value="70"`, "/image/test-id-1/edits/reset"} {
+		if !strings.Contains(output, want) {
+			t.Errorf("Edits form output does not contain %s", want)
+		}
+	}
 }
 
 func TestUploadComponent(t *testing.T) {
 	// Render the component
 	var buf bytes.Buffer
-	err := Upload().Render(context.Background(), &buf)
+	err := Upload(10<<20).Render(context.Background(), &buf)
 	if err != nil {
 		t.Fatalf("Failed to render upload component: %v", err)
 	}
@@ -123,4 +401,55 @@ func TestUploadComponent(t *testing.T) {
 	if !strings.Contains(output, "enctype=\"multipart/form-data\"") {
 		t.Errorf("Upload component output does not contain multipart form")
 	}
-}
\ No newline at end of file
+}
+func TestCountdown(t *testing.T) {
+	tests := []struct {
+		remaining time.Duration
+		want      string
+	}{
+		{-time.Second, "Expired"},
+		{45 * time.Second, "Expires in 45s"},
+		{2*time.Minute + 5*time.Second, "Expires in 2m 5s"},
+		{3*time.Hour + 12*time.Minute, "Expires in 3h 12m"},
+		{50 * time.Hour, "Expires in 2d 2h"},
+	}
+	for _, tt := range tests {
+		if got := formatCountdown(tt.remaining + time.Second/2); got != tt.want {
+			t.Errorf("Expected %q for %v, got %q", tt.want, tt.remaining, got)
+		}
+	}
+
+	expiresAt := time.Now().Add(time.Hour)
+	var buf bytes.Buffer
+	if err := List([]models.Image{{ID: "test-id-1", Title: "Expiring", ExpiresAt: &expiresAt}}, "").Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render list component: %v", err)
+	}
+	if want := `data-expires-at="` + expiresAt.UTC().Format(time.RFC3339) + `"`; !strings.Contains(buf.String(), want) {
+		t.Errorf("List component output does not contain the countdown %s", want)
+	}
+}
+
+func TestViewComponentShowsSimilarImages(t *testing.T) {
+	image := models.Image{ID: "test-id-1", Title: "Beach", S3Key: "/images/test1.jpg"}
+	similar := []models.Image{
+		{ID: "test-id-2", Title: "Beach again", S3Key: "/images/test2.jpg", Variants: []models.Variant{{Size: 256, Width: 256, Height: 192, Key: "/images/variants/256/test2.jpg"}}},
+	}
+
+	var buf bytes.Buffer
+	if err := View(image, similar).Render(context.Background(), &buf); err != nil {
+		t.Fatalf("Failed to render view component: %v", err)
+	}
+
+	output := buf.String()
+	for _, want := range []string{"Similar images", `href="/image/test-id-2"`, `src="/images/variants/256/test2.jpg"`} {
+		if !strings.Contains(output, want) {
+			t.Errorf("View component output does not contain %q", want)
+		}
+	}
+
+	buf.Reset()
+	View(image, nil).Render(context.Background(), &buf)
+	if strings.Contains(buf.String(), "Similar images") {
+		t.Errorf("Expected no strip without similar images")
+	}
+}
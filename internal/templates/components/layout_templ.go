@@ -9,6 +9,7 @@ import "github.com/a-h/templ"
 import templruntime "github.com/a-h/templ/runtime"
 
 import (
+	"fmt"
 	"time"
 )
 
@@ -34,7 +35,7 @@ func Layout(content templ.Component) templ.Component {
 			templ_7745c5c3_Var1 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 1, "<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1.0\"><title>Image Gallery</title><link href=\"https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css\" rel=\"stylesheet\"><link href=\"https://cdn.jsdelivr.net/npm/bootstrap-icons@1.11.0/font/bootstrap-icons.css\" rel=\"stylesheet\"><style>\n\t\t\t.image-card {\n\t\t\t\theight: 300px;\n\t\t\t\tmargin-bottom: 20px;\n\t\t\t}\n\t\t\t.image-card img {\n\t\t\t\tmax-height: 200px;\n\t\t\t\tobject-fit: contain;\n\t\t\t}\n\t\t</style></head><body><nav class=\"navbar navbar-expand-lg navbar-dark bg-dark\"><div class=\"container\"><a class=\"navbar-brand\" href=\"/\">Image Gallery</a> <button class=\"navbar-toggler\" type=\"button\" data-bs-toggle=\"collapse\" data-bs-target=\"#navbarNav\"><span class=\"navbar-toggler-icon\"></span></button><div class=\"collapse navbar-collapse\" id=\"navbarNav\"><ul class=\"navbar-nav\"><li class=\"nav-item\"><a class=\"nav-link\" href=\"/\"><i class=\"bi bi-house-fill\"></i> Home</a></li><li class=\"nav-item\"><a class=\"nav-link\" href=\"/upload\"><i class=\"bi bi-upload\"></i> Upload Image</a></li></ul></div></div></nav><div class=\"container mt-4\">")
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 1, "<!doctype html><html lang=\"en\"><head><meta charset=\"UTF-8\"><meta name=\"viewport\" content=\"width=device-width, initial-scale=1.0\"><title>Image Gallery</title><link href=\"https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/css/bootstrap.min.css\" rel=\"stylesheet\"><link href=\"https://cdn.jsdelivr.net/npm/bootstrap-icons@1.11.0/font/bootstrap-icons.css\" rel=\"stylesheet\"><style>\n\t\t\t.image-card {\n\t\t\t\theight: 300px;\n\t\t\t\tmargin-bottom: 20px;\n\t\t\t}\n\t\t\t.image-card img {\n\t\t\t\theight: auto;\n\t\t\t\tmax-height: 200px;\n\t\t\t\tobject-fit: contain;\n\t\t\t}\n\t\t\t.swatch {\n\t\t\t\tdisplay: inline-block;\n\t\t\t\twidth: 1.75rem;\n\t\t\t\theight: 1.75rem;\n\t\t\t\tborder-radius: 50%;\n\t\t\t\tborder: 1px solid rgba(0, 0, 0, 0.2);\n\t\t\t}\n\t\t\t.swatch-selected {\n\t\t\t\toutline: 3px solid #0d6efd;\n\t\t\t\toutline-offset: 2px;\n\t\t\t}\n\t\t\t.palette-strip {\n\t\t\t\theight: 1.5rem;\n\t\t\t}\n\t\t\t.similar-image {\n\t\t\t\twidth: 100%;\n\t\t\t\theight: 120px;\n\t\t\t\tobject-fit: cover;\n\t\t\t}\n\t\t</style></head><body><nav class=\"navbar navbar-expand-lg navbar-dark bg-dark\"><div class=\"container\"><a class=\"navbar-brand\" href=\"/\">Image Gallery</a> <button class=\"navbar-toggler\" type=\"button\" data-bs-toggle=\"collapse\" data-bs-target=\"#navbarNav\"><span class=\"navbar-toggler-icon\"></span></button><div class=\"collapse navbar-collapse\" id=\"navbarNav\"><ul class=\"navbar-nav\"><li class=\"nav-item\"><a class=\"nav-link\" href=\"/\"><i class=\"bi bi-house-fill\"></i> Home</a></li><li class=\"nav-item\"><a class=\"nav-link\" href=\"/upload\"><i class=\"bi bi-upload\"></i> Upload Image</a></li></ul></div></div></nav><div class=\"container mt-4\">")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -42,7 +43,7 @@ func Layout(content templ.Component) templ.Component {
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
-		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 2, "</div><script src=\"https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/js/bootstrap.bundle.min.js\"></script></body></html>")
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 2, "</div><script src=\"https://cdn.jsdelivr.net/npm/bootstrap@5.3.0/dist/js/bootstrap.bundle.min.js\"></script><script>\n\t\t\t// Count down expiring images; the server renders the initial text\n\t\t\tfunction formatRemaining(seconds) {\n\t\t\t\tconst days = Math.floor(seconds / 86400);\n\t\t\t\tconst hours = Math.floor(seconds % 86400 / 3600);\n\t\t\t\tconst minutes = Math.floor(seconds % 3600 / 60);\n\t\t\t\tif (days > 0) return days + 'd ' + hours + 'h';\n\t\t\t\tif (hours > 0) return hours + 'h ' + minutes + 'm';\n\t\t\t\tif (minutes > 0) return minutes + 'm ' + seconds % 60 + 's';\n\t\t\t\treturn seconds + 's';\n\t\t\t}\n\t\t\tfunction updateCountdowns() {\n\t\t\t\tdocument.querySelectorAll('[data-expires-at]').forEach(function(el) {\n\t\t\t\t\tconst seconds = Math.floor((Date.parse(el.dataset.expiresAt) - Date.now()) / 1000);\n\t\t\t\t\tel.querySelector('.countdown').textContent = seconds > 0 ? 'Expires in ' + formatRemaining(seconds) : 'Expired';\n\t\t\t\t});\n\t\t\t}\n\t\t\tupdateCountdowns();\n\t\t\tsetInterval(updateCountdowns, 1000);\n\t\t</script></body></html>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -55,4 +56,93 @@ func formatTime(t time.Time) string {
 	return t.Format("Jan 2, 2006 at 15:04")
 }
 
+// Countdown shows the time left before an image expires
+func Countdown(expiresAt time.Time) templ.Component {
+	return templruntime.GeneratedTemplate(func(templ_7745c5c3_Input templruntime.GeneratedComponentInput) (templ_7745c5c3_Err error) {
+		templ_7745c5c3_W, ctx := templ_7745c5c3_Input.Writer, templ_7745c5c3_Input.Context
+		if templ_7745c5c3_CtxErr := ctx.Err(); templ_7745c5c3_CtxErr != nil {
+			return templ_7745c5c3_CtxErr
+		}
+		templ_7745c5c3_Buffer, templ_7745c5c3_IsBuffer := templruntime.GetBuffer(templ_7745c5c3_W)
+		if !templ_7745c5c3_IsBuffer {
+			defer func() {
+				templ_7745c5c3_BufErr := templruntime.ReleaseBuffer(templ_7745c5c3_Buffer)
+				if templ_7745c5c3_Err == nil {
+					templ_7745c5c3_Err = templ_7745c5c3_BufErr
+				}
+			}()
+		}
+		ctx = templ.InitializeContext(ctx)
+		templ_7745c5c3_Var2 := templ.GetChildren(ctx)
+		if templ_7745c5c3_Var2 == nil {
+			templ_7745c5c3_Var2 = templ.NopComponent
+		}
+		ctx = templ.ClearChildren(ctx)
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 3, "<span class=\"badge bg-warning text-dark\" data-expires-at=\"")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		var templ_7745c5c3_Var3 string
+		templ_7745c5c3_Var3, templ_7745c5c3_Err = templ.JoinStringErrs(expiresAt.UTC().Format(time.RFC3339))
+		if templ_7745c5c3_Err != nil {
+			return templ.Error{Err: templ_7745c5c3_Err, FileName: `internal/templates/components/layout.templ`, Line: 105, Col: 95}
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var3))
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 4, "\" title=\"")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		var templ_7745c5c3_Var4 string
+		templ_7745c5c3_Var4, templ_7745c5c3_Err = templ.JoinStringErrs("Expires " + formatTime(expiresAt))
+		if templ_7745c5c3_Err != nil {
+			return templ.Error{Err: templ_7745c5c3_Err, FileName: `internal/templates/components/layout.templ`, Line: 105, Col: 138}
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var4))
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 5, "\"><i class=\"bi bi-hourglass-split\"></i> <span class=\"countdown\">")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		var templ_7745c5c3_Var5 string
+		templ_7745c5c3_Var5, templ_7745c5c3_Err = templ.JoinStringErrs(formatCountdown(time.Until(expiresAt)))
+		if templ_7745c5c3_Err != nil {
+			return templ.Error{Err: templ_7745c5c3_Err, FileName: `internal/templates/components/layout.templ`, Line: 106, Col: 103}
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var5))
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 6, "</span></span>")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		return nil
+	})
+}
+
+// formatCountdown formats the time left before an expiry like the page's
+// countdown script does
+func formatCountdown(d time.Duration) string {
+	seconds := int(d.Seconds())
+	if seconds <= 0 {
+		return "Expired"
+	}
+
+	days, hours, minutes := seconds/86400, seconds%86400/3600, seconds%3600/60
+	switch {
+	case days > 0:
+		return fmt.Sprintf("Expires in %dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("Expires in %dh %dm", hours, minutes)
+	case minutes > 0:
+		return fmt.Sprintf("Expires in %dm %ds", minutes, seconds%60)
+	}
+	return fmt.Sprintf("Expires in %ds", seconds)
+}
+
 var _ = templruntime.GeneratedTemplate
@@ -6,22 +6,29 @@ import (
 	"net/http"
 )
 
-// RenderListPage renders the list page with the given images
-func RenderListPage(w http.ResponseWriter, images []models.Image) error {
-	return Layout(List(images)).Render(context.Background(), w)
+// RenderListPage renders the list page with the given images, filtered by
+// color when it is not empty
+func RenderListPage(w http.ResponseWriter, images []models.Image, color string) error {
+	return Layout(List(images, color)).Render(context.Background(), w)
 }
 
-// RenderViewPage renders the view page for a single image
-func RenderViewPage(w http.ResponseWriter, image models.Image) error {
-	return Layout(View(image)).Render(context.Background(), w)
+// RenderViewPage renders the view page for a single image and the images
+// similar to it
+func RenderViewPage(w http.ResponseWriter, image models.Image, similar []models.Image) error {
+	return Layout(View(image, similar)).Render(context.Background(), w)
 }
 
-// RenderUploadPage renders the upload form
-func RenderUploadPage(w http.ResponseWriter) error {
-	return Layout(Upload()).Render(context.Background(), w)
+// RenderUploadPage renders the upload form for files up to maxFileSize bytes
+func RenderUploadPage(w http.ResponseWriter, maxFileSize int64) error {
+	return Layout(Upload(maxFileSize)).Render(context.Background(), w)
 }
 
 // RenderEditPage renders the edit form for an image
 func RenderEditPage(w http.ResponseWriter, image models.Image) error {
 	return Layout(Edit(image)).Render(context.Background(), w)
+}
+
+// RenderEditConflictPage renders the edit form with a stale-edit warning
+func RenderEditConflictPage(w http.ResponseWriter, image models.Image) error {
+	return Layout(EditConflict(image)).Render(context.Background(), w)
 }
\ No newline at end of file
@@ -8,8 +8,10 @@ package components
 import "github.com/a-h/templ"
 import templruntime "github.com/a-h/templ/runtime"
 
+import "fmt"
+
 // Upload renders the upload form
-func Upload() templ.Component {
+func Upload(maxFileSize int64) templ.Component {
 	return templruntime.GeneratedTemplate(func(templ_7745c5c3_Input templruntime.GeneratedComponentInput) (templ_7745c5c3_Err error) {
 		templ_7745c5c3_W, ctx := templ_7745c5c3_Input.Writer, templ_7745c5c3_Input.Context
 		if templ_7745c5c3_CtxErr := ctx.Err(); templ_7745c5c3_CtxErr != nil {
@@ -30,7 +32,20 @@ func Upload() templ.Component {
 			templ_7745c5c3_Var1 = templ.NopComponent
 		}
 		ctx = templ.ClearChildren(ctx)
-		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 1, "<div class=\"row\"><div class=\"col-md-8 offset-md-2\"><div class=\"card shadow\"><div class=\"card-header bg-primary text-white\"><h2><i class=\"bi bi-upload\"></i> Upload New Image</h2></div><div class=\"card-body\"><form action=\"/upload\" method=\"POST\" enctype=\"multipart/form-data\"><div class=\"mb-3\"><label for=\"title\" class=\"form-label\">Title</label> <input type=\"text\" class=\"form-control\" id=\"title\" name=\"title\" placeholder=\"Enter a title for your image\" required></div><div class=\"mb-3\"><label for=\"description\" class=\"form-label\">Description</label> <textarea class=\"form-control\" id=\"description\" name=\"description\" rows=\"3\" placeholder=\"Enter a description (optional)\"></textarea></div><div class=\"mb-4\"><label for=\"image\" class=\"form-label\">Image File</label><div class=\"input-group mb-3\"><input class=\"form-control\" type=\"file\" id=\"image\" name=\"image\" accept=\"image/*\" required> <span class=\"input-group-text\"><i class=\"bi bi-image\"></i></span></div><div class=\"form-text\">Accepted formats: JPG, PNG, GIF, etc. (Max size: 10MB)</div></div><div id=\"image-preview\" class=\"text-center mb-3\" style=\"display: none;\"><p class=\"text-muted\">Image Preview:</p><img id=\"preview-img\" class=\"img-fluid img-thumbnail\" style=\"max-height: 300px;\" alt=\"Preview\"></div><div class=\"d-grid gap-2 d-md-flex justify-content-md-end mt-4\"><a href=\"/\" class=\"btn btn-secondary me-md-2\"><i class=\"bi bi-x-circle\"></i> Cancel</a> <button type=\"submit\" class=\"btn btn-primary btn-lg\"><i class=\"bi bi-cloud-upload\"></i> Upload Image</button></div></form></div></div></div></div><script>\n\t\t// Add image preview functionality\n\t\tdocument.getElementById('image').addEventListener('change', function(event) {\n\t\t\tconst file = event.target.files[0];\n\t\t\tif (file) {\n\t\t\t\tconst reader = new FileReader();\n\t\t\t\treader.onload = function(e) {\n\t\t\t\t\tconst previewImg = document.getElementById('preview-img');\n\t\t\t\t\tpreviewImg.src = e.target.result;\n\t\t\t\t\tdocument.getElementById('image-preview').style.display = 'block';\n\t\t\t\t}\n\t\t\t\treader.readAsDataURL(file);\n\t\t\t}\n\t\t});\n\t</script>")
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 1, "<div class=\"row\"><div class=\"col-md-8 offset-md-2\"><div class=\"card shadow\"><div class=\"card-header bg-primary text-white\"><h2><i class=\"bi bi-upload\"></i> Upload New Image</h2></div><div class=\"card-body\"><form action=\"/upload\" method=\"POST\" enctype=\"multipart/form-data\"><div class=\"mb-3\"><label for=\"title\" class=\"form-label\">Title</label> <input type=\"text\" class=\"form-control\" id=\"title\" name=\"title\" placeholder=\"Enter a title for your image\" required></div><div class=\"mb-3\"><label for=\"description\" class=\"form-label\">Description</label> <textarea class=\"form-control\" id=\"description\" name=\"description\" rows=\"3\" placeholder=\"Enter a description (optional)\"></textarea></div><div class=\"mb-4\"><label for=\"image\" class=\"form-label\">Image File</label><div class=\"input-group mb-3\"><input class=\"form-control\" type=\"file\" id=\"image\" name=\"image\" accept=\"image/jpeg,image/png,image/gif,image/webp,image/bmp,image/tiff\" required> <span class=\"input-group-text\"><i class=\"bi bi-image\"></i></span></div><div class=\"form-text\">Accepted formats: JPEG, PNG, GIF, WebP, BMP and TIFF (Max size: ")
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		var templ_7745c5c3_Var2 string
+		templ_7745c5c3_Var2, templ_7745c5c3_Err = templ.JoinStringErrs(fmt.Sprintf("%.0f MB", float64(maxFileSize)/(1<<20)))
+		if templ_7745c5c3_Err != nil {
+			return templ.Error{Err: templ_7745c5c3_Err, FileName: `internal/templates/components/upload.templ`, Line: 29, Col: 148}
+		}
+		_, templ_7745c5c3_Err = templ_7745c5c3_Buffer.WriteString(templ.EscapeString(templ_7745c5c3_Var2))
+		if templ_7745c5c3_Err != nil {
+			return templ_7745c5c3_Err
+		}
+		templ_7745c5c3_Err = templruntime.WriteString(templ_7745c5c3_Buffer, 2, ")</div></div><div class=\"mb-4\"><label for=\"expiresIn\" class=\"form-label\">Delete Automatically</label> <select class=\"form-select\" id=\"expiresIn\" name=\"expiresIn\"><option value=\"\" selected>Never</option> <option value=\"1h\">After 1 hour</option> <option value=\"24h\">After 1 day</option> <option value=\"168h\">After 1 week</option> <option value=\"720h\">After 30 days</option></select><div class=\"form-text\">Use this for temporary shares and review uploads.</div></div><div class=\"form-check mb-4\"><input class=\"form-check-input\" type=\"checkbox\" id=\"noWatermark\" name=\"noWatermark\" value=\"true\"> <label class=\"form-check-label\" for=\"noWatermark\">Serve without watermark</label><div class=\"form-text\">Applies when the gallery is configured to watermark images.</div></div><div id=\"image-preview\" class=\"text-center mb-3\" style=\"display: none;\"><p class=\"text-muted\">Image Preview:</p><img id=\"preview-img\" class=\"img-fluid img-thumbnail\" style=\"max-height: 300px;\" alt=\"Preview\"></div><div class=\"d-grid gap-2 d-md-flex justify-content-md-end mt-4\"><a href=\"/\" class=\"btn btn-secondary me-md-2\"><i class=\"bi bi-x-circle\"></i> Cancel</a> <button type=\"submit\" class=\"btn btn-primary btn-lg\"><i class=\"bi bi-cloud-upload\"></i> Upload Image</button></div></form></div></div></div></div><script>\n\t\t// Add image preview functionality\n\t\tdocument.getElementById('image').addEventListener('change', function(event) {\n\t\t\tconst file = event.target.files[0];\n\t\t\tif (file) {\n\t\t\t\tconst reader = new FileReader();\n\t\t\t\treader.onload = function(e) {\n\t\t\t\t\tconst previewImg = document.getElementById('preview-img');\n\t\t\t\t\tpreviewImg.src = e.target.result;\n\t\t\t\t\tdocument.getElementById('image-preview').style.display = 'block';\n\t\t\t\t}\n\t\t\t\treader.readAsDataURL(file);\n\t\t\t}\n\t\t});\n\t</script>")
 		if templ_7745c5c3_Err != nil {
 			return templ_7745c5c3_Err
 		}
@@ -0,0 +1,238 @@
+package transfer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// ErrInvalidImport is returned when an import file fails validation; the
+// report lists the offending records and nothing is written
+var ErrInvalidImport = errors.New("import file is invalid")
+
+// Actions reported for each imported record
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionUnchanged = "unchanged"
+)
+
+// FieldChange is a single field that an import changes
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// Change describes what an import does to one record
+type Change struct {
+	ID     string        `json:"id"`
+	Action string        `json:"action"`
+	Fields []FieldChange `json:"fields,omitempty"`
+}
+
+// RecordError is a validation or write failure of one record
+type RecordError struct {
+	Line  int    `json:"line,omitempty"`
+	ID    string `json:"id,omitempty"`
+	Error string `json:"error"`
+}
+
+// Report summarizes an import
+type Report struct {
+	DryRun    bool          `json:"dryRun"`
+	Created   int           `json:"created"`
+	Updated   int           `json:"updated"`
+	Unchanged int           `json:"unchanged"`
+	Changes   []Change      `json:"changes"`
+	Errors    []RecordError `json:"errors,omitempty"`
+}
+
+// ImportOptions controls an import
+type ImportOptions struct {
+	// DryRun validates and reports the changes without writing them
+	DryRun bool
+}
+
+// Import upserts the records in r by ID. Only the fields present in a record
+// are changed on an existing image. The file is validated as a whole first,
+// so either every valid change is written or, on validation errors, none is
+func Import(ctx context.Context, db services.DatabaseService, r io.Reader, format Format, opts ImportOptions) (Report, error) {
+	report := Report{DryRun: opts.DryRun, Changes: []Change{}}
+
+	records, errs := readRecords(r, format)
+	report.Errors = append(report.Errors, errs...)
+	report.Errors = append(report.Errors, validateRecords(records)...)
+	if len(report.Errors) > 0 {
+		return report, ErrInvalidImport
+	}
+
+	ids := make([]string, len(records))
+	for i, rec := range records {
+		ids[i] = rec.image.ID
+	}
+
+	// Missing IDs become new records; any other failure aborts the import
+	existing, err := db.BatchGetImages(ctx, ids)
+	var batchErr *services.BatchError
+	if errors.As(err, &batchErr) {
+		for id, itemErr := range batchErr.Errors {
+			if !errors.Is(itemErr, services.ErrNotFound) {
+				return report, fmt.Errorf("failed to read image %s: %w", id, itemErr)
+			}
+		}
+	} else if err != nil {
+		return report, fmt.Errorf("failed to read images: %w", err)
+	}
+
+	current := make(map[string]models.Image, len(existing))
+	for _, image := range existing {
+		current[image.ID] = image
+	}
+
+	now := time.Now()
+	var writes []models.Image
+	for _, rec := range records {
+		image, exists := current[rec.image.ID]
+		if !exists {
+			if !rec.fields["s3Key"] || !rec.fields["title"] {
+				report.Errors = append(report.Errors, RecordError{Line: rec.line, ID: rec.image.ID, Error: "new records need title and s3Key"})
+				continue
+			}
+			image = models.Image{ID: rec.image.ID, CreatedAt: now}
+		}
+
+		updated, changes := applyRecord(image, rec)
+		change := Change{ID: rec.image.ID, Fields: changes}
+		switch {
+		case !exists:
+			change.Action = ActionCreate
+			report.Created++
+		case len(changes) > 0:
+			change.Action = ActionUpdate
+			report.Updated++
+		default:
+			change.Action = ActionUnchanged
+			report.Unchanged++
+		}
+		report.Changes = append(report.Changes, change)
+
+		if change.Action != ActionUnchanged {
+			updated.UpdatedAt = now
+			writes = append(writes, updated)
+		}
+	}
+
+	if len(report.Errors) > 0 {
+		return report, ErrInvalidImport
+	}
+
+	if opts.DryRun || len(writes) == 0 {
+		return report, nil
+	}
+
+	// Each write is conditional on the version read above, so an image edited
+	// in the meantime is reported instead of overwritten
+	if err := db.BatchUpdateImages(ctx, writes); err != nil {
+		if !errors.As(err, &batchErr) {
+			return report, fmt.Errorf("failed to save images: %w", err)
+		}
+		for id, itemErr := range batchErr.Errors {
+			message := itemErr.Error()
+			if errors.Is(itemErr, services.ErrConflict) {
+				message = "image changed during the import; import it again"
+			}
+			report.Errors = append(report.Errors, RecordError{ID: id, Error: message})
+		}
+		return report, fmt.Errorf("failed to save %d images: %w", len(batchErr.Errors), err)
+	}
+
+	return report, nil
+}
+
+// validateRecords checks records before anything is written
+func validateRecords(records []record) []RecordError {
+	var errs []RecordError
+	seen := make(map[string]int)
+
+	for _, rec := range records {
+		id := rec.image.ID
+		fail := func(format string, args ...any) {
+			errs = append(errs, RecordError{Line: rec.line, ID: id, Error: fmt.Sprintf(format, args...)})
+		}
+
+		if id == "" {
+			fail("id is required")
+			continue
+		}
+		if line, ok := seen[id]; ok {
+			fail("duplicate id, first seen on line %d", line)
+			continue
+		}
+		seen[id] = rec.line
+
+		if rec.fields["title"] && rec.image.Title == "" {
+			fail("title must not be empty")
+		}
+		if rec.fields["s3Key"] {
+			if err := services.ValidateKey(rec.image.S3Key); err != nil {
+				fail("invalid s3Key: %v", err)
+			}
+		}
+		if rec.fields["size"] && rec.image.Size < 0 {
+			fail("size must not be negative")
+		}
+	}
+
+	return errs
+}
+
+// applyRecord sets the importable fields present in rec on image and reports
+// what changed
+func applyRecord(image models.Image, rec record) (models.Image, []FieldChange) {
+	var changes []FieldChange
+	set := func(field string, old, new string, apply func()) {
+		if rec.fields[field] && old != new {
+			changes = append(changes, FieldChange{Field: field, Old: old, New: new})
+			apply()
+		}
+	}
+
+	set("title", image.Title, rec.image.Title, func() { image.Title = rec.image.Title })
+	set("description", image.Description, rec.image.Description, func() { image.Description = rec.image.Description })
+	set("s3Key", image.S3Key, rec.image.S3Key, func() { image.S3Key = rec.image.S3Key })
+	set("contentType", image.ContentType, rec.image.ContentType, func() { image.ContentType = rec.image.ContentType })
+	set("size", strconv.FormatInt(image.Size, 10), strconv.FormatInt(rec.image.Size, 10), func() { image.Size = rec.image.Size })
+	if rec.fields["createdAt"] && !image.CreatedAt.Equal(rec.image.CreatedAt) {
+		changes = append(changes, FieldChange{
+			Field: "createdAt",
+			Old:   image.CreatedAt.Format(time.RFC3339Nano),
+			New:   rec.image.CreatedAt.Format(time.RFC3339Nano),
+		})
+		image.CreatedAt = rec.image.CreatedAt
+	}
+	if rec.fields["expiresAt"] && !sameExpiry(image.ExpiresAt, rec.image.ExpiresAt) {
+		changes = append(changes, FieldChange{
+			Field: "expiresAt",
+			Old:   formatExpiry(image.ExpiresAt),
+			New:   formatExpiry(rec.image.ExpiresAt),
+		})
+		image.ExpiresAt = rec.image.ExpiresAt
+	}
+
+	return image, changes
+}
+
+// sameExpiry reports whether two optional expiry times are equal
+func sameExpiry(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
@@ -0,0 +1,270 @@
+package transfer
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+// Format is a metadata file format
+type Format string
+
+const (
+	FormatJSONL Format = "jsonl"
+	FormatCSV   Format = "csv"
+)
+
+// ParseFormat parses a format name
+func ParseFormat(name string) (Format, error) {
+	switch Format(strings.ToLower(name)) {
+	case FormatJSONL, "ndjson":
+		return FormatJSONL, nil
+	case FormatCSV:
+		return FormatCSV, nil
+	}
+	return "", fmt.Errorf("unknown format %q, expected jsonl or csv", name)
+}
+
+// FormatFromPath infers the format from a file extension
+func FormatFromPath(path string) (Format, error) {
+	return ParseFormat(strings.TrimPrefix(filepath.Ext(path), "."))
+}
+
+// ContentType returns the MIME type of the format
+func (f Format) ContentType() string {
+	if f == FormatCSV {
+		return "text/csv; charset=utf-8"
+	}
+	return "application/x-ndjson"
+}
+
+// columns are the exported fields in CSV column order. Imports set all of
+// them except updatedAt and version, which the gallery manages
+var columns = []string{"id", "title", "description", "s3Key", "contentType", "size", "createdAt", "updatedAt", "version", "expiresAt"}
+
+// Export writes every image record to w, ordered by creation time
+func Export(ctx context.Context, db services.DatabaseService, w io.Writer, format Format) (int, error) {
+	images, err := db.ListImages(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	sort.Slice(images, func(i, j int) bool {
+		if !images[i].CreatedAt.Equal(images[j].CreatedAt) {
+			return images[i].CreatedAt.Before(images[j].CreatedAt)
+		}
+		return images[i].ID < images[j].ID
+	})
+
+	switch format {
+	case FormatJSONL:
+		encoder := json.NewEncoder(w)
+		for _, image := range images {
+			if err := encoder.Encode(image); err != nil {
+				return 0, err
+			}
+		}
+	case FormatCSV:
+		writer := csv.NewWriter(w)
+		writer.Write(columns)
+		for _, image := range images {
+			writer.Write([]string{
+				escapeCell(image.ID),
+				escapeCell(image.Title),
+				escapeCell(image.Description),
+				escapeCell(image.S3Key),
+				escapeCell(image.ContentType),
+				strconv.FormatInt(image.Size, 10),
+				image.CreatedAt.Format(time.RFC3339Nano),
+				image.UpdatedAt.Format(time.RFC3339Nano),
+				strconv.FormatInt(image.Version, 10),
+				formatExpiry(image.ExpiresAt),
+			})
+		}
+		writer.Flush()
+		if err := writer.Error(); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("unknown format %q", format)
+	}
+
+	return len(images), nil
+}
+
+// record is one parsed import row with the fields it sets
+type record struct {
+	line   int
+	image  models.Image
+	fields map[string]bool
+}
+
+// readRecords parses every record of an import file
+func readRecords(r io.Reader, format Format) ([]record, []RecordError) {
+	switch format {
+	case FormatJSONL:
+		return readJSONL(r)
+	case FormatCSV:
+		return readCSV(r)
+	}
+	return nil, []RecordError{{Error: fmt.Sprintf("unknown format %q", format)}}
+}
+
+func readJSONL(r io.Reader) ([]record, []RecordError) {
+	var records []record
+	var errs []RecordError
+
+	decoder := json.NewDecoder(r)
+	for line := 1; ; line++ {
+		var raw map[string]json.RawMessage
+		if err := decoder.Decode(&raw); err == io.EOF {
+			break
+		} else if err != nil {
+			// The decoder cannot resynchronize after a syntax error
+			errs = append(errs, RecordError{Line: line, Error: err.Error()})
+			break
+		}
+
+		rec := record{line: line, fields: make(map[string]bool)}
+		for field := range raw {
+			rec.fields[field] = true
+		}
+
+		data, _ := json.Marshal(raw)
+		if err := json.Unmarshal(data, &rec.image); err != nil {
+			errs = append(errs, RecordError{Line: line, Error: err.Error()})
+			continue
+		}
+		records = append(records, rec)
+	}
+
+	return records, errs
+}
+
+func readCSV(r io.Reader) ([]record, []RecordError) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, []RecordError{{Line: 1, Error: fmt.Sprintf("failed to read header: %v", err)}}
+	}
+
+	var records []record
+	var errs []RecordError
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			errs = append(errs, RecordError{Line: parseErr.StartLine, Error: parseErr.Err.Error()})
+			continue
+		}
+		if err != nil {
+			errs = append(errs, RecordError{Error: err.Error()})
+			break
+		}
+
+		line, _ := reader.FieldPos(0)
+		if len(row) != len(header) {
+			errs = append(errs, RecordError{Line: line, Error: fmt.Sprintf("expected %d columns, got %d", len(header), len(row))})
+			continue
+		}
+
+		rec := record{line: line, fields: make(map[string]bool)}
+		for i, column := range header {
+			value := row[i]
+			rec.fields[column] = true
+
+			switch column {
+			case "id", "title", "description", "s3Key", "contentType":
+				value = unescapeCell(value)
+			}
+			switch column {
+			case "id":
+				rec.image.ID = value
+			case "title":
+				rec.image.Title = value
+			case "description":
+				rec.image.Description = value
+			case "s3Key":
+				rec.image.S3Key = value
+			case "contentType":
+				rec.image.ContentType = value
+			case "size":
+				rec.image.Size, err = strconv.ParseInt(value, 10, 64)
+			case "createdAt":
+				rec.image.CreatedAt, err = time.Parse(time.RFC3339Nano, value)
+			case "expiresAt":
+				rec.image.ExpiresAt, err = parseExpiry(value)
+			}
+			if err != nil {
+				errs = append(errs, RecordError{Line: line, ID: rec.image.ID, Error: fmt.Sprintf("invalid %s: %v", column, err)})
+				break
+			}
+		}
+		if err == nil {
+			records = append(records, rec)
+		}
+	}
+
+	return records, errs
+}
+
+// escapeCell keeps a spreadsheet from running a text cell as a formula by
+// prefixing a value that starts like one with a quote. A value that already
+// starts with a quote before such a character gets another, so unescapeCell
+// restores every value exactly
+func escapeCell(value string) string {
+	if needsEscape(value) {
+		return "'" + value
+	}
+	return value
+}
+
+// unescapeCell removes the quote added by escapeCell
+func unescapeCell(value string) string {
+	if strings.HasPrefix(value, "'") && needsEscape(value[1:]) {
+		return value[1:]
+	}
+	return value
+}
+
+// needsEscape reports whether a spreadsheet could read value as a formula
+func needsEscape(value string) bool {
+	value = strings.TrimLeft(value, "'")
+	return value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0]))
+}
+
+// formatExpiry formats an optional expiry as a CSV cell, empty for none
+func formatExpiry(expiresAt *time.Time) string {
+	if expiresAt == nil {
+		return ""
+	}
+	return expiresAt.Format(time.RFC3339)
+}
+
+// parseExpiry parses a CSV expiry cell, where empty means no expiry
+func parseExpiry(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return nil, err
+	}
+	return &expiresAt, nil
+}
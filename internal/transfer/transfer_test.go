@@ -0,0 +1,268 @@
+package transfer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"image_gallery/internal/models"
+	"image_gallery/internal/services"
+)
+
+func newTestDB(t *testing.T) services.DatabaseService {
+	t.Helper()
+
+	db, err := services.NewLocalDBService(t.TempDir())
+	if err != nil {
+		t.Fatalf("Failed to create local DB service: %v", err)
+	}
+
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	for i, id := range []string{"a", "b"} {
+		err := db.SaveImage(context.Background(), models.Image{
+			ID:          id,
+			Title:       "Image " + id,
+			Description: "Description " + id,
+			S3Key:       id + ".jpg",
+			ContentType: "image/jpeg",
+			Size:        100,
+			CreatedAt:   now.Add(time.Duration(i) * time.Hour),
+			UpdatedAt:   now,
+		})
+		if err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+	}
+	return db
+}
+
+// editingDB saves a concurrent edit to one image right after it is read
+type editingDB struct {
+	services.DatabaseService
+	id string
+}
+
+func (d *editingDB) BatchGetImages(ctx context.Context, ids []string) ([]models.Image, error) {
+	images, err := d.DatabaseService.BatchGetImages(ctx, ids)
+	for _, image := range images {
+		if image.ID == d.id {
+			image.Title = "Concurrent edit"
+			if err := d.DatabaseService.SaveImage(ctx, image); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return images, err
+}
+
+func TestExportImportRoundTrip(t *testing.T) {
+	for _, format := range []Format{FormatJSONL, FormatCSV} {
+		t.Run(string(format), func(t *testing.T) {
+			ctx := context.Background()
+			db := newTestDB(t)
+
+			var buf bytes.Buffer
+			count, err := Export(ctx, db, &buf, format)
+			if err != nil {
+				t.Fatalf("Failed to export: %v", err)
+			}
+			if count != 2 {
+				t.Fatalf("Expected 2 exported images, got %d", count)
+			}
+
+			report, err := Import(ctx, db, &buf, format, ImportOptions{})
+			if err != nil {
+				t.Fatalf("Failed to import: %v (%+v)", err, report.Errors)
+			}
+			if report.Unchanged != 2 || report.Created != 0 || report.Updated != 0 {
+				t.Errorf("Expected 2 unchanged images, got %+v", report)
+			}
+		})
+	}
+}
+
+func TestCSVEscapesFormulas(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	titles := map[string]string{"a": "=HYPERLINK(\"http://example.com\")", "b": "'-quoted"}
+	for id, title := range titles {
+		image, _ := db.GetImage(ctx, id)
+		image.Title = title
+		image.Description = "@" + id
+		if err := db.SaveImage(ctx, image); err != nil {
+			t.Fatalf("Failed to save image: %v", err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := Export(ctx, db, &buf, FormatCSV); err != nil {
+		t.Fatalf("Failed to export: %v", err)
+	}
+	exported := buf.String()
+	for _, cell := range []string{`'=HYPERLINK`, `''-quoted`, `'@a`} {
+		if !strings.Contains(exported, cell) {
+			t.Errorf("Expected %s in the export, got %s", cell, exported)
+		}
+	}
+
+	report, err := Import(ctx, db, &buf, FormatCSV, ImportOptions{})
+	if err != nil {
+		t.Fatalf("Failed to import: %v (%+v)", err, report.Errors)
+	}
+	if report.Unchanged != 2 {
+		t.Errorf("Expected the escaped values to import unchanged, got %+v", report.Changes)
+	}
+}
+
+func TestImport(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("CSVSetsAndClearsExpiry", func(t *testing.T) {
+		db := newTestDB(t)
+
+		report, err := Import(ctx, db, strings.NewReader("id,expiresAt\na,2030-01-02T03:04:05Z\n"), FormatCSV, ImportOptions{})
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		if report.Updated != 1 {
+			t.Fatalf("Expected 1 updated image, got %+v", report)
+		}
+		image, err := db.GetImage(ctx, "a")
+		if err != nil {
+			t.Fatalf("Failed to get image: %v", err)
+		}
+		if want := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC); image.ExpiresAt == nil || !image.ExpiresAt.Equal(want) {
+			t.Errorf("Expected expiry %v, got %v", want, image.ExpiresAt)
+		}
+
+		if _, err := Import(ctx, db, strings.NewReader("id,expiresAt\na,\n"), FormatCSV, ImportOptions{}); err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		if image, _ := db.GetImage(ctx, "a"); image.ExpiresAt != nil {
+			t.Errorf("Expected expiry to be cleared, got %v", image.ExpiresAt)
+		}
+	})
+
+	t.Run("PartialCSVUpdatesOnlyGivenColumns", func(t *testing.T) {
+		db := newTestDB(t)
+		input := "id,title\na,Renamed\nc,New image\n"
+
+		_, err := Import(ctx, db, strings.NewReader(input), FormatCSV, ImportOptions{})
+		if !errors.Is(err, ErrInvalidImport) {
+			t.Fatalf("Expected ErrInvalidImport for new record without s3Key, got %v", err)
+		}
+
+		input = "id,title\na,Renamed\n"
+		report, err := Import(ctx, db, strings.NewReader(input), FormatCSV, ImportOptions{})
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		if report.Updated != 1 || len(report.Changes[0].Fields) != 1 {
+			t.Fatalf("Expected a single title change, got %+v", report)
+		}
+		if change := report.Changes[0].Fields[0]; change.Old != "Image a" || change.New != "Renamed" {
+			t.Errorf("Expected title change from 'Image a' to 'Renamed', got %+v", change)
+		}
+
+		image, err := db.GetImage(ctx, "a")
+		if err != nil {
+			t.Fatalf("Failed to get image: %v", err)
+		}
+		if image.Title != "Renamed" || image.Description != "Description a" {
+			t.Errorf("Expected only the title to change, got %+v", image)
+		}
+	})
+
+	t.Run("CreatesNewRecords", func(t *testing.T) {
+		db := newTestDB(t)
+		input := `{"id":"c","title":"New image","s3Key":"c.png","contentType":"image/png"}` + "\n"
+
+		report, err := Import(ctx, db, strings.NewReader(input), FormatJSONL, ImportOptions{})
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		if report.Created != 1 || report.Changes[0].Action != ActionCreate {
+			t.Errorf("Expected one created record, got %+v", report)
+		}
+		if _, err := db.GetImage(ctx, "c"); err != nil {
+			t.Errorf("Expected new image to be saved, got %v", err)
+		}
+	})
+
+	t.Run("ConcurrentEditIsReported", func(t *testing.T) {
+		db := newTestDB(t)
+		input := `{"id":"a","title":"Imported"}` + "\n" + `{"id":"b","title":"Imported"}` + "\n"
+
+		report, err := Import(ctx, &editingDB{DatabaseService: db, id: "a"}, strings.NewReader(input), FormatJSONL, ImportOptions{})
+		if !errors.Is(err, services.ErrConflict) {
+			t.Fatalf("Expected a conflict, got %v", err)
+		}
+		if len(report.Errors) != 1 || report.Errors[0].ID != "a" {
+			t.Errorf("Expected an error for a only, got %+v", report.Errors)
+		}
+
+		if image, _ := db.GetImage(ctx, "a"); image.Title != "Concurrent edit" {
+			t.Errorf("Expected the concurrent edit to be kept, got %q", image.Title)
+		}
+		if image, _ := db.GetImage(ctx, "b"); image.Title != "Imported" {
+			t.Errorf("Expected b to be imported, got %q", image.Title)
+		}
+	})
+
+	t.Run("DryRunWritesNothing", func(t *testing.T) {
+		db := newTestDB(t)
+		input := `{"id":"a","description":"Changed"}` + "\n"
+
+		report, err := Import(ctx, db, strings.NewReader(input), FormatJSONL, ImportOptions{DryRun: true})
+		if err != nil {
+			t.Fatalf("Failed to import: %v", err)
+		}
+		if !report.DryRun || report.Updated != 1 {
+			t.Errorf("Expected a dry-run update, got %+v", report)
+		}
+
+		image, _ := db.GetImage(ctx, "a")
+		if image.Description != "Description a" {
+			t.Errorf("Dry run changed the image: %+v", image)
+		}
+	})
+
+	t.Run("ValidationErrorsWriteNothing", func(t *testing.T) {
+		db := newTestDB(t)
+		input := strings.Join([]string{
+			`{"id":"a","title":"Renamed"}`,
+			`{"id":"b","s3Key":"../escape.jpg"}`,
+			`{"id":"a","title":"Again"}`,
+			`{"title":"No ID"}`,
+		}, "\n")
+
+		report, err := Import(ctx, db, strings.NewReader(input), FormatJSONL, ImportOptions{})
+		if !errors.Is(err, ErrInvalidImport) {
+			t.Fatalf("Expected ErrInvalidImport, got %v", err)
+		}
+		if len(report.Errors) != 3 {
+			t.Errorf("Expected 3 errors, got %+v", report.Errors)
+		}
+
+		image, _ := db.GetImage(ctx, "a")
+		if image.Title != "Image a" {
+			t.Errorf("Invalid import changed the image: %+v", image)
+		}
+	})
+
+	t.Run("ReportsMalformedLines", func(t *testing.T) {
+		db := newTestDB(t)
+		input := "id,title,size\na,Renamed,big\n"
+
+		report, err := Import(ctx, db, strings.NewReader(input), FormatCSV, ImportOptions{})
+		if !errors.Is(err, ErrInvalidImport) {
+			t.Fatalf("Expected ErrInvalidImport, got %v", err)
+		}
+		if len(report.Errors) != 1 || report.Errors[0].Line != 2 {
+			t.Errorf("Expected an error on line 2, got %+v", report.Errors)
+		}
+	})
+}